@@ -11,7 +11,7 @@ import (
 
     "github.com/Tmacphee13/NanachiGo/internal/auth"
     "github.com/Tmacphee13/NanachiGo/internal/db"
-    "github.com/Tmacphee13/NanachiGo/internal/login"
+    "github.com/Tmacphee13/NanachiGo/internal/server"
     "github.com/Tmacphee13/NanachiGo/internal/utils"
     "github.com/joho/godotenv"
 )
@@ -82,47 +82,14 @@ func main() {
 
 	flag.Parse()
 
-	// each route gets a handler that points to a function that handles that path
-	http.HandleFunc("/", home)
-	http.HandleFunc("/admin", admin)
-	http.HandleFunc("/api/login", login.Login)
-	http.HandleFunc("/api/mindmaps", db.GetAllMindmaps)
-	// id-based routes and actions
-	http.HandleFunc("/api/mindmaps/", func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path
-		// action subroutes
-		if r.Method == http.MethodPost {
-			switch {
-			case strings.HasSuffix(path, "/redo-description"):
-				utils.RedoDescriptionHandler(w, r)
-				return
-			case strings.HasSuffix(path, "/remake-subtree"):
-				utils.RemakeSubtreeHandler(w, r)
-				return
-			case strings.HasSuffix(path, "/go-deeper"):
-				utils.GoDeeperHandler(w, r)
-				return
-			}
-		}
-		// DELETE /api/mindmaps/{id}
-		if r.Method == http.MethodDelete {
-			db.DeleteMindmapHandler(w, r)
-			return
-		}
-		http.NotFound(w, r)
-	})
-	http.HandleFunc("/api/upload", utils.UploadPaper)
-	http.ListenAndServe(":3000", nil)
-	//http.ListenAndServe(*addr, nil)
-}
+	// trash older than TRASH_RETENTION is purged in the background
+	utils.StartTrashPurge(context.Background())
+	// items written by older versions are upgraded once, here rather than on read
+	db.StartMigrations(context.Background())
 
-// --------------------- Handler Funcs --------------------------//
-func home(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "./public/index.html")
-}
-
-func admin(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "./public/admin.html")
+	// all routes live in internal/server so tests can exercise the same mux
+	http.ListenAndServe(":3000", server.New().Router())
+	//http.ListenAndServe(*addr, nil)
 }
 
 /* #------------ Imported Functions ------------#
@@ -3,10 +3,13 @@ package db
 import (
     "context"
     "encoding/json"
+    "errors"
     "fmt"
     "log"
     "net/http"
     "os"
+    "sort"
+    "strconv"
     "strings"
     "sync"
 
@@ -33,6 +36,49 @@ func getTableName() string {
     return tableName
 }
 
+// Every item carries listPartitionAttr set to listPartition, so the
+// MINDMAPS_CREATED_INDEX global secondary index, with that attribute as its
+// partition key and createdAt as its sort key, holds them all in CreatedAt
+// order.
+const (
+    listPartitionAttr = "listPartition"
+    listPartition     = "mindmaps"
+)
+
+var (
+    createdIndexOnce sync.Once
+    createdIndex     string
+)
+
+func getCreatedIndexName() string {
+    createdIndexOnce.Do(func() {
+        v := strings.TrimSpace(os.Getenv("MINDMAPS_CREATED_INDEX"))
+        if v == "" {
+            v = "listPartition-createdAt-index"
+        }
+        createdIndex = v
+    })
+    return createdIndex
+}
+
+var (
+    hashIndexOnce sync.Once
+    hashIndex     string
+)
+
+// getHashIndexName names the global secondary index keyed by contentHash
+// that duplicate uploads are looked up in, from MINDMAPS_HASH_INDEX.
+func getHashIndexName() string {
+    hashIndexOnce.Do(func() {
+        v := strings.TrimSpace(os.Getenv("MINDMAPS_HASH_INDEX"))
+        if v == "" {
+            v = "contentHash-index"
+        }
+        hashIndex = v
+    })
+    return hashIndex
+}
+
 func GetDynamoDBClient() (*dynamodb.Client, error) {
     // Get AWS config from auth package
     cfg, err := auth.GetAWSConfig()
@@ -91,130 +137,125 @@ Test this function by running the server and curling:
 curl http://localhost:3000/api/mindmap
 */
 func GetAllMindmaps(w http.ResponseWriter, r *http.Request) {
-    platform := r.URL.Query().Get("platform")
-    if platform == "" { platform = defaultPlatform() }
+    store, platform, err := StoreForRequest(r)
+    if err != nil {
+        http.Error(w, "unknown platform", http.StatusBadRequest)
+        return
+    }
     debug := strings.EqualFold(os.Getenv("DEBUG"), "1") || strings.EqualFold(os.Getenv("DEBUG"), "true") || strings.EqualFold(os.Getenv("DEBUG"), "yes")
     if debug {
         log.Printf("api: GET /api/mindmaps platform=%s remote=%s", platform, r.RemoteAddr)
     }
 
-    var resp any
-    var err error
-    switch platform {
-    case "aws":
-        // create dynamodb client
-        client, e := GetDynamoDBClient()
-        if e != nil {
-            log.Printf("aws: dynamodb client init failed: %v", e)
-            http.Error(w, "Error retrieving db client", http.StatusInternalServerError)
-            return
-        }
-        output, e := client.Scan(r.Context(), &dynamodb.ScanInput{TableName: aws.String(getTableName())})
-        if e != nil {
-            log.Printf("aws: dynamodb scan failed (table=%s): %v", getTableName(), e)
-            http.Error(w, "Error scanning mindmaps table", http.StatusInternalServerError)
-            return
-        }
-        var items []MindmapItem
-        for _, it := range output.Items {
-            var mm MindmapItem
-            if e := attributevalue.UnmarshalMap(it, &mm); e == nil {
-                items = append(items, mm)
-            }
-        }
-        if items == nil { items = []MindmapItem{} }
-        resp = items
-    case "gcp":
-        var items []MindmapItem
-        items, err = ListMindmapsGCP(r.Context())
-        if err != nil {
-            log.Printf("gcp: firestore list failed: %v", err)
-            // When DEBUG is enabled, surface the underlying error to the client
-            if debug {
-                http.Error(w, "GCP Firestore list error: "+err.Error(), http.StatusInternalServerError)
-            } else {
-                http.Error(w, "Error listing firestore mindmaps", http.StatusInternalServerError)
-            }
-            return
+    // Always one page of summaries: the trees and PDF text are fetched one
+    // map at a time. Items in the trash are only listed by the trash endpoints
+    q, err := ParseListQuery(r.URL.Query())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    page, err := ListMindmapPage(r.Context(), store, q)
+    if errors.Is(err, ErrBadCursor) {
+        http.Error(w, "invalid cursor", http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        log.Printf("%s: list mindmap page failed: %v", platform, err)
+        // When DEBUG is enabled, surface the underlying error to the client
+        if debug {
+            http.Error(w, "list mindmaps error: "+err.Error(), http.StatusInternalServerError)
+        } else {
+            http.Error(w, "Error listing mindmaps", http.StatusInternalServerError)
         }
-        if items == nil { items = []MindmapItem{} }
-        resp = items
-    default:
-        http.Error(w, "unknown platform", http.StatusBadRequest)
         return
     }
-
     w.Header().Set("Content-Type", "application/json")
-    if err := json.NewEncoder(w).Encode(resp); err != nil {
+    if err := json.NewEncoder(w).Encode(page); err != nil {
         http.Error(w, "Error encoding response", http.StatusInternalServerError)
-        return
     }
 }
 
-// Platform-agnostic wrappers
-func CreateMindmapPlatform(ctx context.Context, platform string, item MindmapItem) (string, error) {
-    if platform == "gcp" { return CreateMindmapGCP(ctx, item) }
-    return CreateMindmap(ctx, item)
-}
-
-func GetMindmapByIDPlatform(ctx context.Context, platform, id string) (*MindmapItem, error) {
-    if platform == "gcp" { return GetMindmapByIDGCP(ctx, id) }
-    return GetMindmapByID(ctx, id)
-}
-
-func UpdateMindmapPlatform(ctx context.Context, platform, id string, updates map[string]interface{}) error {
-    if platform == "gcp" { return UpdateMindmapGCP(ctx, id, updates) }
-    return UpdateMindmap(ctx, id, updates)
-}
-
-func DeleteMindmapByIDPlatform(ctx context.Context, platform, id string) (bool, error) {
-    if platform == "gcp" { return DeleteMindmapByIDGCP(ctx, id) }
-    return DeleteMindmapByID(ctx, id)
-}
-
-// DeleteMindmapHandler routes delete to correct backend
-func DeleteMindmapHandler(w http.ResponseWriter, r *http.Request) {
-    platform := r.URL.Query().Get("platform")
-    if platform == "" { platform = defaultPlatform() }
-    path := strings.TrimPrefix(r.URL.Path, "/api/mindmaps/")
-    parts := strings.Split(path, "/")
-    if len(parts) < 1 || parts[0] == "" {
-        http.Error(w, "missing id", http.StatusBadRequest)
+// GetMindmapHandler: GET /api/mindmaps/{id}
+//
+// One mind map with its tree, for clients that list summaries. The PDF text
+// is left out.
+func GetMindmapHandler(w http.ResponseWriter, r *http.Request) {
+    store, platform, err := StoreForRequest(r)
+    if err != nil {
+        http.Error(w, "unknown platform", http.StatusBadRequest)
         return
     }
-    id := parts[0]
-    deleted, err := DeleteMindmapByIDPlatform(r.Context(), platform, id)
+    id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/mindmaps/"), "/")
+    if id == "" || strings.Contains(id, "/") {
+        http.NotFound(w, r)
+        return
+    }
+    item, err := store.Get(r.Context(), id)
     if err != nil {
-        http.Error(w, "error deleting mindmap", http.StatusInternalServerError)
+        log.Printf("%s: get mindmap %s failed: %v", platform, id, err)
+        http.Error(w, "Error loading mindmap", http.StatusInternalServerError)
         return
     }
-    if !deleted {
+    if item == nil || item.DeletedAt != "" {
         http.Error(w, "mindmap not found", http.StatusNotFound)
         return
     }
+    item.PDFText, item.PageTexts = "", nil
     w.Header().Set("Content-Type", "application/json")
-    w.WriteHeader(http.StatusOK)
-    fmt.Fprintf(w, `{"success":true,"message":"Mindmap deleted successfully"}`)
-}
-
-func defaultPlatform() string {
-    p := strings.ToLower(strings.TrimSpace(os.Getenv("DEFAULT_PLATFORM")))
-    if p == "gcp" { return "gcp" }
-    return "aws"
+    json.NewEncoder(w).Encode(item)
 }
 
 // ---------------------- Types + CRUD helpers ---------------------- //
 
 type MindmapItem struct {
-    ID          string                 `dynamodbav:"id" json:"id"`
-    Filename    string                 `dynamodbav:"filename" json:"filename"`
-    Title       string                 `dynamodbav:"title" json:"title"`
-    Authors     []string               `dynamodbav:"authors" json:"authors"`
-    Date        string                 `dynamodbav:"date" json:"date"`
-    MindmapData map[string]interface{} `dynamodbav:"mindmapData" json:"mindmapData"`
-    PDFText     string                 `dynamodbav:"pdfText" json:"pdfText"`
-    CreatedAt   string                 `dynamodbav:"createdAt" json:"createdAt"`
-    UpdatedAt   string                 `dynamodbav:"updatedAt" json:"updatedAt"`
+    ID           string                 `dynamodbav:"id" json:"id"`
+    Filename     string                 `dynamodbav:"filename" json:"filename"`
+    Title        string                 `dynamodbav:"title" json:"title"`
+    Authors      []string               `dynamodbav:"authors" json:"authors"`
+    Date         string                 `dynamodbav:"date" json:"date"`
+    // Tags are free-form labels given at upload, for filtering the list.
+    Tags         []string               `dynamodbav:"tags,omitempty" json:"tags,omitempty" firestore:"tags,omitempty"`
+    MindmapData  map[string]interface{} `dynamodbav:"mindmapData" json:"mindmapData"`
+    // PageTexts is the paper's text; items stored before pages were kept
+    // have PDFText instead. Use PlainText to read either.
+    PDFText      string                 `dynamodbav:"pdfText" json:"pdfText"`
+    PageTexts    []PageText             `dynamodbav:"pageTexts,omitempty" json:"pageTexts,omitempty"`
+    // Owner uploaded the paper; LastEditedBy made the latest change to it.
+    Owner        string                 `dynamodbav:"owner,omitempty" json:"owner,omitempty"`
+    LastEditedBy string                 `dynamodbav:"lastEditedBy,omitempty" json:"lastEditedBy,omitempty"`
+    // ContentHash is the hex SHA-256 of the uploaded PDF, used to spot
+    // duplicate uploads. It is tagged for Firestore so it can be queried.
+    ContentHash  string                 `dynamodbav:"contentHash,omitempty" json:"contentHash,omitempty" firestore:"contentHash,omitempty"`
+    // Version counts the updates made to the item; the store bumps it on
+    // every write so conditional updates can detect concurrent changes.
+    // Items written before versioning read as 0.
+    Version      int                    `dynamodbav:"version" json:"version" firestore:"version"`
+    // DeletedAt is when the item was moved to the trash, and DeletedBy who
+    // moved it there; live items have neither.
+    DeletedAt    string                 `dynamodbav:"deletedAt,omitempty" json:"deletedAt,omitempty" firestore:"deletedAt,omitempty"`
+    DeletedBy    string                 `dynamodbav:"deletedBy,omitempty" json:"deletedBy,omitempty" firestore:"deletedBy,omitempty"`
+    // CreatedAt is tagged for Firestore so listings can be ordered by it.
+    CreatedAt    string                 `dynamodbav:"createdAt" json:"createdAt" firestore:"createdAt"`
+    UpdatedAt    string                 `dynamodbav:"updatedAt" json:"updatedAt"`
+}
+
+// PageText is the extracted text of one PDF page; Page is 1-based.
+type PageText struct {
+    Page int    `dynamodbav:"page" json:"page"`
+    Text string `dynamodbav:"text" json:"text"`
+}
+
+// PlainText is the paper's text without page markers.
+func (item *MindmapItem) PlainText() string {
+    if len(item.PageTexts) == 0 {
+        return item.PDFText
+    }
+    var b strings.Builder
+    for _, p := range item.PageTexts {
+        b.WriteString(p.Text)
+        b.WriteString("\n")
+    }
+    return b.String()
 }
 
 // CreateMindmap inserts a new item and returns its id
@@ -227,6 +268,7 @@ func CreateMindmap(ctx context.Context, item MindmapItem) (string, error) {
     if err != nil {
         return "", err
     }
+    av[listPartitionAttr] = &types.AttributeValueMemberS{Value: listPartition}
     _, err = client.PutItem(ctx, &dynamodb.PutItemInput{
         TableName: aws.String(getTableName()),
         Item:      av,
@@ -263,41 +305,261 @@ func GetMindmapByID(ctx context.Context, id string) (*MindmapItem, error) {
     return &item, nil
 }
 
+// ListMindmaps scans the whole table, following LastEvaluatedKey past the
+// 1 MB a single Scan call returns
+func ListMindmaps(ctx context.Context) ([]MindmapItem, error) {
+    return scanMindmaps(ctx, &dynamodb.ScanInput{TableName: aws.String(getTableName())})
+}
+
+// ListMindmapSummaries scans the whole table for the summary fields only
+func ListMindmapSummaries(ctx context.Context) ([]MindmapItem, error) {
+    names := map[string]string{}
+    projection := summaryProjection(names)
+    return scanMindmaps(ctx, &dynamodb.ScanInput{
+        TableName:                aws.String(getTableName()),
+        ProjectionExpression:     aws.String(projection),
+        ExpressionAttributeNames: names,
+    })
+}
+
+// summaryProjection adds a placeholder to names for each of SummaryFields,
+// since several of them, like date and owner, are reserved words, and
+// returns the projection expression listing them.
+func summaryProjection(names map[string]string) string {
+    var keys []string
+    for i, f := range SummaryFields {
+        key := "#f" + strconv.Itoa(i)
+        names[key] = f
+        keys = append(keys, key)
+    }
+    return strings.Join(keys, ", ")
+}
+
+// QueryMindmapSummariesByCreatedAt reads up to limit summaries in CreatedAt
+// order from the MINDMAPS_CREATED_INDEX index, starting after the given item.
+// The index must project the SummaryFields.
+func QueryMindmapSummariesByCreatedAt(ctx context.Context, desc bool, after *PageKey, limit int) ([]MindmapItem, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return nil, err
+    }
+    names := map[string]string{"#lp": listPartitionAttr}
+    input := &dynamodb.QueryInput{
+        TableName:                 aws.String(getTableName()),
+        IndexName:                 aws.String(getCreatedIndexName()),
+        KeyConditionExpression:    aws.String("#lp = :lp"),
+        ProjectionExpression:      aws.String(summaryProjection(names)),
+        ExpressionAttributeNames:  names,
+        ExpressionAttributeValues: map[string]types.AttributeValue{":lp": &types.AttributeValueMemberS{Value: listPartition}},
+        ScanIndexForward:          aws.Bool(!desc),
+    }
+    if after != nil {
+        input.ExclusiveStartKey = map[string]types.AttributeValue{
+            "id":              &types.AttributeValueMemberS{Value: after.ID},
+            "createdAt":       &types.AttributeValueMemberS{Value: after.CreatedAt},
+            listPartitionAttr: &types.AttributeValueMemberS{Value: listPartition},
+        }
+    }
+    items := []MindmapItem{}
+    // A query stops at 1 MB, possibly short of the limit
+    for len(items) < limit {
+        input.Limit = aws.Int32(int32(limit - len(items)))
+        out, err := client.Query(ctx, input)
+        if err != nil {
+            log.Printf("aws: dynamodb query failed (table=%s index=%s): %v", getTableName(), getCreatedIndexName(), err)
+            return nil, err
+        }
+        for _, it := range out.Items {
+            var mm MindmapItem
+            if e := attributevalue.UnmarshalMap(it, &mm); e == nil {
+                items = append(items, mm)
+            }
+        }
+        if len(out.LastEvaluatedKey) == 0 {
+            break
+        }
+        input.ExclusiveStartKey = out.LastEvaluatedKey
+    }
+    return items, nil
+}
+
+// TagListPartition gives items stored before MINDMAPS_CREATED_INDEX existed
+// the attribute that puts them in it, and reports how many it tagged.
+func TagListPartition(ctx context.Context) (int, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return 0, err
+    }
+    paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+        TableName:                aws.String(getTableName()),
+        FilterExpression:         aws.String("attribute_not_exists(#lp)"),
+        ProjectionExpression:     aws.String("id"),
+        ExpressionAttributeNames: map[string]string{"#lp": listPartitionAttr},
+    })
+    tagged := 0
+    for paginator.HasMorePages() {
+        page, err := paginator.NextPage(ctx)
+        if err != nil {
+            return tagged, err
+        }
+        for _, it := range page.Items {
+            // Not a change to the map itself, so the version stays put
+            _, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+                TableName:                 aws.String(getTableName()),
+                Key:                       map[string]types.AttributeValue{"id": it["id"]},
+                UpdateExpression:          aws.String("SET #lp = :lp"),
+                ConditionExpression:       aws.String("attribute_exists(id)"),
+                ExpressionAttributeNames:  map[string]string{"#lp": listPartitionAttr},
+                ExpressionAttributeValues: map[string]types.AttributeValue{":lp": &types.AttributeValueMemberS{Value: listPartition}},
+            })
+            var failed *types.ConditionalCheckFailedException
+            if errors.As(err, &failed) {
+                continue
+            }
+            if err != nil {
+                return tagged, err
+            }
+            tagged++
+        }
+    }
+    return tagged, nil
+}
+
+func scanMindmaps(ctx context.Context, input *dynamodb.ScanInput) ([]MindmapItem, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return nil, err
+    }
+    items := []MindmapItem{}
+    paginator := dynamodb.NewScanPaginator(client, input)
+    for paginator.HasMorePages() {
+        page, err := paginator.NextPage(ctx)
+        if err != nil {
+            log.Printf("aws: dynamodb scan failed (table=%s): %v", getTableName(), err)
+            return nil, err
+        }
+        for _, it := range page.Items {
+            var mm MindmapItem
+            if e := attributevalue.UnmarshalMap(it, &mm); e == nil {
+                items = append(items, mm)
+            }
+        }
+    }
+    return items, nil
+}
+
+// FindMindmapByContentHash queries the MINDMAPS_HASH_INDEX index for a live
+// item whose PDF hashes to hash, or nil. The index must project the
+// SummaryFields.
+func FindMindmapByContentHash(ctx context.Context, hash string) (*MindmapItem, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return nil, err
+    }
+    names := map[string]string{"#h": "contentHash", "#del": "deletedAt"}
+    paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+        TableName:                aws.String(getTableName()),
+        IndexName:                aws.String(getHashIndexName()),
+        KeyConditionExpression:   aws.String("#h = :h"),
+        FilterExpression:         aws.String("attribute_not_exists(#del) OR #del = :live"),
+        ProjectionExpression:     aws.String(summaryProjection(names)),
+        ExpressionAttributeNames: names,
+        ExpressionAttributeValues: map[string]types.AttributeValue{
+            ":h":    &types.AttributeValueMemberS{Value: hash},
+            ":live": &types.AttributeValueMemberS{Value: ""},
+        },
+    })
+    for paginator.HasMorePages() {
+        page, err := paginator.NextPage(ctx)
+        if err != nil {
+            log.Printf("aws: dynamodb query failed (table=%s index=%s): %v", getTableName(), getHashIndexName(), err)
+            return nil, err
+        }
+        for _, it := range page.Items {
+            var mm MindmapItem
+            if e := attributevalue.UnmarshalMap(it, &mm); e == nil {
+                return &mm, nil
+            }
+        }
+    }
+    return nil, nil
+}
+
 // UpdateMindmap updates arbitrary fields by id
 func UpdateMindmap(ctx context.Context, id string, updates map[string]interface{}) error {
     client, err := GetDynamoDBClient()
     if err != nil {
         return err
     }
+    input, err := updateInput(id, updates)
+    if err != nil {
+        return err
+    }
+    _, err = client.UpdateItem(ctx, input)
+    return err
+}
+
+// UpdateMindmapIfVersion updates fields only while the stored version still
+// equals version, returning ErrVersionConflict otherwise. Items saved before
+// versioning have no version attribute and match version 0.
+func UpdateMindmapIfVersion(ctx context.Context, id string, version int, updates map[string]interface{}) error {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return err
+    }
+    input, err := updateInput(id, updates)
+    if err != nil {
+        return err
+    }
+    cond := "#ver = :expected"
+    if version == 0 {
+        cond = "attribute_exists(#id) AND (attribute_not_exists(#ver) OR #ver = :expected)"
+        input.ExpressionAttributeNames["#id"] = "id"
+    }
+    input.ConditionExpression = aws.String(cond)
+    input.ExpressionAttributeValues[":expected"] = &types.AttributeValueMemberN{Value: strconv.Itoa(version)}
+    _, err = client.UpdateItem(ctx, input)
+    var failed *types.ConditionalCheckFailedException
+    if errors.As(err, &failed) {
+        return ErrVersionConflict
+    }
+    return err
+}
 
-    // Build UpdateExpression dynamically
+// updateInput builds an UpdateItem that sets each field and bumps version.
+func updateInput(id string, updates map[string]interface{}) (*dynamodb.UpdateItemInput, error) {
     var setExprs []string
-    exprAttrNames := map[string]string{}
-    exprAttrValues := map[string]types.AttributeValue{}
+    exprAttrNames := map[string]string{"#ver": "version"}
+    exprAttrValues := map[string]types.AttributeValue{":one": &types.AttributeValueMemberN{Value: "1"}}
     i := 0
     for k, v := range updates {
+        if k == "version" {
+            continue
+        }
         nameKey := fmt.Sprintf("#n%d", i)
         valueKey := fmt.Sprintf(":v%d", i)
         setExprs = append(setExprs, fmt.Sprintf("%s = %s", nameKey, valueKey))
         exprAttrNames[nameKey] = k
         av, err := attributevalue.Marshal(v)
         if err != nil {
-            return err
+            return nil, err
         }
         exprAttrValues[valueKey] = av
         i++
     }
-
-    _, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+    expr := "ADD #ver :one"
+    if len(setExprs) > 0 {
+        expr = "SET " + strings.Join(setExprs, ", ") + " " + expr
+    }
+    return &dynamodb.UpdateItemInput{
         TableName: aws.String(getTableName()),
         Key: map[string]types.AttributeValue{
             "id": &types.AttributeValueMemberS{Value: id},
         },
-        UpdateExpression:          aws.String("SET " + strings.Join(setExprs, ", ")),
+        UpdateExpression:          aws.String(expr),
         ExpressionAttributeNames:  exprAttrNames,
         ExpressionAttributeValues: exprAttrValues,
-    })
-    return err
+    }, nil
 }
 
 // DeleteMindmapByID deletes an item by id, returns true if deleted
@@ -306,16 +568,490 @@ func DeleteMindmapByID(ctx context.Context, id string) (bool, error) {
     if err != nil {
         return false, err
     }
+    out, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+        TableName: aws.String(getTableName()),
+        Key: map[string]types.AttributeValue{
+            "id": &types.AttributeValueMemberS{Value: id},
+        },
+        // The old item comes back only if there was one
+        ReturnValues: types.ReturnValueAllOld,
+    })
+    if err != nil {
+        return false, err
+    }
+    return len(out.Attributes) > 0, nil
+}
+
+// DeleteTrashedMindmap deletes id only while it is in the trash at version,
+// returning ErrVersionConflict otherwise.
+func DeleteTrashedMindmap(ctx context.Context, id string, version int) error {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return err
+    }
     _, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
         TableName: aws.String(getTableName()),
         Key: map[string]types.AttributeValue{
             "id": &types.AttributeValueMemberS{Value: id},
         },
+        ConditionExpression:      aws.String("#ver = :expected AND attribute_exists(#del) AND #del <> :empty"),
+        ExpressionAttributeNames: map[string]string{"#ver": "version", "#del": "deletedAt"},
+        ExpressionAttributeValues: map[string]types.AttributeValue{
+            ":expected": &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+            ":empty":    &types.AttributeValueMemberS{Value: ""},
+        },
+    })
+    var failed *types.ConditionalCheckFailedException
+    if errors.As(err, &failed) {
+        return ErrVersionConflict
+    }
+    return err
+}
+
+// ---------------------- Users (DynamoDB) ---------------------- //
+
+var (
+    usersTableOnce sync.Once
+    usersTable     string
+)
+
+// getUsersTable reads USERS_TABLE (default "users"), keyed by username.
+func getUsersTable() string {
+    usersTableOnce.Do(func() {
+        v := strings.TrimSpace(os.Getenv("USERS_TABLE"))
+        if v == "" {
+            v = "users"
+        }
+        usersTable = v
+    })
+    return usersTable
+}
+
+func usernameKey(username string) map[string]types.AttributeValue {
+    return map[string]types.AttributeValue{
+        "username": &types.AttributeValueMemberS{Value: username},
+    }
+}
+
+// CreateUser inserts a user, failing with ErrUserExists if the name is taken
+func CreateUser(ctx context.Context, u User) error {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return err
+    }
+    av, err := attributevalue.MarshalMap(u)
+    if err != nil {
+        return err
+    }
+    _, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+        TableName:           aws.String(getUsersTable()),
+        Item:                av,
+        ConditionExpression: aws.String("attribute_not_exists(username)"),
+    })
+    var ccf *types.ConditionalCheckFailedException
+    if errors.As(err, &ccf) {
+        return ErrUserExists
+    }
+    return err
+}
+
+// GetUserByUsername fetches a user, or nil if there is none
+func GetUserByUsername(ctx context.Context, username string) (*User, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return nil, err
+    }
+    out, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+        TableName: aws.String(getUsersTable()),
+        Key:       usernameKey(username),
+    })
+    if err != nil {
+        return nil, err
+    }
+    if out.Item == nil {
+        return nil, nil
+    }
+    var u User
+    if err := attributevalue.UnmarshalMap(out.Item, &u); err != nil {
+        return nil, err
+    }
+    return &u, nil
+}
+
+// PutUser creates or replaces a user
+func PutUser(ctx context.Context, u User) error {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return err
+    }
+    av, err := attributevalue.MarshalMap(u)
+    if err != nil {
+        return err
+    }
+    _, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+        TableName: aws.String(getUsersTable()),
+        Item:      av,
+    })
+    return err
+}
+
+// DeleteUserByUsername deletes a user, returns true if one was removed
+func DeleteUserByUsername(ctx context.Context, username string) (bool, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return false, err
+    }
+    out, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+        TableName:    aws.String(getUsersTable()),
+        Key:          usernameKey(username),
+        ReturnValues: types.ReturnValueAllOld,
     })
     if err != nil {
         return false, err
     }
-    return true, nil
+    return len(out.Attributes) > 0, nil
+}
+
+// ListUsers scans the users table, following pagination
+func ListUsers(ctx context.Context) ([]User, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return nil, err
+    }
+    users := []User{}
+    paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{TableName: aws.String(getUsersTable())})
+    for paginator.HasMorePages() {
+        page, err := paginator.NextPage(ctx)
+        if err != nil {
+            return nil, err
+        }
+        for _, it := range page.Items {
+            var u User
+            if e := attributevalue.UnmarshalMap(it, &u); e == nil {
+                users = append(users, u)
+            }
+        }
+    }
+    return users, nil
+}
+
+// ---------------------- API tokens (DynamoDB) ---------------------- //
+
+var (
+    tokensTableOnce sync.Once
+    tokensTable     string
+)
+
+// getTokensTable reads TOKENS_TABLE (default "api_tokens"), keyed by id.
+func getTokensTable() string {
+    tokensTableOnce.Do(func() {
+        v := strings.TrimSpace(os.Getenv("TOKENS_TABLE"))
+        if v == "" {
+            v = "api_tokens"
+        }
+        tokensTable = v
+    })
+    return tokensTable
+}
+
+// CreateToken inserts a token, failing if the id is already used
+func CreateToken(ctx context.Context, t APIToken) error {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return err
+    }
+    av, err := attributevalue.MarshalMap(t)
+    if err != nil {
+        return err
+    }
+    _, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+        TableName:           aws.String(getTokensTable()),
+        Item:                av,
+        ConditionExpression: aws.String("attribute_not_exists(id)"),
+    })
+    return err
+}
+
+// GetTokenByID fetches a token, or nil if there is none
+func GetTokenByID(ctx context.Context, id string) (*APIToken, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return nil, err
+    }
+    out, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+        TableName: aws.String(getTokensTable()),
+        Key:       map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+    })
+    if err != nil {
+        return nil, err
+    }
+    if out.Item == nil {
+        return nil, nil
+    }
+    var t APIToken
+    if err := attributevalue.UnmarshalMap(out.Item, &t); err != nil {
+        return nil, err
+    }
+    return &t, nil
+}
+
+// ListTokens scans the tokens table, optionally only one user's tokens
+func ListTokens(ctx context.Context, username string) ([]APIToken, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return nil, err
+    }
+    input := &dynamodb.ScanInput{TableName: aws.String(getTokensTable())}
+    if username != "" {
+        input.FilterExpression = aws.String("username = :u")
+        input.ExpressionAttributeValues = map[string]types.AttributeValue{
+            ":u": &types.AttributeValueMemberS{Value: username},
+        }
+    }
+    tokens := []APIToken{}
+    paginator := dynamodb.NewScanPaginator(client, input)
+    for paginator.HasMorePages() {
+        page, err := paginator.NextPage(ctx)
+        if err != nil {
+            return nil, err
+        }
+        for _, it := range page.Items {
+            var t APIToken
+            if e := attributevalue.UnmarshalMap(it, &t); e == nil {
+                tokens = append(tokens, t)
+            }
+        }
+    }
+    return tokens, nil
+}
+
+// DeleteTokenByID deletes a token, returns true if one was removed
+func DeleteTokenByID(ctx context.Context, id string) (bool, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return false, err
+    }
+    out, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+        TableName:    aws.String(getTokensTable()),
+        Key:          map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+        ReturnValues: types.ReturnValueAllOld,
+    })
+    if err != nil {
+        return false, err
+    }
+    return len(out.Attributes) > 0, nil
+}
+
+// TouchToken records when a token was last used
+func TouchToken(ctx context.Context, id, usedAt string) error {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return err
+    }
+    _, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+        TableName:           aws.String(getTokensTable()),
+        Key:                 map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+        UpdateExpression:    aws.String("SET lastUsedAt = :t"),
+        ConditionExpression: aws.String("attribute_exists(id)"),
+        ExpressionAttributeValues: map[string]types.AttributeValue{
+            ":t": &types.AttributeValueMemberS{Value: usedAt},
+        },
+    })
+    return err
+}
+
+// ---------------------- LLM usage (DynamoDB) ---------------------- //
+
+var (
+    usageTableOnce sync.Once
+    usageTable     string
+)
+
+// getUsageTable reads USAGE_TABLE (default "llm_usage"), keyed by id.
+func getUsageTable() string {
+    usageTableOnce.Do(func() {
+        v := strings.TrimSpace(os.Getenv("USAGE_TABLE"))
+        if v == "" {
+            v = "llm_usage"
+        }
+        usageTable = v
+    })
+    return usageTable
+}
+
+// RecordUsage stores one usage record
+func RecordUsage(ctx context.Context, rec UsageRecord) error {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return err
+    }
+    av, err := attributevalue.MarshalMap(rec)
+    if err != nil {
+        return err
+    }
+    _, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+        TableName: aws.String(getUsageTable()),
+        Item:      av,
+    })
+    return err
+}
+
+// ListUsage scans the usage table for records in [from, to), oldest first
+func ListUsage(ctx context.Context, from, to string) ([]UsageRecord, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return nil, err
+    }
+    input := &dynamodb.ScanInput{TableName: aws.String(getUsageTable())}
+    var conds []string
+    values := map[string]types.AttributeValue{}
+    if from != "" {
+        conds = append(conds, "#t >= :from")
+        values[":from"] = &types.AttributeValueMemberS{Value: from}
+    }
+    if to != "" {
+        conds = append(conds, "#t < :to")
+        values[":to"] = &types.AttributeValueMemberS{Value: to}
+    }
+    if len(conds) > 0 {
+        input.FilterExpression = aws.String(strings.Join(conds, " AND "))
+        input.ExpressionAttributeNames = map[string]string{"#t": "time"}
+        input.ExpressionAttributeValues = values
+    }
+    records := []UsageRecord{}
+    paginator := dynamodb.NewScanPaginator(client, input)
+    for paginator.HasMorePages() {
+        page, err := paginator.NextPage(ctx)
+        if err != nil {
+            return nil, err
+        }
+        for _, it := range page.Items {
+            var rec UsageRecord
+            if e := attributevalue.UnmarshalMap(it, &rec); e == nil {
+                records = append(records, rec)
+            }
+        }
+    }
+    sort.SliceStable(records, func(i, j int) bool { return records[i].Time < records[j].Time })
+    return records, nil
+}
+
+// ---------------------- Mindmap revisions (DynamoDB) ---------------------- //
+
+var (
+    revisionsTableOnce sync.Once
+    revisionsTable     string
+)
+
+// getRevisionsTable reads REVISIONS_TABLE (default "mindmap_revisions"),
+// keyed by mindmapId with version as the sort key.
+func getRevisionsTable() string {
+    revisionsTableOnce.Do(func() {
+        v := strings.TrimSpace(os.Getenv("REVISIONS_TABLE"))
+        if v == "" {
+            v = "mindmap_revisions"
+        }
+        revisionsTable = v
+    })
+    return revisionsTable
+}
+
+// SaveRevision stores one revision, replacing any with the same version
+func SaveRevision(ctx context.Context, rev Revision) error {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return err
+    }
+    av, err := attributevalue.MarshalMap(rev)
+    if err != nil {
+        return err
+    }
+    _, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+        TableName: aws.String(getRevisionsTable()),
+        Item:      av,
+    })
+    return err
+}
+
+// ListRevisions queries a mind map's revisions, oldest first
+func ListRevisions(ctx context.Context, mindmapID string) ([]Revision, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return nil, err
+    }
+    paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+        TableName:                 aws.String(getRevisionsTable()),
+        KeyConditionExpression:    aws.String("mindmapId = :id"),
+        ExpressionAttributeValues: map[string]types.AttributeValue{":id": &types.AttributeValueMemberS{Value: mindmapID}},
+        ScanIndexForward:          aws.Bool(true),
+    })
+    revs := []Revision{}
+    for paginator.HasMorePages() {
+        page, err := paginator.NextPage(ctx)
+        if err != nil {
+            return nil, err
+        }
+        for _, it := range page.Items {
+            var rev Revision
+            if e := attributevalue.UnmarshalMap(it, &rev); e == nil {
+                revs = append(revs, rev)
+            }
+        }
+    }
+    return revs, nil
+}
+
+// GetRevision fetches one revision, or nil if there is none
+func GetRevision(ctx context.Context, mindmapID string, version int) (*Revision, error) {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return nil, err
+    }
+    out, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+        TableName: aws.String(getRevisionsTable()),
+        Key: map[string]types.AttributeValue{
+            "mindmapId": &types.AttributeValueMemberS{Value: mindmapID},
+            "version":   &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+        },
+    })
+    if err != nil {
+        return nil, err
+    }
+    if out.Item == nil {
+        return nil, nil
+    }
+    var rev Revision
+    if err := attributevalue.UnmarshalMap(out.Item, &rev); err != nil {
+        return nil, err
+    }
+    return &rev, nil
+}
+
+// DeleteRevisions removes every revision of a mind map
+func DeleteRevisions(ctx context.Context, mindmapID string) error {
+    client, err := GetDynamoDBClient()
+    if err != nil {
+        return err
+    }
+    paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+        TableName:                 aws.String(getRevisionsTable()),
+        KeyConditionExpression:    aws.String("mindmapId = :id"),
+        ExpressionAttributeNames:  map[string]string{"#ver": "version"},
+        ExpressionAttributeValues: map[string]types.AttributeValue{":id": &types.AttributeValueMemberS{Value: mindmapID}},
+        ProjectionExpression:      aws.String("mindmapId, #ver"),
+    })
+    for paginator.HasMorePages() {
+        page, err := paginator.NextPage(ctx)
+        if err != nil {
+            return err
+        }
+        for _, key := range page.Items {
+            if _, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{TableName: aws.String(getRevisionsTable()), Key: key}); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
 }
 
 // ---------------------- HTTP router for /api/mindmaps/* ---------------------- //
@@ -340,7 +1076,7 @@ func MindmapRouter(w http.ResponseWriter, r *http.Request) {
             http.NotFound(w, r)
             return
         }
-        deleted, err := DeleteMindmapByID(r.Context(), id)
+        deleted, err := TrashMindmap(r.Context(), DynamoStore{}, id, "")
         if err != nil {
             http.Error(w, "error deleting mindmap", http.StatusInternalServerError)
             return
@@ -6,6 +6,8 @@ import (
     "fmt"
     "log"
     "os"
+    "strconv"
+    "strings"
     "time"
 
     "cloud.google.com/go/firestore"
@@ -17,6 +19,19 @@ import (
 
 const FS_COLLECTION string = "mindmaps"
 
+// FS_USERS_COLLECTION holds user accounts, one document per username.
+const FS_USERS_COLLECTION string = "users"
+
+// FS_TOKENS_COLLECTION holds API tokens, one document per token id.
+const FS_TOKENS_COLLECTION string = "api_tokens"
+
+// FS_REVISIONS_COLLECTION is the subcollection of each mind map document
+// holding its revisions, one document per version.
+const FS_REVISIONS_COLLECTION string = "revisions"
+
+// FS_USAGE_COLLECTION holds LLM usage records, one document per call.
+const FS_USAGE_COLLECTION string = "llm_usage"
+
 func getFirestoreClient(ctx context.Context) (*firestore.Client, string, error) {
     projectID := os.Getenv("GCP_PROJECT_ID")
     if projectID == "" {
@@ -104,31 +119,498 @@ func UpdateMindmapGCP(ctx context.Context, id string, updates map[string]interfa
         return err
     }
     defer client.Close()
-    _, err = client.Collection(FS_COLLECTION).Doc(id).Set(ctx, updates, firestore.MergeAll)
+    _, err = client.Collection(FS_COLLECTION).Doc(id).Set(ctx, withVersionBump(updates, firestore.Increment(1)), firestore.MergeAll)
     return err
 }
 
+// UpdateMindmapIfVersionGCP applies updates in a transaction that first
+// checks the stored version, returning ErrVersionConflict if it moved on.
+func UpdateMindmapIfVersionGCP(ctx context.Context, id string, version int, updates map[string]interface{}) error {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    ref := client.Collection(FS_COLLECTION).Doc(id)
+    return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+        snap, err := tx.Get(ref)
+        if status.Code(err) == codes.NotFound {
+            return ErrVersionConflict
+        }
+        if err != nil {
+            return err
+        }
+        if snapshotToMindmapItem(snap).Version != version {
+            return ErrVersionConflict
+        }
+        return tx.Set(ref, withVersionBump(updates, version+1), firestore.MergeAll)
+    })
+}
+
 func DeleteMindmapByIDGCP(ctx context.Context, id string) (bool, error) {
     client, _, err := getFirestoreClient(ctx)
     if err != nil {
         return false, err
     }
     defer client.Close()
-    _, err = client.Collection(FS_COLLECTION).Doc(id).Delete(ctx)
+    // Without the Exists precondition Firestore reports success for unknown ids
+    _, err = client.Collection(FS_COLLECTION).Doc(id).Delete(ctx, firestore.Exists)
+    if status.Code(err) == codes.NotFound {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// DeleteTrashedMindmapGCP deletes id only while it is in the trash at
+// version, returning ErrVersionConflict otherwise.
+func DeleteTrashedMindmapGCP(ctx context.Context, id string, version int) error {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    ref := client.Collection(FS_COLLECTION).Doc(id)
+    return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+        snap, err := tx.Get(ref)
+        if status.Code(err) == codes.NotFound {
+            return ErrVersionConflict
+        }
+        if err != nil {
+            return err
+        }
+        item := snapshotToMindmapItem(snap)
+        if item.DeletedAt == "" || item.Version != version {
+            return ErrVersionConflict
+        }
+        // Fails the transaction if the document changed since it was read
+        return tx.Delete(ref, firestore.LastUpdateTime(snap.UpdateTime))
+    })
+}
+
+func FindMindmapByContentHashGCP(ctx context.Context, hash string) (*MindmapItem, error) {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+    it := client.Collection(FS_COLLECTION).Where("contentHash", "==", hash).Documents(ctx)
+    defer it.Stop()
+    for {
+        doc, err := it.Next()
+        if err == iterator.Done {
+            return nil, nil
+        }
+        if err != nil {
+            return nil, fmt.Errorf("firestore hash lookup failed: %w", err)
+        }
+        // Firestore cannot filter on a missing field, so trashed copies are skipped here
+        if item := snapshotToMindmapItem(doc); item.DeletedAt == "" {
+            return &item, nil
+        }
+    }
+}
+
+// ---------------- Firestore users (GCP) ---------------- //
+
+func CreateUserGCP(ctx context.Context, u User) error {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    _, err = client.Collection(FS_USERS_COLLECTION).Doc(u.Username).Create(ctx, u)
+    if status.Code(err) == codes.AlreadyExists {
+        return ErrUserExists
+    }
+    return err
+}
+
+func GetUserGCP(ctx context.Context, username string) (*User, error) {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+    snap, err := client.Collection(FS_USERS_COLLECTION).Doc(username).Get(ctx)
+    if err != nil {
+        if status.Code(err) == codes.NotFound {
+            return nil, nil
+        }
+        return nil, err
+    }
+    var u User
+    if err := snap.DataTo(&u); err != nil {
+        return nil, err
+    }
+    return &u, nil
+}
+
+func PutUserGCP(ctx context.Context, u User) error {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    _, err = client.Collection(FS_USERS_COLLECTION).Doc(u.Username).Set(ctx, u)
+    return err
+}
+
+func DeleteUserGCP(ctx context.Context, username string) (bool, error) {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return false, err
+    }
+    defer client.Close()
+    // Delete with an Exists precondition fails with NotFound for unknown users
+    _, err = client.Collection(FS_USERS_COLLECTION).Doc(username).Delete(ctx, firestore.Exists)
+    if status.Code(err) == codes.NotFound {
+        return false, nil
+    }
     if err != nil {
         return false, err
     }
     return true, nil
 }
 
+func ListUsersGCP(ctx context.Context) ([]User, error) {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+    it := client.Collection(FS_USERS_COLLECTION).Documents(ctx)
+    defer it.Stop()
+    users := []User{}
+    for {
+        doc, err := it.Next()
+        if err == iterator.Done {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("firestore list users failed: %w", err)
+        }
+        var u User
+        if err := doc.DataTo(&u); err != nil {
+            log.Printf("gcp: skipping unreadable user %s: %v", doc.Ref.ID, err)
+            continue
+        }
+        users = append(users, u)
+    }
+    return users, nil
+}
+
+// ---------------- Firestore API tokens (GCP) ---------------- //
+
+func CreateTokenGCP(ctx context.Context, t APIToken) error {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    _, err = client.Collection(FS_TOKENS_COLLECTION).Doc(t.ID).Create(ctx, t)
+    return err
+}
+
+func GetTokenGCP(ctx context.Context, id string) (*APIToken, error) {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+    snap, err := client.Collection(FS_TOKENS_COLLECTION).Doc(id).Get(ctx)
+    if err != nil {
+        if status.Code(err) == codes.NotFound {
+            return nil, nil
+        }
+        return nil, err
+    }
+    var t APIToken
+    if err := snap.DataTo(&t); err != nil {
+        return nil, err
+    }
+    return &t, nil
+}
+
+func ListTokensGCP(ctx context.Context, username string) ([]APIToken, error) {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+    q := client.Collection(FS_TOKENS_COLLECTION).Query
+    if username != "" {
+        q = q.Where("username", "==", username)
+    }
+    it := q.Documents(ctx)
+    defer it.Stop()
+    tokens := []APIToken{}
+    for {
+        doc, err := it.Next()
+        if err == iterator.Done {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("firestore list tokens failed: %w", err)
+        }
+        var t APIToken
+        if err := doc.DataTo(&t); err != nil {
+            log.Printf("gcp: skipping unreadable token %s: %v", doc.Ref.ID, err)
+            continue
+        }
+        tokens = append(tokens, t)
+    }
+    return tokens, nil
+}
+
+func DeleteTokenGCP(ctx context.Context, id string) (bool, error) {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return false, err
+    }
+    defer client.Close()
+    _, err = client.Collection(FS_TOKENS_COLLECTION).Doc(id).Delete(ctx, firestore.Exists)
+    if status.Code(err) == codes.NotFound {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+func TouchTokenGCP(ctx context.Context, id, usedAt string) error {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    _, err = client.Collection(FS_TOKENS_COLLECTION).Doc(id).Update(ctx, []firestore.Update{{Path: "lastUsedAt", Value: usedAt}})
+    return err
+}
+
+// ---------------- Firestore LLM usage (GCP) ---------------- //
+
+func RecordUsageGCP(ctx context.Context, rec UsageRecord) error {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    _, err = client.Collection(FS_USAGE_COLLECTION).Doc(rec.ID).Set(ctx, rec)
+    return err
+}
+
+func ListUsageGCP(ctx context.Context, from, to string) ([]UsageRecord, error) {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+    q := client.Collection(FS_USAGE_COLLECTION).OrderBy("time", firestore.Asc)
+    if from != "" {
+        q = q.Where("time", ">=", from)
+    }
+    if to != "" {
+        q = q.Where("time", "<", to)
+    }
+    it := q.Documents(ctx)
+    defer it.Stop()
+    records := []UsageRecord{}
+    for {
+        doc, err := it.Next()
+        if err == iterator.Done {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("firestore list usage failed: %w", err)
+        }
+        var rec UsageRecord
+        if err := doc.DataTo(&rec); err != nil {
+            log.Printf("gcp: skipping unreadable usage record %s: %v", doc.Ref.ID, err)
+            continue
+        }
+        records = append(records, rec)
+    }
+    return records, nil
+}
+
+func revisionsGCP(client *firestore.Client, mindmapID string) *firestore.CollectionRef {
+    return client.Collection(FS_COLLECTION).Doc(mindmapID).Collection(FS_REVISIONS_COLLECTION)
+}
+
+func SaveRevisionGCP(ctx context.Context, rev Revision) error {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    _, err = revisionsGCP(client, rev.MindmapID).Doc(strconv.Itoa(rev.Version)).Set(ctx, rev)
+    return err
+}
+
+func ListRevisionsGCP(ctx context.Context, mindmapID string) ([]Revision, error) {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+    it := revisionsGCP(client, mindmapID).OrderBy("version", firestore.Asc).Documents(ctx)
+    defer it.Stop()
+    revs := []Revision{}
+    for {
+        doc, err := it.Next()
+        if err == iterator.Done {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("firestore list revisions failed: %w", err)
+        }
+        var rev Revision
+        if err := doc.DataTo(&rev); err != nil {
+            log.Printf("gcp: skipping unreadable revision %s/%s: %v", mindmapID, doc.Ref.ID, err)
+            continue
+        }
+        revs = append(revs, rev)
+    }
+    return revs, nil
+}
+
+func GetRevisionGCP(ctx context.Context, mindmapID string, version int) (*Revision, error) {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+    snap, err := revisionsGCP(client, mindmapID).Doc(strconv.Itoa(version)).Get(ctx)
+    if status.Code(err) == codes.NotFound {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var rev Revision
+    if err := snap.DataTo(&rev); err != nil {
+        return nil, err
+    }
+    return &rev, nil
+}
+
+func DeleteRevisionsGCP(ctx context.Context, mindmapID string) error {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    refs, err := revisionsGCP(client, mindmapID).DocumentRefs(ctx).GetAll()
+    if err != nil {
+        return fmt.Errorf("firestore list revisions failed: %w", err)
+    }
+    for _, ref := range refs {
+        if _, err := ref.Delete(ctx); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
 func ListMindmapsGCP(ctx context.Context) ([]MindmapItem, error) {
+    return listMindmapsGCP(ctx, func(c *firestore.CollectionRef) firestore.Query { return c.Query })
+}
+
+// ListMindmapSummariesGCP reads only the summary fields of every document,
+// leaving the PDF text and the tree on the server
+func ListMindmapSummariesGCP(ctx context.Context) ([]MindmapItem, error) {
+    return listMindmapsGCP(ctx, func(c *firestore.CollectionRef) firestore.Query { return c.Select(summaryPathsGCP()...) })
+}
+
+// summaryPathsGCP lists the SummaryFields under both casings, since older
+// documents use the Go field names.
+func summaryPathsGCP() []string {
+    var paths []string
+    for _, f := range SummaryFields {
+        if f == "id" {
+            continue
+        }
+        paths = append(paths, f)
+        if goName := strings.ToUpper(f[:1]) + f[1:]; goName != f {
+            paths = append(paths, goName)
+        }
+    }
+    return paths
+}
+
+// ListMindmapSummariesByCreatedAtGCP reads up to limit summaries ordered by
+// createdAt, then id, starting after the given document. Documents whose
+// createdAt is not a string yet are left out until MigrateCreatedAtGCP runs.
+func ListMindmapSummariesByCreatedAtGCP(ctx context.Context, desc bool, after *PageKey, limit int) ([]MindmapItem, error) {
+    dir := firestore.Asc
+    if desc {
+        dir = firestore.Desc
+    }
+    return listMindmapsGCP(ctx, func(c *firestore.CollectionRef) firestore.Query {
+        q := c.Select(summaryPathsGCP()...).
+            Where("createdAt", ">=", "").
+            OrderBy("createdAt", dir).
+            OrderBy(firestore.DocumentID, dir)
+        if after != nil {
+            q = q.StartAfter(after.CreatedAt, after.ID)
+        }
+        return q.Limit(limit)
+    })
+}
+
+// MigrateCreatedAtGCP copies the creation time of documents written before
+// createdAt was a string field, under either casing or as a timestamp, into
+// a string createdAt, and reports how many it changed.
+func MigrateCreatedAtGCP(ctx context.Context) (int, error) {
+    client, _, err := getFirestoreClient(ctx)
+    if err != nil {
+        return 0, err
+    }
+    defer client.Close()
+    it := client.Collection(FS_COLLECTION).Select("createdAt", "CreatedAt").Documents(ctx)
+    defer it.Stop()
+    migrated := 0
+    for {
+        doc, err := it.Next()
+        if err == iterator.Done {
+            break
+        }
+        if err != nil {
+            return migrated, err
+        }
+        if _, ok := doc.Data()["createdAt"].(string); ok {
+            continue
+        }
+        createdAt := snapshotToMindmapItem(doc).CreatedAt
+        if createdAt == "" {
+            continue
+        }
+        // Not a change to the map itself, so the version stays put. Update,
+        // unlike Set, fails rather than recreating a document deleted meanwhile
+        _, err = doc.Ref.Update(ctx, []firestore.Update{{Path: "createdAt", Value: createdAt}})
+        if status.Code(err) == codes.NotFound {
+            continue
+        }
+        if err != nil {
+            return migrated, err
+        }
+        migrated++
+    }
+    return migrated, nil
+}
+
+func listMindmapsGCP(ctx context.Context, query func(*firestore.CollectionRef) firestore.Query) ([]MindmapItem, error) {
     client, _, err := getFirestoreClient(ctx)
     if err != nil {
         return nil, err
     }
     defer client.Close()
 
-    it := client.Collection(FS_COLLECTION).Documents(ctx)
+    it := query(client.Collection(FS_COLLECTION)).Documents(ctx)
     defer it.Stop()
 
     var res []MindmapItem
@@ -179,6 +661,16 @@ func snapshotToMindmapItem(snap *firestore.DocumentSnapshot) MindmapItem {
         }
     }
 
+    getInt := func(keys ...string) int {
+        switch n := val(keys...).(type) {
+        case int64:
+            return int(n)
+        case float64:
+            return int(n)
+        }
+        return 0
+    }
+
     toISOString := func(v any) string {
         switch t := v.(type) {
         case string:
@@ -236,15 +728,37 @@ func snapshotToMindmapItem(snap *firestore.DocumentSnapshot) MindmapItem {
     }
 
     item := MindmapItem{
-        ID:          snap.Ref.ID,
-        Filename:    getString("filename", "Filename"),
-        Title:       getString("title", "Title"),
-        Authors:     toStringSlice(val("authors", "Authors")),
-        Date:        getString("date", "Date"),
-        PDFText:     getString("pdfText", "PDFText"),
-        CreatedAt:   toISOString(val("createdAt", "CreatedAt")),
-        UpdatedAt:   toISOString(val("updatedAt", "UpdatedAt")),
-        MindmapData: nil,
+        ID:           snap.Ref.ID,
+        Filename:     getString("filename", "Filename"),
+        Title:        getString("title", "Title"),
+        Authors:      toStringSlice(val("authors", "Authors")),
+        Date:         getString("date", "Date"),
+        Tags:         toStringSlice(val("tags", "Tags")),
+        PDFText:      getString("pdfText", "PDFText"),
+        Owner:        getString("owner", "Owner"),
+        LastEditedBy: getString("lastEditedBy", "LastEditedBy"),
+        ContentHash:  getString("contentHash", "ContentHash"),
+        Version:      getInt("version", "Version"),
+        DeletedAt:    getString("deletedAt", "DeletedAt"),
+        DeletedBy:    getString("deletedBy", "DeletedBy"),
+        CreatedAt:    toISOString(val("createdAt", "CreatedAt")),
+        UpdatedAt:    toISOString(val("updatedAt", "UpdatedAt")),
+        MindmapData:  nil,
+    }
+
+    if pv, ok := val("pageTexts", "PageTexts").([]interface{}); ok {
+        for _, e := range pv {
+            m, ok := e.(map[string]interface{})
+            if !ok { continue }
+            pt := PageText{Text: getStringFrom(m, "text", "Text")}
+            switch n := firstOf(m, "page", "Page").(type) {
+            case int64:
+                pt.Page = int(n)
+            case float64:
+                pt.Page = int(n)
+            }
+            item.PageTexts = append(item.PageTexts, pt)
+        }
     }
 
     // Mindmap data may be stored under either casing depending on writer
@@ -268,3 +782,19 @@ func snapshotToMindmapItem(snap *firestore.DocumentSnapshot) MindmapItem {
 
     return item
 }
+
+func firstOf(m map[string]interface{}, keys ...string) interface{} {
+    for _, k := range keys {
+        if v, ok := m[k]; ok && v != nil {
+            return v
+        }
+    }
+    return nil
+}
+
+func getStringFrom(m map[string]interface{}, keys ...string) string {
+    if s, ok := firstOf(m, keys...).(string); ok {
+        return s
+    }
+    return ""
+}
@@ -0,0 +1,393 @@
+package db
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/url"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// SummaryFields are the attributes a listing page needs. Backends that
+// implement SummaryLister read only these.
+var SummaryFields = []string{"id", "filename", "title", "authors", "date", "tags", "owner", "lastEditedBy", "version", "deletedAt", "deletedBy", "createdAt", "updatedAt"}
+
+// Sort orders for ListMindmapPage.
+const (
+    SortCreatedAt = "createdAt"
+    SortTitle     = "title"
+    SortDate      = "date"
+)
+
+// Page sizes for ListMindmapPage.
+const (
+    DefaultPageSize = 20
+    MaxPageSize     = 100
+)
+
+// ErrBadCursor means a cursor was not handed out by ListMindmapPage for the
+// same sort order.
+var ErrBadCursor = errors.New("invalid cursor")
+
+// ListQuery selects one page of the live mind maps. Author matches part of
+// any author's name, Tag and Owner match exactly, all ignoring case. From
+// and To bound the paper's date, the one sort=date orders by, as YYYY-MM-DD
+// with To exclusive; papers without a date are left out when either is set.
+// Desc reverses the sort.
+type ListQuery struct {
+    Limit  int
+    Cursor string
+    Sort   string
+    Desc   bool
+    Author string
+    Tag    string
+    Owner  string
+    From   string
+    To     string
+}
+
+// MindmapSummary is what a listing page says about each mind map.
+type MindmapSummary struct {
+    ID           string   `json:"id"`
+    Filename     string   `json:"filename"`
+    Title        string   `json:"title"`
+    Authors      []string `json:"authors"`
+    Date         string   `json:"date"`
+    Tags         []string `json:"tags,omitempty"`
+    Owner        string   `json:"owner,omitempty"`
+    LastEditedBy string   `json:"lastEditedBy,omitempty"`
+    Version      int      `json:"version"`
+    CreatedAt    string   `json:"createdAt"`
+    UpdatedAt    string   `json:"updatedAt"`
+}
+
+// ListPage is one page of summaries; NextCursor is empty on the last page.
+type ListPage struct {
+    Items      []MindmapSummary `json:"items"`
+    NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+// listCursor is where a page ended. Clients get it base64-encoded and
+// should treat it as opaque.
+type listCursor struct {
+    Sort string `json:"s"`
+    Desc bool   `json:"d"`
+    Key  string `json:"k"`
+    ID   string `json:"i"`
+}
+
+// PageKey is where a CreatedAtPager batch starts: just after the item with
+// this CreatedAt and ID.
+type PageKey struct {
+    CreatedAt string
+    ID        string
+}
+
+// CreatedAtPager is implemented by backends that can read summaries in
+// CreatedAt order a batch at a time, so the default listing does not read
+// every item. A batch shorter than limit is the last one.
+type CreatedAtPager interface {
+    SummariesByCreatedAt(ctx context.Context, desc bool, after *PageKey, limit int) ([]MindmapItem, error)
+}
+
+// ParseListQuery reads limit (default 20, at most 100), cursor, sort
+// (createdAt, title or date), order (asc or desc; createdAt and date default
+// to newest first, title to A-Z), author, tag, owner, and from and to, which
+// take RFC 3339 times or YYYY-MM-DD dates and bound the paper's date. A date
+// given as to includes that whole day. Its errors are meant for the caller.
+func ParseListQuery(q url.Values) (ListQuery, error) {
+    lq := ListQuery{
+        Limit:  DefaultPageSize,
+        Cursor: strings.TrimSpace(q.Get("cursor")),
+        Sort:   SortCreatedAt,
+        Author: strings.TrimSpace(q.Get("author")),
+        Tag:    strings.TrimSpace(q.Get("tag")),
+        Owner:  strings.TrimSpace(q.Get("owner")),
+    }
+    if v := strings.TrimSpace(q.Get("limit")); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return lq, fmt.Errorf("limit must be a positive number")
+        }
+        lq.Limit = min(n, MaxPageSize)
+    }
+    switch v := strings.TrimSpace(q.Get("sort")); v {
+    case "", SortCreatedAt:
+    case SortTitle, SortDate:
+        lq.Sort = v
+    default:
+        return lq, fmt.Errorf("sort must be createdAt, title or date")
+    }
+    lq.Desc = lq.Sort != SortTitle
+    switch strings.ToLower(strings.TrimSpace(q.Get("order"))) {
+    case "":
+    case "asc":
+        lq.Desc = false
+    case "desc":
+        lq.Desc = true
+    default:
+        return lq, fmt.Errorf("order must be asc or desc")
+    }
+    for _, b := range []struct {
+        name string
+        dst  *string
+        end  bool
+    }{{"from", &lq.From, false}, {"to", &lq.To, true}} {
+        v := strings.TrimSpace(q.Get(b.name))
+        if v == "" {
+            continue
+        }
+        t, ok := ParseTimeBound(v, b.end)
+        if !ok {
+            return lq, fmt.Errorf("%s must be an RFC 3339 time or a YYYY-MM-DD date", b.name)
+        }
+        // paper dates are days, so a bound inside a day counts from the next
+        if day := t.Truncate(24 * time.Hour); day.Before(t) {
+            t = day.AddDate(0, 0, 1)
+        }
+        *b.dst = t.Format("2006-01-02")
+    }
+    return lq, nil
+}
+
+// ParseTimeBound accepts an RFC 3339 time or a YYYY-MM-DD date as one end of
+// a range. A date used as the end includes that whole day.
+func ParseTimeBound(v string, end bool) (time.Time, bool) {
+    if t, err := time.Parse(time.RFC3339, v); err == nil {
+        return t.UTC(), true
+    }
+    t, err := time.Parse("2006-01-02", v)
+    if err != nil {
+        return time.Time{}, false
+    }
+    if end {
+        t = t.AddDate(0, 0, 1)
+    }
+    return t, true
+}
+
+// ListSummaries lists every item, trashed ones included, with only the
+// SummaryFields filled in.
+func ListSummaries(ctx context.Context, store MindmapStore) ([]MindmapItem, error) {
+    if sl, ok := store.(SummaryLister); ok {
+        return sl.ListSummaries(ctx)
+    }
+    items, err := store.List(ctx)
+    if err != nil {
+        return nil, err
+    }
+    for i := range items {
+        items[i].PDFText, items[i].PageTexts, items[i].MindmapData = "", nil, nil
+    }
+    return items, nil
+}
+
+// ListMindmapPage filters, sorts and pages the live items. A page starts
+// after the sort value and id of the previous page's last item rather than
+// at an offset, so maps added or deleted in between do not shift it. Sorted
+// by CreatedAt on a CreatedAtPager, only the batches the page needs are
+// read; otherwise every summary is.
+func ListMindmapPage(ctx context.Context, store MindmapStore, q ListQuery) (*ListPage, error) {
+    if q.Sort == "" {
+        q.Sort = SortCreatedAt
+    }
+    if q.Limit < 1 {
+        q.Limit = DefaultPageSize
+    }
+    var after *listCursor
+    if q.Cursor != "" {
+        c, err := decodeListCursor(q.Cursor)
+        if err != nil || c.Sort != q.Sort || c.Desc != q.Desc {
+            return nil, ErrBadCursor
+        }
+        after = c
+    }
+    if pager, ok := store.(CreatedAtPager); ok && q.Sort == SortCreatedAt {
+        return pageByCreatedAt(ctx, pager, q, after)
+    }
+    items, err := ListSummaries(ctx, store)
+    if err != nil {
+        return nil, err
+    }
+
+    type keyed struct {
+        key  string
+        item MindmapItem
+    }
+    var matches []keyed
+    for _, item := range items {
+        if item.DeletedAt == "" && q.matches(item) {
+            matches = append(matches, keyed{sortKey(item, q.Sort), item})
+        }
+    }
+    // before reports whether (ka, ida) comes ahead of (kb, idb) in this order
+    before := func(ka, ida, kb, idb string) bool {
+        if ka != kb {
+            return (ka < kb) != q.Desc
+        }
+        if ida == idb {
+            return false
+        }
+        return (ida < idb) != q.Desc
+    }
+    sort.Slice(matches, func(i, j int) bool {
+        return before(matches[i].key, matches[i].item.ID, matches[j].key, matches[j].item.ID)
+    })
+    start := 0
+    if after != nil {
+        start = sort.Search(len(matches), func(i int) bool {
+            return before(after.Key, after.ID, matches[i].key, matches[i].item.ID)
+        })
+    }
+    end := min(start+q.Limit, len(matches))
+
+    page := &ListPage{Items: make([]MindmapSummary, 0, end-start)}
+    for _, m := range matches[start:end] {
+        page.Items = append(page.Items, summaryOf(m.item))
+    }
+    if end < len(matches) {
+        last := matches[end-1]
+        page.NextCursor = encodeListCursor(listCursor{Sort: q.Sort, Desc: q.Desc, Key: last.key, ID: last.item.ID})
+    }
+    return page, nil
+}
+
+// pageByCreatedAt reads batches from pager until it has one match more than
+// the page holds, or runs out.
+func pageByCreatedAt(ctx context.Context, pager CreatedAtPager, q ListQuery, after *listCursor) (*ListPage, error) {
+    var key *PageKey
+    if after != nil {
+        key = &PageKey{CreatedAt: after.Key, ID: after.ID}
+    }
+    batch := q.Limit + 1
+    var found []MindmapItem
+    for len(found) <= q.Limit {
+        items, err := pager.SummariesByCreatedAt(ctx, q.Desc, key, batch)
+        if err != nil {
+            return nil, err
+        }
+        for _, item := range items {
+            if item.DeletedAt == "" && q.matches(item) && len(found) <= q.Limit {
+                found = append(found, item)
+            }
+        }
+        if len(items) < batch {
+            break
+        }
+        last := items[len(items)-1]
+        key = &PageKey{CreatedAt: last.CreatedAt, ID: last.ID}
+    }
+
+    end := min(q.Limit, len(found))
+    page := &ListPage{Items: make([]MindmapSummary, 0, end)}
+    for _, item := range found[:end] {
+        page.Items = append(page.Items, summaryOf(item))
+    }
+    if len(found) > q.Limit {
+        last := found[end-1]
+        page.NextCursor = encodeListCursor(listCursor{Sort: q.Sort, Desc: q.Desc, Key: last.CreatedAt, ID: last.ID})
+    }
+    return page, nil
+}
+
+func (q ListQuery) matches(item MindmapItem) bool {
+    if q.Owner != "" && !strings.EqualFold(item.Owner, q.Owner) {
+        return false
+    }
+    if q.From != "" || q.To != "" {
+        day := paperDateKey(item.Date)
+        if day == "" || (q.From != "" && day < q.From) || (q.To != "" && day >= q.To) {
+            return false
+        }
+    }
+    if q.Tag != "" {
+        found := false
+        for _, t := range item.Tags {
+            found = found || strings.EqualFold(t, q.Tag)
+        }
+        if !found {
+            return false
+        }
+    }
+    if q.Author != "" {
+        needle := strings.ToLower(q.Author)
+        found := false
+        for _, a := range item.Authors {
+            found = found || strings.Contains(strings.ToLower(a), needle)
+        }
+        if !found {
+            return false
+        }
+    }
+    return true
+}
+
+func sortKey(item MindmapItem, by string) string {
+    switch by {
+    case SortTitle:
+        return strings.ToLower(strings.TrimSpace(item.Title))
+    case SortDate:
+        return paperDateKey(item.Date)
+    }
+    return item.CreatedAt
+}
+
+var (
+    paperDateLayouts = []string{"2006-01-02", "2006-01", "January 2, 2006", "Jan 2, 2006", "2 January 2006", "January 2006", "Jan 2006", "2006"}
+    paperYear        = regexp.MustCompile(`\b(1[89]|20)\d\d\b`)
+)
+
+// paperDateKey turns the free-form date the LLM extracted from a paper into
+// YYYY-MM-DD so it sorts. A year found anywhere in it counts as January 1st,
+// and papers without one get "", which sorts before every date.
+func paperDateKey(date string) string {
+    date = strings.TrimSpace(date)
+    for _, layout := range paperDateLayouts {
+        if t, err := time.Parse(layout, date); err == nil {
+            return t.Format("2006-01-02")
+        }
+    }
+    if y := paperYear.FindString(date); y != "" {
+        return y + "-01-01"
+    }
+    return ""
+}
+
+func summaryOf(item MindmapItem) MindmapSummary {
+    return MindmapSummary{
+        ID:           item.ID,
+        Filename:     item.Filename,
+        Title:        item.Title,
+        Authors:      item.Authors,
+        Date:         item.Date,
+        Tags:         item.Tags,
+        Owner:        item.Owner,
+        LastEditedBy: item.LastEditedBy,
+        Version:      item.Version,
+        CreatedAt:    item.CreatedAt,
+        UpdatedAt:    item.UpdatedAt,
+    }
+}
+
+func encodeListCursor(c listCursor) string {
+    raw, _ := json.Marshal(c)
+    return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeListCursor(s string) (*listCursor, error) {
+    raw, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil {
+        return nil, err
+    }
+    var c listCursor
+    if err := json.Unmarshal(raw, &c); err != nil {
+        return nil, err
+    }
+    return &c, nil
+}
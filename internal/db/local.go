@@ -0,0 +1,564 @@
+package db
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    bolt "go.etcd.io/bbolt"
+)
+
+const (
+    localMindmapsBucket  = "mindmaps"
+    localUsersBucket     = "users"
+    localTokensBucket    = "tokens"
+    localUsageBucket     = "usage"
+    localRevisionsBucket = "revisions"
+)
+
+func init() {
+    RegisterStore("local", NewLocalStore(""))
+}
+
+func localDBPath() string {
+    v := strings.TrimSpace(os.Getenv("LOCAL_DB_PATH"))
+    if v == "" {
+        v = "nanachi.db"
+    }
+    return v
+}
+
+// LocalStore keeps every item in a single BoltDB file on disk, so the server
+// can run without AWS or GCP. The file is opened lazily on first use; an
+// empty path means LOCAL_DB_PATH as it is set then, so .env is honoured.
+type LocalStore struct {
+    path string
+
+    once sync.Once
+    db   *bolt.DB
+    err  error
+}
+
+func NewLocalStore(path string) *LocalStore {
+    return &LocalStore{path: path}
+}
+
+func (s *LocalStore) open() (*bolt.DB, error) {
+    s.once.Do(func() {
+        if s.path == "" {
+            s.path = localDBPath()
+        }
+        db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+        if err != nil {
+            log.Printf("local: failed to open %s: %v", s.path, err)
+            s.err = fmt.Errorf("open local db %q: %w", s.path, err)
+            return
+        }
+        err = db.Update(func(tx *bolt.Tx) error {
+            for _, name := range []string{localMindmapsBucket, localUsersBucket, localTokensBucket, localUsageBucket, localRevisionsBucket} {
+                if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+                    return err
+                }
+            }
+            return nil
+        })
+        if err != nil {
+            db.Close()
+            s.err = fmt.Errorf("init local db %q: %w", s.path, err)
+            return
+        }
+        log.Printf("local: using %s", s.path)
+        s.db = db
+    })
+    return s.db, s.err
+}
+
+// Close releases the underlying file. It is safe to call on a store that was
+// never opened.
+func (s *LocalStore) Close() error {
+    if s.db == nil {
+        return nil
+    }
+    return s.db.Close()
+}
+
+func (s *LocalStore) Create(ctx context.Context, item MindmapItem) (string, error) {
+    if item.ID == "" {
+        item.ID = uuid.New().String()
+    }
+    db, err := s.open()
+    if err != nil {
+        return "", err
+    }
+    raw, err := json.Marshal(item)
+    if err != nil {
+        return "", err
+    }
+    err = db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(localMindmapsBucket))
+        if b.Get([]byte(item.ID)) != nil {
+            return fmt.Errorf("mindmap %s already exists", item.ID)
+        }
+        return b.Put([]byte(item.ID), raw)
+    })
+    if err != nil {
+        return "", err
+    }
+    return item.ID, nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, id string) (*MindmapItem, error) {
+    db, err := s.open()
+    if err != nil {
+        return nil, err
+    }
+    var item *MindmapItem
+    err = db.View(func(tx *bolt.Tx) error {
+        raw := tx.Bucket([]byte(localMindmapsBucket)).Get([]byte(id))
+        if raw == nil {
+            return nil
+        }
+        item = &MindmapItem{}
+        return json.Unmarshal(raw, item)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return item, nil
+}
+
+// Update merges the given top-level fields (keyed by their JSON names, e.g.
+// "mindmapData", "updatedAt") into the stored record. Like the cloud
+// backends, updating a missing id creates it.
+func (s *LocalStore) Update(ctx context.Context, id string, updates map[string]interface{}) error {
+    return s.update(id, -1, updates)
+}
+
+func (s *LocalStore) UpdateIfVersion(ctx context.Context, id string, version int, updates map[string]interface{}) error {
+    return s.update(id, version, updates)
+}
+
+func (s *LocalStore) update(id string, version int, updates map[string]interface{}) error {
+    db, err := s.open()
+    if err != nil {
+        return err
+    }
+    return db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(localMindmapsBucket))
+        raw, err := mergeUpdate(b.Get([]byte(id)), id, version, updates)
+        if err != nil {
+            return err
+        }
+        return b.Put([]byte(id), raw)
+    })
+}
+
+func (s *LocalStore) Delete(ctx context.Context, id string) (bool, error) {
+    db, err := s.open()
+    if err != nil {
+        return false, err
+    }
+    deleted := false
+    err = db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(localMindmapsBucket))
+        if b.Get([]byte(id)) == nil {
+            return nil
+        }
+        deleted = true
+        return b.Delete([]byte(id))
+    })
+    if err != nil {
+        return false, err
+    }
+    return deleted, nil
+}
+
+func (s *LocalStore) DeleteIfTrashed(ctx context.Context, id string, version int) error {
+    db, err := s.open()
+    if err != nil {
+        return err
+    }
+    return db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(localMindmapsBucket))
+        if !trashedAt(b.Get([]byte(id)), version) {
+            return ErrVersionConflict
+        }
+        return b.Delete([]byte(id))
+    })
+}
+
+func (s *LocalStore) List(ctx context.Context) ([]MindmapItem, error) {
+    db, err := s.open()
+    if err != nil {
+        return nil, err
+    }
+    items := []MindmapItem{}
+    err = db.View(func(tx *bolt.Tx) error {
+        return tx.Bucket([]byte(localMindmapsBucket)).ForEach(func(k, v []byte) error {
+            var mm MindmapItem
+            if err := json.Unmarshal(v, &mm); err != nil {
+                log.Printf("local: skipping unreadable mindmap %s: %v", k, err)
+                return nil
+            }
+            items = append(items, mm)
+            return nil
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+    return items, nil
+}
+
+func (s *LocalStore) FindByContentHash(ctx context.Context, hash string) (*MindmapItem, error) {
+    db, err := s.open()
+    if err != nil {
+        return nil, err
+    }
+    var item *MindmapItem
+    err = db.View(func(tx *bolt.Tx) error {
+        c := tx.Bucket([]byte(localMindmapsBucket)).Cursor()
+        for k, v := c.First(); k != nil; k, v = c.Next() {
+            if liveContentHash(v) != hash {
+                continue
+            }
+            item = &MindmapItem{}
+            return json.Unmarshal(v, item)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return item, nil
+}
+
+func (s *LocalStore) CreateUser(ctx context.Context, u User) error {
+    db, err := s.open()
+    if err != nil {
+        return err
+    }
+    raw, err := json.Marshal(u)
+    if err != nil {
+        return err
+    }
+    return db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(localUsersBucket))
+        if b.Get([]byte(u.Username)) != nil {
+            return ErrUserExists
+        }
+        return b.Put([]byte(u.Username), raw)
+    })
+}
+
+func (s *LocalStore) GetUser(ctx context.Context, username string) (*User, error) {
+    db, err := s.open()
+    if err != nil {
+        return nil, err
+    }
+    var u *User
+    err = db.View(func(tx *bolt.Tx) error {
+        raw := tx.Bucket([]byte(localUsersBucket)).Get([]byte(username))
+        if raw == nil {
+            return nil
+        }
+        u = &User{}
+        return json.Unmarshal(raw, u)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return u, nil
+}
+
+func (s *LocalStore) PutUser(ctx context.Context, u User) error {
+    db, err := s.open()
+    if err != nil {
+        return err
+    }
+    raw, err := json.Marshal(u)
+    if err != nil {
+        return err
+    }
+    return db.Update(func(tx *bolt.Tx) error {
+        return tx.Bucket([]byte(localUsersBucket)).Put([]byte(u.Username), raw)
+    })
+}
+
+func (s *LocalStore) DeleteUser(ctx context.Context, username string) (bool, error) {
+    db, err := s.open()
+    if err != nil {
+        return false, err
+    }
+    deleted := false
+    err = db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(localUsersBucket))
+        if b.Get([]byte(username)) == nil {
+            return nil
+        }
+        deleted = true
+        return b.Delete([]byte(username))
+    })
+    if err != nil {
+        return false, err
+    }
+    return deleted, nil
+}
+
+func (s *LocalStore) ListUsers(ctx context.Context) ([]User, error) {
+    db, err := s.open()
+    if err != nil {
+        return nil, err
+    }
+    users := []User{}
+    err = db.View(func(tx *bolt.Tx) error {
+        return tx.Bucket([]byte(localUsersBucket)).ForEach(func(k, v []byte) error {
+            var u User
+            if err := json.Unmarshal(v, &u); err != nil {
+                log.Printf("local: skipping unreadable user %s: %v", k, err)
+                return nil
+            }
+            users = append(users, u)
+            return nil
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+    return users, nil
+}
+
+func (s *LocalStore) CreateToken(ctx context.Context, t APIToken) error {
+    db, err := s.open()
+    if err != nil {
+        return err
+    }
+    raw, err := json.Marshal(t)
+    if err != nil {
+        return err
+    }
+    return db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(localTokensBucket))
+        if b.Get([]byte(t.ID)) != nil {
+            return fmt.Errorf("token %s already exists", t.ID)
+        }
+        return b.Put([]byte(t.ID), raw)
+    })
+}
+
+func (s *LocalStore) GetToken(ctx context.Context, id string) (*APIToken, error) {
+    db, err := s.open()
+    if err != nil {
+        return nil, err
+    }
+    var t *APIToken
+    err = db.View(func(tx *bolt.Tx) error {
+        raw := tx.Bucket([]byte(localTokensBucket)).Get([]byte(id))
+        if raw == nil {
+            return nil
+        }
+        t = &APIToken{}
+        return json.Unmarshal(raw, t)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return t, nil
+}
+
+func (s *LocalStore) ListTokens(ctx context.Context, username string) ([]APIToken, error) {
+    db, err := s.open()
+    if err != nil {
+        return nil, err
+    }
+    tokens := []APIToken{}
+    err = db.View(func(tx *bolt.Tx) error {
+        return tx.Bucket([]byte(localTokensBucket)).ForEach(func(k, v []byte) error {
+            var t APIToken
+            if err := json.Unmarshal(v, &t); err != nil {
+                log.Printf("local: skipping unreadable token %s: %v", k, err)
+                return nil
+            }
+            if username == "" || t.Username == username {
+                tokens = append(tokens, t)
+            }
+            return nil
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+    return tokens, nil
+}
+
+func (s *LocalStore) DeleteToken(ctx context.Context, id string) (bool, error) {
+    db, err := s.open()
+    if err != nil {
+        return false, err
+    }
+    deleted := false
+    err = db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(localTokensBucket))
+        if b.Get([]byte(id)) == nil {
+            return nil
+        }
+        deleted = true
+        return b.Delete([]byte(id))
+    })
+    if err != nil {
+        return false, err
+    }
+    return deleted, nil
+}
+
+func (s *LocalStore) TouchToken(ctx context.Context, id, usedAt string) error {
+    db, err := s.open()
+    if err != nil {
+        return err
+    }
+    return db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(localTokensBucket))
+        raw := b.Get([]byte(id))
+        if raw == nil {
+            return fmt.Errorf("token %s not found", id)
+        }
+        var t APIToken
+        if err := json.Unmarshal(raw, &t); err != nil {
+            return err
+        }
+        t.LastUsedAt = usedAt
+        out, err := json.Marshal(t)
+        if err != nil {
+            return err
+        }
+        return b.Put([]byte(id), out)
+    })
+}
+
+// Usage records are keyed by time then id, so a cursor seek finds the start
+// of a range and iteration stops at its end.
+
+func (s *LocalStore) RecordUsage(ctx context.Context, rec UsageRecord) error {
+    db, err := s.open()
+    if err != nil {
+        return err
+    }
+    raw, err := json.Marshal(rec)
+    if err != nil {
+        return err
+    }
+    return db.Update(func(tx *bolt.Tx) error {
+        return tx.Bucket([]byte(localUsageBucket)).Put([]byte(rec.Time+"/"+rec.ID), raw)
+    })
+}
+
+func (s *LocalStore) ListUsage(ctx context.Context, from, to string) ([]UsageRecord, error) {
+    db, err := s.open()
+    if err != nil {
+        return nil, err
+    }
+    records := []UsageRecord{}
+    err = db.View(func(tx *bolt.Tx) error {
+        c := tx.Bucket([]byte(localUsageBucket)).Cursor()
+        for k, v := c.Seek([]byte(from)); k != nil; k, v = c.Next() {
+            var rec UsageRecord
+            if err := json.Unmarshal(v, &rec); err != nil {
+                log.Printf("local: skipping unreadable usage record %s: %v", k, err)
+                continue
+            }
+            if to != "" && rec.Time >= to {
+                break
+            }
+            records = append(records, rec)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return records, nil
+}
+
+func (s *LocalStore) SaveRevision(ctx context.Context, rev Revision) error {
+    db, err := s.open()
+    if err != nil {
+        return err
+    }
+    raw, err := json.Marshal(rev)
+    if err != nil {
+        return err
+    }
+    return db.Update(func(tx *bolt.Tx) error {
+        return tx.Bucket([]byte(localRevisionsBucket)).Put([]byte(revisionKey(rev.MindmapID, rev.Version)), raw)
+    })
+}
+
+func (s *LocalStore) ListRevisions(ctx context.Context, mindmapID string) ([]Revision, error) {
+    db, err := s.open()
+    if err != nil {
+        return nil, err
+    }
+    revs := []Revision{}
+    prefix := []byte(mindmapID + "/")
+    err = db.View(func(tx *bolt.Tx) error {
+        c := tx.Bucket([]byte(localRevisionsBucket)).Cursor()
+        for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+            var rev Revision
+            if err := json.Unmarshal(v, &rev); err != nil {
+                log.Printf("local: skipping unreadable revision %s: %v", k, err)
+                continue
+            }
+            revs = append(revs, rev)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return revs, nil
+}
+
+func (s *LocalStore) GetRevision(ctx context.Context, mindmapID string, version int) (*Revision, error) {
+    db, err := s.open()
+    if err != nil {
+        return nil, err
+    }
+    var rev *Revision
+    err = db.View(func(tx *bolt.Tx) error {
+        raw := tx.Bucket([]byte(localRevisionsBucket)).Get([]byte(revisionKey(mindmapID, version)))
+        if raw == nil {
+            return nil
+        }
+        rev = &Revision{}
+        return json.Unmarshal(raw, rev)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return rev, nil
+}
+
+func (s *LocalStore) DeleteRevisions(ctx context.Context, mindmapID string) error {
+    db, err := s.open()
+    if err != nil {
+        return err
+    }
+    prefix := []byte(mindmapID + "/")
+    return db.Update(func(tx *bolt.Tx) error {
+        c := tx.Bucket([]byte(localRevisionsBucket)).Cursor()
+        // Delete moves the cursor on, so seek back to the prefix each time
+        for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+            if err := c.Delete(); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
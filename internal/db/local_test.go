@@ -0,0 +1,437 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStorePathFromEnvAtFirstUse(t *testing.T) {
+	store := NewLocalStore("")
+	defer store.Close()
+	// set after the store is made, as main does when it loads .env
+	path := filepath.Join(t.TempDir(), "env.db")
+	t.Setenv("LOCAL_DB_PATH", path)
+	if _, err := store.Create(context.Background(), MindmapItem{Title: "t"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the store at LOCAL_DB_PATH: %v", err)
+	}
+}
+
+func TestLocalStoreCRUD(t *testing.T) {
+	ctx := context.Background()
+	store := NewLocalStore(filepath.Join(t.TempDir(), "test.db"))
+	defer store.Close()
+
+	id, err := store.Create(ctx, MindmapItem{
+		Title:       "Attention Is All You Need",
+		Authors:     []string{"Vaswani"},
+		MindmapData: map[string]interface{}{"name": "root"},
+		PDFText:     "text",
+	})
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if id == "" {
+		t.Fatal("expected generated id")
+	}
+	if _, err := store.Create(ctx, MindmapItem{ID: id}); err == nil {
+		t.Fatal("expected duplicate create to fail")
+	}
+
+	// Partial update must only touch the given fields
+	err = store.Update(ctx, id, map[string]interface{}{
+		"mindmapData": map[string]interface{}{"name": "new root"},
+		"updatedAt":   "2025-01-01T00:00:00Z",
+	})
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	got, err := store.Get(ctx, id)
+	if err != nil || got == nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if got.Title != "Attention Is All You Need" || got.PDFText != "text" {
+		t.Fatalf("update clobbered untouched fields: %+v", got)
+	}
+	if got.MindmapData["name"] != "new root" || got.UpdatedAt != "2025-01-01T00:00:00Z" {
+		t.Fatalf("update not applied: %+v", got)
+	}
+
+	items, err := store.List(ctx)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("expected 1 item, got %d (%v)", len(items), err)
+	}
+
+	deleted, err := store.Delete(ctx, id)
+	if err != nil || !deleted {
+		t.Fatalf("expected delete to succeed, got %t (%v)", deleted, err)
+	}
+	deleted, err = store.Delete(ctx, id)
+	if err != nil || deleted {
+		t.Fatalf("expected second delete to report not found, got %t (%v)", deleted, err)
+	}
+	if got, _ := store.Get(ctx, id); got != nil {
+		t.Fatal("expected nil after delete")
+	}
+}
+
+func TestUserStores(t *testing.T) {
+	local := NewLocalStore(filepath.Join(t.TempDir(), "users.db"))
+	defer local.Close()
+	for name, store := range map[string]UserStore{"memory": NewMemoryStore(), "local": local} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if u, err := store.GetUser(ctx, "erin"); err != nil || u != nil {
+				t.Fatalf("missing user: expected (nil, nil), got %v (%v)", u, err)
+			}
+			if err := store.CreateUser(ctx, User{Username: "erin", PasswordHash: "h1", Role: "editor"}); err != nil {
+				t.Fatalf("create failed: %v", err)
+			}
+			if err := store.CreateUser(ctx, User{Username: "erin", Role: "admin"}); !errors.Is(err, ErrUserExists) {
+				t.Fatalf("duplicate create: expected ErrUserExists, got %v", err)
+			}
+			if err := store.PutUser(ctx, User{Username: "erin", PasswordHash: "h2", Role: "viewer"}); err != nil {
+				t.Fatalf("put failed: %v", err)
+			}
+			u, err := store.GetUser(ctx, "erin")
+			if err != nil || u == nil || u.Role != "viewer" || u.PasswordHash != "h2" {
+				t.Fatalf("put not applied: %+v (%v)", u, err)
+			}
+			if users, err := store.ListUsers(ctx); err != nil || len(users) != 1 {
+				t.Fatalf("expected 1 user, got %d (%v)", len(users), err)
+			}
+			if deleted, err := store.DeleteUser(ctx, "erin"); err != nil || !deleted {
+				t.Fatalf("expected delete to succeed, got %t (%v)", deleted, err)
+			}
+			if deleted, err := store.DeleteUser(ctx, "erin"); err != nil || deleted {
+				t.Fatalf("expected second delete to report not found, got %t (%v)", deleted, err)
+			}
+		})
+	}
+}
+
+func TestTokenStores(t *testing.T) {
+	local := NewLocalStore(filepath.Join(t.TempDir(), "tokens.db"))
+	defer local.Close()
+	for name, store := range map[string]TokenStore{"memory": NewMemoryStore(), "local": local} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, tok := range []APIToken{
+				{ID: "t1", Username: "erin", Hash: "h1", Role: "editor", CreatedAt: "2025-01-01T00:00:00Z"},
+				{ID: "t2", Username: "vic", Hash: "h2", Role: "viewer", CreatedAt: "2025-01-02T00:00:00Z"},
+			} {
+				if err := store.CreateToken(ctx, tok); err != nil {
+					t.Fatalf("create failed: %v", err)
+				}
+			}
+			if err := store.CreateToken(ctx, APIToken{ID: "t1"}); err == nil {
+				t.Fatal("expected duplicate create to fail")
+			}
+			if tokens, err := store.ListTokens(ctx, "erin"); err != nil || len(tokens) != 1 || tokens[0].ID != "t1" {
+				t.Fatalf("expected erin's token only, got %+v (%v)", tokens, err)
+			}
+			if tokens, err := store.ListTokens(ctx, ""); err != nil || len(tokens) != 2 {
+				t.Fatalf("expected 2 tokens, got %d (%v)", len(tokens), err)
+			}
+			if err := store.TouchToken(ctx, "t1", "2025-02-01T00:00:00Z"); err != nil {
+				t.Fatalf("touch failed: %v", err)
+			}
+			if tok, err := store.GetToken(ctx, "t1"); err != nil || tok == nil || tok.LastUsedAt != "2025-02-01T00:00:00Z" || tok.Hash != "h1" {
+				t.Fatalf("touch not applied: %+v (%v)", tok, err)
+			}
+			if deleted, err := store.DeleteToken(ctx, "t1"); err != nil || !deleted {
+				t.Fatalf("expected delete to succeed, got %t (%v)", deleted, err)
+			}
+			if tok, err := store.GetToken(ctx, "t1"); err != nil || tok != nil {
+				t.Fatalf("expected (nil, nil) after delete, got %+v (%v)", tok, err)
+			}
+			if deleted, _ := store.DeleteToken(ctx, "t1"); deleted {
+				t.Fatal("expected second delete to report not found")
+			}
+		})
+	}
+}
+
+func TestUsageStores(t *testing.T) {
+	local := NewLocalStore(filepath.Join(t.TempDir(), "usage.db"))
+	defer local.Close()
+	for name, store := range map[string]UsageStore{"memory": NewMemoryStore(), "local": local} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, rec := range []UsageRecord{
+				{ID: "u2", Time: "2025-02-10T00:00:00Z", Operation: "mindmap", InputTokens: 200},
+				{ID: "u1", Time: "2025-01-31T23:59:59Z", Operation: "metadata", InputTokens: 100},
+				{ID: "u3", Time: "2025-03-01T00:00:00Z", Operation: "go-deeper", InputTokens: 300},
+			} {
+				if err := store.RecordUsage(ctx, rec); err != nil {
+					t.Fatalf("record failed: %v", err)
+				}
+			}
+			all, err := store.ListUsage(ctx, "", "")
+			if err != nil || len(all) != 3 || all[0].ID != "u1" || all[2].ID != "u3" {
+				t.Fatalf("expected all records oldest first, got %+v (%v)", all, err)
+			}
+			feb, err := store.ListUsage(ctx, "2025-02-01T00:00:00Z", "2025-03-01T00:00:00Z")
+			if err != nil || len(feb) != 1 || feb[0].ID != "u2" || feb[0].InputTokens != 200 {
+				t.Fatalf("expected only February's record, got %+v (%v)", feb, err)
+			}
+		})
+	}
+}
+
+func TestFindByContentHash(t *testing.T) {
+	local := NewLocalStore(filepath.Join(t.TempDir(), "hash.db"))
+	defer local.Close()
+	for name, store := range map[string]MindmapStore{"memory": NewMemoryStore(), "local": local} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store.Create(ctx, MindmapItem{ID: "a", Title: "First", ContentHash: "aaa"})
+			store.Create(ctx, MindmapItem{ID: "b", Title: "Second", ContentHash: "bbb"})
+			if item, err := FindByContentHash(ctx, store, "bbb"); err != nil || item == nil || item.ID != "b" {
+				t.Fatalf("expected item b, got %+v (%v)", item, err)
+			}
+			if item, err := FindByContentHash(ctx, store, "ccc"); err != nil || item != nil {
+				t.Fatalf("expected (nil, nil) for an unknown hash, got %+v (%v)", item, err)
+			}
+		})
+	}
+}
+
+func TestUpdateIfVersion(t *testing.T) {
+	local := NewLocalStore(filepath.Join(t.TempDir(), "version.db"))
+	defer local.Close()
+	for name, store := range map[string]MindmapStore{"memory": NewMemoryStore(), "local": local} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			// Items created before versioning start at 0
+			store.Create(ctx, MindmapItem{ID: "v", Title: "Old"})
+			if err := store.UpdateIfVersion(ctx, "v", 0, map[string]interface{}{"title": "First"}); err != nil {
+				t.Fatalf("expected update at version 0 to apply: %v", err)
+			}
+			if err := store.UpdateIfVersion(ctx, "v", 0, map[string]interface{}{"title": "Stale"}); !errors.Is(err, ErrVersionConflict) {
+				t.Fatalf("expected a conflict for a stale version, got %v", err)
+			}
+			if err := store.Update(ctx, "v", map[string]interface{}{"title": "Second", "version": 99}); err != nil {
+				t.Fatalf("update failed: %v", err)
+			}
+			item, _ := store.Get(ctx, "v")
+			if item.Title != "Second" || item.Version != 2 {
+				t.Fatalf("expected plain updates to bump the version too, got %+v", item)
+			}
+			if err := store.UpdateIfVersion(ctx, "missing", 0, map[string]interface{}{"title": "x"}); !errors.Is(err, ErrVersionConflict) {
+				t.Fatalf("expected a conflict for a missing item, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRevisionStores(t *testing.T) {
+	local := NewLocalStore(filepath.Join(t.TempDir(), "revisions.db"))
+	defer local.Close()
+	for name, store := range map[string]MindmapStore{"memory": NewMemoryStore(), "local": local} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store.Create(ctx, MindmapItem{ID: "m", Version: 3, UpdatedAt: "2025-01-01T00:00:00Z", Owner: "erin", MindmapData: map[string]interface{}{"name": "Old"}})
+			store.Create(ctx, MindmapItem{ID: "m2"})
+			before, _ := store.Get(ctx, "m")
+			// a map without history gets its prior state saved as a baseline
+			RecordRevision(ctx, store, before, Revision{MindmapID: "m", Version: 4, Actor: "vic", Operation: "go-deeper", MindmapData: map[string]interface{}{"name": "New"}})
+			RecordRevision(ctx, store, nil, Revision{MindmapID: "m2", Version: 0, Operation: "upload"})
+			rs, err := Revisions(store)
+			if err != nil {
+				t.Fatalf("expected %s to keep revisions: %v", name, err)
+			}
+			revs, err := rs.ListRevisions(ctx, "m")
+			if err != nil || len(revs) != 2 {
+				t.Fatalf("expected 2 revisions of m, got %+v (%v)", revs, err)
+			}
+			if revs[0].Version != 3 || revs[0].Operation != "baseline" || revs[0].Actor != "erin" || revs[1].Version != 4 || revs[1].Time == "" {
+				t.Fatalf("unexpected revisions %+v", revs)
+			}
+			rev, err := rs.GetRevision(ctx, "m", 4)
+			if err != nil || rev == nil || rev.MindmapData["name"] != "New" {
+				t.Fatalf("expected revision 4, got %+v (%v)", rev, err)
+			}
+			if rev, err := rs.GetRevision(ctx, "m", 9); err != nil || rev != nil {
+				t.Fatalf("expected (nil, nil) for a missing revision, got %+v (%v)", rev, err)
+			}
+		})
+	}
+}
+
+func TestTrash(t *testing.T) {
+	local := NewLocalStore(filepath.Join(t.TempDir(), "trash.db"))
+	defer local.Close()
+	for name, store := range map[string]MindmapStore{"memory": NewMemoryStore(), "local": local} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store.Create(ctx, MindmapItem{ID: "t1", ContentHash: "hhh", MindmapData: map[string]interface{}{"name": "One"}})
+			store.Create(ctx, MindmapItem{ID: "t2"})
+			RecordRevision(ctx, store, nil, Revision{MindmapID: "t1", Version: 0, Operation: "upload"})
+
+			if ok, err := TrashMindmap(ctx, store, "t1", "ann"); err != nil || !ok {
+				t.Fatalf("expected t1 to move to the trash, got %t (%v)", ok, err)
+			}
+			if ok, _ := TrashMindmap(ctx, store, "t1", "ann"); ok {
+				t.Fatal("expected a second delete to find nothing live")
+			}
+			if ok, _ := TrashMindmap(ctx, store, "missing", "ann"); ok {
+				t.Fatal("expected deleting a missing item to report false")
+			}
+			if item, _ := store.Get(ctx, "missing"); item != nil {
+				t.Fatal("trashing a missing item must not create it")
+			}
+			// a trashed copy does not count as a duplicate upload
+			if item, err := FindByContentHash(ctx, store, "hhh"); err != nil || item != nil {
+				t.Fatalf("expected the hash lookup to skip trashed items, got %+v (%v)", item, err)
+			}
+			trash, err := ListTrash(ctx, store)
+			if err != nil || len(trash) != 1 || trash[0].ID != "t1" || trash[0].DeletedBy != "ann" || trash[0].DeletedAt == "" {
+				t.Fatalf("expected t1 alone in the trash, got %+v (%v)", trash, err)
+			}
+
+			if ok, _ := PurgeMindmap(ctx, store, "t2"); ok {
+				t.Fatal("expected live items to be left alone by purge")
+			}
+			if ok, err := RestoreMindmap(ctx, store, "t1"); err != nil || !ok {
+				t.Fatalf("expected t1 to be restored, got %t (%v)", ok, err)
+			}
+			if item, _ := store.Get(ctx, "t1"); item == nil || item.DeletedAt != "" || item.MindmapData["name"] != "One" {
+				t.Fatalf("expected t1 back as it was, got %+v", item)
+			}
+			// a purge that read t1 in the trash before the restore leaves it be
+			if err := store.DeleteIfTrashed(ctx, "t1", trash[0].Version); !errors.Is(err, ErrVersionConflict) {
+				t.Fatalf("expected a conflict deleting a restored item, got %v", err)
+			}
+			rs, _ := Revisions(store)
+			if item, _ := store.Get(ctx, "t1"); item == nil {
+				t.Fatal("a restored item must survive a stale purge")
+			}
+			if revs, _ := rs.ListRevisions(ctx, "t1"); len(revs) != 1 {
+				t.Fatalf("a restored item keeps its history, got %+v", revs)
+			}
+
+			TrashMindmap(ctx, store, "t1", "ann")
+			TrashMindmap(ctx, store, "t2", "bo")
+			// nothing was deleted before this cutoff
+			if n, err := PurgeTrash(ctx, store, "2000-01-01T00:00:00Z"); err != nil || n != 0 {
+				t.Fatalf("expected nothing old enough to purge, got %d (%v)", n, err)
+			}
+			if n, err := PurgeTrash(ctx, store, ""); err != nil || n != 2 {
+				t.Fatalf("expected both items purged, got %d (%v)", n, err)
+			}
+			if items, _ := store.List(ctx); len(items) != 0 {
+				t.Fatalf("expected an empty store, got %+v", items)
+			}
+			if revs, err := rs.ListRevisions(ctx, "t1"); err != nil || len(revs) != 0 {
+				t.Fatalf("expected the history purged too, got %+v (%v)", revs, err)
+			}
+		})
+	}
+}
+
+func TestListMindmapPage(t *testing.T) {
+	local := NewLocalStore(filepath.Join(t.TempDir(), "list.db"))
+	defer local.Close()
+	for name, store := range map[string]MindmapStore{"memory": NewMemoryStore(), "local": local} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store.Create(ctx, MindmapItem{ID: "a", Title: "Beta", Authors: []string{"Ada Lovelace"}, Date: "June 2017", Tags: []string{"NLP"}, Owner: "erin", CreatedAt: "2025-01-01T00:00:00Z", PDFText: "long", MindmapData: map[string]interface{}{"name": "A"}})
+			store.Create(ctx, MindmapItem{ID: "b", Title: "alpha", Authors: []string{"Alan Turing"}, Date: "1950", Owner: "vic", CreatedAt: "2025-02-01T00:00:00Z"})
+			store.Create(ctx, MindmapItem{ID: "c", Title: "Gamma", Authors: []string{"Grace Hopper", "Ada Byron"}, Date: "2019-03-04", Tags: []string{"nlp", "vision"}, Owner: "erin", CreatedAt: "2025-03-01T00:00:00Z"})
+			store.Create(ctx, MindmapItem{ID: "d", Title: "Trashed", CreatedAt: "2025-04-01T00:00:00Z", DeletedAt: "2025-04-02T00:00:00Z"})
+
+			ids := func(page *ListPage) (out []string) {
+				for _, s := range page.Items {
+					out = append(out, s.ID)
+				}
+				return out
+			}
+			// newest first by default, walked two at a time
+			q, _ := ParseListQuery(url.Values{"limit": {"2"}})
+			page, err := ListMindmapPage(ctx, store, q)
+			if err != nil || fmt.Sprint(ids(page)) != "[c b]" || page.NextCursor == "" {
+				t.Fatalf("expected [c b] and a cursor, got %+v (%v)", page, err)
+			}
+			q.Cursor = page.NextCursor
+			page, err = ListMindmapPage(ctx, store, q)
+			if err != nil || fmt.Sprint(ids(page)) != "[a]" || page.NextCursor != "" {
+				t.Fatalf("expected [a] on the last page, got %+v (%v)", page, err)
+			}
+			if page.Items[0].Tags[0] != "NLP" || page.Items[0].Owner != "erin" {
+				t.Fatalf("summary lost fields: %+v", page.Items[0])
+			}
+
+			for query, want := range map[string]string{
+				"sort=title":                    "[b a c]",
+				"sort=date":                     "[c a b]",
+				"sort=date&order=asc":           "[b a c]",
+				"author=ada":                    "[c a]",
+				"tag=nlp":                       "[c a]",
+				"owner=ERIN&tag=vision":         "[c]",
+				"from=2017-01-01&to=2019-03-04": "[c a]",
+				"to=1999-12-31":                 "[b]",
+			} {
+				v, _ := url.ParseQuery(query)
+				q, err := ParseListQuery(v)
+				if err != nil {
+					t.Fatalf("%s: %v", query, err)
+				}
+				page, err := ListMindmapPage(ctx, store, q)
+				if err != nil || fmt.Sprint(ids(page)) != want {
+					t.Fatalf("%s: expected %s, got %v (%v)", query, want, ids(page), err)
+				}
+			}
+
+			// filters that skip items still fill each page
+			q, _ = ParseListQuery(url.Values{"limit": {"1"}, "tag": {"nlp"}})
+			var walked []string
+			for {
+				page, err := ListMindmapPage(ctx, store, q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				walked = append(walked, ids(page)...)
+				if page.NextCursor == "" {
+					break
+				}
+				q.Cursor = page.NextCursor
+			}
+			if fmt.Sprint(walked) != "[c a]" {
+				t.Fatalf("expected [c a] a page at a time, got %v", walked)
+			}
+
+			// a cursor only continues the order it came from
+			q, _ = ParseListQuery(url.Values{"limit": {"1"}})
+			page, _ = ListMindmapPage(ctx, store, q)
+			q, _ = ParseListQuery(url.Values{"sort": {"title"}, "cursor": {page.NextCursor}})
+			if _, err := ListMindmapPage(ctx, store, q); !errors.Is(err, ErrBadCursor) {
+				t.Fatalf("expected ErrBadCursor for another order, got %v", err)
+			}
+			q.Cursor = "not-a-cursor"
+			if _, err := ListMindmapPage(ctx, store, q); !errors.Is(err, ErrBadCursor) {
+				t.Fatalf("expected ErrBadCursor for garbage, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseListQuery(t *testing.T) {
+	for _, bad := range []string{"limit=0", "limit=x", "sort=size", "order=up", "from=yesterday"} {
+		v, _ := url.ParseQuery(bad)
+		if _, err := ParseListQuery(v); err == nil {
+			t.Fatalf("%s: expected an error", bad)
+		}
+	}
+	q, err := ParseListQuery(url.Values{"limit": {"1000"}, "from": {"2025-01-31T12:00:00Z"}, "to": {"2025-01-31"}})
+	if err != nil || q.Limit != MaxPageSize || q.From != "2025-02-01" || q.To != "2025-02-01" || !q.Desc {
+		t.Fatalf("unexpected query %+v (%v)", q, err)
+	}
+}
@@ -0,0 +1,373 @@
+package db
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+
+    "github.com/google/uuid"
+)
+
+// The memory store loses everything on restart, so it is only offered when
+// asked for with ENABLE_MEMORY_STORE or DEFAULT_PLATFORM=memory. Tests
+// register their own.
+func init() {
+    registerOptInStore("memory", NewMemoryStore(), memoryStoreEnabled)
+}
+
+func memoryStoreEnabled() bool {
+    if strings.EqualFold(strings.TrimSpace(os.Getenv("DEFAULT_PLATFORM")), "memory") {
+        return true
+    }
+    on, _ := strconv.ParseBool(strings.TrimSpace(os.Getenv("ENABLE_MEMORY_STORE")))
+    return on
+}
+
+// MemoryStore keeps items in process memory. Nothing survives a restart, so
+// it is meant for tests and throwaway demos.
+type MemoryStore struct {
+    mu     sync.RWMutex
+    items  map[string][]byte
+    users  map[string]User
+    tokens map[string]APIToken
+    usage  []UsageRecord
+    // revisions are JSON keyed by revisionKey
+    revisions map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{items: map[string][]byte{}, users: map[string]User{}, tokens: map[string]APIToken{}, revisions: map[string][]byte{}}
+}
+
+// Items are stored as JSON so callers never share maps with the store,
+// mirroring how the real backends behave.
+
+func (s *MemoryStore) Create(ctx context.Context, item MindmapItem) (string, error) {
+    if item.ID == "" {
+        item.ID = uuid.New().String()
+    }
+    raw, err := json.Marshal(item)
+    if err != nil {
+        return "", err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, exists := s.items[item.ID]; exists {
+        return "", fmt.Errorf("mindmap %s already exists", item.ID)
+    }
+    s.items[item.ID] = raw
+    return item.ID, nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, id string) (*MindmapItem, error) {
+    s.mu.RLock()
+    raw, ok := s.items[id]
+    s.mu.RUnlock()
+    if !ok {
+        return nil, nil
+    }
+    var item MindmapItem
+    if err := json.Unmarshal(raw, &item); err != nil {
+        return nil, err
+    }
+    return &item, nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, id string, updates map[string]interface{}) error {
+    return s.update(id, -1, updates)
+}
+
+func (s *MemoryStore) UpdateIfVersion(ctx context.Context, id string, version int, updates map[string]interface{}) error {
+    return s.update(id, version, updates)
+}
+
+func (s *MemoryStore) update(id string, version int, updates map[string]interface{}) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    raw, err := mergeUpdate(s.items[id], id, version, updates)
+    if err != nil {
+        return err
+    }
+    s.items[id] = raw
+    return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.items[id]; !ok {
+        return false, nil
+    }
+    delete(s.items, id)
+    return true, nil
+}
+
+func (s *MemoryStore) DeleteIfTrashed(ctx context.Context, id string, version int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !trashedAt(s.items[id], version) {
+        return ErrVersionConflict
+    }
+    delete(s.items, id)
+    return nil
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]MindmapItem, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    ids := make([]string, 0, len(s.items))
+    for id := range s.items {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    items := make([]MindmapItem, 0, len(ids))
+    for _, id := range ids {
+        var mm MindmapItem
+        if err := json.Unmarshal(s.items[id], &mm); err != nil {
+            return nil, err
+        }
+        items = append(items, mm)
+    }
+    return items, nil
+}
+
+// SummariesByCreatedAt sorts every item, as the memory store has no index,
+// but lets tests page through the batches the cloud backends return.
+func (s *MemoryStore) SummariesByCreatedAt(ctx context.Context, desc bool, after *PageKey, limit int) ([]MindmapItem, error) {
+    items, err := ListSummaries(ctx, s)
+    if err != nil {
+        return nil, err
+    }
+    before := func(a, b MindmapItem) bool {
+        if a.CreatedAt != b.CreatedAt {
+            return (a.CreatedAt < b.CreatedAt) != desc
+        }
+        return a.ID != b.ID && (a.ID < b.ID) != desc
+    }
+    sort.Slice(items, func(i, j int) bool { return before(items[i], items[j]) })
+    start := 0
+    if after != nil {
+        key := MindmapItem{CreatedAt: after.CreatedAt, ID: after.ID}
+        start = sort.Search(len(items), func(i int) bool { return before(key, items[i]) })
+    }
+    return items[start:min(start+limit, len(items))], nil
+}
+
+// liveContentHash reads only the content hash of a stored item, or "" for
+// an item in the trash.
+func liveContentHash(raw []byte) string {
+    var h struct {
+        ContentHash string `json:"contentHash"`
+        DeletedAt   string `json:"deletedAt"`
+    }
+    json.Unmarshal(raw, &h)
+    if h.DeletedAt != "" {
+        return ""
+    }
+    return h.ContentHash
+}
+
+func (s *MemoryStore) FindByContentHash(ctx context.Context, hash string) (*MindmapItem, error) {
+    s.mu.RLock()
+    var match []byte
+    for _, raw := range s.items {
+        if liveContentHash(raw) == hash {
+            match = raw
+            break
+        }
+    }
+    s.mu.RUnlock()
+    if match == nil {
+        return nil, nil
+    }
+    var item MindmapItem
+    if err := json.Unmarshal(match, &item); err != nil {
+        return nil, err
+    }
+    return &item, nil
+}
+
+func (s *MemoryStore) CreateUser(ctx context.Context, u User) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, exists := s.users[u.Username]; exists {
+        return ErrUserExists
+    }
+    s.users[u.Username] = u
+    return nil
+}
+
+func (s *MemoryStore) GetUser(ctx context.Context, username string) (*User, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    u, ok := s.users[username]
+    if !ok {
+        return nil, nil
+    }
+    return &u, nil
+}
+
+func (s *MemoryStore) PutUser(ctx context.Context, u User) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.users[u.Username] = u
+    return nil
+}
+
+func (s *MemoryStore) DeleteUser(ctx context.Context, username string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.users[username]; !ok {
+        return false, nil
+    }
+    delete(s.users, username)
+    return true, nil
+}
+
+func (s *MemoryStore) ListUsers(ctx context.Context) ([]User, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    users := make([]User, 0, len(s.users))
+    for _, u := range s.users {
+        users = append(users, u)
+    }
+    sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+    return users, nil
+}
+
+func (s *MemoryStore) CreateToken(ctx context.Context, t APIToken) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, exists := s.tokens[t.ID]; exists {
+        return fmt.Errorf("token %s already exists", t.ID)
+    }
+    s.tokens[t.ID] = t
+    return nil
+}
+
+func (s *MemoryStore) GetToken(ctx context.Context, id string) (*APIToken, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    t, ok := s.tokens[id]
+    if !ok {
+        return nil, nil
+    }
+    return &t, nil
+}
+
+func (s *MemoryStore) ListTokens(ctx context.Context, username string) ([]APIToken, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    tokens := []APIToken{}
+    for _, t := range s.tokens {
+        if username == "" || t.Username == username {
+            tokens = append(tokens, t)
+        }
+    }
+    sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt < tokens[j].CreatedAt })
+    return tokens, nil
+}
+
+func (s *MemoryStore) DeleteToken(ctx context.Context, id string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.tokens[id]; !ok {
+        return false, nil
+    }
+    delete(s.tokens, id)
+    return true, nil
+}
+
+func (s *MemoryStore) TouchToken(ctx context.Context, id, usedAt string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    t, ok := s.tokens[id]
+    if !ok {
+        return fmt.Errorf("token %s not found", id)
+    }
+    t.LastUsedAt = usedAt
+    s.tokens[id] = t
+    return nil
+}
+
+func (s *MemoryStore) RecordUsage(ctx context.Context, rec UsageRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.usage = append(s.usage, rec)
+    return nil
+}
+
+func (s *MemoryStore) ListUsage(ctx context.Context, from, to string) ([]UsageRecord, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    records := []UsageRecord{}
+    for _, rec := range s.usage {
+        if inRange(rec.Time, from, to) {
+            records = append(records, rec)
+        }
+    }
+    sort.SliceStable(records, func(i, j int) bool { return records[i].Time < records[j].Time })
+    return records, nil
+}
+
+func (s *MemoryStore) SaveRevision(ctx context.Context, rev Revision) error {
+    raw, err := json.Marshal(rev)
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.revisions[revisionKey(rev.MindmapID, rev.Version)] = raw
+    return nil
+}
+
+func (s *MemoryStore) ListRevisions(ctx context.Context, mindmapID string) ([]Revision, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    keys := []string{}
+    for k := range s.revisions {
+        if strings.HasPrefix(k, mindmapID+"/") {
+            keys = append(keys, k)
+        }
+    }
+    sort.Strings(keys)
+    revs := make([]Revision, 0, len(keys))
+    for _, k := range keys {
+        var rev Revision
+        if err := json.Unmarshal(s.revisions[k], &rev); err != nil {
+            return nil, err
+        }
+        revs = append(revs, rev)
+    }
+    return revs, nil
+}
+
+func (s *MemoryStore) GetRevision(ctx context.Context, mindmapID string, version int) (*Revision, error) {
+    s.mu.RLock()
+    raw, ok := s.revisions[revisionKey(mindmapID, version)]
+    s.mu.RUnlock()
+    if !ok {
+        return nil, nil
+    }
+    var rev Revision
+    if err := json.Unmarshal(raw, &rev); err != nil {
+        return nil, err
+    }
+    return &rev, nil
+}
+
+func (s *MemoryStore) DeleteRevisions(ctx context.Context, mindmapID string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for k := range s.revisions {
+        if strings.HasPrefix(k, mindmapID+"/") {
+            delete(s.revisions, k)
+        }
+    }
+    return nil
+}
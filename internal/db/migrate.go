@@ -0,0 +1,46 @@
+package db
+
+import (
+    "context"
+    "log"
+)
+
+// Migrator is implemented by backends whose items written by older versions
+// need upgrading before every query can find them. Migrate reports how many
+// items it changed.
+type Migrator interface {
+    Migrate(ctx context.Context) (int, error)
+}
+
+// StartMigrations upgrades the items on each platform in MIGRATE_PLATFORMS
+// once, in the background: it backfills node ids and runs the backend's own
+// Migrator. Reads never write, so this is where old items are brought up to
+// date.
+func StartMigrations(ctx context.Context) {
+    platforms := PlatformsFromEnv("MIGRATE_PLATFORMS")
+    go func() {
+        for _, p := range platforms {
+            store, err := GetStore(p)
+            if err != nil {
+                log.Printf("migrate: %v", err)
+                continue
+            }
+            if m, ok := store.(Migrator); ok {
+                n, err := m.Migrate(ctx)
+                if err != nil {
+                    log.Printf("migrate: %s incomplete: %v", p, err)
+                }
+                if n > 0 {
+                    log.Printf("migrate: upgraded %d mind maps on %s", n, p)
+                }
+            }
+            n, err := BackfillNodeIDs(ctx, store)
+            if err != nil {
+                log.Printf("migrate: node id backfill on %s incomplete: %v", p, err)
+            }
+            if n > 0 {
+                log.Printf("migrate: backfilled node ids of %d mind maps on %s", n, p)
+            }
+        }
+    }()
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// Every node in mindmapData carries an "id" that stays with it across edits,
+// so node actions can address a node directly instead of by its position.
+
+// OpNodeIDs is the revision operation of a node id backfill.
+const OpNodeIDs = "node-ids"
+
+// EnsureNodeIDs gives every node in tree an id, replacing duplicates, and
+// reports how many it assigned.
+func EnsureNodeIDs(tree map[string]interface{}) int {
+    if tree == nil {
+        return 0
+    }
+    seen := map[string]bool{}
+    return ensureNodeIDs(tree, seen)
+}
+
+func ensureNodeIDs(node map[string]interface{}, seen map[string]bool) int {
+    added := 0
+    id, _ := node["id"].(string)
+    if id == "" || seen[id] {
+        id = uuid.New().String()
+        node["id"] = id
+        added++
+    }
+    seen[id] = true
+    if kids, ok := node["children"].([]interface{}); ok {
+        for _, k := range kids {
+            if child, ok := k.(map[string]interface{}); ok {
+                added += ensureNodeIDs(child, seen)
+            }
+        }
+    }
+    return added
+}
+
+// BackfillNodeIDs gives ids to the nodes of maps stored before node ids
+// existed, recording each as a revision, and reports how many maps it
+// updated. Reads never write, so this runs at startup; node actions also add
+// missing ids with their own update, so a map that changes meanwhile is left
+// alone.
+func BackfillNodeIDs(ctx context.Context, store MindmapStore) (int, error) {
+    items, err := store.List(ctx)
+    if err != nil {
+        return 0, err
+    }
+    updated := 0
+    for _, item := range items {
+        // kept as stored, for the baseline revision
+        before := item
+        before.MindmapData = nil
+        raw, _ := json.Marshal(item.MindmapData)
+        json.Unmarshal(raw, &before.MindmapData)
+        if EnsureNodeIDs(item.MindmapData) == 0 {
+            continue
+        }
+        now := time.Now().UTC().Format(time.RFC3339)
+        err := store.UpdateIfVersion(ctx, item.ID, item.Version, map[string]interface{}{"mindmapData": item.MindmapData, "updatedAt": now})
+        if errors.Is(err, ErrVersionConflict) {
+            continue
+        }
+        if err != nil {
+            return updated, err
+        }
+        RecordRevision(ctx, store, &before, Revision{MindmapID: item.ID, Version: item.Version + 1, Time: now, Operation: OpNodeIDs, MindmapData: item.MindmapData})
+        updated++
+    }
+    return updated, nil
+}
@@ -0,0 +1,32 @@
+package db
+
+import "testing"
+
+func TestEnsureNodeIDsBackfillsAndDedupes(t *testing.T) {
+	tree := map[string]interface{}{
+		"name": "Root",
+		"children": []interface{}{
+			map[string]interface{}{"name": "Kept", "id": "a"},
+			map[string]interface{}{"name": "Duplicate", "id": "a"},
+			map[string]interface{}{"name": "Missing"},
+		},
+	}
+	if added := EnsureNodeIDs(tree); added != 3 {
+		t.Fatalf("expected 3 ids assigned (root, duplicate, missing), got %d", added)
+	}
+	kids := tree["children"].([]interface{})
+	if kids[0].(map[string]interface{})["id"] != "a" {
+		t.Fatalf("existing id must be kept: %v", kids[0])
+	}
+	seen := map[interface{}]bool{tree["id"]: true}
+	for _, k := range kids {
+		id := k.(map[string]interface{})["id"]
+		if id == "" || seen[id] {
+			t.Fatalf("ids must be unique and non-empty: %v", tree)
+		}
+		seen[id] = true
+	}
+	if added := EnsureNodeIDs(tree); added != 0 {
+		t.Fatalf("second pass should be a no-op, assigned %d", added)
+	}
+}
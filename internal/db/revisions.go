@@ -0,0 +1,89 @@
+package db
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "time"
+)
+
+// Revision is the mind map tree as it stood after one change. Version is the
+// item's Version once the change was saved, so revisions and versions line
+// up. Time is RFC 3339 in UTC.
+type Revision struct {
+    MindmapID    string                 `dynamodbav:"mindmapId" json:"mindmapId" firestore:"mindmapId"`
+    Version      int                    `dynamodbav:"version" json:"version" firestore:"version"`
+    Time         string                 `dynamodbav:"time" json:"time" firestore:"time"`
+    Actor        string                 `dynamodbav:"actor,omitempty" json:"actor,omitempty" firestore:"actor,omitempty"`
+    // Operation is the node action that made the change, or "upload",
+    // "restore", "undo", "redo", "node-ids" for an id backfill, or
+    // "baseline" for a state recorded before history existed.
+    Operation    string                 `dynamodbav:"operation" json:"operation" firestore:"operation"`
+    NodeID       string                 `dynamodbav:"nodeId,omitempty" json:"nodeId,omitempty" firestore:"nodeId,omitempty"`
+    // RestoredFrom is the version a restore copied.
+    RestoredFrom *int                   `dynamodbav:"restoredFrom,omitempty" json:"restoredFrom,omitempty" firestore:"restoredFrom,omitempty"`
+    // Reverts is the version of the node action an undo took back or a redo
+    // put back.
+    Reverts      *int                   `dynamodbav:"reverts,omitempty" json:"reverts,omitempty" firestore:"reverts,omitempty"`
+    MindmapData  map[string]interface{} `dynamodbav:"mindmapData" json:"mindmapData,omitempty" firestore:"mindmapData"`
+}
+
+// RevisionStore is implemented by backends that keep the history of each
+// mind map next to it. ListRevisions returns them oldest first, and
+// GetRevision returns (nil, nil) when there is no such revision.
+// DeleteRevisions drops a map's whole history when the map is purged.
+type RevisionStore interface {
+    SaveRevision(ctx context.Context, rev Revision) error
+    ListRevisions(ctx context.Context, mindmapID string) ([]Revision, error)
+    GetRevision(ctx context.Context, mindmapID string, version int) (*Revision, error)
+    DeleteRevisions(ctx context.Context, mindmapID string) error
+}
+
+// Revisions returns the history kept by store.
+func Revisions(store MindmapStore) (RevisionStore, error) {
+    rs, ok := store.(RevisionStore)
+    if !ok {
+        return nil, fmt.Errorf("this platform does not keep revisions")
+    }
+    return rs, nil
+}
+
+// revisionKey orders a map's revisions by version when keys sort as strings.
+func revisionKey(mindmapID string, version int) string {
+    return fmt.Sprintf("%s/%010d", mindmapID, version)
+}
+
+// RecordRevision saves rev, the state a change just wrote. When before, the
+// item as it was read for the change, is not in the history yet (the map
+// predates history, or its last write left the tree as it was, like an id
+// backfill or a move to the trash) it is saved first as a baseline, so the
+// change can still be undone. The change itself has already been saved, so
+// failures are only logged.
+func RecordRevision(ctx context.Context, store MindmapStore, before *MindmapItem, rev Revision) {
+    rs, ok := store.(RevisionStore)
+    if !ok {
+        return
+    }
+    // A lost history entry must not depend on whether the caller hung up
+    ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+    defer cancel()
+    if before != nil {
+        prev, err := rs.GetRevision(ctx, before.ID, before.Version)
+        if err == nil && prev == nil {
+            actor := before.LastEditedBy
+            if actor == "" {
+                actor = before.Owner
+            }
+            base := Revision{MindmapID: before.ID, Version: before.Version, Time: before.UpdatedAt, Actor: actor, Operation: "baseline", MindmapData: before.MindmapData}
+            if err := rs.SaveRevision(ctx, base); err != nil {
+                log.Printf("revisions: baseline %s@%d not saved: %v", before.ID, before.Version, err)
+            }
+        }
+    }
+    if rev.Time == "" {
+        rev.Time = time.Now().UTC().Format(time.RFC3339)
+    }
+    if err := rs.SaveRevision(ctx, rev); err != nil {
+        log.Printf("revisions: %s@%d (%s) not saved: %v", rev.MindmapID, rev.Version, rev.Operation, err)
+    }
+}
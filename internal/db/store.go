@@ -0,0 +1,435 @@
+package db
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// MindmapStore is the persistence contract every storage backend implements.
+// Get returns (nil, nil) when the id does not exist, and Delete reports
+// whether an item was actually removed. Both updates bump the item's
+// Version; UpdateIfVersion only applies when the stored version still equals
+// version, and otherwise returns ErrVersionConflict.
+type MindmapStore interface {
+    Create(ctx context.Context, item MindmapItem) (string, error)
+    Get(ctx context.Context, id string) (*MindmapItem, error)
+    Update(ctx context.Context, id string, updates map[string]interface{}) error
+    UpdateIfVersion(ctx context.Context, id string, version int, updates map[string]interface{}) error
+    Delete(ctx context.Context, id string) (bool, error)
+    DeleteIfTrashed(ctx context.Context, id string, version int) error
+    List(ctx context.Context) ([]MindmapItem, error)
+}
+
+// ErrVersionConflict means the item was changed, or removed, since the
+// version passed to UpdateIfVersion or DeleteIfTrashed was read.
+var ErrVersionConflict = errors.New("mindmap was changed concurrently")
+
+// withVersionBump copies updates with version set to v, so callers cannot
+// set the counter themselves.
+func withVersionBump(updates map[string]interface{}, v interface{}) map[string]interface{} {
+    out := make(map[string]interface{}, len(updates)+1)
+    for k, val := range updates {
+        out[k] = val
+    }
+    out["version"] = v
+    return out
+}
+
+// mergeUpdate applies updates to an item stored as JSON (nil if missing) and
+// bumps its version, for the stores that keep items that way. A negative
+// version skips the version check.
+func mergeUpdate(raw []byte, id string, version int, updates map[string]interface{}) ([]byte, error) {
+    doc := map[string]interface{}{}
+    if raw != nil {
+        if err := json.Unmarshal(raw, &doc); err != nil {
+            return nil, err
+        }
+    }
+    current, _ := doc["version"].(float64)
+    if version >= 0 && (raw == nil || int(current) != version) {
+        return nil, ErrVersionConflict
+    }
+    for k, v := range withVersionBump(updates, int(current)+1) {
+        doc[k] = v
+    }
+    doc["id"] = id
+    // Round-trip through MindmapItem so unknown keys are dropped and the
+    // stored shape matches what Get returns.
+    merged, err := json.Marshal(doc)
+    if err != nil {
+        return nil, err
+    }
+    var item MindmapItem
+    if err := json.Unmarshal(merged, &item); err != nil {
+        return nil, fmt.Errorf("invalid update for mindmap %s: %w", id, err)
+    }
+    return json.Marshal(item)
+}
+
+// trashedAt reports whether a stored item is in the trash at version.
+func trashedAt(raw []byte, version int) bool {
+    if raw == nil {
+        return false
+    }
+    var item struct {
+        Version   int    `json:"version"`
+        DeletedAt string `json:"deletedAt"`
+    }
+    if err := json.Unmarshal(raw, &item); err != nil {
+        return false
+    }
+    return item.DeletedAt != "" && item.Version == version
+}
+
+// ContentHashFinder is implemented by backends that can find an item by the
+// SHA-256 of its PDF. Items in the trash never match, and FindByContentHash
+// returns (nil, nil) when none does. The item returned may carry only the
+// SummaryFields.
+type ContentHashFinder interface {
+    FindByContentHash(ctx context.Context, hash string) (*MindmapItem, error)
+}
+
+// FindByContentHash looks an item up by PDF hash, listing every item when
+// the backend has no faster way.
+func FindByContentHash(ctx context.Context, store MindmapStore, hash string) (*MindmapItem, error) {
+    if f, ok := store.(ContentHashFinder); ok {
+        return f.FindByContentHash(ctx, hash)
+    }
+    items, err := store.List(ctx)
+    if err != nil {
+        return nil, err
+    }
+    for i := range items {
+        if items[i].ContentHash == hash && items[i].DeletedAt == "" {
+            return &items[i], nil
+        }
+    }
+    return nil, nil
+}
+
+// SummaryLister is implemented by backends that can list items without
+// their pdfText, pageTexts and mindmapData, which are most of each item's
+// size. Only the SummaryFields need to be filled in.
+type SummaryLister interface {
+    ListSummaries(ctx context.Context) ([]MindmapItem, error)
+}
+
+var (
+    storesMu sync.RWMutex
+    stores   = map[string]MindmapStore{}
+    // optIn holds, for backends that must be asked for, whether they are;
+    // it is checked on every lookup so settings loaded after init count
+    optIn = map[string]func() bool{}
+)
+
+func init() {
+    RegisterStore("aws", DynamoStore{})
+    RegisterStore("gcp", FirestoreStore{})
+}
+
+// RegisterStore makes a backend available under the given platform name.
+// Registering the same name twice replaces the previous backend.
+func RegisterStore(name string, store MindmapStore) {
+    storesMu.Lock()
+    defer storesMu.Unlock()
+    stores[strings.ToLower(name)] = store
+    delete(optIn, strings.ToLower(name))
+}
+
+// registerOptInStore registers a backend that is only available while
+// enabled reports true.
+func registerOptInStore(name string, store MindmapStore, enabled func() bool) {
+    RegisterStore(name, store)
+    storesMu.Lock()
+    defer storesMu.Unlock()
+    optIn[strings.ToLower(name)] = enabled
+}
+
+// GetStore returns the backend registered under name.
+func GetStore(name string) (MindmapStore, error) {
+    storesMu.RLock()
+    defer storesMu.RUnlock()
+    s, ok := stores[strings.ToLower(name)]
+    if !ok {
+        return nil, fmt.Errorf("unknown platform %q", name)
+    }
+    if enabled := optIn[strings.ToLower(name)]; enabled != nil && !enabled() {
+        return nil, fmt.Errorf("platform %q is not enabled", name)
+    }
+    return s, nil
+}
+
+// StoreNames lists the registered platform names in sorted order.
+func StoreNames() []string {
+    storesMu.RLock()
+    defer storesMu.RUnlock()
+    names := make([]string, 0, len(stores))
+    for n := range stores {
+        if enabled := optIn[n]; enabled == nil || enabled() {
+            names = append(names, n)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+// StoreForRequest resolves the backend from the `platform` query param,
+// falling back to DEFAULT_PLATFORM. The resolved platform name is returned
+// alongside the store so callers can pick a matching LLM.
+func StoreForRequest(r *http.Request) (MindmapStore, string, error) {
+    platform := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("platform")))
+    if platform == "" {
+        platform = DefaultPlatform()
+    }
+    s, err := GetStore(platform)
+    if err != nil {
+        return nil, platform, err
+    }
+    return s, platform, nil
+}
+
+// DefaultPlatform returns DEFAULT_PLATFORM if it names a registered backend,
+// otherwise "aws".
+func DefaultPlatform() string {
+    p := strings.ToLower(strings.TrimSpace(os.Getenv("DEFAULT_PLATFORM")))
+    if _, err := GetStore(p); p != "" && err == nil {
+        return p
+    }
+    return "aws"
+}
+
+// PlatformsFromEnv reads a comma-separated list of platforms from the named
+// variable, defaulting to DefaultPlatform.
+func PlatformsFromEnv(name string) []string {
+    var platforms []string
+    for _, p := range strings.Split(os.Getenv(name), ",") {
+        if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+            platforms = append(platforms, p)
+        }
+    }
+    if len(platforms) == 0 {
+        platforms = []string{DefaultPlatform()}
+    }
+    return platforms
+}
+
+// DynamoStore is the AWS backend, storing items in the MINDMAPS_TABLE table.
+type DynamoStore struct{}
+
+func (DynamoStore) Create(ctx context.Context, item MindmapItem) (string, error) {
+    return CreateMindmap(ctx, item)
+}
+
+func (DynamoStore) Get(ctx context.Context, id string) (*MindmapItem, error) {
+    return GetMindmapByID(ctx, id)
+}
+
+func (DynamoStore) Update(ctx context.Context, id string, updates map[string]interface{}) error {
+    return UpdateMindmap(ctx, id, updates)
+}
+
+func (DynamoStore) UpdateIfVersion(ctx context.Context, id string, version int, updates map[string]interface{}) error {
+    return UpdateMindmapIfVersion(ctx, id, version, updates)
+}
+
+func (DynamoStore) Delete(ctx context.Context, id string) (bool, error) {
+    return DeleteMindmapByID(ctx, id)
+}
+
+func (DynamoStore) DeleteIfTrashed(ctx context.Context, id string, version int) error {
+    return DeleteTrashedMindmap(ctx, id, version)
+}
+
+func (DynamoStore) List(ctx context.Context) ([]MindmapItem, error) {
+    return ListMindmaps(ctx)
+}
+
+func (DynamoStore) ListSummaries(ctx context.Context) ([]MindmapItem, error) {
+    return ListMindmapSummaries(ctx)
+}
+
+func (DynamoStore) SummariesByCreatedAt(ctx context.Context, desc bool, after *PageKey, limit int) ([]MindmapItem, error) {
+    return QueryMindmapSummariesByCreatedAt(ctx, desc, after, limit)
+}
+
+func (DynamoStore) Migrate(ctx context.Context) (int, error) { return TagListPartition(ctx) }
+
+func (DynamoStore) FindByContentHash(ctx context.Context, hash string) (*MindmapItem, error) {
+    return FindMindmapByContentHash(ctx, hash)
+}
+
+// Users live in the USERS_TABLE table.
+
+func (DynamoStore) CreateUser(ctx context.Context, u User) error { return CreateUser(ctx, u) }
+
+func (DynamoStore) GetUser(ctx context.Context, username string) (*User, error) {
+    return GetUserByUsername(ctx, username)
+}
+
+func (DynamoStore) PutUser(ctx context.Context, u User) error { return PutUser(ctx, u) }
+
+func (DynamoStore) DeleteUser(ctx context.Context, username string) (bool, error) {
+    return DeleteUserByUsername(ctx, username)
+}
+
+func (DynamoStore) ListUsers(ctx context.Context) ([]User, error) { return ListUsers(ctx) }
+
+// API tokens live in the TOKENS_TABLE table.
+
+func (DynamoStore) CreateToken(ctx context.Context, t APIToken) error { return CreateToken(ctx, t) }
+
+func (DynamoStore) GetToken(ctx context.Context, id string) (*APIToken, error) {
+    return GetTokenByID(ctx, id)
+}
+
+func (DynamoStore) ListTokens(ctx context.Context, username string) ([]APIToken, error) {
+    return ListTokens(ctx, username)
+}
+
+func (DynamoStore) DeleteToken(ctx context.Context, id string) (bool, error) {
+    return DeleteTokenByID(ctx, id)
+}
+
+func (DynamoStore) TouchToken(ctx context.Context, id, usedAt string) error {
+    return TouchToken(ctx, id, usedAt)
+}
+
+// LLM usage records live in the USAGE_TABLE table.
+
+func (DynamoStore) RecordUsage(ctx context.Context, rec UsageRecord) error { return RecordUsage(ctx, rec) }
+
+func (DynamoStore) ListUsage(ctx context.Context, from, to string) ([]UsageRecord, error) {
+    return ListUsage(ctx, from, to)
+}
+
+// Revisions live in the REVISIONS_TABLE table.
+
+func (DynamoStore) SaveRevision(ctx context.Context, rev Revision) error { return SaveRevision(ctx, rev) }
+
+func (DynamoStore) ListRevisions(ctx context.Context, mindmapID string) ([]Revision, error) {
+    return ListRevisions(ctx, mindmapID)
+}
+
+func (DynamoStore) GetRevision(ctx context.Context, mindmapID string, version int) (*Revision, error) {
+    return GetRevision(ctx, mindmapID, version)
+}
+
+func (DynamoStore) DeleteRevisions(ctx context.Context, mindmapID string) error {
+    return DeleteRevisions(ctx, mindmapID)
+}
+
+// FirestoreStore is the GCP backend, storing items in the FS_COLLECTION collection.
+type FirestoreStore struct{}
+
+func (FirestoreStore) Create(ctx context.Context, item MindmapItem) (string, error) {
+    return CreateMindmapGCP(ctx, item)
+}
+
+func (FirestoreStore) Get(ctx context.Context, id string) (*MindmapItem, error) {
+    return GetMindmapByIDGCP(ctx, id)
+}
+
+func (FirestoreStore) Update(ctx context.Context, id string, updates map[string]interface{}) error {
+    return UpdateMindmapGCP(ctx, id, updates)
+}
+
+func (FirestoreStore) UpdateIfVersion(ctx context.Context, id string, version int, updates map[string]interface{}) error {
+    return UpdateMindmapIfVersionGCP(ctx, id, version, updates)
+}
+
+func (FirestoreStore) Delete(ctx context.Context, id string) (bool, error) {
+    return DeleteMindmapByIDGCP(ctx, id)
+}
+
+func (FirestoreStore) DeleteIfTrashed(ctx context.Context, id string, version int) error {
+    return DeleteTrashedMindmapGCP(ctx, id, version)
+}
+
+func (FirestoreStore) List(ctx context.Context) ([]MindmapItem, error) {
+    return ListMindmapsGCP(ctx)
+}
+
+func (FirestoreStore) ListSummaries(ctx context.Context) ([]MindmapItem, error) {
+    return ListMindmapSummariesGCP(ctx)
+}
+
+func (FirestoreStore) SummariesByCreatedAt(ctx context.Context, desc bool, after *PageKey, limit int) ([]MindmapItem, error) {
+    return ListMindmapSummariesByCreatedAtGCP(ctx, desc, after, limit)
+}
+
+func (FirestoreStore) Migrate(ctx context.Context) (int, error) { return MigrateCreatedAtGCP(ctx) }
+
+func (FirestoreStore) FindByContentHash(ctx context.Context, hash string) (*MindmapItem, error) {
+    return FindMindmapByContentHashGCP(ctx, hash)
+}
+
+// Users live in the FS_USERS_COLLECTION collection.
+
+func (FirestoreStore) CreateUser(ctx context.Context, u User) error { return CreateUserGCP(ctx, u) }
+
+func (FirestoreStore) GetUser(ctx context.Context, username string) (*User, error) {
+    return GetUserGCP(ctx, username)
+}
+
+func (FirestoreStore) PutUser(ctx context.Context, u User) error { return PutUserGCP(ctx, u) }
+
+func (FirestoreStore) DeleteUser(ctx context.Context, username string) (bool, error) {
+    return DeleteUserGCP(ctx, username)
+}
+
+func (FirestoreStore) ListUsers(ctx context.Context) ([]User, error) { return ListUsersGCP(ctx) }
+
+// API tokens live in the FS_TOKENS_COLLECTION collection.
+
+func (FirestoreStore) CreateToken(ctx context.Context, t APIToken) error { return CreateTokenGCP(ctx, t) }
+
+func (FirestoreStore) GetToken(ctx context.Context, id string) (*APIToken, error) {
+    return GetTokenGCP(ctx, id)
+}
+
+func (FirestoreStore) ListTokens(ctx context.Context, username string) ([]APIToken, error) {
+    return ListTokensGCP(ctx, username)
+}
+
+func (FirestoreStore) DeleteToken(ctx context.Context, id string) (bool, error) {
+    return DeleteTokenGCP(ctx, id)
+}
+
+func (FirestoreStore) TouchToken(ctx context.Context, id, usedAt string) error {
+    return TouchTokenGCP(ctx, id, usedAt)
+}
+
+// LLM usage records live in the FS_USAGE_COLLECTION collection.
+
+func (FirestoreStore) RecordUsage(ctx context.Context, rec UsageRecord) error {
+    return RecordUsageGCP(ctx, rec)
+}
+
+func (FirestoreStore) ListUsage(ctx context.Context, from, to string) ([]UsageRecord, error) {
+    return ListUsageGCP(ctx, from, to)
+}
+
+// Revisions live in each mind map's FS_REVISIONS_COLLECTION subcollection.
+
+func (FirestoreStore) SaveRevision(ctx context.Context, rev Revision) error {
+    return SaveRevisionGCP(ctx, rev)
+}
+
+func (FirestoreStore) ListRevisions(ctx context.Context, mindmapID string) ([]Revision, error) {
+    return ListRevisionsGCP(ctx, mindmapID)
+}
+
+func (FirestoreStore) GetRevision(ctx context.Context, mindmapID string, version int) (*Revision, error) {
+    return GetRevisionGCP(ctx, mindmapID, version)
+}
+
+func (FirestoreStore) DeleteRevisions(ctx context.Context, mindmapID string) error {
+    return DeleteRevisionsGCP(ctx, mindmapID)
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+type stubStore struct{ name string }
+
+func (stubStore) Create(ctx context.Context, item MindmapItem) (string, error) { return item.ID, nil }
+func (stubStore) Get(ctx context.Context, id string) (*MindmapItem, error)     { return nil, nil }
+func (stubStore) Update(ctx context.Context, id string, updates map[string]interface{}) error {
+	return nil
+}
+func (stubStore) UpdateIfVersion(ctx context.Context, id string, version int, updates map[string]interface{}) error {
+	return nil
+}
+func (stubStore) Delete(ctx context.Context, id string) (bool, error) { return false, nil }
+func (stubStore) DeleteIfTrashed(ctx context.Context, id string, version int) error {
+	return nil
+}
+func (stubStore) List(ctx context.Context) ([]MindmapItem, error)     { return nil, nil }
+
+func TestStoreRegistry(t *testing.T) {
+	RegisterStore("Stub", stubStore{name: "stub"})
+
+	s, err := GetStore("stub")
+	if err != nil {
+		t.Fatalf("expected stub store to be registered: %v", err)
+	}
+	if got := s.(stubStore).name; got != "stub" {
+		t.Fatalf("expected stub store, got %q", got)
+	}
+	if _, err := GetStore("nope"); err == nil {
+		t.Fatal("expected error for unknown platform")
+	}
+	for _, want := range []string{"aws", "gcp", "stub"} {
+		found := false
+		for _, n := range StoreNames() {
+			if n == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected %q in StoreNames(), got %v", want, StoreNames())
+		}
+	}
+}
+
+func TestMemoryStoreIsOptIn(t *testing.T) {
+	// set after package init, as main does when it loads .env
+	t.Setenv("DEFAULT_PLATFORM", "")
+	t.Setenv("ENABLE_MEMORY_STORE", "")
+	if _, err := GetStore("memory"); err == nil {
+		t.Fatal("the memory store must not be offered by default")
+	}
+	for _, n := range StoreNames() {
+		if n == "memory" {
+			t.Fatalf("a disabled store must not be listed, got %v", StoreNames())
+		}
+	}
+	t.Setenv("ENABLE_MEMORY_STORE", "true")
+	if _, err := GetStore("memory"); err != nil {
+		t.Fatalf("ENABLE_MEMORY_STORE should offer the memory store: %v", err)
+	}
+	t.Setenv("ENABLE_MEMORY_STORE", "")
+	t.Setenv("DEFAULT_PLATFORM", "Memory")
+	if got := DefaultPlatform(); got != "memory" {
+		t.Fatalf("DEFAULT_PLATFORM=memory should select the memory store, got %q", got)
+	}
+}
+
+func TestStoreForRequest(t *testing.T) {
+	RegisterStore("stub", stubStore{name: "stub"})
+	t.Setenv("DEFAULT_PLATFORM", "stub")
+
+	r := httptest.NewRequest("GET", "/api/mindmaps", nil)
+	if _, platform, err := StoreForRequest(r); err != nil || platform != "stub" {
+		t.Fatalf("expected DEFAULT_PLATFORM fallback to stub, got %q (%v)", platform, err)
+	}
+
+	r = httptest.NewRequest("GET", "/api/mindmaps?platform=GCP", nil)
+	if _, platform, err := StoreForRequest(r); err != nil || platform != "gcp" {
+		t.Fatalf("expected gcp from query param, got %q (%v)", platform, err)
+	}
+
+	r = httptest.NewRequest("GET", "/api/mindmaps?platform=azure", nil)
+	if _, _, err := StoreForRequest(r); err == nil {
+		t.Fatal("expected error for unregistered platform")
+	}
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+    "context"
+    "fmt"
+)
+
+// APIToken is a long-lived credential for scripted access. Only a SHA-256
+// hash of the secret is stored; Role caps what the token may do, and it never
+// exceeds the current role of the user who owns it.
+type APIToken struct {
+    ID         string `dynamodbav:"id" json:"id" firestore:"id"`
+    Username   string `dynamodbav:"username" json:"username" firestore:"username"`
+    Name       string `dynamodbav:"name" json:"name" firestore:"name"`
+    Hash       string `dynamodbav:"hash" json:"hash" firestore:"hash"`
+    Role       string `dynamodbav:"role" json:"role" firestore:"role"`
+    CreatedAt  string `dynamodbav:"createdAt" json:"createdAt" firestore:"createdAt"`
+    LastUsedAt string `dynamodbav:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty" firestore:"lastUsedAt,omitempty"`
+}
+
+// TokenStore is implemented by backends that can also hold API tokens.
+// GetToken returns (nil, nil) for an unknown id, ListTokens lists every
+// token when username is empty, and DeleteToken reports whether a token was
+// actually removed.
+type TokenStore interface {
+    CreateToken(ctx context.Context, t APIToken) error
+    GetToken(ctx context.Context, id string) (*APIToken, error)
+    ListTokens(ctx context.Context, username string) ([]APIToken, error)
+    DeleteToken(ctx context.Context, id string) (bool, error)
+    TouchToken(ctx context.Context, id, usedAt string) error
+}
+
+// Tokens returns the API token store, which lives alongside the accounts.
+func Tokens() (TokenStore, error) {
+    name := UsersPlatform()
+    s, err := GetStore(name)
+    if err != nil {
+        return nil, err
+    }
+    ts, ok := s.(TokenStore)
+    if !ok {
+        return nil, fmt.Errorf("platform %q cannot store API tokens", name)
+    }
+    return ts, nil
+}
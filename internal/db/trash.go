@@ -0,0 +1,118 @@
+package db
+
+import (
+    "context"
+    "errors"
+    "log"
+    "sort"
+    "time"
+)
+
+// trashRetries is how often a trash operation re-reads an item that changed
+// while it was being updated.
+const trashRetries = 3
+
+// updateExisting applies updates to id if it exists and ok accepts it. The
+// write is conditional, so it neither recreates an item purged in the
+// meantime nor overwrites a concurrent change. It reports whether it wrote.
+func updateExisting(ctx context.Context, store MindmapStore, id string, ok func(*MindmapItem) bool, updates map[string]interface{}) (bool, error) {
+    for attempt := 0; ; attempt++ {
+        item, err := store.Get(ctx, id)
+        if err != nil {
+            return false, err
+        }
+        if item == nil || !ok(item) {
+            return false, nil
+        }
+        err = store.UpdateIfVersion(ctx, id, item.Version, updates)
+        if err == nil {
+            return true, nil
+        }
+        if !errors.Is(err, ErrVersionConflict) || attempt == trashRetries {
+            return false, err
+        }
+    }
+}
+
+// TrashMindmap moves a live item to the trash on behalf of by. It reports
+// false if there is no such live item.
+func TrashMindmap(ctx context.Context, store MindmapStore, id, by string) (bool, error) {
+    now := time.Now().UTC().Format(time.RFC3339)
+    return updateExisting(ctx, store, id, func(item *MindmapItem) bool { return item.DeletedAt == "" },
+        map[string]interface{}{"deletedAt": now, "deletedBy": by})
+}
+
+// RestoreMindmap takes an item back out of the trash. It reports false if
+// the item is not in the trash.
+func RestoreMindmap(ctx context.Context, store MindmapStore, id string) (bool, error) {
+    return updateExisting(ctx, store, id, func(item *MindmapItem) bool { return item.DeletedAt != "" },
+        map[string]interface{}{"deletedAt": "", "deletedBy": ""})
+}
+
+// PurgeMindmap deletes an item and its history for good. Only what is in
+// the trash can be purged: the delete is conditional on the item not having
+// changed since it was read, so one restored meanwhile is left alone. The
+// history goes only once the item is gone.
+func PurgeMindmap(ctx context.Context, store MindmapStore, id string) (bool, error) {
+    item, err := store.Get(ctx, id)
+    if err != nil || item == nil || item.DeletedAt == "" {
+        return false, err
+    }
+    err = store.DeleteIfTrashed(ctx, id, item.Version)
+    if errors.Is(err, ErrVersionConflict) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    if rs, ok := store.(RevisionStore); ok {
+        // The item is gone either way, so a failure here is only logged
+        if err := rs.DeleteRevisions(ctx, id); err != nil {
+            log.Printf("trash: history of purged %s not deleted: %v", id, err)
+        }
+    }
+    return true, nil
+}
+
+// ListTrash returns the items in the trash, most recently deleted first.
+func ListTrash(ctx context.Context, store MindmapStore) ([]MindmapItem, error) {
+    items, err := ListSummaries(ctx, store)
+    if err != nil {
+        return nil, err
+    }
+    trash := []MindmapItem{}
+    for _, item := range items {
+        if item.DeletedAt != "" {
+            trash = append(trash, item)
+        }
+    }
+    sort.Slice(trash, func(i, j int) bool { return trash[i].DeletedAt > trash[j].DeletedAt })
+    return trash, nil
+}
+
+// PurgeTrash purges the items deleted before cutoff, an RFC 3339 time, or
+// the whole trash when cutoff is empty. It returns how many it purged and
+// keeps going past items that fail, returning the last error.
+func PurgeTrash(ctx context.Context, store MindmapStore, cutoff string) (int, error) {
+    trash, err := ListTrash(ctx, store)
+    if err != nil {
+        return 0, err
+    }
+    purged := 0
+    var lastErr error
+    for _, item := range trash {
+        if cutoff != "" && item.DeletedAt >= cutoff {
+            continue
+        }
+        ok, err := PurgeMindmap(ctx, store, item.ID)
+        if err != nil {
+            log.Printf("trash: purge %s failed: %v", item.ID, err)
+            lastErr = err
+            continue
+        }
+        if ok {
+            purged++
+        }
+    }
+    return purged, lastErr
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+    "context"
+    "fmt"
+)
+
+// UsageRecord is one LLM call: the tokens it consumed, what it cost at the
+// prices in force when it was made, and who and what it was made for. Time
+// is RFC 3339 in UTC, so records sort and filter as strings.
+type UsageRecord struct {
+    ID           string  `dynamodbav:"id" json:"id" firestore:"id"`
+    Time         string  `dynamodbav:"time" json:"time" firestore:"time"`
+    Provider     string  `dynamodbav:"provider" json:"provider" firestore:"provider"`
+    Model        string  `dynamodbav:"model" json:"model" firestore:"model"`
+    Operation    string  `dynamodbav:"operation" json:"operation" firestore:"operation"`
+    MindmapID    string  `dynamodbav:"mindmapId,omitempty" json:"mindmapId,omitempty" firestore:"mindmapId,omitempty"`
+    User         string  `dynamodbav:"user,omitempty" json:"user,omitempty" firestore:"user,omitempty"`
+    InputTokens  int     `dynamodbav:"inputTokens" json:"inputTokens" firestore:"inputTokens"`
+    OutputTokens int     `dynamodbav:"outputTokens" json:"outputTokens" firestore:"outputTokens"`
+    CostUSD      float64 `dynamodbav:"costUsd" json:"costUsd" firestore:"costUsd"`
+}
+
+// UsageStore is implemented by backends that can also keep LLM usage
+// records. ListUsage returns the records with from <= Time < to, oldest
+// first; an empty bound is open.
+type UsageStore interface {
+    RecordUsage(ctx context.Context, rec UsageRecord) error
+    ListUsage(ctx context.Context, from, to string) ([]UsageRecord, error)
+}
+
+// inRange reports whether t falls in [from, to), treating empty bounds as open.
+func inRange(t, from, to string) bool {
+    return (from == "" || t >= from) && (to == "" || t < to)
+}
+
+// Usage returns the usage store, which lives alongside the accounts.
+func Usage() (UsageStore, error) {
+    name := UsersPlatform()
+    s, err := GetStore(name)
+    if err != nil {
+        return nil, err
+    }
+    us, ok := s.(UsageStore)
+    if !ok {
+        return nil, fmt.Errorf("platform %q cannot store usage records", name)
+    }
+    return us, nil
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// User is an account that can sign in. Role is one of the roles defined in
+// the login package; PasswordHash is a bcrypt hash and never leaves the server.
+// Provider is "oidc" for accounts created by single sign-on, which have no
+// password and get their role from the identity provider at each login.
+// MonthlyBudgetUSD overrides the default per-user LLM budget; zero keeps it.
+type User struct {
+    Username         string  `dynamodbav:"username" json:"username" firestore:"username"`
+    PasswordHash     string  `dynamodbav:"passwordHash" json:"passwordHash" firestore:"passwordHash"`
+    Role             string  `dynamodbav:"role" json:"role" firestore:"role"`
+    Provider         string  `dynamodbav:"provider,omitempty" json:"provider,omitempty" firestore:"provider,omitempty"`
+    // Subject is the identity provider's id for an SSO account, the only
+    // identity allowed to sign in as it.
+    Subject          string  `dynamodbav:"subject,omitempty" json:"subject,omitempty" firestore:"subject,omitempty"`
+    MonthlyBudgetUSD float64 `dynamodbav:"monthlyBudgetUsd,omitempty" json:"monthlyBudgetUsd,omitempty" firestore:"monthlyBudgetUsd,omitempty"`
+    CreatedAt        string  `dynamodbav:"createdAt" json:"createdAt" firestore:"createdAt"`
+    UpdatedAt        string  `dynamodbav:"updatedAt" json:"updatedAt" firestore:"updatedAt"`
+}
+
+// ErrUserExists is returned by CreateUser when the username is taken.
+var ErrUserExists = errors.New("user already exists")
+
+// UserStore is implemented by backends that can also hold user accounts.
+// GetUser returns (nil, nil) for an unknown username, and DeleteUser reports
+// whether a user was actually removed.
+type UserStore interface {
+    CreateUser(ctx context.Context, u User) error
+    GetUser(ctx context.Context, username string) (*User, error)
+    PutUser(ctx context.Context, u User) error
+    DeleteUser(ctx context.Context, username string) (bool, error)
+    ListUsers(ctx context.Context) ([]User, error)
+}
+
+// UsersPlatform returns the backend that holds accounts: USERS_PLATFORM, or
+// the default platform. Accounts are global, so unlike mind maps they never
+// follow the request's platform parameter.
+func UsersPlatform() string {
+    if p := strings.ToLower(strings.TrimSpace(os.Getenv("USERS_PLATFORM"))); p != "" {
+        return p
+    }
+    return DefaultPlatform()
+}
+
+// Users returns the account store.
+func Users() (UserStore, error) {
+    name := UsersPlatform()
+    s, err := GetStore(name)
+    if err != nil {
+        return nil, err
+    }
+    us, ok := s.(UserStore)
+    if !ok {
+        return nil, fmt.Errorf("platform %q cannot store users", name)
+    }
+    return us, nil
+}
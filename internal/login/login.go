@@ -1,12 +1,18 @@
 package login
 
 import (
+    "context"
+    "crypto/subtle"
     "encoding/json"
     "log"
     "net/http"
     "os"
     "strings"
     "sync"
+
+    "golang.org/x/crypto/bcrypt"
+
+    "github.com/Tmacphee13/NanachiGo/internal/db"
 )
 
 var (
@@ -26,7 +32,19 @@ func getAdminPass() string {
     return adminPass
 }
 
+// envAdmin is the username of the built-in admin account.
+const envAdmin = "admin"
+
+// envAdminConfigured reports whether ADMIN_PASSWORD is set, rather than the
+// built-in admin falling back to the default password.
+func envAdminConfigured() bool {
+    return strings.TrimSpace(os.Getenv("ADMIN_PASSWORD")) != ""
+}
+
+// LoginRequest signs in a stored user, or the built-in admin when Username
+// is empty.
 type LoginRequest struct {
+	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
@@ -35,7 +53,12 @@ type LoginResponse struct {
 	Message string `json:"message"`
 }
 
+// Login checks the credentials and, on success, sets a signed session cookie.
 func Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
 	var req LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -45,15 +68,65 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
     var resp LoginResponse
-    if req.Password == getAdminPass() {
+    status := http.StatusOK
+    if s, ok := authenticate(r.Context(), strings.TrimSpace(req.Username), req.Password); ok {
+        setSessionCookie(w, r, s)
         resp = LoginResponse{Success: true, Message: "Login successful"}
-        w.WriteHeader(http.StatusOK)
     } else {
-		resp = LoginResponse{Success: false, Message: "Invalid password"}
-		w.WriteHeader(http.StatusUnauthorized)
+		resp = LoginResponse{Success: false, Message: "Invalid username or password"}
+		status = http.StatusUnauthorized
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(resp)
 
 }
+
+// authenticate checks a stored account first. The built-in admin, with
+// ADMIN_PASSWORD, is only accepted once the store has answered that no
+// account is named "admin"; if it cannot answer, nobody signs in.
+func authenticate(ctx context.Context, username, password string) (Session, bool) {
+    if username == "" {
+        username = envAdmin
+    }
+    users, err := db.Users()
+    if err != nil {
+        log.Printf("login: user store unavailable: %v", err)
+        return Session{}, false
+    }
+    stored, err := users.GetUser(ctx, username)
+    if err != nil {
+        log.Printf("login: lookup %q failed: %v", username, err)
+        return Session{}, false
+    }
+    if stored != nil {
+        if bcrypt.CompareHashAndPassword([]byte(stored.PasswordHash), []byte(password)) != nil {
+            return Session{}, false
+        }
+        return Session{User: stored.Username, Role: stored.Role}, true
+    }
+    if username == envAdmin && subtle.ConstantTimeCompare([]byte(password), []byte(getAdminPass())) == 1 {
+        return Session{User: envAdmin, Role: RoleAdmin, Env: true, PassTag: envAdminTag(getAdminPass())}, true
+    }
+    return Session{}, false
+}
+
+// Logout clears the session cookie.
+func Logout(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    http.SetCookie(w, &http.Cookie{Name: SessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: secureCookies(r), SameSite: http.SameSiteLaxMode})
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(LoginResponse{Success: true, Message: "Logged out"})
+}
+
+// SessionStatus: GET /api/session reports whether the caller is signed in,
+// and as whom.
+func SessionStatus(w http.ResponseWriter, r *http.Request) {
+    s, ok, _ := requestSession(r)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"authenticated": ok, "user": s.User, "role": s.Role})
+}
@@ -0,0 +1,43 @@
+package login
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Tmacphee13/NanachiGo/internal/db"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// brokenUsers is a user store whose lookups fail, as during an outage.
+type brokenUsers struct {
+	*db.MemoryStore
+}
+
+func (brokenUsers) GetUser(ctx context.Context, username string) (*db.User, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func TestAuthenticateFailsClosed(t *testing.T) {
+	store := db.NewMemoryStore()
+	db.RegisterStore("login-test", store)
+	t.Setenv("USERS_PLATFORM", "login-test")
+	ctx := context.Background()
+	admin := getAdminPass()
+
+	if s, ok := authenticate(ctx, "", admin); !ok || !s.Env || s.Role != RoleAdmin {
+		t.Fatalf("expected the built-in admin without a stored one, got %+v (%t)", s, ok)
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("stored-admin-password"), bcrypt.MinCost)
+	store.CreateUser(ctx, db.User{Username: "admin", PasswordHash: string(hash), Role: RoleAdmin})
+	if _, ok := authenticate(ctx, "admin", admin); ok {
+		t.Fatal("a stored admin must replace the built-in password")
+	}
+
+	db.RegisterStore("login-test", brokenUsers{store})
+	for _, password := range []string{admin, "stored-admin-password"} {
+		if s, ok := authenticate(ctx, "admin", password); ok {
+			t.Fatalf("expected no sign-in while the store is down, got %+v", s)
+		}
+	}
+}
@@ -0,0 +1,534 @@
+package login
+
+import (
+    "context"
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math/big"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/oauth2"
+
+    "github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+// Single sign-on uses the OpenID Connect authorization-code flow with PKCE.
+// The state, nonce and verifier travel in a short-lived signed cookie, so
+// like sessions the flow needs no server-side storage. ID tokens must be
+// signed with RS256 by a key from the issuer's JWKS.
+
+// oidcCookie carries the pending login between /login and /callback.
+const oidcCookie = "nanachi_oidc"
+
+// oidcLoginTTL bounds how long the user may take at the identity provider.
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcClockSkew is tolerated when checking ID token expiry.
+const oidcClockSkew = time.Minute
+
+// OIDCConfig configures single sign-on.
+type OIDCConfig struct {
+    Issuer       string
+    ClientID     string
+    ClientSecret string
+    // RedirectURL is the callback registered with the provider; it is
+    // required, so the flow never trusts the request's Host header.
+    RedirectURL string
+    Scopes      []string
+    // AllowedDomains and AllowedGroups limit who may sign in; a user must
+    // match at least one of each list that is set.
+    AllowedDomains []string
+    AllowedGroups  []string
+    GroupsClaim    string
+    // RoleMap maps group names to roles. A user gets the highest role of
+    // their groups, or DefaultRole.
+    RoleMap     map[string]string
+    DefaultRole string
+}
+
+// OIDCConfigFromEnv reads the OIDC_* variables. ok is false when OIDC_ISSUER
+// is unset, leaving single sign-on disabled.
+func OIDCConfigFromEnv() (OIDCConfig, bool) {
+    cfg := OIDCConfig{
+        Issuer:         strings.TrimRight(strings.TrimSpace(os.Getenv("OIDC_ISSUER")), "/"),
+        ClientID:       strings.TrimSpace(os.Getenv("OIDC_CLIENT_ID")),
+        ClientSecret:   strings.TrimSpace(os.Getenv("OIDC_CLIENT_SECRET")),
+        RedirectURL:    strings.TrimSpace(os.Getenv("OIDC_REDIRECT_URL")),
+        Scopes:         splitList(os.Getenv("OIDC_SCOPES"), " "),
+        AllowedDomains: splitList(strings.ToLower(os.Getenv("OIDC_ALLOWED_DOMAINS")), ","),
+        AllowedGroups:  splitList(os.Getenv("OIDC_ALLOWED_GROUPS"), ","),
+        GroupsClaim:    strings.TrimSpace(os.Getenv("OIDC_GROUPS_CLAIM")),
+        RoleMap:        map[string]string{},
+        DefaultRole:    strings.TrimSpace(os.Getenv("OIDC_DEFAULT_ROLE")),
+    }
+    if cfg.Issuer == "" {
+        return cfg, false
+    }
+    if cfg.RedirectURL == "" {
+        log.Printf("oidc: OIDC_ISSUER is set but OIDC_REDIRECT_URL is not; single sign-on is disabled")
+        return cfg, false
+    }
+    if len(cfg.Scopes) == 0 {
+        cfg.Scopes = []string{"openid", "email", "profile"}
+    }
+    if cfg.GroupsClaim == "" {
+        cfg.GroupsClaim = "groups"
+    }
+    if cfg.DefaultRole == "" {
+        cfg.DefaultRole = RoleViewer
+    }
+    // OIDC_ROLE_MAP is a list of group=role pairs
+    for _, pair := range splitList(os.Getenv("OIDC_ROLE_MAP"), ",") {
+        group, role, ok := strings.Cut(pair, "=")
+        if !ok || !ValidRole(strings.TrimSpace(role)) {
+            log.Printf("oidc: ignoring invalid OIDC_ROLE_MAP entry %q", pair)
+            continue
+        }
+        cfg.RoleMap[strings.TrimSpace(group)] = strings.TrimSpace(role)
+    }
+    return cfg, true
+}
+
+func splitList(v, sep string) []string {
+    var out []string
+    for _, part := range strings.Split(v, sep) {
+        if part = strings.TrimSpace(part); part != "" {
+            out = append(out, part)
+        }
+    }
+    return out
+}
+
+// OIDC serves the single sign-on routes for one identity provider. The
+// provider's metadata and keys are fetched on first use and cached.
+type OIDC struct {
+    cfg    OIDCConfig
+    client *http.Client
+
+    mu   sync.Mutex
+    meta *oidcMetadata
+    keys map[string]*rsa.PublicKey
+}
+
+type oidcMetadata struct {
+    Issuer                string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcState is the signed content of the oidcCookie.
+type oidcState struct {
+    State    string `json:"state"`
+    Nonce    string `json:"nonce"`
+    Verifier string `json:"verifier"`
+    Next     string `json:"next"`
+    Expires  int64  `json:"exp"`
+}
+
+// idClaims are the ID token claims used to sign a user in. Raw keeps every
+// claim, for the configurable groups claim.
+type idClaims struct {
+    Issuer        string                 `json:"iss"`
+    Subject       string                 `json:"sub"`
+    Audience      audience               `json:"aud"`
+    Expires       int64                  `json:"exp"`
+    Nonce         string                 `json:"nonce"`
+    Email         string                 `json:"email"`
+    EmailVerified *bool                  `json:"email_verified"`
+    Raw           map[string]interface{} `json:"-"`
+}
+
+// audience accepts both forms of the aud claim: a string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+    var one string
+    if err := json.Unmarshal(b, &one); err == nil {
+        *a = audience{one}
+        return nil
+    }
+    var many []string
+    if err := json.Unmarshal(b, &many); err != nil {
+        return err
+    }
+    *a = many
+    return nil
+}
+
+// NewOIDC returns the single sign-on handlers for cfg.
+func NewOIDC(cfg OIDCConfig) *OIDC {
+    return &OIDC{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Login: GET /api/oidc/login[?next=/path] redirects to the identity provider.
+func (o *OIDC) Login(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    meta, err := o.metadata(r.Context())
+    if err != nil {
+        log.Printf("oidc: discovery failed: %v", err)
+        http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+        return
+    }
+    st := oidcState{
+        State:    randomString(),
+        Nonce:    randomString(),
+        Verifier: oauth2.GenerateVerifier(),
+        Next:     safeNext(r.URL.Query().Get("next")),
+        Expires:  time.Now().Add(oidcLoginTTL).Unix(),
+    }
+    http.SetCookie(w, &http.Cookie{
+        Name:     oidcCookie,
+        Value:    signValue(st, getSessionSecret()),
+        Path:     "/api/oidc/",
+        MaxAge:   int(oidcLoginTTL.Seconds()),
+        HttpOnly: true,
+        Secure:   secureCookies(r),
+        // Lax still sends the cookie on the provider's top-level redirect back
+        SameSite: http.SameSiteLaxMode,
+    })
+    target := o.oauth2Config(meta).AuthCodeURL(st.State,
+        oauth2.SetAuthURLParam("nonce", st.Nonce),
+        oauth2.S256ChallengeOption(st.Verifier))
+    http.Redirect(w, r, target, http.StatusFound)
+}
+
+// Callback: GET /api/oidc/callback finishes the flow, provisions the user and
+// sets the session cookie. Failures go back to the admin page with sso_error.
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) {
+    http.SetCookie(w, &http.Cookie{Name: oidcCookie, Value: "", Path: "/api/oidc/", MaxAge: -1, HttpOnly: true, Secure: secureCookies(r), SameSite: http.SameSiteLaxMode})
+    fail := func(msg string) {
+        http.Redirect(w, r, "/admin?sso_error="+url.QueryEscape(msg), http.StatusFound)
+    }
+
+    var st oidcState
+    c, err := r.Cookie(oidcCookie)
+    if err != nil || openValue(c.Value, getSessionSecret(), &st) != nil || time.Now().Unix() >= st.Expires {
+        fail("Sign-in expired, please try again")
+        return
+    }
+    q := r.URL.Query()
+    if e := q.Get("error"); e != "" {
+        log.Printf("oidc: provider returned %s: %s", e, q.Get("error_description"))
+        fail("Sign-in was cancelled or refused")
+        return
+    }
+    if q.Get("state") == "" || q.Get("state") != st.State {
+        fail("Sign-in state mismatch, please try again")
+        return
+    }
+
+    claims, err := o.exchange(r, q.Get("code"), st)
+    if err != nil {
+        log.Printf("oidc: %v", err)
+        fail("Could not verify your identity")
+        return
+    }
+    username, role, err := o.authorize(claims)
+    if err != nil {
+        log.Printf("oidc: %s refused: %v", claims.Subject, err)
+        fail(err.Error())
+        return
+    }
+    if err := provisionUser(r.Context(), username, claims.Subject, role); err != nil {
+        log.Printf("oidc: provisioning %q for %s failed: %v", username, claims.Subject, err)
+        if errors.Is(err, errAccountTaken) {
+            fail("An account named " + username + " already exists; ask an admin")
+            return
+        }
+        fail("User store unavailable")
+        return
+    }
+    log.Printf("oidc: %s signed in as %s", username, role)
+    setSessionCookie(w, r, Session{User: username, Role: role})
+    http.Redirect(w, r, st.Next, http.StatusFound)
+}
+
+// exchange trades the code for tokens and verifies the ID token.
+func (o *OIDC) exchange(r *http.Request, code string, st oidcState) (*idClaims, error) {
+    meta, err := o.metadata(r.Context())
+    if err != nil {
+        return nil, fmt.Errorf("discovery failed: %w", err)
+    }
+    ctx := context.WithValue(r.Context(), oauth2.HTTPClient, o.client)
+    tok, err := o.oauth2Config(meta).Exchange(ctx, code, oauth2.VerifierOption(st.Verifier))
+    if err != nil {
+        return nil, fmt.Errorf("code exchange failed: %w", err)
+    }
+    raw, _ := tok.Extra("id_token").(string)
+    if raw == "" {
+        return nil, errors.New("token response has no id_token")
+    }
+    return o.verifyIDToken(r.Context(), raw, st.Nonce, time.Now())
+}
+
+// authorize applies the allow lists and maps the user's groups onto a role.
+// The email only becomes the username once the provider has verified it;
+// otherwise the user is named after their subject.
+func (o *OIDC) authorize(c *idClaims) (string, string, error) {
+    verified := c.Email != "" && c.EmailVerified != nil && *c.EmailVerified
+    username := "oidc:" + c.Subject
+    if verified {
+        username = strings.ToLower(c.Email)
+    }
+    if len(o.cfg.AllowedDomains) > 0 {
+        _, domain, _ := strings.Cut(username, "@")
+        if !verified || !contains(o.cfg.AllowedDomains, domain) {
+            return "", "", errors.New("Your email domain is not allowed, or it is not verified")
+        }
+    }
+    groups := claimStrings(c.Raw[o.cfg.GroupsClaim])
+    if len(o.cfg.AllowedGroups) > 0 && !containsAny(o.cfg.AllowedGroups, groups) {
+        return "", "", errors.New("You are not in an allowed group")
+    }
+    role := o.cfg.DefaultRole
+    for _, g := range groups {
+        if mapped, ok := o.cfg.RoleMap[g]; ok && !HasRole(role, mapped) {
+            role = mapped
+        }
+    }
+    return username, role, nil
+}
+
+// errAccountTaken refuses an SSO login whose username belongs to a password
+// account or to another subject.
+var errAccountTaken = errors.New("username is taken by another account")
+
+// provisionUser creates or updates the stored account of an SSO user, so
+// ownership, tokens and role checks work as for password accounts. An
+// existing account is only reused if the same subject created it.
+func provisionUser(ctx context.Context, username, subject, role string) error {
+    users, err := db.Users()
+    if err != nil {
+        return err
+    }
+    now := time.Now().UTC().Format(time.RFC3339)
+    u, err := users.GetUser(ctx, username)
+    if err != nil {
+        return err
+    }
+    if u == nil {
+        u = &db.User{Username: username, Provider: "oidc", Subject: subject, CreatedAt: now}
+    }
+    if u.Provider != "oidc" || subject == "" || u.Subject != subject {
+        return errAccountTaken
+    }
+    u.Role = role
+    u.UpdatedAt = now
+    return users.PutUser(ctx, *u)
+}
+
+func (o *OIDC) oauth2Config(meta *oidcMetadata) *oauth2.Config {
+    return &oauth2.Config{
+        ClientID:     o.cfg.ClientID,
+        ClientSecret: o.cfg.ClientSecret,
+        Endpoint:     oauth2.Endpoint{AuthURL: meta.AuthorizationEndpoint, TokenURL: meta.TokenEndpoint},
+        RedirectURL:  o.cfg.RedirectURL,
+        Scopes:       o.cfg.Scopes,
+    }
+}
+
+// metadata fetches and caches the issuer's discovery document.
+func (o *OIDC) metadata(ctx context.Context) (*oidcMetadata, error) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    if o.meta != nil {
+        return o.meta, nil
+    }
+    var meta oidcMetadata
+    if err := o.getJSON(ctx, o.cfg.Issuer+"/.well-known/openid-configuration", &meta); err != nil {
+        return nil, err
+    }
+    if strings.TrimRight(meta.Issuer, "/") != o.cfg.Issuer {
+        return nil, fmt.Errorf("discovery issuer %q does not match %q", meta.Issuer, o.cfg.Issuer)
+    }
+    if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+        return nil, errors.New("discovery document is missing endpoints")
+    }
+    o.meta = &meta
+    return o.meta, nil
+}
+
+// key returns the signing key kid, refetching the JWKS once for unknown ids
+// so the provider can rotate keys.
+func (o *OIDC) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+    meta, err := o.metadata(ctx)
+    if err != nil {
+        return nil, err
+    }
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    if k, ok := o.keys[kid]; ok {
+        return k, nil
+    }
+    var set struct {
+        Keys []struct {
+            Kty string `json:"kty"`
+            Kid string `json:"kid"`
+            N   string `json:"n"`
+            E   string `json:"e"`
+        } `json:"keys"`
+    }
+    if err := o.getJSON(ctx, meta.JWKSURI, &set); err != nil {
+        return nil, err
+    }
+    o.keys = map[string]*rsa.PublicKey{}
+    for _, k := range set.Keys {
+        if k.Kty != "RSA" {
+            continue
+        }
+        n, errN := base64.RawURLEncoding.DecodeString(k.N)
+        e, errE := base64.RawURLEncoding.DecodeString(k.E)
+        if errN != nil || errE != nil {
+            continue
+        }
+        o.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+    }
+    k, ok := o.keys[kid]
+    if !ok {
+        return nil, fmt.Errorf("unknown signing key %q", kid)
+    }
+    return k, nil
+}
+
+// verifyIDToken checks the token's signature, issuer, audience, expiry and
+// nonce, and returns its claims.
+func (o *OIDC) verifyIDToken(ctx context.Context, raw, nonce string, now time.Time) (*idClaims, error) {
+    parts := strings.Split(raw, ".")
+    if len(parts) != 3 {
+        return nil, errors.New("malformed id_token")
+    }
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    if err := decodeSegment(parts[0], &header); err != nil {
+        return nil, fmt.Errorf("id_token header: %w", err)
+    }
+    if header.Alg != "RS256" {
+        return nil, fmt.Errorf("unsupported id_token algorithm %q", header.Alg)
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, errors.New("malformed id_token signature")
+    }
+    key, err := o.key(ctx, header.Kid)
+    if err != nil {
+        return nil, err
+    }
+    digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+    if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+        return nil, errors.New("id_token signature is invalid")
+    }
+
+    var c idClaims
+    if err := decodeSegment(parts[1], &c); err != nil {
+        return nil, fmt.Errorf("id_token claims: %w", err)
+    }
+    if err := decodeSegment(parts[1], &c.Raw); err != nil {
+        return nil, fmt.Errorf("id_token claims: %w", err)
+    }
+    switch {
+    case strings.TrimRight(c.Issuer, "/") != o.cfg.Issuer:
+        return nil, fmt.Errorf("id_token issuer %q is not %q", c.Issuer, o.cfg.Issuer)
+    case !contains(c.Audience, o.cfg.ClientID):
+        return nil, errors.New("id_token is not for this client")
+    case now.Add(-oidcClockSkew).Unix() >= c.Expires:
+        return nil, errors.New("id_token has expired")
+    case c.Nonce != nonce:
+        return nil, errors.New("id_token nonce mismatch")
+    case c.Subject == "":
+        return nil, errors.New("id_token has no subject")
+    }
+    return &c, nil
+}
+
+func (o *OIDC) getJSON(ctx context.Context, url string, v interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := o.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("GET %s: %s", url, resp.Status)
+    }
+    return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+    b, err := base64.RawURLEncoding.DecodeString(seg)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(b, v)
+}
+
+// claimStrings reads a claim holding a string or a list of strings.
+func claimStrings(v interface{}) []string {
+    switch t := v.(type) {
+    case string:
+        return []string{t}
+    case []interface{}:
+        out := make([]string, 0, len(t))
+        for _, x := range t {
+            if s, ok := x.(string); ok {
+                out = append(out, s)
+            }
+        }
+        return out
+    }
+    return nil
+}
+
+func contains(list []string, v string) bool {
+    for _, x := range list {
+        if x == v {
+            return true
+        }
+    }
+    return false
+}
+
+func containsAny(list, values []string) bool {
+    for _, v := range values {
+        if contains(list, v) {
+            return true
+        }
+    }
+    return false
+}
+
+// safeNext keeps post-login redirects on this site.
+func safeNext(next string) string {
+    if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+        return "/admin"
+    }
+    return next
+}
+
+func randomString() string {
+    b := make([]byte, 24)
+    if _, err := rand.Read(b); err != nil {
+        log.Fatalf("oidc: failed to read random bytes: %v", err)
+    }
+    return base64.RawURLEncoding.EncodeToString(b)
+}
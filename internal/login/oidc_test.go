@@ -0,0 +1,111 @@
+package login
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tmacphee13/NanachiGo/internal/login/oidctest"
+)
+
+func TestVerifyIDToken(t *testing.T) {
+	issuer := oidctest.NewIssuer("nanachi", "secret")
+	defer issuer.Close()
+	o := NewOIDC(OIDCConfig{Issuer: issuer.URL, ClientID: "nanachi"})
+	now := time.Now()
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"iss": issuer.URL, "aud": "nanachi", "sub": "u1", "exp": now.Add(time.Hour).Unix(), "nonce": "n1"}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	c, err := o.verifyIDToken(context.Background(), issuer.Sign(claims(nil)), "n1", now)
+	if err != nil || c.Subject != "u1" {
+		t.Fatalf("valid token rejected: %+v (%v)", c, err)
+	}
+	if _, err := o.verifyIDToken(context.Background(), issuer.Sign(claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "nanachi"} })), "n1", now); err != nil {
+		t.Fatalf("list audience containing the client rejected: %v", err)
+	}
+
+	bad := map[string]string{
+		"wrong nonce":    issuer.Sign(claims(nil)),
+		"wrong audience": issuer.Sign(claims(func(c map[string]interface{}) { c["aud"] = "other" })),
+		"wrong issuer":   issuer.Sign(claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example" })),
+		"expired":        issuer.Sign(claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() })),
+		"no subject":     issuer.Sign(claims(func(c map[string]interface{}) { delete(c, "sub") })),
+	}
+	for name, token := range bad {
+		nonce := "n1"
+		if name == "wrong nonce" {
+			nonce = "n2"
+		}
+		if _, err := o.verifyIDToken(context.Background(), token, nonce, now); err == nil {
+			t.Errorf("%s: expected the token to be rejected", name)
+		}
+	}
+
+	// a payload swapped under a valid signature
+	good := strings.Split(issuer.Sign(claims(nil)), ".")
+	forged := strings.Split(issuer.Sign(claims(func(c map[string]interface{}) { c["sub"] = "admin" })), ".")
+	if _, err := o.verifyIDToken(context.Background(), good[0]+"."+forged[1]+"."+good[2], "n1", now); err == nil {
+		t.Error("tampered token: expected rejection")
+	}
+	// unsigned tokens are never accepted
+	if _, err := o.verifyIDToken(context.Background(), "eyJhbGciOiJub25lIn0."+good[1]+".", "n1", now); err == nil {
+		t.Error("alg none: expected rejection")
+	}
+}
+
+func TestOIDCAuthorize(t *testing.T) {
+	o := NewOIDC(OIDCConfig{
+		AllowedDomains: []string{"corp.example"},
+		AllowedGroups:  []string{"staff", "research"},
+		GroupsClaim:    "groups",
+		RoleMap:        map[string]string{"research": RoleEditor, "it": RoleAdmin},
+		DefaultRole:    RoleViewer,
+	})
+	verified, unverified := true, false
+	cases := []struct {
+		name     string
+		claims   idClaims
+		wantRole string
+	}{
+		{"mapped group", idClaims{Email: "Ann@corp.example", EmailVerified: &verified, Raw: map[string]interface{}{"groups": []interface{}{"staff", "research"}}}, RoleEditor},
+		{"highest role wins", idClaims{Email: "bo@corp.example", EmailVerified: &verified, Raw: map[string]interface{}{"groups": []interface{}{"it", "research"}}}, RoleAdmin},
+		{"default role", idClaims{Email: "cy@corp.example", EmailVerified: &verified, Raw: map[string]interface{}{"groups": "staff"}}, RoleViewer},
+		{"other domain", idClaims{Email: "dee@else.example", EmailVerified: &verified, Raw: map[string]interface{}{"groups": []interface{}{"staff"}}}, ""},
+		{"unverified email", idClaims{Email: "ed@corp.example", EmailVerified: &unverified, Raw: map[string]interface{}{"groups": []interface{}{"staff"}}}, ""},
+		{"unstated verification", idClaims{Email: "eve@corp.example", Raw: map[string]interface{}{"groups": []interface{}{"staff"}}}, ""},
+		{"no allowed group", idClaims{Email: "fay@corp.example", EmailVerified: &verified, Raw: map[string]interface{}{"groups": []interface{}{"it"}}}, ""},
+	}
+	for _, c := range cases {
+		user, role, err := o.authorize(&c.claims)
+		if c.wantRole == "" {
+			if err == nil {
+				t.Errorf("%s: expected refusal, got %s as %s", c.name, user, role)
+			}
+			continue
+		}
+		if err != nil || role != c.wantRole || user != strings.ToLower(c.claims.Email) {
+			t.Errorf("%s: got %q as %q (%v), want role %q", c.name, user, role, err, c.wantRole)
+		}
+	}
+}
+
+func TestOIDCAuthorizeUnverifiedEmail(t *testing.T) {
+	// without a domain list an unverified email must not pick the username
+	o := NewOIDC(OIDCConfig{GroupsClaim: "groups", DefaultRole: RoleViewer})
+	unverified := false
+	for _, c := range []idClaims{
+		{Subject: "s-1", Email: "admin@corp.example", EmailVerified: &unverified},
+		{Subject: "s-1", Email: "admin@corp.example"},
+	} {
+		user, _, err := o.authorize(&c)
+		if err != nil || user != "oidc:s-1" {
+			t.Errorf("expected oidc:s-1 for %+v, got %q (%v)", c, user, err)
+		}
+	}
+}
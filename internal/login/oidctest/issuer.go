@@ -0,0 +1,194 @@
+// Package oidctest runs a minimal OpenID Connect issuer for tests and local
+// development. It approves every authorization request without showing a
+// login page and signs ID tokens with a throwaway RSA key.
+package oidctest
+
+import (
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "sync"
+    "time"
+)
+
+const keyID = "oidctest"
+
+// Issuer is a running mock issuer; its URL is the issuer identifier.
+type Issuer struct {
+    *httptest.Server
+    ClientID     string
+    ClientSecret string
+
+    key *rsa.PrivateKey
+
+    mu     sync.Mutex
+    claims map[string]interface{}
+    codes  map[string]grant
+}
+
+// grant is an issued authorization code waiting to be exchanged.
+type grant struct {
+    nonce     string
+    challenge string
+    redirect  string
+    claims    map[string]interface{}
+}
+
+// NewIssuer starts an issuer that accepts the given client credentials.
+// Close it when done.
+func NewIssuer(clientID, clientSecret string) *Issuer {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        panic("oidctest: " + err.Error())
+    }
+    i := &Issuer{
+        ClientID:     clientID,
+        ClientSecret: clientSecret,
+        key:          key,
+        claims:       map[string]interface{}{"sub": "user-1", "email": "user@example.com", "email_verified": true},
+        codes:        map[string]grant{},
+    }
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", i.discovery)
+    mux.HandleFunc("/jwks", i.jwks)
+    mux.HandleFunc("/authorize", i.authorize)
+    mux.HandleFunc("/token", i.token)
+    i.Server = httptest.NewServer(mux)
+    return i
+}
+
+// SetClaims sets the identity claims (sub, email, groups...) of the ID tokens
+// issued from now on. iss, aud, exp, iat and nonce are always filled in.
+func (i *Issuer) SetClaims(claims map[string]interface{}) {
+    i.mu.Lock()
+    defer i.mu.Unlock()
+    i.claims = claims
+}
+
+// Sign returns claims as an ID token signed by the issuer's key, for tests
+// that need to craft tokens directly.
+func (i *Issuer) Sign(claims map[string]interface{}) string {
+    header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": keyID, "typ": "JWT"})
+    payload, _ := json.Marshal(claims)
+    signed := b64(header) + "." + b64(payload)
+    digest := sha256.Sum256([]byte(signed))
+    sig, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+    if err != nil {
+        panic("oidctest: " + err.Error())
+    }
+    return signed + "." + b64(sig)
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "issuer":                                i.URL,
+        "authorization_endpoint":                i.URL + "/authorize",
+        "token_endpoint":                        i.URL + "/token",
+        "jwks_uri":                              i.URL + "/jwks",
+        "response_types_supported":              []string{"code"},
+        "id_token_signing_alg_values_supported": []string{"RS256"},
+        "code_challenge_methods_supported":      []string{"S256"},
+    })
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+    pub := i.key.PublicKey
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "keys": []map[string]string{{
+            "kty": "RSA",
+            "kid": keyID,
+            "alg": "RS256",
+            "use": "sig",
+            "n":   b64(pub.N.Bytes()),
+            "e":   b64(big.NewInt(int64(pub.E)).Bytes()),
+        }},
+    })
+}
+
+// authorize immediately redirects back with a code, as if the user had
+// signed in and consented.
+func (i *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    redirect, err := url.Parse(q.Get("redirect_uri"))
+    if err != nil || q.Get("client_id") != i.ClientID || q.Get("response_type") != "code" {
+        http.Error(w, "invalid authorization request", http.StatusBadRequest)
+        return
+    }
+    code := randomString()
+    i.mu.Lock()
+    i.codes[code] = grant{nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), redirect: q.Get("redirect_uri"), claims: i.claims}
+    i.mu.Unlock()
+
+    back := redirect.Query()
+    back.Set("code", code)
+    back.Set("state", q.Get("state"))
+    redirect.RawQuery = back.Encode()
+    http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+    if err := r.ParseForm(); err != nil || r.Method != http.MethodPost {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+        return
+    }
+    id, secret, ok := r.BasicAuth()
+    if !ok {
+        id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+    }
+    if id != i.ClientID || secret != i.ClientSecret {
+        writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+        return
+    }
+    code := r.PostForm.Get("code")
+    i.mu.Lock()
+    g, found := i.codes[code]
+    delete(i.codes, code)
+    i.mu.Unlock()
+    sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+    if !found || g.redirect != r.PostForm.Get("redirect_uri") || (g.challenge != "" && b64(sum[:]) != g.challenge) {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+        return
+    }
+
+    claims := map[string]interface{}{}
+    for k, v := range g.claims {
+        claims[k] = v
+    }
+    now := time.Now()
+    claims["iss"] = i.URL
+    claims["aud"] = i.ClientID
+    claims["iat"] = now.Unix()
+    claims["exp"] = now.Add(time.Hour).Unix()
+    if g.nonce != "" {
+        claims["nonce"] = g.nonce
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "access_token": randomString(),
+        "token_type":   "Bearer",
+        "expires_in":   3600,
+        "id_token":     i.Sign(claims),
+    })
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+func b64(b []byte) string {
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func randomString() string {
+    b := make([]byte, 16)
+    rand.Read(b)
+    return b64(b)
+}
@@ -0,0 +1,26 @@
+package login
+
+// Roles, from least to most privileged. Viewers browse, editors also upload
+// papers and regenerate nodes, and admins also delete papers and manage users.
+const (
+    RoleViewer = "viewer"
+    RoleEditor = "editor"
+    RoleAdmin  = "admin"
+)
+
+var roleRank = map[string]int{
+    RoleViewer: 1,
+    RoleEditor: 2,
+    RoleAdmin:  3,
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+    _, ok := roleRank[role]
+    return ok
+}
+
+// HasRole reports whether have grants at least the privileges of need.
+func HasRole(have, need string) bool {
+    return ValidRole(have) && roleRank[have] >= roleRank[need]
+}
@@ -0,0 +1,22 @@
+package login
+
+import "testing"
+
+func TestHasRole(t *testing.T) {
+	cases := []struct {
+		have, need string
+		want       bool
+	}{
+		{RoleAdmin, RoleEditor, true},
+		{RoleEditor, RoleEditor, true},
+		{RoleViewer, RoleEditor, false},
+		{RoleEditor, RoleAdmin, false},
+		{"", RoleViewer, false},
+		{"root", RoleViewer, false},
+	}
+	for _, c := range cases {
+		if got := HasRole(c.have, c.need); got != c.want {
+			t.Errorf("HasRole(%q, %q) = %t, want %t", c.have, c.need, got, c.want)
+		}
+	}
+}
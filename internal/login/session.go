@@ -0,0 +1,274 @@
+package login
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+// Sessions are stateless: the cookie holds the session itself, signed with
+// HMAC-SHA256, so any server sharing SESSION_SECRET can verify it.
+
+// SessionCookie is the name of the cookie Login sets.
+const SessionCookie = "nanachi_session"
+
+// Session identifies a signed-in user. Env marks the built-in admin that
+// signed in with ADMIN_PASSWORD rather than a stored account, and PassTag
+// ties that session to the password it signed in with. Token is set when the
+// request was authenticated by an API token instead of a cookie.
+type Session struct {
+    User    string `json:"sub"`
+    Role    string `json:"role"`
+    Env     bool   `json:"env,omitempty"`
+    PassTag string `json:"pw,omitempty"`
+    Expires int64  `json:"exp"`
+    Token   string `json:"-"`
+}
+
+var (
+    errBadSession     = errors.New("invalid session")
+    errExpiredSession = errors.New("session expired")
+)
+
+var (
+    sessionSecret     []byte
+    sessionSecretOnce sync.Once
+)
+
+// getSessionSecret reads SESSION_SECRET, falling back to a random key that
+// lasts as long as the process.
+func getSessionSecret() []byte {
+    sessionSecretOnce.Do(func() {
+        if v := strings.TrimSpace(os.Getenv("SESSION_SECRET")); v != "" {
+            sessionSecret = []byte(v)
+            return
+        }
+        log.Printf("WARNING: SESSION_SECRET not set; sessions will not survive a restart")
+        sessionSecret = make([]byte, 32)
+        if _, err := rand.Read(sessionSecret); err != nil {
+            log.Fatalf("session: failed to generate secret: %v", err)
+        }
+    })
+    return sessionSecret
+}
+
+// sessionTTL reads SESSION_TTL (default 12h).
+func sessionTTL() time.Duration {
+    if v := strings.TrimSpace(os.Getenv("SESSION_TTL")); v != "" {
+        if d, err := time.ParseDuration(v); err == nil && d > 0 {
+            return d
+        }
+        log.Printf("session: ignoring invalid SESSION_TTL=%q", v)
+    }
+    return 12 * time.Hour
+}
+
+// signSession encodes s as base64(payload).base64(mac).
+func signSession(s Session, secret []byte) string {
+    return signValue(s, secret)
+}
+
+// verifySession checks the token's signature and expiry.
+func verifySession(token string, secret []byte, now time.Time) (Session, error) {
+    var s Session
+    if err := openValue(token, secret, &s); err != nil || s.User == "" {
+        return Session{}, errBadSession
+    }
+    if now.Unix() >= s.Expires {
+        return Session{}, errExpiredSession
+    }
+    return s, nil
+}
+
+// signValue encodes v as base64(json).base64(mac).
+func signValue(v interface{}, secret []byte) string {
+    payload, _ := json.Marshal(v)
+    body := base64.RawURLEncoding.EncodeToString(payload)
+    return body + "." + base64.RawURLEncoding.EncodeToString(sessionMAC(body, secret))
+}
+
+// openValue checks a signValue token's signature and decodes it into v.
+func openValue(token string, secret []byte, v interface{}) error {
+    body, sig, ok := strings.Cut(token, ".")
+    if !ok {
+        return errBadSession
+    }
+    mac, err := base64.RawURLEncoding.DecodeString(sig)
+    if err != nil || !hmac.Equal(mac, sessionMAC(body, secret)) {
+        return errBadSession
+    }
+    payload, err := base64.RawURLEncoding.DecodeString(body)
+    if err != nil {
+        return errBadSession
+    }
+    if err := json.Unmarshal(payload, v); err != nil {
+        return errBadSession
+    }
+    return nil
+}
+
+// envAdminTag keys the built-in admin's password with the session secret, so
+// the cookie can carry it without revealing it.
+func envAdminTag(password string) string {
+    return base64.RawURLEncoding.EncodeToString(sessionMAC("admin-password:"+password, getSessionSecret())[:16])
+}
+
+func sessionMAC(body string, secret []byte) []byte {
+    m := hmac.New(sha256.New, secret)
+    m.Write([]byte(body))
+    return m.Sum(nil)
+}
+
+// setSessionCookie signs s, with a fresh expiry, and attaches it to w.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, s Session) Session {
+    ttl := sessionTTL()
+    s.Expires = time.Now().Add(ttl).Unix()
+    http.SetCookie(w, &http.Cookie{
+        Name:     SessionCookie,
+        Value:    signSession(s, getSessionSecret()),
+        Path:     "/",
+        MaxAge:   int(ttl.Seconds()),
+        HttpOnly: true,
+        Secure:   secureCookies(r),
+        // Lax keeps the cookie off cross-site POSTs, which covers CSRF for the write routes
+        SameSite: http.SameSiteLaxMode,
+    })
+    return s
+}
+
+// secureCookies is true behind TLS or when COOKIE_SECURE is set.
+func secureCookies(r *http.Request) bool {
+    if r.TLS != nil {
+        return true
+    }
+    v := strings.ToLower(strings.TrimSpace(os.Getenv("COOKIE_SECURE")))
+    return v == "1" || v == "true" || v == "yes"
+}
+
+// SessionFromRequest returns the verified session carried by r's cookie.
+func SessionFromRequest(r *http.Request) (Session, bool) {
+    c, err := r.Cookie(SessionCookie)
+    if err != nil {
+        return Session{}, false
+    }
+    s, err := verifySession(c.Value, getSessionSecret(), time.Now())
+    if err != nil {
+        return Session{}, false
+    }
+    return s, true
+}
+
+type sessionKey struct{}
+
+// WithSession attaches s to ctx.
+func WithSession(ctx context.Context, s Session) context.Context {
+    return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// SessionFrom returns the session Guard attached to the request context.
+func SessionFrom(ctx context.Context) (Session, bool) {
+    s, ok := ctx.Value(sessionKey{}).(Session)
+    return s, ok
+}
+
+// requestSession authenticates r by its bearer token or else its session
+// cookie. badToken is set when a bearer token was sent but is not valid.
+func requestSession(r *http.Request) (s Session, ok, badToken bool) {
+    if token, sent := bearerToken(r); sent {
+        s, ok = tokenSession(r.Context(), token)
+        return s, ok, !ok
+    }
+    if s, ok = SessionFromRequest(r); ok {
+        s, ok = refreshSession(r.Context(), s)
+    }
+    return s, ok, false
+}
+
+// Guard requires a valid session or API token for every request that can
+// change data. Safe methods (GET, HEAD, OPTIONS) pass without one when
+// publicReads is set, but an invalid token is always rejected. Sessions of
+// stored accounts are checked against the user store, so deleted users are
+// locked out and role changes apply immediately.
+func Guard(publicReads bool, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        s, ok, badToken := requestSession(r)
+        if badToken {
+            writeAuthError(w, http.StatusUnauthorized, "Invalid API token")
+            return
+        }
+        if ok {
+            r = r.WithContext(WithSession(r.Context(), s))
+        } else if !(publicReads && isSafeMethod(r.Method)) {
+            writeAuthError(w, http.StatusUnauthorized, "Authentication required")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Require lets the request through only if Guard attached a session whose
+// role is at least role.
+func Require(role string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        s, ok := SessionFrom(r.Context())
+        if !ok {
+            writeAuthError(w, http.StatusUnauthorized, "Authentication required")
+            return
+        }
+        if !HasRole(s.Role, role) {
+            writeAuthError(w, http.StatusForbidden, "This action requires the "+role+" role")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// refreshSession replaces a stored account's role with its current one. The
+// built-in admin's session only lasts while ADMIN_PASSWORD is the one it
+// signed in with and no stored account has taken the name.
+func refreshSession(ctx context.Context, s Session) (Session, bool) {
+    users, err := db.Users()
+    if err != nil {
+        log.Printf("session: user store unavailable: %v", err)
+        return Session{}, false
+    }
+    u, err := users.GetUser(ctx, s.User)
+    if err != nil {
+        log.Printf("session: lookup %q failed: %v", s.User, err)
+        return Session{}, false
+    }
+    if s.Env {
+        if u != nil || s.User != envAdmin || subtle.ConstantTimeCompare([]byte(s.PassTag), []byte(envAdminTag(getAdminPass()))) != 1 {
+            return Session{}, false
+        }
+        return s, true
+    }
+    if u == nil {
+        return Session{}, false
+    }
+    s.Role = u.Role
+    return s, true
+}
+
+func writeAuthError(w http.ResponseWriter, status int, message string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(LoginResponse{Success: false, Message: message})
+}
+
+func isSafeMethod(method string) bool {
+    return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
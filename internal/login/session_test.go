@@ -0,0 +1,143 @@
+package login
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+func TestSignAndVerifySession(t *testing.T) {
+	secret := []byte("test-secret")
+	now := time.Now()
+	token := signSession(Session{User: "admin", Expires: now.Add(time.Hour).Unix()}, secret)
+
+	s, err := verifySession(token, secret, now)
+	if err != nil || s.User != "admin" {
+		t.Fatalf("expected a valid session, got %+v (%v)", s, err)
+	}
+	if _, err := verifySession(token, []byte("other-secret"), now); err != errBadSession {
+		t.Fatalf("wrong secret: expected errBadSession, got %v", err)
+	}
+	body, sig, _ := strings.Cut(token, ".")
+	forged := signSession(Session{User: "mallory", Expires: now.Add(time.Hour).Unix()}, []byte("guess"))
+	forgedBody, _, _ := strings.Cut(forged, ".")
+	if _, err := verifySession(forgedBody+"."+sig, secret, now); err != errBadSession {
+		t.Fatalf("swapped payload: expected errBadSession, got %v", err)
+	}
+	if _, err := verifySession(body, secret, now); err != errBadSession {
+		t.Fatalf("missing signature: expected errBadSession, got %v", err)
+	}
+	if _, err := verifySession(token, secret, now.Add(2*time.Hour)); err != errExpiredSession {
+		t.Fatalf("expected errExpiredSession, got %v", err)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s, found := SessionFrom(r.Context()); found {
+			w.Write([]byte(s.User))
+		}
+	})
+	db.RegisterStore("guard-test", db.NewMemoryStore())
+	t.Setenv("USERS_PLATFORM", "guard-test")
+	rec := httptest.NewRecorder()
+	setSessionCookie(rec, httptest.NewRequest(http.MethodPost, "/api/login", nil), Session{User: "admin", Role: RoleAdmin, Env: true, PassTag: envAdminTag(getAdminPass())})
+	cookie := rec.Result().Cookies()[0]
+
+	cases := []struct {
+		method      string
+		publicReads bool
+		withCookie  bool
+		want        int
+	}{
+		{http.MethodGet, true, false, http.StatusOK},
+		{http.MethodGet, false, false, http.StatusUnauthorized},
+		{http.MethodGet, false, true, http.StatusOK},
+		{http.MethodPost, true, false, http.StatusUnauthorized},
+		{http.MethodDelete, true, true, http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/api/mindmaps", nil)
+		if c.withCookie {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		Guard(c.publicReads, ok).ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("%s publicReads=%t cookie=%t: expected %d, got %d", c.method, c.publicReads, c.withCookie, c.want, rec.Code)
+		}
+		if c.withCookie && rec.Body.String() != "admin" {
+			t.Errorf("%s: session was not attached to the request context", c.method)
+		}
+	}
+}
+
+func TestRequireUsesStoredRole(t *testing.T) {
+	store := db.NewMemoryStore()
+	db.RegisterStore("login-test", store)
+	t.Setenv("USERS_PLATFORM", "login-test")
+	ctx := context.Background()
+	if err := store.CreateUser(ctx, db.User{Username: "erin", Role: RoleEditor}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	setSessionCookie(rec, httptest.NewRequest(http.MethodPost, "/api/login", nil), Session{User: "erin", Role: RoleViewer})
+	cookie := rec.Result().Cookies()[0]
+	call := func(need string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/upload", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h := Require(need, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		Guard(true, h).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// the stored role wins over the one signed into the cookie
+	if got := call(RoleEditor); got != http.StatusOK {
+		t.Fatalf("editor route: expected 200, got %d", got)
+	}
+	if got := call(RoleAdmin); got != http.StatusForbidden {
+		t.Fatalf("admin route: expected 403, got %d", got)
+	}
+	if _, err := store.DeleteUser(ctx, "erin"); err != nil {
+		t.Fatal(err)
+	}
+	if got := call(RoleViewer); got != http.StatusUnauthorized {
+		t.Fatalf("deleted user: expected 401, got %d", got)
+	}
+}
+
+func TestEnvAdminSessionRevalidated(t *testing.T) {
+	store := db.NewMemoryStore()
+	db.RegisterStore("env-admin-test", store)
+	t.Setenv("USERS_PLATFORM", "env-admin-test")
+	ctx := context.Background()
+
+	current := Session{User: envAdmin, Role: RoleAdmin, Env: true, PassTag: envAdminTag(getAdminPass())}
+	if _, ok := refreshSession(ctx, current); !ok {
+		t.Fatal("a session signed in with the current password should stay valid")
+	}
+	// signed in before ADMIN_PASSWORD changed, or with no tag at all
+	for _, tag := range []string{envAdminTag(getAdminPass() + "-old"), ""} {
+		stale := current
+		stale.PassTag = tag
+		if _, ok := refreshSession(ctx, stale); ok {
+			t.Fatalf("a session with tag %q must be rejected", tag)
+		}
+	}
+	// a stored "admin" takes the name over
+	store.CreateUser(ctx, db.User{Username: envAdmin, Role: RoleAdmin})
+	if _, ok := refreshSession(ctx, current); ok {
+		t.Fatal("an env admin session must not outlive a stored admin account")
+	}
+	db.RegisterStore("env-admin-test", brokenUsers{store})
+	if _, ok := refreshSession(ctx, current); ok {
+		t.Fatal("expected no session while the store is down")
+	}
+}
@@ -0,0 +1,252 @@
+package login
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+// API tokens look like nng_<id>_<secret>. The id locates the stored token and
+// the whole string is compared against its SHA-256 hash, so the secret is
+// never stored. Tokens are shown once, when they are created.
+
+const tokenPrefix = "nng_"
+
+// touchInterval limits how often a token's last-used time is written.
+const touchInterval = time.Minute
+
+// TokenInfo is an API token as returned by the API, without its hash.
+type TokenInfo struct {
+    ID         string `json:"id"`
+    Name       string `json:"name"`
+    Username   string `json:"username"`
+    Role       string `json:"role"`
+    CreatedAt  string `json:"createdAt"`
+    LastUsedAt string `json:"lastUsedAt,omitempty"`
+}
+
+// TokenRequest creates a token. Role defaults to the caller's own role.
+type TokenRequest struct {
+    Name string `json:"name"`
+    Role string `json:"role"`
+}
+
+func tokenInfo(t db.APIToken) TokenInfo {
+    return TokenInfo{ID: t.ID, Name: t.Name, Username: t.Username, Role: t.Role, CreatedAt: t.CreatedAt, LastUsedAt: t.LastUsedAt}
+}
+
+// newToken returns a fresh token and its id.
+func newToken() (string, string, error) {
+    id := make([]byte, 8)
+    secret := make([]byte, 32)
+    if _, err := rand.Read(id); err != nil {
+        return "", "", err
+    }
+    if _, err := rand.Read(secret); err != nil {
+        return "", "", err
+    }
+    idHex := hex.EncodeToString(id)
+    return tokenPrefix + idHex + "_" + base64.RawURLEncoding.EncodeToString(secret), idHex, nil
+}
+
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// tokenID extracts the id from a token, or reports that it is malformed.
+func tokenID(token string) (string, bool) {
+    rest, ok := strings.CutPrefix(token, tokenPrefix)
+    if !ok {
+        return "", false
+    }
+    id, secret, ok := strings.Cut(rest, "_")
+    return id, ok && id != "" && secret != ""
+}
+
+// bearerToken returns the credential of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+    h := r.Header.Get("Authorization")
+    if h == "" {
+        return "", false
+    }
+    scheme, token, _ := strings.Cut(h, " ")
+    if !strings.EqualFold(scheme, "Bearer") {
+        return "", true
+    }
+    return strings.TrimSpace(token), true
+}
+
+// tokenSession authenticates an API token as its owner, with the lower of
+// the token's role and the owner's current one. Tokens of the built-in admin
+// only work while no stored account is named "admin" and ADMIN_PASSWORD is
+// set; if the user store cannot say, no token works.
+func tokenSession(ctx context.Context, token string) (Session, bool) {
+    id, ok := tokenID(token)
+    if !ok {
+        return Session{}, false
+    }
+    tokens, err := db.Tokens()
+    if err != nil {
+        log.Printf("tokens: store unavailable: %v", err)
+        return Session{}, false
+    }
+    t, err := tokens.GetToken(ctx, id)
+    if err != nil {
+        log.Printf("tokens: lookup %s failed: %v", id, err)
+        return Session{}, false
+    }
+    if t == nil || subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(t.Hash)) != 1 {
+        return Session{}, false
+    }
+    users, err := db.Users()
+    if err != nil {
+        log.Printf("tokens: user store unavailable: %v", err)
+        return Session{}, false
+    }
+    u, err := users.GetUser(ctx, t.Username)
+    if err != nil {
+        log.Printf("tokens: owner lookup %q failed: %v", t.Username, err)
+        return Session{}, false
+    }
+    ownerRole := RoleAdmin
+    if u != nil {
+        ownerRole = u.Role
+    } else if t.Username != envAdmin || !envAdminConfigured() {
+        return Session{}, false
+    }
+    role := t.Role
+    if !HasRole(ownerRole, role) {
+        role = ownerRole
+    }
+
+    now := time.Now().UTC()
+    if last, err := time.Parse(time.RFC3339, t.LastUsedAt); err != nil || now.Sub(last) >= touchInterval {
+        if err := tokens.TouchToken(ctx, t.ID, now.Format(time.RFC3339)); err != nil {
+            log.Printf("tokens: failed to record use of %s: %v", t.ID, err)
+        }
+    }
+    return Session{User: t.Username, Role: role, Token: t.ID}, true
+}
+
+// TokensHandler serves the API token routes for the signed-in user:
+//
+//	GET    /api/tokens        own tokens; admins may add ?all=true
+//	POST   /api/tokens        {name, role}; the token is only returned here
+//	DELETE /api/tokens/{id}   revoke one of your tokens, or any as an admin
+func TokensHandler(w http.ResponseWriter, r *http.Request) {
+    s, ok := SessionFrom(r.Context())
+    if !ok {
+        writeAuthError(w, http.StatusUnauthorized, "Authentication required")
+        return
+    }
+    tokens, err := db.Tokens()
+    if err != nil {
+        log.Printf("tokens: %v", err)
+        writeAuthError(w, http.StatusServiceUnavailable, "Token store unavailable")
+        return
+    }
+    id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tokens"), "/")
+    switch {
+    case id == "" && r.Method == http.MethodGet:
+        listTokens(w, r, tokens, s)
+    case id == "" && r.Method == http.MethodPost:
+        createToken(w, r, tokens, s)
+    case id != "" && r.Method == http.MethodDelete:
+        revokeToken(w, r, tokens, s, id)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func listTokens(w http.ResponseWriter, r *http.Request, tokens db.TokenStore, s Session) {
+    owner := s.User
+    if r.URL.Query().Get("all") == "true" && HasRole(s.Role, RoleAdmin) {
+        owner = ""
+    }
+    list, err := tokens.ListTokens(r.Context(), owner)
+    if err != nil {
+        log.Printf("tokens: list failed: %v", err)
+        writeAuthError(w, http.StatusInternalServerError, "Failed to list tokens")
+        return
+    }
+    out := make([]TokenInfo, 0, len(list))
+    for _, t := range list {
+        out = append(out, tokenInfo(t))
+    }
+    writeUserJSON(w, http.StatusOK, map[string]interface{}{"success": true, "tokens": out})
+}
+
+func createToken(w http.ResponseWriter, r *http.Request, tokens db.TokenStore, s Session) {
+    var req TokenRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeAuthError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+    req.Name = strings.TrimSpace(req.Name)
+    if req.Name == "" || len(req.Name) > 100 {
+        writeAuthError(w, http.StatusBadRequest, "Name must be 1-100 characters")
+        return
+    }
+    if req.Role == "" {
+        req.Role = s.Role
+    }
+    if !ValidRole(req.Role) {
+        writeAuthError(w, http.StatusBadRequest, "Role must be admin, editor or viewer")
+        return
+    }
+    if !HasRole(s.Role, req.Role) {
+        writeAuthError(w, http.StatusForbidden, "A token cannot have a higher role than yours")
+        return
+    }
+    token, id, err := newToken()
+    if err != nil {
+        log.Printf("tokens: failed to generate token: %v", err)
+        writeAuthError(w, http.StatusInternalServerError, "Failed to create token")
+        return
+    }
+    t := db.APIToken{
+        ID:        id,
+        Username:  s.User,
+        Name:      req.Name,
+        Hash:      hashToken(token),
+        Role:      req.Role,
+        CreatedAt: time.Now().UTC().Format(time.RFC3339),
+    }
+    if err := tokens.CreateToken(r.Context(), t); err != nil {
+        log.Printf("tokens: create failed: %v", err)
+        writeAuthError(w, http.StatusInternalServerError, "Failed to create token")
+        return
+    }
+    writeUserJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "token": token, "info": tokenInfo(t)})
+}
+
+func revokeToken(w http.ResponseWriter, r *http.Request, tokens db.TokenStore, s Session, id string) {
+    t, err := tokens.GetToken(r.Context(), id)
+    if err != nil {
+        log.Printf("tokens: lookup %s failed: %v", id, err)
+        writeAuthError(w, http.StatusInternalServerError, "Failed to load token")
+        return
+    }
+    // other users' tokens look missing unless the caller is an admin
+    if t == nil || (t.Username != s.User && !HasRole(s.Role, RoleAdmin)) {
+        writeAuthError(w, http.StatusNotFound, "Token not found")
+        return
+    }
+    if _, err := tokens.DeleteToken(r.Context(), id); err != nil {
+        log.Printf("tokens: delete %s failed: %v", id, err)
+        writeAuthError(w, http.StatusInternalServerError, "Failed to revoke token")
+        return
+    }
+    writeUserJSON(w, http.StatusOK, LoginResponse{Success: true, Message: "Token revoked"})
+}
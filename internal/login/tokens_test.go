@@ -0,0 +1,83 @@
+package login
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+func TestTokenID(t *testing.T) {
+	token, id, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := tokenID(token); !ok || got != id {
+		t.Fatalf("tokenID(%q) = %q, %t; want %q", token, got, ok, id)
+	}
+	for _, bad := range []string{"", "nng_", "nng_abc", "nng__secret", "ghp_abc_secret", strings.TrimPrefix(token, tokenPrefix)} {
+		if _, ok := tokenID(bad); ok {
+			t.Errorf("tokenID(%q) should be rejected", bad)
+		}
+	}
+}
+
+func TestTokenSessionCapsRole(t *testing.T) {
+	store := db.NewMemoryStore()
+	db.RegisterStore("token-test", store)
+	t.Setenv("USERS_PLATFORM", "token-test")
+	ctx := context.Background()
+	store.CreateUser(ctx, db.User{Username: "erin", Role: RoleEditor})
+
+	token, id, _ := newToken()
+	store.CreateToken(ctx, db.APIToken{ID: id, Username: "erin", Hash: hashToken(token), Role: RoleEditor})
+	s, ok := tokenSession(ctx, token)
+	if !ok || s.User != "erin" || s.Role != RoleEditor || s.Token != id {
+		t.Fatalf("expected an editor session for erin, got %+v (%t)", s, ok)
+	}
+	if stored, _ := store.GetToken(ctx, id); stored.LastUsedAt == "" {
+		t.Fatal("use should be recorded")
+	}
+
+	// a demoted owner drags the token down with them
+	store.PutUser(ctx, db.User{Username: "erin", Role: RoleViewer})
+	if s, _ := tokenSession(ctx, token); s.Role != RoleViewer {
+		t.Fatalf("expected the owner's lower role, got %q", s.Role)
+	}
+	if _, ok := tokenSession(ctx, token+"x"); ok {
+		t.Fatal("a token with the wrong secret must be rejected")
+	}
+	store.DeleteUser(ctx, "erin")
+	if _, ok := tokenSession(ctx, token); ok {
+		t.Fatal("tokens of deleted users must be rejected")
+	}
+}
+
+func TestTokenSessionEnvAdminFailsClosed(t *testing.T) {
+	store := db.NewMemoryStore()
+	db.RegisterStore("token-test", store)
+	t.Setenv("USERS_PLATFORM", "token-test")
+	t.Setenv("ADMIN_PASSWORD", "")
+	ctx := context.Background()
+
+	token, id, _ := newToken()
+	store.CreateToken(ctx, db.APIToken{ID: id, Username: envAdmin, Hash: hashToken(token), Role: RoleAdmin})
+	if s, ok := tokenSession(ctx, token); ok {
+		t.Fatalf("the built-in admin is not configured, got %+v", s)
+	}
+	t.Setenv("ADMIN_PASSWORD", "configured")
+	if s, ok := tokenSession(ctx, token); !ok || s.Role != RoleAdmin {
+		t.Fatalf("expected the built-in admin, got %+v (%t)", s, ok)
+	}
+	// a stored "admin" takes the name over, with its own role
+	store.CreateUser(ctx, db.User{Username: envAdmin, Role: RoleViewer})
+	if s, _ := tokenSession(ctx, token); s.Role != RoleViewer {
+		t.Fatalf("expected the stored admin's role, got %q", s.Role)
+	}
+
+	db.RegisterStore("token-test", brokenUsers{store})
+	if s, ok := tokenSession(ctx, token); ok {
+		t.Fatalf("expected no session while the store is down, got %+v", s)
+	}
+}
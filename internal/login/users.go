@@ -0,0 +1,251 @@
+package login
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "regexp"
+    "strings"
+    "time"
+
+    "golang.org/x/crypto/bcrypt"
+
+    "github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+// minPasswordLen is the shortest password accepted for a stored account.
+const minPasswordLen = 8
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// UserInfo is a user as returned by the API, without the password hash.
+type UserInfo struct {
+    Username         string  `json:"username"`
+    Role             string  `json:"role"`
+    MonthlyBudgetUSD float64 `json:"monthlyBudgetUsd,omitempty"`
+    CreatedAt        string  `json:"createdAt"`
+    UpdatedAt        string  `json:"updatedAt"`
+}
+
+// UserRequest creates or updates a user. On update, empty fields are left
+// unchanged; a MonthlyBudgetUSD of 0 restores the default budget.
+type UserRequest struct {
+    Username         string   `json:"username"`
+    Password         string   `json:"password"`
+    Role             string   `json:"role"`
+    MonthlyBudgetUSD *float64 `json:"monthlyBudgetUsd,omitempty"`
+}
+
+func userInfo(u db.User) UserInfo {
+    return UserInfo{Username: u.Username, Role: u.Role, MonthlyBudgetUSD: u.MonthlyBudgetUSD, CreatedAt: u.CreatedAt, UpdatedAt: u.UpdatedAt}
+}
+
+// UsersHandler serves the admin-only account API:
+//
+//	GET    /api/users
+//	POST   /api/users             {username, password, role, monthlyBudgetUsd?}
+//	PATCH  /api/users/{username}  {password?, role?, monthlyBudgetUsd?}
+//	DELETE /api/users/{username}
+func UsersHandler(w http.ResponseWriter, r *http.Request) {
+    users, err := db.Users()
+    if err != nil {
+        log.Printf("users: %v", err)
+        writeAuthError(w, http.StatusServiceUnavailable, "User store unavailable")
+        return
+    }
+    name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/users"), "/")
+    switch {
+    case name == "" && r.Method == http.MethodGet:
+        listUsers(w, r, users)
+    case name == "" && r.Method == http.MethodPost:
+        createUser(w, r, users)
+    case name != "" && r.Method == http.MethodPatch:
+        updateUser(w, r, users, name)
+    case name != "" && r.Method == http.MethodDelete:
+        deleteUser(w, r, users, name)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func listUsers(w http.ResponseWriter, r *http.Request, users db.UserStore) {
+    list, err := users.ListUsers(r.Context())
+    if err != nil {
+        log.Printf("users: list failed: %v", err)
+        writeAuthError(w, http.StatusInternalServerError, "Failed to list users")
+        return
+    }
+    out := make([]UserInfo, 0, len(list))
+    for _, u := range list {
+        out = append(out, userInfo(u))
+    }
+    writeUserJSON(w, http.StatusOK, map[string]interface{}{"success": true, "users": out})
+}
+
+func createUser(w http.ResponseWriter, r *http.Request, users db.UserStore) {
+    var req UserRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeAuthError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+    req.Username = strings.TrimSpace(req.Username)
+    if !usernamePattern.MatchString(req.Username) {
+        writeAuthError(w, http.StatusBadRequest, "Username must be 1-64 letters, digits or . _ @ -")
+        return
+    }
+    if !ValidRole(req.Role) {
+        writeAuthError(w, http.StatusBadRequest, "Role must be admin, editor or viewer")
+        return
+    }
+    if !validBudget(req.MonthlyBudgetUSD) {
+        writeAuthError(w, http.StatusBadRequest, "Monthly budget must not be negative")
+        return
+    }
+    hash, msg := hashPassword(req.Password)
+    if msg != "" {
+        writeAuthError(w, http.StatusBadRequest, msg)
+        return
+    }
+    now := time.Now().UTC().Format(time.RFC3339)
+    u := db.User{Username: req.Username, PasswordHash: hash, Role: req.Role, CreatedAt: now, UpdatedAt: now}
+    if req.MonthlyBudgetUSD != nil {
+        u.MonthlyBudgetUSD = *req.MonthlyBudgetUSD
+    }
+    if err := users.CreateUser(r.Context(), u); err != nil {
+        if errors.Is(err, db.ErrUserExists) {
+            writeAuthError(w, http.StatusConflict, "User already exists")
+            return
+        }
+        log.Printf("users: create %q failed: %v", u.Username, err)
+        writeAuthError(w, http.StatusInternalServerError, "Failed to create user")
+        return
+    }
+    writeUserJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "user": userInfo(u)})
+}
+
+func updateUser(w http.ResponseWriter, r *http.Request, users db.UserStore, name string) {
+    var req UserRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeAuthError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+    u, err := users.GetUser(r.Context(), name)
+    if err != nil {
+        log.Printf("users: lookup %q failed: %v", name, err)
+        writeAuthError(w, http.StatusInternalServerError, "Failed to load user")
+        return
+    }
+    if u == nil {
+        writeAuthError(w, http.StatusNotFound, "User not found")
+        return
+    }
+    if req.Role != "" {
+        if !ValidRole(req.Role) {
+            writeAuthError(w, http.StatusBadRequest, "Role must be admin, editor or viewer")
+            return
+        }
+        if isSelf(r, name) && req.Role != RoleAdmin {
+            writeAuthError(w, http.StatusBadRequest, "You cannot remove your own admin role")
+            return
+        }
+        u.Role = req.Role
+    }
+    if req.MonthlyBudgetUSD != nil {
+        if !validBudget(req.MonthlyBudgetUSD) {
+            writeAuthError(w, http.StatusBadRequest, "Monthly budget must not be negative")
+            return
+        }
+        u.MonthlyBudgetUSD = *req.MonthlyBudgetUSD
+    }
+    if req.Password != "" {
+        hash, msg := hashPassword(req.Password)
+        if msg != "" {
+            writeAuthError(w, http.StatusBadRequest, msg)
+            return
+        }
+        u.PasswordHash = hash
+    }
+    u.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+    if err := users.PutUser(r.Context(), *u); err != nil {
+        log.Printf("users: update %q failed: %v", name, err)
+        writeAuthError(w, http.StatusInternalServerError, "Failed to update user")
+        return
+    }
+    writeUserJSON(w, http.StatusOK, map[string]interface{}{"success": true, "user": userInfo(*u)})
+}
+
+func deleteUser(w http.ResponseWriter, r *http.Request, users db.UserStore, name string) {
+    if isSelf(r, name) {
+        writeAuthError(w, http.StatusBadRequest, "You cannot delete your own account")
+        return
+    }
+    // Tokens go first: a token left behind by a deleted account must never
+    // be picked up by a later account of the same name
+    if err := revokeUserTokens(r, name); err != nil {
+        log.Printf("users: revoking tokens of %q failed: %v", name, err)
+        writeAuthError(w, http.StatusInternalServerError, "Failed to revoke the user's API tokens; the user was not deleted")
+        return
+    }
+    deleted, err := users.DeleteUser(r.Context(), name)
+    if err != nil {
+        log.Printf("users: delete %q failed: %v", name, err)
+        writeAuthError(w, http.StatusInternalServerError, "Failed to delete user")
+        return
+    }
+    if !deleted {
+        writeAuthError(w, http.StatusNotFound, "User not found")
+        return
+    }
+    writeUserJSON(w, http.StatusOK, LoginResponse{Success: true, Message: "User deleted"})
+}
+
+// revokeUserTokens removes the API tokens of a user about to be deleted.
+func revokeUserTokens(r *http.Request, name string) error {
+    tokens, err := db.Tokens()
+    if err != nil {
+        return err
+    }
+    list, err := tokens.ListTokens(r.Context(), name)
+    if err != nil {
+        return err
+    }
+    for _, t := range list {
+        if _, err := tokens.DeleteToken(r.Context(), t.ID); err != nil {
+            return fmt.Errorf("token %s: %w", t.ID, err)
+        }
+    }
+    return nil
+}
+
+// hashPassword returns the bcrypt hash of password, or a message saying why
+// the password was rejected.
+func hashPassword(password string) (string, string) {
+    if len(password) < minPasswordLen {
+        return "", "Password must be at least 8 characters"
+    }
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        // bcrypt only fails on inputs over 72 bytes
+        return "", "Password is too long"
+    }
+    return string(hash), ""
+}
+
+// validBudget accepts a missing budget or any non-negative amount.
+func validBudget(usd *float64) bool {
+    return usd == nil || *usd >= 0
+}
+
+// isSelf reports whether the stored account name belongs to the caller.
+func isSelf(r *http.Request, name string) bool {
+    s, ok := SessionFrom(r.Context())
+    return ok && !s.Env && s.User == name
+}
+
+func writeUserJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
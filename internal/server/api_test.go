@@ -0,0 +1,1373 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tmacphee13/NanachiGo/internal/db"
+	"github.com/Tmacphee13/NanachiGo/internal/login"
+	"github.com/Tmacphee13/NanachiGo/internal/login/oidctest"
+	"github.com/Tmacphee13/NanachiGo/internal/utils"
+)
+
+// apiFixture wires the real router to an in-memory store and the scripted
+// fake LLM, so every /api route can be driven without network access.
+type apiFixture struct {
+	t      *testing.T
+	srv    *httptest.Server
+	store  *db.MemoryStore
+	llm    *utils.FakeProvider
+	client *http.Client
+	suffix string
+	// force makes uploads regenerate papers already stored
+	force bool
+	// tags are sent with uploads when set
+	tags string
+}
+
+func newAPIFixture(t *testing.T) *apiFixture {
+	t.Helper()
+	store := db.NewMemoryStore()
+	llm := utils.NewFakeProvider()
+	db.RegisterStore("e2e", store)
+	utils.RegisterProvider("fake", func(ctx context.Context) (utils.LLMProvider, error) { return llm, nil })
+	t.Setenv("LLM_PROVIDER", "fake")
+	t.Setenv("ADMIN_PASSWORD", testAdminPassword)
+	t.Setenv("USERS_PLATFORM", "e2e")
+
+	// the address is known before New reads the environment, so SSO can be
+	// pointed at the fixture's own callback
+	srv := httptest.NewUnstartedServer(nil)
+	t.Setenv("OIDC_REDIRECT_URL", "http://"+srv.Listener.Addr().String()+"/api/oidc/callback")
+	srv.Config.Handler = New().Router()
+	srv.Start()
+	t.Cleanup(srv.Close)
+	jar, _ := cookiejar.New(nil)
+	f := &apiFixture{t: t, srv: srv, store: store, llm: llm, client: &http.Client{Jar: jar}, suffix: "?platform=e2e"}
+	f.login()
+	return f
+}
+
+const testAdminPassword = "test-admin-password"
+
+// login signs the fixture's client in as the built-in admin, so its cookie
+// jar carries a session.
+func (f *apiFixture) login() {
+	f.t.Helper()
+	f.loginAs("", testAdminPassword)
+}
+
+// loginAs replaces the fixture client's session with username's.
+func (f *apiFixture) loginAs(username, password string) {
+	f.t.Helper()
+	b, _ := json.Marshal(login.LoginRequest{Username: username, Password: password})
+	resp, err := f.client.Post(f.srv.URL+"/api/login", "application/json", bytes.NewReader(b))
+	if err != nil {
+		f.t.Fatalf("login: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		f.t.Fatalf("login: expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func (f *apiFixture) do(method, path string, body io.Reader, contentType string) (*http.Response, map[string]interface{}) {
+	f.t.Helper()
+	url := f.srv.URL + path + f.suffix
+	if strings.Contains(path, "?") {
+		url = f.srv.URL + path + "&" + strings.TrimPrefix(f.suffix, "?")
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		f.t.Fatalf("build %s %s: %v", method, path, err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		f.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	var out map[string]interface{}
+	json.Unmarshal(raw, &out)
+	return resp, out
+}
+
+func (f *apiFixture) postJSON(path string, payload interface{}) (*http.Response, map[string]interface{}) {
+	f.t.Helper()
+	b, _ := json.Marshal(payload)
+	return f.do(http.MethodPost, path, bytes.NewReader(b), "application/json")
+}
+
+func (f *apiFixture) upload(fixture string) (*http.Response, map[string]interface{}) {
+	f.t.Helper()
+	pdf, err := os.ReadFile(fixture)
+	if err != nil {
+		f.t.Fatalf("read fixture: %v", err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("pdf", "paper.pdf")
+	fw.Write(pdf)
+	if f.force {
+		mw.WriteField("force", "true")
+	}
+	if f.tags != "" {
+		mw.WriteField("tags", f.tags)
+	}
+	mw.Close()
+	return f.do(http.MethodPost, "/api/upload", &body, mw.FormDataContentType())
+}
+
+// waitForUpload uploads fixture, expects 202 and polls the job until it
+// finishes, returning its final state.
+func (f *apiFixture) waitForUpload(fixture string) utils.Job {
+	f.t.Helper()
+	resp, out := f.upload(fixture)
+	if resp.StatusCode != http.StatusAccepted {
+		f.t.Fatalf("upload: expected 202, got %d (%v)", resp.StatusCode, out)
+	}
+	jobID, _ := out["jobId"].(string)
+	if jobID == "" || resp.Header.Get("Location") != "/api/jobs/"+jobID {
+		f.t.Fatalf("upload: missing job id or Location in %v", out)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := f.client.Get(f.srv.URL + "/api/jobs/" + jobID)
+		if err != nil {
+			f.t.Fatalf("job status: %v", err)
+		}
+		var job utils.Job
+		json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			f.t.Fatalf("job status: expected 200, got %d", resp.StatusCode)
+		}
+		if job.Status == utils.JobDone || job.Status == utils.JobFailed {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.t.Fatalf("job %s did not finish", jobID)
+	return utils.Job{}
+}
+
+// uploadMindmap uploads fixture and returns the id of the mind map its job created.
+func (f *apiFixture) uploadMindmap(fixture string) string {
+	f.t.Helper()
+	job := f.waitForUpload(fixture)
+	if job.Status != utils.JobDone || job.MindmapID == "" || job.Percent != 100 {
+		f.t.Fatalf("upload job did not succeed: %+v", job)
+	}
+	return job.MindmapID
+}
+
+// list walks every page of the listing and fetches each map in full, as the
+// library page does.
+func (f *apiFixture) list() []db.MindmapItem {
+	f.t.Helper()
+	get := func(path string, v interface{}) {
+		f.t.Helper()
+		resp, err := f.client.Get(f.srv.URL + path)
+		if err != nil {
+			f.t.Fatalf("list: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			f.t.Fatalf("list: GET %s: expected 200, got %d", path, resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			f.t.Fatalf("list: decode: %v", err)
+		}
+	}
+	items := []db.MindmapItem{}
+	cursor := ""
+	for {
+		var page db.ListPage
+		path := "/api/mindmaps" + f.suffix
+		if cursor != "" {
+			path += "&cursor=" + url.QueryEscape(cursor)
+		}
+		get(path, &page)
+		for _, s := range page.Items {
+			var item db.MindmapItem
+			get("/api/mindmaps/"+s.ID+f.suffix, &item)
+			items = append(items, item)
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			return items
+		}
+	}
+}
+
+func TestUploadAndNodeActionsEndToEnd(t *testing.T) {
+	f := newAPIFixture(t)
+
+	id := f.uploadMindmap("testdata/paper.pdf")
+
+	items := f.list()
+	if len(items) != 1 || items[0].ID != id {
+		t.Fatalf("list: expected the uploaded mindmap, got %+v", items)
+	}
+	if items[0].Title != "A Fake Paper" || len(items[0].Authors) != 2 {
+		t.Fatalf("list: metadata not stored: %+v", items[0])
+	}
+	stored, _ := f.store.Get(context.Background(), id)
+	if !bytes.Contains([]byte(stored.PlainText()), []byte("scripted fake model")) {
+		t.Fatalf("pdf text not extracted: %+v", stored.PageTexts)
+	}
+	if stored.PDFText != "" {
+		t.Fatal("the text should only be stored per page")
+	}
+	if len(stored.PageTexts) != 2 || stored.PageTexts[1].Page != 2 {
+		t.Fatalf("per-page text not stored: %+v", stored.PageTexts)
+	}
+	if mm := f.llm.Calls()[1]; !strings.Contains(mm.Prompt, "--- Page 2 ---\n\n2 Method") {
+		t.Fatalf("mindmap prompt was not page-marked: %q", mm.Prompt)
+	}
+
+	// redo-description on the first child
+	introPath := []interface{}{"children", 0}
+	resp, out := f.postJSON("/api/mindmaps/"+id+"/redo-description", map[string]interface{}{
+		"nodePath": introPath,
+		"nodeData": map[string]interface{}{"name": "Introduction"},
+	})
+	if resp.StatusCode != http.StatusOK || out["newTooltip"] != "A freshly rewritten explanation." {
+		t.Fatalf("redo-description: got %d %v", resp.StatusCode, out)
+	}
+
+	// remake-subtree on the second child
+	methodPath := []interface{}{"children", 1}
+	resp, out = f.postJSON("/api/mindmaps/"+id+"/remake-subtree", map[string]interface{}{
+		"nodePath": methodPath,
+		"nodeData": map[string]interface{}{"name": "Method"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("remake-subtree: got %d %v", resp.StatusCode, out)
+	}
+	if kids, _ := out["newChildren"].([]interface{}); len(kids) != 1 {
+		t.Fatalf("remake-subtree: expected 1 new child, got %v", out["newChildren"])
+	}
+
+	// go-deeper on the remade child
+	resp, out = f.postJSON("/api/mindmaps/"+id+"/go-deeper", map[string]interface{}{
+		"nodePath": []interface{}{"children", 1, "children", 0},
+		"nodeData": map[string]interface{}{"name": "Remade child"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("go-deeper: got %d %v", resp.StatusCode, out)
+	}
+	if kids, _ := out["newChildren"].([]interface{}); len(kids) != 2 {
+		t.Fatalf("go-deeper: expected 2 new children, got %v", out["newChildren"])
+	}
+
+	// every mutation must have been persisted
+	item, err := f.store.Get(context.Background(), id)
+	if err != nil || item == nil {
+		t.Fatalf("store get: %v", err)
+	}
+	children := item.MindmapData["children"].([]interface{})
+	intro := children[0].(map[string]interface{})
+	if intro["tooltip"] != "A freshly rewritten explanation." {
+		t.Fatalf("persisted tooltip not updated: %v", intro)
+	}
+	method := children[1].(map[string]interface{})
+	remade := method["children"].([]interface{})[0].(map[string]interface{})
+	if remade["name"] != "Remade child" || len(remade["children"].([]interface{})) != 2 {
+		t.Fatalf("persisted subtree not updated: %v", method)
+	}
+
+	// the fake saw one call per pipeline step, in order
+	var ops []string
+	for _, c := range f.llm.Calls() {
+		ops = append(ops, c.Operation)
+	}
+	want := []string{utils.OpMetadata, utils.OpMindmap, utils.OpRedoDescription, utils.OpRemakeSubtree, utils.OpGoDeeper}
+	if len(ops) != len(want) {
+		t.Fatalf("expected LLM calls %v, got %v", want, ops)
+	}
+	for i := range want {
+		if ops[i] != want[i] {
+			t.Fatalf("expected LLM calls %v, got %v", want, ops)
+		}
+	}
+
+	// delete, then confirm it is gone
+	resp, _ = f.do(http.MethodDelete, "/api/mindmaps/"+id, nil, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete: expected 200, got %d", resp.StatusCode)
+	}
+	if items := f.list(); len(items) != 0 {
+		t.Fatalf("expected empty list after delete, got %d items", len(items))
+	}
+	resp, _ = f.do(http.MethodDelete, "/api/mindmaps/"+id, nil, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("second delete: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestNodeActionErrors(t *testing.T) {
+	f := newAPIFixture(t)
+	id := f.uploadMindmap("testdata/paper.pdf")
+
+	resp, _ := f.postJSON("/api/mindmaps/does-not-exist/redo-description", map[string]interface{}{
+		"nodePath": []interface{}{"children", 0},
+		"nodeData": map[string]interface{}{"name": "x"},
+	})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown mindmap: expected 404, got %d", resp.StatusCode)
+	}
+
+	resp, _ = f.postJSON("/api/mindmaps/"+id+"/go-deeper", map[string]interface{}{
+		"nodePath": []interface{}{"children", 9},
+		"nodeData": map[string]interface{}{"name": "x"},
+	})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("bad node path: expected 404, got %d", resp.StatusCode)
+	}
+
+	resp, _ = f.do(http.MethodPost, "/api/mindmaps/"+id+"/remake-subtree", bytes.NewReader([]byte("not json")), "application/json")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad body: expected 400, got %d", resp.StatusCode)
+	}
+
+	f.suffix = "?platform=nowhere"
+	resp, _ = f.upload("testdata/paper.pdf")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown platform: expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestMalformedLLMOutputIsRepairedOrRejected(t *testing.T) {
+	f := newAPIFixture(t)
+	// numeric pages and a missing children array are repaired on upload
+	f.llm.Script(utils.OpMindmap, `{"name":"Root","tooltip":"t","section":"s","pages":1,"children":[{"name":"Leaf","pages":2}]}`)
+	id := f.uploadMindmap("testdata/paper.pdf")
+	item, _ := f.store.Get(context.Background(), id)
+	leaf := item.MindmapData["children"].([]interface{})[0].(map[string]interface{})
+	if leaf["pages"] != "2" {
+		t.Fatalf("numeric pages not normalized: %v", leaf)
+	}
+	if _, ok := leaf["children"].([]interface{}); !ok {
+		t.Fatalf("missing children not normalized: %v", leaf)
+	}
+
+	// a go-deeper reply without usable children is rejected and nothing is persisted
+	f.llm.Script(utils.OpGoDeeper, `{"children":"none"}`)
+	resp, _ := f.postJSON("/api/mindmaps/"+id+"/go-deeper", map[string]interface{}{
+		"nodePath": []interface{}{"children", 0},
+		"nodeData": map[string]interface{}{"name": "Leaf"},
+	})
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("go-deeper: expected 502, got %d", resp.StatusCode)
+	}
+	after, _ := f.store.Get(context.Background(), id)
+	if after.UpdatedAt != item.UpdatedAt {
+		t.Fatal("rejected go-deeper must not write to the store")
+	}
+
+	// an unsalvageable upload tree fails the job outright
+	f.llm.Script(utils.OpMindmap, `{"tooltip":"no name, no children"}`)
+	f.force = true
+	job := f.waitForUpload("testdata/paper.pdf")
+	if job.Status != utils.JobFailed || job.Error != "LLM returned a malformed mind map" || job.Stage != utils.StageMindmap {
+		t.Fatalf("upload: expected the job to fail at the mindmap stage, got %+v", job)
+	}
+	if items := f.list(); len(items) != 1 {
+		t.Fatalf("failed job must not store a mindmap, got %d items", len(items))
+	}
+}
+
+func TestNodeActionsByID(t *testing.T) {
+	f := newAPIFixture(t)
+	id := f.uploadMindmap("testdata/paper.pdf")
+	item, _ := f.store.Get(context.Background(), id)
+	method := item.MindmapData["children"].([]interface{})[1].(map[string]interface{})
+	methodID, _ := method["id"].(string)
+	if item.MindmapData["id"] == nil || methodID == "" {
+		t.Fatalf("generated nodes must carry ids: %v", item.MindmapData)
+	}
+
+	// remake by id, with a misleading path that must be ignored
+	resp, out := f.postJSON("/api/mindmaps/"+id+"/remake-subtree", map[string]interface{}{
+		"nodeId":   methodID,
+		"nodePath": []interface{}{"children", 0},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("remake-subtree by id: got %d %v", resp.StatusCode, out)
+	}
+	if prompt := f.llm.Calls()[len(f.llm.Calls())-1].Prompt; !strings.Contains(prompt, `topic: "`+method["name"].(string)+`"`) {
+		t.Fatalf("prompt should use the stored node's name: %q", prompt)
+	}
+	item, _ = f.store.Get(context.Background(), id)
+	children := item.MindmapData["children"].([]interface{})
+	if children[1].(map[string]interface{})["id"] != methodID {
+		t.Fatal("remade node must keep its id")
+	}
+	if _, ok := children[0].(map[string]interface{})["children"].([]interface{}); !ok || children[0].(map[string]interface{})["name"] != "Introduction" {
+		t.Fatalf("the node at nodePath must not be touched: %v", children[0])
+	}
+	staleID := method["children"].([]interface{})[0].(map[string]interface{})["id"].(string)
+
+	// the replaced child's id is gone: 404, and no LLM call is made
+	calls := len(f.llm.Calls())
+	resp, _ = f.postJSON("/api/mindmaps/"+id+"/go-deeper", map[string]interface{}{"nodeId": staleID})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("stale node id: expected 404, got %d", resp.StatusCode)
+	}
+	if len(f.llm.Calls()) != calls {
+		t.Fatal("stale node id must be rejected before calling the LLM")
+	}
+}
+
+func TestNodeIDBackfill(t *testing.T) {
+	f := newAPIFixture(t)
+	legacy := db.MindmapItem{
+		Title: "Legacy",
+		MindmapData: map[string]interface{}{
+			"name":     "Root",
+			"children": []interface{}{map[string]interface{}{"name": "Child", "children": []interface{}{}}},
+		},
+	}
+	id, err := f.store.Create(context.Background(), legacy)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	// reads never write, so they cannot cause a version conflict
+	for _, path := range []string{"/api/mindmaps", "/api/mindmaps/" + id} {
+		if resp, _ := f.do(http.MethodGet, path, nil, ""); resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %d", path, resp.StatusCode)
+		}
+	}
+	if stored, _ := f.store.Get(context.Background(), id); stored.Version != 0 || stored.MindmapData["id"] != nil {
+		t.Fatalf("a read must not change the map: %+v", stored)
+	}
+
+	if n, err := db.BackfillNodeIDs(context.Background(), f.store); n != 1 || err != nil {
+		t.Fatalf("backfill: got %d, %v", n, err)
+	}
+	if n, _ := db.BackfillNodeIDs(context.Background(), f.store); n != 0 {
+		t.Fatalf("a second backfill should find nothing to do, updated %d", n)
+	}
+	items := f.list()
+	child := items[0].MindmapData["children"].([]interface{})[0].(map[string]interface{})
+	childID, _ := child["id"].(string)
+	if childID == "" || items[0].Version != 1 {
+		t.Fatalf("backfilled ids must be persisted: %+v", items[0])
+	}
+	// the backfill is a change like any other, with the map before it kept
+	resp, out := f.do(http.MethodGet, "/api/mindmaps/"+id+"/revisions/diff?from=0&to=1", nil, "")
+	diff, _ := out["diff"].(map[string]interface{})
+	if added, _ := diff["added"].([]interface{}); resp.StatusCode != http.StatusOK || len(added) != 2 {
+		t.Fatalf("expected both nodes gaining ids between the baseline and the backfill, got %d %v", resp.StatusCode, out)
+	}
+	resp, out = f.postJSON("/api/mindmaps/"+id+"/redo-description", map[string]interface{}{"nodeId": childID})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("redo-description by backfilled id: got %d %v", resp.StatusCode, out)
+	}
+}
+
+// readEvents reads a Server-Sent Events stream until the server closes it.
+func readEvents(t *testing.T, body io.Reader) []utils.JobEvent {
+	t.Helper()
+	var events []utils.JobEvent
+	sc := bufio.NewScanner(body)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ev utils.JobEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+			t.Fatalf("bad event %q: %v", line, err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestUploadEventStream(t *testing.T) {
+	f := newAPIFixture(t)
+	resp, out := f.upload("testdata/paper.pdf")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("upload: expected 202, got %d", resp.StatusCode)
+	}
+	jobID := out["jobId"].(string)
+
+	stream, err := f.client.Get(f.srv.URL + "/api/jobs/" + jobID + "/events")
+	if err != nil {
+		t.Fatalf("events: %v", err)
+	}
+	defer stream.Body.Close()
+	if ct := stream.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+	events := readEvents(t, stream.Body)
+
+	// however late the client connects, it sees the last stage, all of the
+	// streamed text and the whole tree
+	var stage string
+	var text strings.Builder
+	var tree map[string]interface{}
+	for i, ev := range events {
+		if i > 0 && ev.ID <= events[i-1].ID {
+			t.Fatalf("event ids must count up, got %+v", events)
+		}
+		switch ev.Type {
+		case utils.EventStage:
+			stage = ev.Message
+		case utils.EventPartial:
+			text.WriteString(ev.Text)
+		case utils.EventTree:
+			if ev.Tree["name"] != "A Fake Paper" {
+				t.Fatalf("partial tree lost its root: %v", ev.Tree)
+			}
+			tree = ev.Tree
+		}
+	}
+	if !strings.Contains(stage, "Mind map generated") || !strings.Contains(text.String(), `"name":"Setup"`) {
+		t.Errorf("expected the last stage and all streamed text, got %q and %q", stage, text.String())
+	}
+	if raw, _ := json.Marshal(tree); !strings.Contains(string(raw), `"name":"Setup"`) {
+		t.Errorf("expected the finished tree, got %s", raw)
+	}
+	last := events[len(events)-1]
+	if last.Type != utils.EventDone || last.MindmapID == "" {
+		t.Fatalf("stream should end with done, got %+v", last)
+	}
+
+	// a reconnecting client only gets what it missed
+	req, _ := http.NewRequest(http.MethodGet, f.srv.URL+"/api/jobs/"+jobID+"/events", nil)
+	req.Header.Set("Last-Event-ID", fmt.Sprint(last.ID-1))
+	resumed, err := f.client.Do(req)
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	defer resumed.Body.Close()
+	if rest := readEvents(t, resumed.Body); len(rest) != 1 || rest[0].ID != last.ID {
+		t.Fatalf("expected only the final event on resume, got %+v", rest)
+	}
+
+	if resp, _ := f.do(http.MethodGet, "/api/jobs/missing/events", nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown job, got %d", resp.StatusCode)
+	}
+}
+
+func TestWritesRequireSession(t *testing.T) {
+	f := newAPIFixture(t)
+	id := f.uploadMindmap("testdata/paper.pdf")
+
+	anon := &http.Client{}
+	writes := []struct{ method, path string }{
+		{http.MethodPost, "/api/upload"},
+		{http.MethodDelete, "/api/mindmaps/" + id},
+		{http.MethodPost, "/api/mindmaps/" + id + "/redo-description"},
+		{http.MethodPost, "/api/mindmaps/" + id + "/remake-subtree"},
+		{http.MethodPost, "/api/mindmaps/" + id + "/go-deeper"},
+	}
+	for _, w := range writes {
+		req, _ := http.NewRequest(w.method, f.srv.URL+w.path+f.suffix, strings.NewReader(`{}`))
+		resp, err := anon.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", w.method, w.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s without a session: expected 401, got %d", w.method, w.path, resp.StatusCode)
+		}
+	}
+	if items := f.list(); len(items) != 1 {
+		t.Fatalf("rejected writes must not change the store, got %d items", len(items))
+	}
+
+	// a forged cookie is no better than none
+	req, _ := http.NewRequest(http.MethodDelete, f.srv.URL+"/api/mindmaps/"+id+f.suffix, nil)
+	req.AddCookie(&http.Cookie{Name: login.SessionCookie, Value: "eyJzdWIiOiJhZG1pbiIsImV4cCI6OTk5OTk5OTk5OX0.forged"})
+	if resp, _ := anon.Do(req); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("forged session: expected 401, got %d", resp.StatusCode)
+	}
+
+	// reads stay public by default
+	resp, err := anon.Get(f.srv.URL + "/api/mindmaps" + f.suffix)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("public read: expected 200, got %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+
+	// wrong password gets no session
+	resp, _ = anon.Post(f.srv.URL+"/api/login", "application/json", strings.NewReader(`{"password":"nope"}`))
+	if resp.StatusCode != http.StatusUnauthorized || len(resp.Cookies()) != 0 {
+		t.Fatalf("bad login: expected 401 without a cookie, got %d %v", resp.StatusCode, resp.Cookies())
+	}
+
+	// logging out drops the session
+	if resp, _ := f.postJSON("/api/logout", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("logout: expected 200, got %d", resp.StatusCode)
+	}
+	if resp, _ := f.do(http.MethodDelete, "/api/mindmaps/"+id, nil, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("after logout: expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestPrivateReads(t *testing.T) {
+	t.Setenv("PUBLIC_READS", "false")
+	f := newAPIFixture(t)
+	if resp, err := http.Get(f.srv.URL + "/api/mindmaps" + f.suffix); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("private read without a session: expected 401, got %v (%v)", resp, err)
+	}
+	// the fixture's signed-in client can still read
+	f.list()
+}
+
+func TestRoles(t *testing.T) {
+	f := newAPIFixture(t)
+	id := f.uploadMindmap("testdata/paper.pdf")
+	if item, _ := f.store.Get(context.Background(), id); item.Owner != "admin" || item.LastEditedBy != "admin" {
+		t.Fatalf("upload should record its owner, got owner=%q lastEditedBy=%q", item.Owner, item.LastEditedBy)
+	}
+
+	for _, u := range []login.UserRequest{
+		{Username: "erin", Password: "editor-password", Role: login.RoleEditor},
+		{Username: "vic", Password: "viewer-password", Role: login.RoleViewer},
+	} {
+		if resp, out := f.postJSON("/api/users", u); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create %s: expected 201, got %d %v", u.Username, resp.StatusCode, out)
+		}
+	}
+	if resp, _ := f.postJSON("/api/users", login.UserRequest{Username: "vic", Password: "another-password", Role: login.RoleViewer}); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("duplicate user: expected 409, got %d", resp.StatusCode)
+	}
+	if resp, _ := f.postJSON("/api/users", login.UserRequest{Username: "bad", Password: "long-enough", Role: "root"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown role: expected 400, got %d", resp.StatusCode)
+	}
+	resp, out := f.do(http.MethodGet, "/api/users", nil, "")
+	if resp.StatusCode != http.StatusOK || len(out["users"].([]interface{})) != 2 {
+		t.Fatalf("list users: got %d %v", resp.StatusCode, out)
+	}
+	if strings.Contains(fmt.Sprint(out), "$2a$") {
+		t.Fatal("password hashes must not be returned")
+	}
+
+	// viewers browse but cannot write
+	f.loginAs("vic", "viewer-password")
+	f.list()
+	if resp, _ := f.upload("testdata/paper.pdf"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("viewer upload: expected 403, got %d", resp.StatusCode)
+	}
+	if resp, _ := f.postJSON("/api/mindmaps/"+id+"/redo-description", map[string]interface{}{"nodePath": []interface{}{}}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("viewer node action: expected 403, got %d", resp.StatusCode)
+	}
+
+	// editors regenerate nodes but cannot delete papers or manage users
+	f.loginAs("erin", "editor-password")
+	if resp, out := f.postJSON("/api/mindmaps/"+id+"/redo-description", map[string]interface{}{"nodePath": []interface{}{"children", 0}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("editor node action: got %d %v", resp.StatusCode, out)
+	}
+	if item, _ := f.store.Get(context.Background(), id); item.Owner != "admin" || item.LastEditedBy != "erin" {
+		t.Fatalf("node action should record its editor, got owner=%q lastEditedBy=%q", item.Owner, item.LastEditedBy)
+	}
+	if resp, _ := f.do(http.MethodDelete, "/api/mindmaps/"+id, nil, ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("editor delete: expected 403, got %d", resp.StatusCode)
+	}
+	if resp, _ := f.do(http.MethodGet, "/api/users", nil, ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("editor listing users: expected 403, got %d", resp.StatusCode)
+	}
+
+	// a demotion applies to sessions already issued
+	f.login()
+	if resp, out := f.do(http.MethodPatch, "/api/users/erin", strings.NewReader(`{"role":"viewer"}`), "application/json"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("demote: got %d %v", resp.StatusCode, out)
+	}
+	f.loginAs("erin", "editor-password")
+	if resp, _ := f.postJSON("/api/mindmaps/"+id+"/go-deeper", map[string]interface{}{"nodePath": []interface{}{}}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("demoted editor: expected 403, got %d", resp.StatusCode)
+	}
+
+	f.login()
+	if resp, _ := f.do(http.MethodDelete, "/api/users/erin", nil, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete user: expected 200, got %d", resp.StatusCode)
+	}
+	if resp, _ := f.do(http.MethodDelete, "/api/users/erin", nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("delete missing user: expected 404, got %d", resp.StatusCode)
+	}
+	resp, _ = f.client.Post(f.srv.URL+"/api/login", "application/json", strings.NewReader(`{"username":"erin","password":"editor-password"}`))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("deleted user login: expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	f := newAPIFixture(t)
+	f.postJSON("/api/users", login.UserRequest{Username: "erin", Password: "editor-password", Role: login.RoleEditor})
+	f.loginAs("erin", "editor-password")
+
+	resp, out := f.postJSON("/api/tokens", login.TokenRequest{Name: "bulk upload"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create token: expected 201, got %d %v", resp.StatusCode, out)
+	}
+	token, _ := out["token"].(string)
+	tokenID, _ := out["info"].(map[string]interface{})["id"].(string)
+	if !strings.HasPrefix(token, "nng_") || tokenID == "" {
+		t.Fatalf("create token: unexpected reply %v", out)
+	}
+	resp, out = f.postJSON("/api/tokens", login.TokenRequest{Name: "too strong", Role: login.RoleAdmin})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("token above the caller's role: expected 403, got %d %v", resp.StatusCode, out)
+	}
+	resp, out = f.postJSON("/api/tokens", login.TokenRequest{Name: "read only", Role: login.RoleViewer})
+	viewerToken, _ := out["token"].(string)
+
+	// scripts send the token instead of a cookie
+	bearer := func(token, method, path string, body io.Reader, contentType string) int {
+		req, _ := http.NewRequest(method, f.srv.URL+path+f.suffix, body)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	pdf, _ := os.ReadFile("testdata/paper.pdf")
+	form := func() (io.Reader, string) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("pdf", "paper.pdf")
+		fw.Write(pdf)
+		mw.Close()
+		return &body, mw.FormDataContentType()
+	}
+	if body, ct := form(); bearer(token, http.MethodPost, "/api/upload", body, ct) != http.StatusAccepted {
+		t.Fatal("editor token should be able to upload")
+	}
+	if body, ct := form(); bearer(viewerToken, http.MethodPost, "/api/upload", body, ct) != http.StatusForbidden {
+		t.Fatal("viewer token must not upload")
+	}
+	if got := bearer(viewerToken, http.MethodGet, "/api/mindmaps", nil, ""); got != http.StatusOK {
+		t.Fatalf("viewer token read: expected 200, got %d", got)
+	}
+	// a bad token is rejected even where reads are public
+	if got := bearer("nng_0000_nope", http.MethodGet, "/api/mindmaps", nil, ""); got != http.StatusUnauthorized {
+		t.Fatalf("bad token read: expected 401, got %d", got)
+	}
+
+	resp, out = f.do(http.MethodGet, "/api/tokens", nil, "")
+	tokens, _ := out["tokens"].([]interface{})
+	if resp.StatusCode != http.StatusOK || len(tokens) != 2 {
+		t.Fatalf("list tokens: got %d %v", resp.StatusCode, out)
+	}
+	if strings.Contains(fmt.Sprint(out), token) || strings.Contains(fmt.Sprint(out), "hash") {
+		t.Fatal("listing must not reveal tokens or their hashes")
+	}
+	used := false
+	for _, tok := range tokens {
+		if m := tok.(map[string]interface{}); m["id"] == tokenID && m["lastUsedAt"] != nil {
+			used = true
+		}
+	}
+	if !used {
+		t.Fatalf("last use should be recorded: %v", tokens)
+	}
+
+	if resp, _ := f.do(http.MethodDelete, "/api/tokens/"+tokenID, nil, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoke: expected 200, got %d", resp.StatusCode)
+	}
+	if got := bearer(token, http.MethodGet, "/api/mindmaps", nil, ""); got != http.StatusUnauthorized {
+		t.Fatalf("revoked token: expected 401, got %d", got)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := oidctest.NewIssuer("nanachi", "client-secret")
+	defer issuer.Close()
+	t.Setenv("OIDC_ISSUER", issuer.URL)
+	t.Setenv("OIDC_CLIENT_ID", "nanachi")
+	t.Setenv("OIDC_CLIENT_SECRET", "client-secret")
+	t.Setenv("OIDC_ALLOWED_DOMAINS", "corp.example")
+	t.Setenv("OIDC_ROLE_MAP", "research=editor")
+	f := newAPIFixture(t)
+
+	// signIn runs the whole redirect flow in a fresh browser and returns
+	// where it ended up
+	signIn := func() (*http.Client, *url.URL) {
+		jar, _ := cookiejar.New(nil)
+		browser := &http.Client{Jar: jar}
+		resp, err := browser.Get(f.srv.URL + "/api/oidc/login?next=/api/session")
+		if err != nil {
+			t.Fatalf("sso login: %v", err)
+		}
+		resp.Body.Close()
+		return browser, resp.Request.URL
+	}
+
+	issuer.SetClaims(map[string]interface{}{"sub": "u-42", "email": "ann@corp.example", "email_verified": true, "groups": []string{"research"}})
+	browser, landed := signIn()
+	if landed.Path != "/api/session" {
+		t.Fatalf("sso login: expected to land on /api/session, got %s", landed)
+	}
+	resp, err := browser.Get(f.srv.URL + "/api/session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&session)
+	resp.Body.Close()
+	if session["authenticated"] != true || session["user"] != "ann@corp.example" || session["role"] != login.RoleEditor {
+		t.Fatalf("sso session: got %v", session)
+	}
+	if u, _ := f.store.GetUser(context.Background(), "ann@corp.example"); u == nil || u.Provider != "oidc" || u.Subject != "u-42" || u.PasswordHash != "" {
+		t.Fatalf("sso users should be provisioned without a password, got %+v", u)
+	}
+	// the same subject signs in to the same account again
+	if _, landed := signIn(); landed.Path != "/api/session" {
+		t.Fatalf("second sso login: expected /api/session, got %s", landed)
+	}
+
+	// the session works like any other: editors may upload
+	f.client = browser
+	if job := f.waitForUpload("testdata/paper.pdf"); job.Status != utils.JobDone {
+		t.Fatalf("sso editor upload: %+v", job)
+	}
+
+	issuer.SetClaims(map[string]interface{}{"sub": "u-7", "email": "mallory@else.example", "email_verified": true})
+	browser, landed = signIn()
+	if landed.Path != "/admin" || !strings.Contains(landed.Query().Get("sso_error"), "domain") {
+		t.Fatalf("disallowed domain: expected /admin with sso_error, got %s", landed)
+	}
+	for _, c := range browser.Jar.Cookies(landed) {
+		if c.Name == login.SessionCookie {
+			t.Fatal("a refused sign-in must not set a session")
+		}
+	}
+
+	// an SSO login never takes over a password account, or another subject's
+	f.store.CreateUser(context.Background(), db.User{Username: "bob@corp.example", PasswordHash: "hash", Role: login.RoleViewer})
+	for _, claims := range []map[string]interface{}{
+		{"sub": "u-9", "email": "bob@corp.example", "email_verified": true, "groups": []string{"research"}},
+		{"sub": "u-10", "email": "ann@corp.example", "email_verified": true},
+	} {
+		issuer.SetClaims(claims)
+		if _, landed := signIn(); landed.Path != "/admin" || !strings.Contains(landed.Query().Get("sso_error"), "already exists") {
+			t.Fatalf("taken username %v: expected sso_error, got %s", claims["email"], landed)
+		}
+	}
+	if u, _ := f.store.GetUser(context.Background(), "bob@corp.example"); u.Provider != "" || u.Role != login.RoleViewer {
+		t.Fatalf("the password account must be left alone, got %+v", u)
+	}
+
+	// without the state cookie the callback is refused
+	resp, err = http.Get(f.srv.URL + "/api/oidc/callback?code=x&state=y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.Query().Get("sso_error") == "" {
+		t.Fatalf("callback without state: expected sso_error, got %s", resp.Request.URL)
+	}
+}
+
+func TestNodeActionRateLimit(t *testing.T) {
+	t.Setenv("NODE_ACTION_RATE_LIMIT", "1/h")
+	t.Setenv("NODE_ACTION_RATE_BURST", "2")
+	f := newAPIFixture(t)
+	id := f.uploadMindmap("testdata/paper.pdf")
+
+	redo := func() *http.Response {
+		resp, _ := f.postJSON("/api/mindmaps/"+id+"/redo-description", map[string]interface{}{"nodePath": []interface{}{"children", 0}})
+		return resp
+	}
+	for i := 0; i < 2; i++ {
+		if resp := redo(); resp.StatusCode != http.StatusOK {
+			t.Fatalf("node action %d: expected 200, got %d", i+1, resp.StatusCode)
+		}
+	}
+	calls := len(f.llm.Calls())
+	resp, out := f.postJSON("/api/mindmaps/"+id+"/go-deeper", map[string]interface{}{"nodePath": []interface{}{"children", 0}})
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("over budget: expected 429 with Retry-After, got %d %v", resp.StatusCode, out)
+	}
+	if len(f.llm.Calls()) != calls {
+		t.Fatal("a limited request must not reach the LLM")
+	}
+	// uploads have their own budget
+	f.force = true
+	if job := f.waitForUpload("testdata/paper.pdf"); job.Status != utils.JobDone {
+		t.Fatalf("upload after node actions ran out: %+v", job)
+	}
+}
+
+func TestUsageReport(t *testing.T) {
+	f := newAPIFixture(t)
+	id := f.uploadMindmap("testdata/paper.pdf")
+	if resp, out := f.postJSON("/api/users", login.UserRequest{Username: "erin", Password: "editor-password", Role: login.RoleEditor}); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create editor: got %d %v", resp.StatusCode, out)
+	}
+	f.loginAs("erin", "editor-password")
+	if resp, out := f.postJSON("/api/mindmaps/"+id+"/go-deeper", map[string]interface{}{"nodePath": []interface{}{"children", 0}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("go-deeper: got %d %v", resp.StatusCode, out)
+	}
+	if resp, _ := f.do(http.MethodGet, "/api/admin/usage", nil, ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("editor reading usage: expected 403, got %d", resp.StatusCode)
+	}
+
+	f.login()
+	resp, err := f.client.Get(f.srv.URL + "/api/admin/usage?platform=e2e&from=2000-01-01")
+	if err != nil {
+		t.Fatalf("usage: %v", err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Usage utils.UsageReport `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("usage: got %d (%v)", resp.StatusCode, err)
+	}
+	report := out.Usage
+	// metadata and mindmap for the upload, then one go-deeper
+	if report.Total.Calls != 3 || report.Total.InputTokens == 0 || report.Total.OutputTokens == 0 {
+		t.Fatalf("unexpected total %+v", report.Total)
+	}
+	if len(report.ByMindmap) != 1 || report.ByMindmap[0].Key != id || report.ByMindmap[0].Title != "A Fake Paper" {
+		t.Fatalf("expected all calls billed to the paper, got %+v", report.ByMindmap)
+	}
+	users := map[string]int{}
+	for _, u := range report.ByUser {
+		users[u.Key] = u.Calls
+	}
+	if users["admin"] != 2 || users["erin"] != 1 {
+		t.Fatalf("unexpected per-user calls %v", users)
+	}
+	if len(report.ByOperation) != 3 {
+		t.Fatalf("expected metadata, mindmap and go-deeper, got %+v", report.ByOperation)
+	}
+
+	resp, err = f.client.Get(f.srv.URL + "/api/admin/usage?from=nope")
+	if err != nil {
+		t.Fatalf("usage: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad bound: expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestBudgets(t *testing.T) {
+	// a thousandth of a dollar per token makes every fake call cost something
+	t.Setenv("LLM_PRICES", "fake=1000/1000")
+	t.Setenv("LLM_BUDGET_MONTHLY_USD", "")
+	t.Setenv("LLM_BUDGET_USER_MONTHLY_USD", "")
+	f := newAPIFixture(t)
+	id := f.uploadMindmap("testdata/paper.pdf")
+	records, _ := f.store.ListUsage(context.Background(), "", "")
+	spent := 0.0
+	for _, rec := range records {
+		spent += rec.CostUSD
+	}
+	if spent == 0 {
+		t.Fatal("expected the upload to cost something")
+	}
+
+	// past the soft threshold the reply carries a warning
+	t.Setenv("LLM_BUDGET_USER_MONTHLY_USD", fmt.Sprint(spent*1.1))
+	action := map[string]interface{}{"nodePath": []interface{}{"children", 0}}
+	resp, out := f.postJSON("/api/mindmaps/"+id+"/redo-description", action)
+	if resp.StatusCode != http.StatusOK || out["budgetWarning"] == nil {
+		t.Fatalf("soft limit: expected 200 with a warning, got %d %v", resp.StatusCode, out)
+	}
+
+	// past the hard limit nothing reaches the LLM
+	calls := len(f.llm.Calls())
+	resp, out = f.postJSON("/api/mindmaps/"+id+"/go-deeper", action)
+	if resp.StatusCode != http.StatusPaymentRequired || !strings.Contains(fmt.Sprint(out["message"]), "budget") {
+		t.Fatalf("hard limit: expected 402 with a message, got %d %v", resp.StatusCode, out)
+	}
+	f.force = true
+	if resp, _ := f.upload("testdata/paper.pdf"); resp.StatusCode != http.StatusPaymentRequired {
+		t.Fatalf("upload over budget: expected 402, got %d", resp.StatusCode)
+	}
+	if len(f.llm.Calls()) != calls {
+		t.Fatal("a request over budget must not reach the LLM")
+	}
+
+	// the team budget applies on its own
+	t.Setenv("LLM_BUDGET_USER_MONTHLY_USD", "")
+	t.Setenv("LLM_BUDGET_MONTHLY_USD", fmt.Sprint(spent))
+	if resp, _ := f.postJSON("/api/mindmaps/"+id+"/go-deeper", action); resp.StatusCode != http.StatusPaymentRequired {
+		t.Fatalf("global limit: expected 402, got %d", resp.StatusCode)
+	}
+	t.Setenv("LLM_BUDGET_MONTHLY_USD", "")
+	if resp, out := f.postJSON("/api/mindmaps/"+id+"/go-deeper", action); resp.StatusCode != http.StatusOK || out["budgetWarning"] != nil {
+		t.Fatalf("no budget: expected 200 without a warning, got %d %v", resp.StatusCode, out)
+	}
+}
+
+func TestDuplicateUploads(t *testing.T) {
+	f := newAPIFixture(t)
+	id := f.uploadMindmap("testdata/paper.pdf")
+	item, _ := f.store.Get(context.Background(), id)
+	if len(item.ContentHash) != 64 {
+		t.Fatalf("expected a SHA-256 content hash, got %q", item.ContentHash)
+	}
+
+	calls := len(f.llm.Calls())
+	resp, out := f.upload("testdata/paper.pdf")
+	if resp.StatusCode != http.StatusOK || out["duplicate"] != true || out["mindmapId"] != id {
+		t.Fatalf("duplicate: expected 200 with the existing id, got %d %v", resp.StatusCode, out)
+	}
+	if len(f.llm.Calls()) != calls || len(f.list()) != 1 {
+		t.Fatal("a duplicate upload must not call the LLM or store anything")
+	}
+
+	f.force = true
+	if job := f.waitForUpload("testdata/paper.pdf"); job.Status != utils.JobDone || job.MindmapID == id {
+		t.Fatalf("forced upload: expected a new mind map, got %+v", job)
+	}
+	if len(f.list()) != 2 {
+		t.Fatal("forced upload should store a second mind map")
+	}
+}
+
+// racingStore makes another write land just before each of the next races
+// conditional updates, as if a second user acted at the same moment.
+type racingStore struct {
+	*db.MemoryStore
+	races int
+}
+
+func (s *racingStore) UpdateIfVersion(ctx context.Context, id string, version int, updates map[string]interface{}) error {
+	if s.races > 0 {
+		s.races--
+		item, _ := s.Get(ctx, id)
+		intro := item.MindmapData["children"].([]interface{})[0].(map[string]interface{})
+		intro["tooltip"] = "Edited elsewhere."
+		s.Update(ctx, id, map[string]interface{}{"mindmapData": item.MindmapData})
+	}
+	return s.MemoryStore.UpdateIfVersion(ctx, id, version, updates)
+}
+
+func TestConcurrentNodeActions(t *testing.T) {
+	f := newAPIFixture(t)
+	id := f.uploadMindmap("testdata/paper.pdf")
+	racing := &racingStore{MemoryStore: f.store}
+	db.RegisterStore("e2e", racing)
+	item, _ := f.store.Get(context.Background(), id)
+	method := item.MindmapData["children"].([]interface{})[1].(map[string]interface{})
+
+	// lost race by id: the change is reapplied on top of the other write
+	racing.races = 1
+	resp, out := f.postJSON("/api/mindmaps/"+id+"/go-deeper", map[string]interface{}{"nodeId": method["id"]})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("go-deeper after a lost race: got %d %v", resp.StatusCode, out)
+	}
+	item, _ = f.store.Get(context.Background(), id)
+	children := item.MindmapData["children"].([]interface{})
+	if children[0].(map[string]interface{})["tooltip"] != "Edited elsewhere." {
+		t.Fatal("the concurrent edit must survive")
+	}
+	if kids := children[1].(map[string]interface{})["children"].([]interface{}); len(kids) != 2 {
+		t.Fatalf("expected the deeper children saved too, got %v", kids)
+	}
+	if int(out["version"].(float64)) != item.Version {
+		t.Fatalf("expected version %d in the reply, got %v", item.Version, out["version"])
+	}
+
+	// losing every retry gives up with 409 and the current version
+	racing.races = 10
+	resp, out = f.postJSON("/api/mindmaps/"+id+"/redo-description", map[string]interface{}{"nodeId": method["id"]})
+	item, _ = f.store.Get(context.Background(), id)
+	if resp.StatusCode != http.StatusConflict || int(out["currentVersion"].(float64)) != item.Version {
+		t.Fatalf("expected 409 with version %d, got %d %v", item.Version, resp.StatusCode, out)
+	}
+
+	// a path may point elsewhere after another write, so it is not retried
+	racing.races = 1
+	resp, _ = f.postJSON("/api/mindmaps/"+id+"/redo-description", map[string]interface{}{"nodePath": []interface{}{"children", 1}})
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("path-addressed action after a lost race: expected 409, got %d", resp.StatusCode)
+	}
+
+	// an undo that loses a race re-checks the node, so the other write survives
+	intro := children[0].(map[string]interface{})
+	if resp, out := f.postJSON("/api/mindmaps/"+id+"/redo-description", map[string]interface{}{"nodeId": intro["id"]}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("redo-description: got %d %v", resp.StatusCode, out)
+	}
+	racing.races = 1
+	resp, out = f.postJSON("/api/mindmaps/"+id+"/undo", nil)
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(out["message"].(string), "changed that node") {
+		t.Fatalf("undo after a lost race: expected 409, got %d %v", resp.StatusCode, out)
+	}
+	item, _ = f.store.Get(context.Background(), id)
+	if utils.FindNodeByID(item.MindmapData, intro["id"].(string))["tooltip"] != "Edited elsewhere." {
+		t.Fatal("the concurrent edit must not be undone")
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	f := newAPIFixture(t)
+	id := f.uploadMindmap("testdata/paper.pdf")
+	item, _ := f.store.Get(context.Background(), id)
+	method := item.MindmapData["children"].([]interface{})[1].(map[string]interface{})
+	setupID := method["children"].([]interface{})[0].(map[string]interface{})["id"].(string)
+
+	resp, out := f.postJSON("/api/mindmaps/"+id+"/remake-subtree", map[string]interface{}{"nodeId": method["id"]})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("remake-subtree: got %d %v", resp.StatusCode, out)
+	}
+
+	resp, out = f.do(http.MethodGet, "/api/mindmaps/"+id+"/revisions", nil, "")
+	revs, _ := out["revisions"].([]interface{})
+	if resp.StatusCode != http.StatusOK || len(revs) != 2 {
+		t.Fatalf("expected 2 revisions, got %d %v", resp.StatusCode, out)
+	}
+	remade := revs[1].(map[string]interface{})
+	if revs[0].(map[string]interface{})["operation"] != "upload" || remade["operation"] != "remake-subtree" || remade["nodeId"] != method["id"] || remade["actor"] != "admin" {
+		t.Fatalf("unexpected revisions %v", revs)
+	}
+	if _, ok := remade["mindmapData"]; ok {
+		t.Fatal("the list must not carry whole trees")
+	}
+
+	resp, out = f.do(http.MethodGet, "/api/mindmaps/"+id+"/revisions/diff?from=0&to=1", nil, "")
+	diff, _ := out["diff"].(map[string]interface{})
+	removed, _ := diff["removed"].([]interface{})
+	if resp.StatusCode != http.StatusOK || len(removed) != 1 || removed[0].(map[string]interface{})["id"] != setupID {
+		t.Fatalf("expected the old Setup node removed, got %d %v", resp.StatusCode, out)
+	}
+
+	// a past revision can be fetched whole and made current again
+	resp, out = f.do(http.MethodGet, "/api/mindmaps/"+id+"/revisions/0", nil, "")
+	if resp.StatusCode != http.StatusOK || out["revision"].(map[string]interface{})["mindmapData"] == nil {
+		t.Fatalf("get revision 0: got %d %v", resp.StatusCode, out)
+	}
+	resp, out = f.postJSON("/api/mindmaps/"+id+"/revisions/0/restore", nil)
+	if resp.StatusCode != http.StatusOK || out["version"].(float64) != 2 {
+		t.Fatalf("restore: got %d %v", resp.StatusCode, out)
+	}
+	item, _ = f.store.Get(context.Background(), id)
+	if utils.FindNodeByID(item.MindmapData, setupID) == nil || item.Version != 2 {
+		t.Fatalf("expected the original subtree back at version 2, got %+v", item)
+	}
+	_, out = f.do(http.MethodGet, "/api/mindmaps/"+id+"/revisions", nil, "")
+	revs = out["revisions"].([]interface{})
+	if last := revs[len(revs)-1].(map[string]interface{}); len(revs) != 3 || last["operation"] != "restore" || last["restoredFrom"] != float64(0) {
+		t.Fatalf("expected the restore recorded, got %v", revs)
+	}
+	if resp, _ := f.do(http.MethodGet, "/api/mindmaps/"+id+"/revisions/7", nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing revision: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestUndoRedo(t *testing.T) {
+	f := newAPIFixture(t)
+	id := f.uploadMindmap("testdata/paper.pdf")
+	if resp, out := f.postJSON("/api/users", login.UserRequest{Username: "erin", Password: "editor-password", Role: login.RoleEditor}); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create erin: got %d %v", resp.StatusCode, out)
+	}
+	item, _ := f.store.Get(context.Background(), id)
+	children := item.MindmapData["children"].([]interface{})
+	intro, method := children[0].(map[string]interface{}), children[1].(map[string]interface{})
+	setupID := method["children"].([]interface{})[0].(map[string]interface{})["id"].(string)
+	node := func(nodeID string) map[string]interface{} {
+		t.Helper()
+		item, _ := f.store.Get(context.Background(), id)
+		return utils.FindNodeByID(item.MindmapData, nodeID)
+	}
+	act := func(action string, nodeID interface{}) {
+		t.Helper()
+		if resp, out := f.postJSON("/api/mindmaps/"+id+"/"+action, map[string]interface{}{"nodeId": nodeID}); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got %d %v", action, resp.StatusCode, out)
+		}
+	}
+	undo := func(action string, want int) map[string]interface{} {
+		t.Helper()
+		resp, out := f.postJSON("/api/mindmaps/"+id+"/"+action, nil)
+		if resp.StatusCode != want {
+			t.Fatalf("%s: expected %d, got %d %v", action, want, resp.StatusCode, out)
+		}
+		return out
+	}
+
+	act("remake-subtree", method["id"])
+	act("go-deeper", intro["id"])
+
+	// erin has done nothing here yet, and her own edit leaves admin's alone
+	f.loginAs("erin", "editor-password")
+	undo("undo", http.StatusConflict)
+	act("redo-description", method["id"])
+
+	f.loginAs("", testAdminPassword)
+	out := undo("undo", http.StatusOK)
+	if out["operation"] != "go-deeper" || out["nodeId"] != intro["id"] || len(node(intro["id"].(string))["children"].([]interface{})) != 0 {
+		t.Fatalf("expected go-deeper undone first, got %v", out)
+	}
+	undo("undo", http.StatusOK)
+	if m := node(method["id"].(string)); utils.FindNodeByID(m, setupID) == nil || m["tooltip"] != "A freshly rewritten explanation." {
+		t.Fatalf("expected the old subtree back under erin's tooltip, got %v", m)
+	}
+	undo("undo", http.StatusConflict)
+	undo("redo", http.StatusOK)
+	if utils.FindNodeByID(node(method["id"].(string)), setupID) != nil {
+		t.Fatal("redo should put the remade subtree back")
+	}
+
+	// a branch someone else has since changed is never overwritten
+	f.loginAs("erin", "editor-password")
+	act("remake-subtree", method["id"])
+	f.loginAs("", testAdminPassword)
+	before := node(method["id"].(string))
+	out = undo("undo", http.StatusConflict)
+	if !strings.Contains(out["message"].(string), "changed that node") || fmt.Sprint(node(method["id"].(string))) != fmt.Sprint(before) {
+		t.Fatalf("expected a refusal that leaves the node alone, got %v", out)
+	}
+
+	_, out = f.do(http.MethodGet, "/api/mindmaps/"+id+"/revisions", nil, "")
+	revs := out["revisions"].([]interface{})
+	if undoRev := revs[4].(map[string]interface{}); undoRev["operation"] != "undo" || undoRev["reverts"] != float64(2) {
+		t.Fatalf("expected undos recorded with the version they revert, got %v", revs)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	f := newAPIFixture(t)
+	id := f.uploadMindmap("testdata/paper.pdf")
+	item, _ := f.store.Get(context.Background(), id)
+	rootID := item.MindmapData["id"].(string)
+
+	if resp, out := f.do(http.MethodDelete, "/api/mindmaps/"+id, nil, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete: got %d %v", resp.StatusCode, out)
+	}
+	if len(f.list()) != 0 {
+		t.Fatal("a trashed mind map must not be listed")
+	}
+	resp, out := f.do(http.MethodGet, "/api/trash", nil, "")
+	trash, _ := out["items"].([]interface{})
+	if resp.StatusCode != http.StatusOK || len(trash) != 1 {
+		t.Fatalf("expected one item in the trash, got %d %v", resp.StatusCode, out)
+	}
+	if entry := trash[0].(map[string]interface{}); entry["id"] != id || entry["deletedBy"] != "admin" || entry["purgeAt"] == nil {
+		t.Fatalf("unexpected trash entry %v", entry)
+	}
+	if resp, _ := f.postJSON("/api/mindmaps/"+id+"/redo-description", map[string]interface{}{"nodeId": rootID}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("node action on a trashed map: expected 404, got %d", resp.StatusCode)
+	}
+	for _, path := range []string{"/revisions", "/revisions/0", "/revisions/diff?from=0&to=0"} {
+		if resp, _ := f.do(http.MethodGet, "/api/mindmaps/"+id+path, nil, ""); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("history of a trashed map %s: expected 404, got %d", path, resp.StatusCode)
+		}
+	}
+
+	// the same paper uploaded again is not a duplicate of the trashed copy
+	other := f.uploadMindmap("testdata/paper.pdf")
+	if other == id {
+		t.Fatal("expected a new mind map for a paper whose copy is in the trash")
+	}
+
+	if resp, out := f.postJSON("/api/trash/"+id+"/restore", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("restore: got %d %v", resp.StatusCode, out)
+	}
+	if len(f.list()) != 2 {
+		t.Fatal("expected the restored mind map back in the list")
+	}
+	if resp, _ := f.postJSON("/api/trash/"+id+"/restore", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("restoring a live map: expected 404, got %d", resp.StatusCode)
+	}
+	if resp, _ := f.do(http.MethodDelete, "/api/trash/"+id, nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("purging a live map: expected 404, got %d", resp.StatusCode)
+	}
+
+	f.do(http.MethodDelete, "/api/mindmaps/"+id, nil, "")
+	if resp, out := f.do(http.MethodDelete, "/api/trash/"+id, nil, ""); resp.StatusCode != http.StatusOK || out["purged"] != float64(1) {
+		t.Fatalf("purge: got %d %v", resp.StatusCode, out)
+	}
+	if item, _ := f.store.Get(context.Background(), id); item != nil {
+		t.Fatal("expected the purged map gone from the store")
+	}
+	if resp, _ := f.do(http.MethodGet, "/api/mindmaps/"+id+"/revisions/0", nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the purged map's history gone, got %d", resp.StatusCode)
+	}
+
+	f.do(http.MethodDelete, "/api/mindmaps/"+other, nil, "")
+	if resp, out := f.do(http.MethodDelete, "/api/trash", nil, ""); resp.StatusCode != http.StatusOK || out["purged"] != float64(1) {
+		t.Fatalf("empty trash: got %d %v", resp.StatusCode, out)
+	}
+	if resp, _ := f.do(http.MethodDelete, "/api/mindmaps/"+other, nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("deleting a purged map: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestPagedList(t *testing.T) {
+	f := newAPIFixture(t)
+	f.tags = "nlp, reading-group"
+	id := f.uploadMindmap("testdata/paper.pdf")
+	ctx := context.Background()
+	f.store.Create(ctx, db.MindmapItem{ID: "older", Title: "Older", Authors: []string{"Grace Hopper"}, Date: "1969", CreatedAt: "2020-01-01T00:00:00Z"})
+	f.store.Create(ctx, db.MindmapItem{ID: "oldest", Title: "Oldest", CreatedAt: "2019-01-01T00:00:00Z"})
+
+	resp, out := f.do(http.MethodGet, "/api/mindmaps?limit=2", nil, "")
+	items, _ := out["items"].([]interface{})
+	cursor, _ := out["nextCursor"].(string)
+	if resp.StatusCode != http.StatusOK || len(items) != 2 || cursor == "" {
+		t.Fatalf("first page: got %d %v", resp.StatusCode, out)
+	}
+	first := items[0].(map[string]interface{})
+	if first["id"] != id || first["owner"] != "admin" || fmt.Sprint(first["tags"]) != "[nlp reading-group]" {
+		t.Fatalf("expected the upload first with its tags, got %v", first)
+	}
+	if _, ok := first["mindmapData"]; ok {
+		t.Fatal("summaries must not carry the tree")
+	}
+	if _, ok := first["pdfText"]; ok {
+		t.Fatal("summaries must not carry the PDF text")
+	}
+	resp, out = f.do(http.MethodGet, "/api/mindmaps?limit=2&cursor="+cursor, nil, "")
+	items, _ = out["items"].([]interface{})
+	if resp.StatusCode != http.StatusOK || len(items) != 1 || items[0].(map[string]interface{})["id"] != "oldest" || out["nextCursor"] != nil {
+		t.Fatalf("last page: got %d %v", resp.StatusCode, out)
+	}
+
+	_, out = f.do(http.MethodGet, "/api/mindmaps?tag=NLP", nil, "")
+	if items, _ := out["items"].([]interface{}); len(items) != 1 {
+		t.Fatalf("tag filter: got %v", out)
+	}
+	_, out = f.do(http.MethodGet, "/api/mindmaps?author=hopper&to=2020-12-31", nil, "")
+	if items, _ := out["items"].([]interface{}); len(items) != 1 || items[0].(map[string]interface{})["id"] != "older" {
+		t.Fatalf("author and paper date filter: got %v", out)
+	}
+	for _, bad := range []string{"?sort=size", "?limit=-1", "?cursor=garbage"} {
+		if resp, _ := f.do(http.MethodGet, "/api/mindmaps"+bad, nil, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", bad, resp.StatusCode)
+		}
+	}
+	// without listing parameters it is the first page of summaries
+	resp, out = f.do(http.MethodGet, "/api/mindmaps", nil, "")
+	if items, _ := out["items"].([]interface{}); resp.StatusCode != http.StatusOK || len(items) != 3 {
+		t.Fatalf("expected a page of all 3, got %d %v", resp.StatusCode, out)
+	}
+
+	resp, out = f.do(http.MethodGet, "/api/mindmaps/"+id, nil, "")
+	if resp.StatusCode != http.StatusOK || out["mindmapData"] == nil || out["pdfText"] != "" {
+		t.Fatalf("get one: expected the tree without the PDF text, got %d %v", resp.StatusCode, out)
+	}
+	if resp, _ := f.do(http.MethodGet, "/api/mindmaps/missing", nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("get missing: expected 404, got %d", resp.StatusCode)
+	}
+}
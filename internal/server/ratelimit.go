@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/Tmacphee13/NanachiGo/internal/login"
+)
+
+// RateLimiter gives every caller its own token bucket. Signed-in callers are
+// told apart by user, however they authenticate, so minting more API tokens
+// buys no more requests; anonymous ones, as on the sign-in route, by client
+// IP.
+type RateLimiter struct {
+	name  string
+	limit rate.Limit
+	burst int
+	// trustProxy takes the client IP from X-Forwarded-For.
+	trustProxy bool
+	now        func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	lim  *rate.Limiter
+	seen time.Time
+}
+
+// NewRateLimiter allows burst requests at once, refilled at perHour.
+func NewRateLimiter(name string, perHour float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		name:    name,
+		limit:   rate.Limit(perHour / 3600),
+		burst:   burst,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// rateLimiterFromEnv reads <prefix>_RATE_LIMIT as "N/s", "N/m" or "N/h" and
+// <prefix>_RATE_BURST. "off" disables the limiter, which returns nil.
+func rateLimiterFromEnv(name, prefix, defLimit string, defBurst int) *RateLimiter {
+	spec := strings.TrimSpace(os.Getenv(prefix + "_RATE_LIMIT"))
+	if spec == "" {
+		spec = defLimit
+	}
+	if strings.EqualFold(spec, "off") {
+		return nil
+	}
+	perHour, err := parseRate(spec)
+	if err != nil {
+		log.Printf("ratelimit: ignoring %s_RATE_LIMIT=%q: %v", prefix, spec, err)
+		perHour, _ = parseRate(defLimit)
+	}
+	burst := defBurst
+	if v := strings.TrimSpace(os.Getenv(prefix + "_RATE_BURST")); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			burst = n
+		} else {
+			log.Printf("ratelimit: ignoring %s_RATE_BURST=%q", prefix, v)
+		}
+	}
+	l := NewRateLimiter(name, perHour, burst)
+	l.trustProxy = envBool("TRUST_PROXY", false)
+	return l
+}
+
+// parseRate turns "N/s", "N/m" or "N/h" into requests per hour.
+func parseRate(spec string) (float64, error) {
+	count, unit, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, fmt.Errorf("want N/s, N/m or N/h")
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(count), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad count %q", count)
+	}
+	switch strings.TrimSpace(unit) {
+	case "s":
+		return n * 3600, nil
+	case "m":
+		return n * 60, nil
+	case "h":
+		return n, nil
+	}
+	return 0, fmt.Errorf("bad unit %q", unit)
+}
+
+// Wrap rejects requests over the caller's budget with 429 and Retry-After.
+// A nil limiter lets everything through.
+func (l *RateLimiter) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := l.key(r)
+		if wait := l.reserve(key); wait > 0 {
+			secs := int(math.Ceil(wait.Seconds()))
+			log.Printf("ratelimit: %s limit hit by %s", l.name, key)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":    false,
+				"message":    fmt.Sprintf("Too many %s requests; try again in %d seconds", l.name, secs),
+				"retryAfter": secs,
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// reserve takes a token from key's bucket, or returns how long until one
+// is available without taking it.
+func (l *RateLimiter) reserve(key string) time.Duration {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweepLocked(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{lim: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	b.seen = now
+	res := b.lim.ReserveN(now, 1)
+	if !res.OK() {
+		return time.Hour
+	}
+	if wait := res.DelayFrom(now); wait > 0 {
+		res.CancelAt(now)
+		return wait
+	}
+	return 0
+}
+
+// sweepLocked drops buckets idle long enough to have refilled completely,
+// at most once a minute.
+func (l *RateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.seen) > full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+func (l *RateLimiter) key(r *http.Request) string {
+	if s, ok := login.SessionFrom(r.Context()); ok {
+		return "user:" + s.User
+	}
+	return "ip:" + l.clientIP(r)
+}
+
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	if l.trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tmacphee13/NanachiGo/internal/login"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := NewRateLimiter("test", 60, 2) // one a minute, two at once
+	l.now = func() time.Time { return now }
+	h := l.Wrap(func(w http.ResponseWriter, r *http.Request) {})
+	call := func(s *login.Session, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/upload", nil)
+		req.RemoteAddr = remote
+		if s != nil {
+			req = req.WithContext(login.WithSession(req.Context(), *s))
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+	ann := &login.Session{User: "ann"}
+
+	for i := 0; i < 2; i++ {
+		if rec := call(ann, "10.0.0.1:1"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: got %d", i+1, rec.Code)
+		}
+	}
+	rec := call(ann, "10.0.0.1:1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("over the burst: expected 429 with Retry-After 60, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	// other users and anonymous IPs have their own buckets, but a user's
+	// API tokens share theirs
+	if rec := call(&login.Session{User: "bo"}, "10.0.0.1:1"); rec.Code != http.StatusOK {
+		t.Fatalf("another user: got %d", rec.Code)
+	}
+	if rec := call(&login.Session{User: "ann", Token: "t1"}, "10.0.0.3:1"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("a token of the same user: expected 429, got %d", rec.Code)
+	}
+	if rec := call(nil, "10.0.0.2:1"); rec.Code != http.StatusOK {
+		t.Fatalf("an anonymous IP: got %d", rec.Code)
+	}
+
+	// rejected requests do not spend tokens, so one minute refills one
+	now = now.Add(30 * time.Second)
+	if rec := call(ann, "10.0.0.1:1"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "30" {
+		t.Fatalf("half refilled: expected 429 with Retry-After 30, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	now = now.Add(30 * time.Second)
+	if rec := call(ann, "10.0.0.1:1"); rec.Code != http.StatusOK {
+		t.Fatalf("refilled: got %d", rec.Code)
+	}
+
+	var off *RateLimiter
+	rec = httptest.NewRecorder()
+	off.Wrap(func(w http.ResponseWriter, r *http.Request) {})(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatal("a nil limiter must let requests through")
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	t.Setenv("LOGIN_RATE_LIMIT", "1/h")
+	t.Setenv("LOGIN_RATE_BURST", "2")
+	h := New().Router()
+	attempt := func(remote string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"username":"admin","password":"wrong"}`))
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for i := 0; i < 2; i++ {
+		if code := attempt("10.0.0.1:1"); code == http.StatusTooManyRequests {
+			t.Fatalf("attempt %d within the burst was limited", i+1)
+		}
+	}
+	if code := attempt("10.0.0.1:1"); code != http.StatusTooManyRequests {
+		t.Fatalf("over the burst: expected 429, got %d", code)
+	}
+	if code := attempt("10.0.0.2:1"); code == http.StatusTooManyRequests {
+		t.Fatal("another IP must have its own budget")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for spec, want := range map[string]float64{"2/s": 7200, "30/m": 1800, "10/h": 10, "0.5/m": 30} {
+		if got, err := parseRate(spec); err != nil || got != want {
+			t.Errorf("parseRate(%q) = %v, %v; want %v", spec, got, err, want)
+		}
+	}
+	for _, bad := range []string{"10", "x/m", "10/d", "-1/h", "0/m"} {
+		if _, err := parseRate(bad); err == nil {
+			t.Errorf("parseRate(%q): expected an error", bad)
+		}
+	}
+}
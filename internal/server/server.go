@@ -2,12 +2,42 @@ package server
 
 import (
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Tmacphee13/NanachiGo/internal/db"
+	"github.com/Tmacphee13/NanachiGo/internal/login"
+	"github.com/Tmacphee13/NanachiGo/internal/utils"
 )
 
-type Server struct{}
+type Server struct {
+	// PublicReads lets GET requests through without a session or API
+	// token; every mutating /api route always requires one.
+	PublicReads bool
+	// OIDC handles single sign-on; nil when it is not configured.
+	OIDC *login.OIDC
+	// UploadLimit and NodeActionLimit budget the routes that call the LLM,
+	// per user; LoginLimit slows password guessing, per client IP. nil
+	// disables a limit.
+	UploadLimit     *RateLimiter
+	NodeActionLimit *RateLimiter
+	LoginLimit      *RateLimiter
+}
 
+// New reads PUBLIC_READS (default true), the OIDC_* settings and the
+// UPLOAD_RATE_*, NODE_ACTION_RATE_* and LOGIN_RATE_* limits.
 func New() *Server {
-	return &Server{}
+	s := &Server{
+		PublicReads:     envBool("PUBLIC_READS", true),
+		UploadLimit:     rateLimiterFromEnv("upload", "UPLOAD", "10/h", 5),
+		NodeActionLimit: rateLimiterFromEnv("node action", "NODE_ACTION", "60/h", 20),
+		LoginLimit:      rateLimiterFromEnv("sign-in", "LOGIN", "30/h", 10),
+	}
+	if cfg, ok := login.OIDCConfigFromEnv(); ok {
+		s.OIDC = login.NewOIDC(cfg)
+	}
+	return s
 }
 
 func (s *Server) Router() http.Handler {
@@ -16,11 +46,123 @@ func (s *Server) Router() http.Handler {
 	// serve static files from public
 	fs := http.FileServer(http.Dir("public"))
 	mux.Handle("/", fs)
+	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "./public/admin.html")
+	})
 
 	// Example API endpoint
 	mux.Handle("/api/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`{"Status":"ok"}`))
 	}))
 
+	mux.HandleFunc("/api/login", s.LoginLimit.Wrap(login.Login))
+	mux.HandleFunc("/api/logout", login.Logout)
+	mux.HandleFunc("/api/session", login.SessionStatus)
+	mux.HandleFunc("/api/oidc/", s.oidcRoutes)
+	mux.Handle("/api/mindmaps", s.guard(db.GetAllMindmaps))
+	// id-based routes and actions
+	mux.Handle("/api/mindmaps/", s.guard(s.mindmapRoutes))
+	mux.Handle("/api/upload", s.guard(requireRole(login.RoleEditor, s.UploadLimit.Wrap(utils.UploadPaper))))
+	mux.Handle("/api/jobs/", s.guard(jobRoutes))
+	mux.Handle("/api/users", s.guard(requireRole(login.RoleAdmin, login.UsersHandler)))
+	mux.Handle("/api/users/", s.guard(requireRole(login.RoleAdmin, login.UsersHandler)))
+	mux.Handle("/api/tokens", s.guard(requireRole(login.RoleViewer, login.TokensHandler)))
+	mux.Handle("/api/tokens/", s.guard(requireRole(login.RoleViewer, login.TokensHandler)))
+	mux.Handle("/api/trash", s.guard(requireRole(login.RoleAdmin, utils.TrashHandler)))
+	mux.Handle("/api/trash/", s.guard(requireRole(login.RoleAdmin, utils.TrashHandler)))
+	mux.Handle("/api/admin/usage", s.guard(requireRole(login.RoleAdmin, utils.UsageHandler)))
+
 	return mux
 }
+
+// guard requires a session for writes, and for reads unless they are public.
+func (s *Server) guard(h http.HandlerFunc) http.Handler {
+	return login.Guard(s.PublicReads, h)
+}
+
+// requireRole wraps h so only sessions with at least role reach it. It must
+// run inside guard, which attaches the session.
+func requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return login.Require(role, h).ServeHTTP
+}
+
+func envBool(name string, def bool) bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(name))) {
+	case "1", "true", "yes":
+		return true
+	case "0", "false", "no":
+		return false
+	}
+	return def
+}
+
+func (s *Server) mindmapRoutes(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	// history: reads follow the guard, restoring needs an editor
+	if _, rest, _ := strings.Cut(strings.TrimPrefix(path, "/api/mindmaps/"), "/"); rest == "revisions" || strings.HasPrefix(rest, "revisions/") {
+		if r.Method == http.MethodGet {
+			utils.RevisionsHandler(w, r)
+			return
+		}
+		requireRole(login.RoleEditor, utils.RevisionsHandler)(w, r)
+		return
+	}
+	// action subroutes
+	if r.Method == http.MethodPost {
+		switch {
+		case strings.HasSuffix(path, "/redo-description"):
+			requireRole(login.RoleEditor, s.NodeActionLimit.Wrap(utils.RedoDescriptionHandler))(w, r)
+			return
+		case strings.HasSuffix(path, "/remake-subtree"):
+			requireRole(login.RoleEditor, s.NodeActionLimit.Wrap(utils.RemakeSubtreeHandler))(w, r)
+			return
+		case strings.HasSuffix(path, "/go-deeper"):
+			requireRole(login.RoleEditor, s.NodeActionLimit.Wrap(utils.GoDeeperHandler))(w, r)
+			return
+		case strings.HasSuffix(path, "/undo"), strings.HasSuffix(path, "/redo"):
+			requireRole(login.RoleEditor, utils.UndoHandler)(w, r)
+			return
+		}
+	}
+	// GET /api/mindmaps/{id}
+	if r.Method == http.MethodGet {
+		db.GetMindmapHandler(w, r)
+		return
+	}
+	// DELETE /api/mindmaps/{id}
+	if r.Method == http.MethodDelete {
+		requireRole(login.RoleAdmin, utils.DeleteMindmapHandler)(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (s *Server) oidcRoutes(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/oidc/status":
+		// lets the admin page decide whether to offer single sign-on
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"enabled":` + strconv.FormatBool(s.OIDC != nil) + `}`))
+		return
+	case "/api/oidc/login":
+		if s.OIDC != nil {
+			s.OIDC.Login(w, r)
+			return
+		}
+	case "/api/oidc/callback":
+		if s.OIDC != nil {
+			s.OIDC.Callback(w, r)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func jobRoutes(w http.ResponseWriter, r *http.Request) {
+	// GET /api/jobs/{id}/events
+	if strings.HasSuffix(r.URL.Path, "/events") {
+		utils.JobEventsHandler(w, r)
+		return
+	}
+	utils.JobStatusHandler(w, r)
+}
@@ -0,0 +1,209 @@
+package utils
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+// ErrBudgetExceeded is matched by the *BudgetError an LLM call returns when
+// this month's spend has reached a hard budget.
+var ErrBudgetExceeded = errors.New("monthly LLM budget exceeded")
+
+// BudgetError says which budget stopped a call.
+type BudgetError struct {
+    Scope string // "global" or "user"
+    Spent float64
+    Limit float64
+}
+
+func (e *BudgetError) Error() string {
+    who := "The team's"
+    if e.Scope == "user" {
+        who = "Your"
+    }
+    return fmt.Sprintf("%s monthly LLM budget of $%.2f is used up ($%.2f spent); it resets on the 1st", who, e.Limit, e.Spent)
+}
+
+func (e *BudgetError) Unwrap() error { return ErrBudgetExceeded }
+
+// budgetConfig holds the hard limits in dollars per calendar month (UTC),
+// where zero means unlimited, and the share of a limit at which warnings
+// start.
+type budgetConfig struct {
+    global float64
+    user   float64
+    soft   float64
+}
+
+// budgetFromEnv reads LLM_BUDGET_MONTHLY_USD, LLM_BUDGET_USER_MONTHLY_USD and
+// LLM_BUDGET_SOFT_PERCENT (default 80).
+func budgetFromEnv() budgetConfig {
+    return budgetConfig{
+        global: envUSD("LLM_BUDGET_MONTHLY_USD"),
+        user:   envUSD("LLM_BUDGET_USER_MONTHLY_USD"),
+        soft:   float64(envInt("LLM_BUDGET_SOFT_PERCENT", 80)) / 100,
+    }
+}
+
+func envUSD(name string) float64 {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return 0
+    }
+    n, err := strconv.ParseFloat(v, 64)
+    if err != nil || n < 0 {
+        log.Printf("budget: ignoring %s=%q", name, v)
+        return 0
+    }
+    return n
+}
+
+// spendRefresh is how long cached monthly totals are trusted before being
+// reloaded, so spend recorded by other server processes is picked up.
+const spendRefresh = time.Minute
+
+// monthlySpend caches this month's spend in one usage store, overall and per
+// user. Calls made by this process are added as they are recorded.
+type monthlySpend struct {
+    mu     sync.Mutex
+    store  db.UsageStore
+    month  string
+    loaded time.Time
+    global float64
+    users  map[string]float64
+}
+
+var spend = &monthlySpend{}
+
+// monthBounds returns the RFC 3339 start of t's month and of the next.
+func monthBounds(t time.Time) (string, string) {
+    start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+    return start.Format(time.RFC3339), start.AddDate(0, 1, 0).Format(time.RFC3339)
+}
+
+// totals returns the spend so far this month overall and by user.
+func (m *monthlySpend) totals(ctx context.Context, user string) (float64, float64, error) {
+    now := time.Now().UTC()
+    from, to := monthBounds(now)
+    store, err := db.Usage()
+    if err != nil {
+        return 0, 0, err
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.store != store || m.month != from || now.Sub(m.loaded) > spendRefresh {
+        records, err := store.ListUsage(ctx, from, to)
+        if err != nil {
+            return 0, 0, err
+        }
+        m.store, m.month, m.loaded, m.global, m.users = store, from, now, 0, map[string]float64{}
+        for _, rec := range records {
+            m.global += rec.CostUSD
+            m.users[rec.User] += rec.CostUSD
+        }
+    }
+    return m.global, m.users[user], nil
+}
+
+// add counts a record this process just saved to store.
+func (m *monthlySpend) add(store db.UsageStore, rec db.UsageRecord) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.store != store || rec.Time < m.month {
+        return
+    }
+    m.global += rec.CostUSD
+    m.users[rec.User] += rec.CostUSD
+}
+
+// userBudget is user's own limit if an admin set one, else the default.
+func userBudget(ctx context.Context, user string, def float64) float64 {
+    if user == "" {
+        return def
+    }
+    users, err := db.Users()
+    if err != nil {
+        return def
+    }
+    u, err := users.GetUser(ctx, user)
+    if err != nil || u == nil || u.MonthlyBudgetUSD == 0 {
+        return def
+    }
+    return u.MonthlyBudgetUSD
+}
+
+// CheckBudget compares this month's spend with the global budget and user's
+// budget. It returns a *BudgetError once either is used up, or a warning
+// once either passes the soft threshold. If spend cannot be read the call is
+// let through, since accounting must never take the app down.
+func CheckBudget(ctx context.Context, user string) (string, error) {
+    cfg := budgetFromEnv()
+    userLimit := userBudget(ctx, user, cfg.user)
+    if cfg.global == 0 && userLimit == 0 {
+        return "", nil
+    }
+    global, mine, err := spend.totals(ctx, user)
+    if err != nil {
+        log.Printf("budget: cannot read this month's spend: %v", err)
+        return "", nil
+    }
+    var warnings []string
+    for _, b := range []BudgetError{{Scope: "global", Spent: global, Limit: cfg.global}, {Scope: "user", Spent: mine, Limit: userLimit}} {
+        if b.Limit == 0 || (b.Scope == "user" && user == "") {
+            continue
+        }
+        if b.Spent >= b.Limit {
+            return "", &b
+        }
+        if b.Spent >= b.Limit*cfg.soft {
+            who := "the team's"
+            if b.Scope == "user" {
+                who = "your"
+            }
+            warnings = append(warnings, fmt.Sprintf("%.0f%% of %s monthly LLM budget is used ($%.2f of $%.2f)", b.Spent/b.Limit*100, who, b.Spent, b.Limit))
+        }
+    }
+    if len(warnings) == 0 {
+        return "", nil
+    }
+    return strings.Join(warnings, "; "), nil
+}
+
+// enforceBudget is called at the top of every provider call, so no code path
+// can spend past a hard budget.
+func enforceBudget(ctx context.Context) error {
+    _, err := CheckBudget(ctx, UsageTagsFrom(ctx).User)
+    return err
+}
+
+// llmFailure is the error shown to users for a failed LLM step: budget
+// errors explain themselves, anything else gets msg.
+func llmFailure(err error, msg string) error {
+    var be *BudgetError
+    if errors.As(err, &be) {
+        return be
+    }
+    return errors.New(msg)
+}
+
+// writeBudgetError refuses a request whose caller is out of budget with 402.
+func writeBudgetError(w http.ResponseWriter, err error) {
+    var be *BudgetError
+    if errors.As(err, &be) {
+        err = be
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusPaymentRequired)
+    json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": err.Error()})
+}
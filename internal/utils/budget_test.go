@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+func TestCheckBudget(t *testing.T) {
+	store := db.NewMemoryStore()
+	db.RegisterStore("budget-test", store)
+	t.Setenv("USERS_PLATFORM", "budget-test")
+	t.Setenv("LLM_BUDGET_MONTHLY_USD", "")
+	t.Setenv("LLM_BUDGET_USER_MONTHLY_USD", "10")
+	t.Setenv("LLM_BUDGET_SOFT_PERCENT", "")
+	ctx := context.Background()
+	now := time.Now().UTC()
+	lastMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Add(-time.Hour)
+	for _, rec := range []db.UsageRecord{
+		{ID: "r1", Time: now.Format(time.RFC3339), User: "erin", CostUSD: 8.5},
+		{ID: "r2", Time: now.Format(time.RFC3339), User: "vic", CostUSD: 2},
+		{ID: "r3", Time: lastMonth.Format(time.RFC3339), User: "vic", CostUSD: 100},
+	} {
+		store.RecordUsage(ctx, rec)
+	}
+
+	// last month's spend does not count
+	if warning, err := CheckBudget(ctx, "vic"); err != nil || warning != "" {
+		t.Fatalf("vic: expected no warning, got %q (%v)", warning, err)
+	}
+	warning, err := CheckBudget(ctx, "erin")
+	if err != nil || !strings.Contains(warning, "85%") {
+		t.Fatalf("erin: expected a soft warning, got %q (%v)", warning, err)
+	}
+
+	// an admin-set budget replaces the default
+	store.CreateUser(ctx, db.User{Username: "erin", Role: "editor", MonthlyBudgetUSD: 8})
+	_, err = CheckBudget(ctx, "erin")
+	var be *BudgetError
+	if !errors.As(err, &be) || be.Scope != "user" || be.Limit != 8 {
+		t.Fatalf("erin: expected her own budget to be exceeded, got %v", err)
+	}
+
+	// the team budget stops everyone, and the providers enforce it themselves
+	t.Setenv("LLM_BUDGET_MONTHLY_USD", "10")
+	llm := NewFakeProvider()
+	tagged := WithUsageTags(WithOperation(ctx, OpGoDeeper), UsageTags{User: "vic"})
+	if _, err := llm.CompleteJSON(tagged, "sys", "prompt"); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("expected the provider to refuse, got %v", err)
+	}
+	if len(llm.Calls()) != 0 {
+		t.Fatal("a refused call must not reach the model")
+	}
+}
@@ -0,0 +1,198 @@
+package utils
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// Papers whose estimated token count exceeds the provider's context budget are
+// mapped chunk by chunk into partial mind maps, then reduced into one tree by
+// merge passes that only ever see the partial maps, never the paper text.
+
+// DefaultContextBudget is used for providers that do not declare their own.
+const DefaultContextBudget = 100000
+
+// contextBudgeter is implemented by providers that know how many input tokens
+// their model can take in a single prompt.
+type contextBudgeter interface {
+    ContextBudget() int
+}
+
+// ContextBudget returns the input-token budget for llm. LLM_TOKEN_BUDGET
+// overrides the per-model value.
+func ContextBudget(llm LLMProvider) int {
+    if v := strings.TrimSpace(os.Getenv("LLM_TOKEN_BUDGET")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n > 0 {
+            return n
+        }
+        log.Printf("llm: ignoring invalid LLM_TOKEN_BUDGET=%q", v)
+    }
+    if b, ok := llm.(contextBudgeter); ok {
+        if n := b.ContextBudget(); n > 0 {
+            return n
+        }
+    }
+    return DefaultContextBudget
+}
+
+// EstimateTokens approximates the token count of English text at roughly
+// four characters per token, which is close enough for budgeting.
+func EstimateTokens(text string) int {
+    return (len(text) + 3) / 4
+}
+
+// SplitChunks cuts text into pieces of about chunkTokens tokens, each sharing
+// overlapTokens with its predecessor so concepts that straddle a boundary are
+// seen whole at least once. Cuts prefer paragraph, then line, then word breaks.
+func SplitChunks(text string, chunkTokens, overlapTokens int) []string {
+    bounds := splitChunkBounds(text, chunkTokens, overlapTokens)
+    chunks := make([]string, len(bounds))
+    for i, b := range bounds {
+        chunks[i] = text[b[0]:b[1]]
+    }
+    return chunks
+}
+
+// splitChunkBounds returns the [start, end) offsets used by SplitChunks.
+func splitChunkBounds(text string, chunkTokens, overlapTokens int) [][2]int {
+    size := chunkTokens * 4
+    overlap := overlapTokens * 4
+    if size <= 0 || len(text) <= size {
+        return [][2]int{{0, len(text)}}
+    }
+    if overlap < 0 || overlap >= size/2 {
+        overlap = size / 10
+    }
+
+    var bounds [][2]int
+    start := 0
+    for start < len(text) {
+        end := start + size
+        if end >= len(text) {
+            bounds = append(bounds, [2]int{start, len(text)})
+            break
+        }
+        end = breakPoint(text, start+size/2, end)
+        bounds = append(bounds, [2]int{start, end})
+        next := end - overlap
+        if next <= start {
+            next = end
+        }
+        start = next
+    }
+    return bounds
+}
+
+// breakPoint finds the last natural break in text[min:max], falling back to max.
+func breakPoint(text string, min, max int) int {
+    window := text[min:max]
+    for _, sep := range []string{"\n\n", "\n", " "} {
+        if i := strings.LastIndex(window, sep); i >= 0 {
+            return min + i + len(sep)
+        }
+    }
+    return max
+}
+
+func generateMindmapChunked(ctx context.Context, llm LLMProvider, pdfText string, budget int) (map[string]interface{}, error) {
+    // Leave half the budget for instructions and the model's reply
+    chunkTokens := budget / 2
+    bounds := splitChunkBounds(pdfText, chunkTokens, chunkTokens/10)
+    log.Printf("mindmap: ~%d tokens exceeds budget %d; generating from %d chunks", EstimateTokens(pdfText), budget, len(bounds))
+
+    partials := make([]map[string]interface{}, 0, len(bounds))
+    for i, b := range bounds {
+        // A chunk that starts mid-page still needs to know which page it is on
+        chunk := continuedMarker(pdfText, b[0]) + pdfText[b[0]:b[1]]
+        prompt := fmt.Sprintf(`The following text is part %d of %d of a research paper that is too long to read at once. Create a hierarchical mind map of the key concepts in THIS PART ONLY. It will later be merged with the mind maps of the other parts.
+
+For each node, provide:
+- 'name': concise topic name
+- 'tooltip': three to five sentences, plain-english explanation, summarization of content
+- 'section': the document section it belongs to (e.g., "Introduction", "2.1 Related Work")
+- 'pages': a string with the source page number(s) (e.g., "3" or "5-7" - these must be factually accurate)
+- 'children': array of child nodes (if applicable)
+
+%s
+
+The root object should summarize this part and must have a 'children' array. Return only a JSON object in this format:
+{
+  "name": "topic of this part",
+  "tooltip": "explanation",
+  "section": "section name",
+  "pages": "page numbers",
+  "children": [...]
+}
+
+Here is part %d:
+
+%s`, i+1, len(bounds), pageMarkerNote, i+1, chunk)
+        partial, err := llm.CompleteJSON(WithOperation(ctx, OpMindmapChunk), mindmapSystemPrompt, prompt)
+        if err != nil {
+            return nil, fmt.Errorf("failed to call %s for chunk %d/%d: %w", llm.Name(), i+1, len(bounds), err)
+        }
+        partials = append(partials, partial)
+    }
+    return mergeMindmaps(ctx, llm, partials, budget)
+}
+
+// mergeMindmaps reduces partial maps into one. When the partials together are
+// still too large for one prompt they are merged in halves first.
+func mergeMindmaps(ctx context.Context, llm LLMProvider, partials []map[string]interface{}, budget int) (map[string]interface{}, error) {
+    if len(partials) == 1 {
+        return partials[0], nil
+    }
+    raw, err := json.MarshalIndent(partials, "", "  ")
+    if err != nil {
+        return nil, fmt.Errorf("failed to marshal partial mind maps: %w", err)
+    }
+    if EstimateTokens(string(raw)) > budget/2 && len(partials) > 2 {
+        mid := len(partials) / 2
+        left, err := mergeMindmaps(ctx, llm, partials[:mid], budget)
+        if err != nil {
+            return nil, err
+        }
+        right, err := mergeMindmaps(ctx, llm, partials[mid:], budget)
+        if err != nil {
+            return nil, err
+        }
+        return mergeMindmaps(ctx, llm, []map[string]interface{}{left, right}, budget)
+    }
+
+    prompt := fmt.Sprintf(`Below are %d partial mind maps, each generated from a consecutive part of the same research paper, in order. Merge them into ONE hierarchical mind map of the whole paper with up to 8 levels but start with no more than 5.
+
+- Combine nodes that describe the same concept, keeping the clearest tooltip.
+- Keep every node's 'section' and 'pages' values from the partial maps; when combining nodes, join their page ranges (e.g., "3, 7-8").
+- The root object should represent the paper's main theme and must have a 'children' array.
+
+Return the response as a JSON object in this exact format:
+{
+  "name": "main topic",
+  "tooltip": "explanation",
+  "section": "section name",
+  "pages": "page numbers",
+  "children": [
+    {
+      "name": "subtopic",
+      "tooltip": "explanation",
+      "section": "section name",
+      "pages": "page numbers",
+      "children": [...]
+    }
+  ]
+}
+
+Partial mind maps:
+
+%s`, len(partials), raw)
+    merged, err := llm.CompleteJSON(WithOperation(ctx, OpMindmapMerge), mindmapSystemPrompt, prompt)
+    if err != nil {
+        return nil, fmt.Errorf("failed to call %s for merge: %w", llm.Name(), err)
+    }
+    return merged, nil
+}
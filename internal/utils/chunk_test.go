@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSplitChunksOverlapAndCoverage(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 200; i++ {
+		b.WriteString("paragraph about transformers and attention heads.\n\n")
+	}
+	text := b.String()
+
+	chunks := SplitChunks(text, 250, 25)
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	for i, c := range chunks {
+		if len(c) > 250*4 {
+			t.Fatalf("chunk %d is %d chars, over the 1000-char limit", i, len(c))
+		}
+		if i > 0 {
+			prev := chunks[i-1]
+			tail := prev[len(prev)-50:]
+			if !strings.Contains(c, tail) {
+				t.Fatalf("chunk %d does not overlap the end of chunk %d", i, i-1)
+			}
+		}
+	}
+	if !strings.HasPrefix(text, chunks[0]) || !strings.HasSuffix(text, chunks[len(chunks)-1]) {
+		t.Fatal("chunks do not cover the start and end of the text")
+	}
+
+	if got := SplitChunks("short", 250, 25); len(got) != 1 || got[0] != "short" {
+		t.Fatalf("short text should be a single chunk, got %v", got)
+	}
+}
+
+func TestGenerateMindmapSwitchesToChunkedMode(t *testing.T) {
+	t.Setenv("LLM_TOKEN_BUDGET", "")
+	text := strings.Repeat("A sentence from a very long survey paper. ", 400) // ~4200 tokens
+
+	fake := NewFakeProvider()
+	out, err := GenerateMindmap(context.Background(), fake, text)
+	if err != nil {
+		t.Fatalf("GenerateMindmap: %v", err)
+	}
+	if calls := fake.Calls(); len(calls) != 1 || calls[0].Operation != OpMindmap {
+		t.Fatalf("expected a single mindmap call within budget, got %+v", calls)
+	}
+	if out["name"] != "A Fake Paper" {
+		t.Fatalf("unexpected single-pass result %v", out)
+	}
+
+	fake = NewFakeProvider()
+	fake.SetContextBudget(1000)
+	out, err = GenerateMindmap(context.Background(), fake, text)
+	if err != nil {
+		t.Fatalf("chunked GenerateMindmap: %v", err)
+	}
+	var chunks, merges int
+	for _, c := range fake.Calls() {
+		switch c.Operation {
+		case OpMindmapChunk:
+			chunks++
+			if len(c.Prompt) > 1000*4+2000 {
+				t.Fatalf("chunk prompt too large: %d chars", len(c.Prompt))
+			}
+		case OpMindmapMerge:
+			merges++
+		default:
+			t.Fatalf("unexpected operation %q in chunked mode", c.Operation)
+		}
+	}
+	if chunks < 8 || merges == 0 {
+		t.Fatalf("expected many chunk calls and at least one merge, got %d chunks, %d merges", chunks, merges)
+	}
+	if out["tooltip"] != "Merged from several parts." {
+		t.Fatalf("expected the merged tree, got %v", out)
+	}
+	if _, ok := out["children"].([]interface{}); !ok {
+		t.Fatalf("merged tree lost its children array: %v", out)
+	}
+}
+
+func TestContextBudgetOverride(t *testing.T) {
+	fake := NewFakeProvider()
+	t.Setenv("LLM_TOKEN_BUDGET", "")
+	if got := ContextBudget(fake); got != DefaultContextBudget {
+		t.Fatalf("expected default budget, got %d", got)
+	}
+	fake.SetContextBudget(1234)
+	if got := ContextBudget(fake); got != 1234 {
+		t.Fatalf("expected provider budget, got %d", got)
+	}
+	t.Setenv("LLM_TOKEN_BUDGET", "42")
+	if got := ContextBudget(fake); got != 42 {
+		t.Fatalf("expected env override, got %d", got)
+	}
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+    "context"
+    "fmt"
+    "sync"
+)
+
+func init() {
+    RegisterProvider("fake", func(ctx context.Context) (LLMProvider, error) {
+        return NewFakeProvider(), nil
+    })
+}
+
+// FakeCall records one CompleteJSON invocation made against a FakeProvider.
+type FakeCall struct {
+    Operation string
+    System    string
+    Prompt    string
+}
+
+// FakeProvider is a deterministic, offline LLM for tests and demos. It answers
+// each call with the canned JSON registered for the call's operation (see
+// WithOperation) and records every call it receives. Usage is recorded from
+// estimated token counts.
+type FakeProvider struct {
+    mu        sync.Mutex
+    responses map[string]string
+    calls     []FakeCall
+    budget    int
+}
+
+// NewFakeProvider returns a provider scripted with a small but well-formed
+// reply for every pipeline operation.
+func NewFakeProvider() *FakeProvider {
+    return &FakeProvider{responses: map[string]string{
+        OpMetadata: `{"title":"A Fake Paper","authors":["Ada Lovelace","Alan Turing"],"date":"January 2024"}`,
+        OpMindmap: `{"name":"A Fake Paper","tooltip":"The paper's main theme.","section":"Abstract","pages":"1","children":[
+            {"name":"Introduction","tooltip":"Why the work matters.","section":"1 Introduction","pages":"1","children":[]},
+            {"name":"Method","tooltip":"How the work was done.","section":"2 Method","pages":"2","children":[
+                {"name":"Setup","tooltip":"Experimental setup.","section":"2.1 Setup","pages":"2","children":[]}
+            ]}
+        ]}`,
+        OpMindmapChunk: `{"name":"Part","tooltip":"One part of the paper.","section":"Body","pages":"1","children":[
+            {"name":"Part topic","tooltip":"A topic from this part.","section":"Body","pages":"1","children":[]}
+        ]}`,
+        OpMindmapMerge: `{"name":"A Fake Paper","tooltip":"Merged from several parts.","section":"Abstract","pages":"1","children":[
+            {"name":"Part topic","tooltip":"A topic seen in several parts.","section":"Body","pages":"1","children":[]}
+        ]}`,
+        OpRedoDescription: `{"tooltip":"A freshly rewritten explanation."}`,
+        OpRemakeSubtree: `{"name":"remade","tooltip":"Remade subtree.","section":"2 Method","pages":"2","children":[
+            {"name":"Remade child","tooltip":"A regenerated child.","section":"2 Method","pages":"2","children":[]}
+        ]}`,
+        OpGoDeeper: `{"children":[
+            {"name":"Deeper A","tooltip":"First deeper topic.","section":"2 Method","pages":"2"},
+            {"name":"Deeper B","tooltip":"Second deeper topic.","section":"2 Method","pages":"3"}
+        ]}`,
+    }}
+}
+
+func (p *FakeProvider) Name() string { return "fake" }
+
+// Script replaces the canned reply for an operation.
+func (p *FakeProvider) Script(op, responseJSON string) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.responses[op] = responseJSON
+}
+
+// SetContextBudget makes the fake report a context budget, so tests can force
+// chunked generation with short texts. Zero means DefaultContextBudget.
+func (p *FakeProvider) SetContextBudget(tokens int) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.budget = tokens
+}
+
+func (p *FakeProvider) ContextBudget() int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.budget
+}
+
+// Calls returns a copy of every call received so far.
+func (p *FakeProvider) Calls() []FakeCall {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return append([]FakeCall(nil), p.calls...)
+}
+
+func (p *FakeProvider) CompleteJSON(ctx context.Context, system, prompt string) (map[string]interface{}, error) {
+    text, err := p.reply(ctx, system, prompt)
+    if err != nil {
+        return nil, err
+    }
+    return parseJSONObject("fake", text)
+}
+
+// fakeStreamChunk is how many bytes of the canned reply each streamed piece holds.
+const fakeStreamChunk = 32
+
+// StreamJSON hands the canned reply to onText in small pieces before parsing it.
+func (p *FakeProvider) StreamJSON(ctx context.Context, system, prompt string, onText func(chunk string)) (map[string]interface{}, error) {
+    text, err := p.reply(ctx, system, prompt)
+    if err != nil {
+        return nil, err
+    }
+    for i := 0; i < len(text); i += fakeStreamChunk {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        onText(text[i:min(i+fakeStreamChunk, len(text))])
+    }
+    return parseJSONObject("fake", text)
+}
+
+// reply records the call and returns the canned text for its operation. Like
+// the real providers it refuses calls once a budget is used up.
+func (p *FakeProvider) reply(ctx context.Context, system, prompt string) (string, error) {
+    if err := enforceBudget(ctx); err != nil {
+        return "", err
+    }
+    op := OperationFrom(ctx)
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.calls = append(p.calls, FakeCall{Operation: op, System: system, Prompt: prompt})
+    text, ok := p.responses[op]
+    if !ok {
+        return "", fmt.Errorf("fake provider: no response scripted for operation %q", op)
+    }
+    recordUsage(ctx, "fake", "fake", EstimateTokens(system+prompt), EstimateTokens(text))
+    return text, nil
+}
@@ -0,0 +1,504 @@
+package utils
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// Uploads run as background jobs so a slow LLM or a dropped connection does
+// not throw the work away: POST /api/upload enqueues a job and returns 202,
+// a small worker pool runs the pipeline, and GET /api/jobs/{id} reports on it.
+// GET /api/jobs/{id}/events streams the same progress as Server-Sent Events.
+
+// Job statuses
+const (
+    JobQueued  = "queued"
+    JobRunning = "running"
+    JobDone    = "done"
+    JobFailed  = "failed"
+)
+
+// Pipeline stages, in the order an upload passes through them
+const (
+    StageQueued     = "queued"
+    StageExtracting = "extracting"
+    StageMetadata   = "metadata"
+    StageMindmap    = "mindmap"
+    StagePersisting = "persisting"
+    StageDone       = "done"
+)
+
+// Event types sent on a job's event stream
+const (
+    EventStage   = "stage"   // the job entered a new stage
+    EventPartial = "partial" // a piece of streamed LLM output
+    EventTree    = "tree"    // the mind map parsed so far from streamed output
+    EventDone    = "done"
+    EventFailed  = "failed"
+)
+
+// maxPartialBytes bounds the streamed text a job keeps for replay, dropping
+// the oldest pieces first. It is well above the size of a mind map.
+const maxPartialBytes = 1 << 20
+
+// stagePercent is the progress reported on entering each stage.
+var stagePercent = map[string]int{
+    StageQueued:     0,
+    StageExtracting: 10,
+    StageMetadata:   25,
+    StageMindmap:    40,
+    StagePersisting: 90,
+    StageDone:       100,
+}
+
+// ErrQueueFull is returned by Submit when every worker is busy and the
+// backlog is at capacity.
+var ErrQueueFull = errors.New("job queue is full")
+
+// Job is the pollable state of one background upload.
+type Job struct {
+    ID        string `json:"id"`
+    Status    string `json:"status"`
+    Stage     string `json:"stage"`
+    Percent   int    `json:"percent"`
+    Message   string `json:"message,omitempty"`
+    Error     string `json:"error,omitempty"`
+    MindmapID string `json:"mindmapId,omitempty"`
+    Filename  string `json:"filename,omitempty"`
+    Platform  string `json:"platform,omitempty"`
+    CreatedAt string `json:"createdAt"`
+    UpdatedAt string `json:"updatedAt"`
+
+    finishedAt time.Time
+    // key identifies the work, so the same work is not queued twice
+    key string
+    // events holds the latest event of each type but partial, whose pieces
+    // are all kept up to maxPartialBytes, oldest first
+    events       []JobEvent
+    nextEvent    int
+    partialBytes int
+    // changed is closed and replaced whenever an event is added
+    changed chan struct{}
+}
+
+// JobEvent is one entry in a job's event stream. IDs count up from zero, so a
+// client can resume after the last one it saw. Stage, tree and outcome events
+// are snapshots, so only the latest of each is kept for replay; partial
+// events are pieces of text, so they are kept until they add up to
+// maxPartialBytes.
+type JobEvent struct {
+    ID        int                    `json:"id"`
+    Type      string                 `json:"type"`
+    Stage     string                 `json:"stage,omitempty"`
+    Percent   int                    `json:"percent"`
+    Message   string                 `json:"message,omitempty"`
+    Text      string                 `json:"text,omitempty"`
+    Tree      map[string]interface{} `json:"tree,omitempty"`
+    MindmapID string                 `json:"mindmapId,omitempty"`
+    Error     string                 `json:"error,omitempty"`
+}
+
+// JobFunc does a job's work, reporting through progress as it goes, and
+// returns the id of the mind map it created.
+type JobFunc func(ctx context.Context, progress JobProgress) (string, error)
+
+// JobProgress reports a running job's stages and streamed output. The zero
+// value discards everything.
+type JobProgress struct {
+    q  *JobQueue
+    id string
+}
+
+// Stage moves the job to stage, with a human-readable note on what happened.
+func (p JobProgress) Stage(stage, message string) {
+    if p.q == nil {
+        return
+    }
+    p.q.update(p.id, func(j *Job) {
+        j.Stage = stage
+        j.Message = message
+        if pct, ok := stagePercent[stage]; ok {
+            j.Percent = pct
+        }
+        p.q.emitLocked(j, JobEvent{Type: EventStage, Message: message})
+    })
+}
+
+// Partial forwards a piece of LLM output as it is generated.
+func (p JobProgress) Partial(text string) {
+    if p.q == nil || text == "" {
+        return
+    }
+    p.q.update(p.id, func(j *Job) { p.q.emitLocked(j, JobEvent{Type: EventPartial, Text: text}) })
+}
+
+// Tree publishes the mind map as far as it has been generated.
+func (p JobProgress) Tree(tree map[string]interface{}) {
+    if p.q == nil {
+        return
+    }
+    p.q.update(p.id, func(j *Job) { p.q.emitLocked(j, JobEvent{Type: EventTree, Tree: tree}) })
+}
+
+type jobTask struct {
+    id  string
+    run JobFunc
+}
+
+// JobQueue runs jobs on a fixed pool of workers and keeps their state in
+// memory. Finished jobs are forgotten after the retention period.
+type JobQueue struct {
+    mu        sync.Mutex
+    jobs      map[string]*Job
+    tasks     chan jobTask
+    timeout   time.Duration
+    retention time.Duration
+}
+
+// NewJobQueue starts workers goroutines reading from a backlog of size jobs.
+func NewJobQueue(workers, size int, timeout, retention time.Duration) *JobQueue {
+    if workers < 1 {
+        workers = 1
+    }
+    if size < 1 {
+        size = 1
+    }
+    q := &JobQueue{
+        jobs:      map[string]*Job{},
+        tasks:     make(chan jobTask, size),
+        timeout:   timeout,
+        retention: retention,
+    }
+    for i := 0; i < workers; i++ {
+        go q.worker()
+    }
+    return q
+}
+
+var (
+    uploadJobsOnce sync.Once
+    uploadJobs     *JobQueue
+)
+
+// UploadJobs returns the process-wide upload queue, sized from JOB_WORKERS
+// (default 2), JOB_QUEUE_SIZE (default 32), JOB_TIMEOUT (default 15m) and
+// JOB_RETENTION (default 1h).
+func UploadJobs() *JobQueue {
+    uploadJobsOnce.Do(func() {
+        uploadJobs = NewJobQueue(
+            envInt("JOB_WORKERS", 2),
+            envInt("JOB_QUEUE_SIZE", 32),
+            envDuration("JOB_TIMEOUT", 15*time.Minute),
+            envDuration("JOB_RETENTION", time.Hour),
+        )
+    })
+    return uploadJobs
+}
+
+// Submit enqueues run and returns a snapshot of the new job.
+func (q *JobQueue) Submit(filename, platform string, run JobFunc) (Job, error) {
+    job, _, err := q.SubmitOnce("", filename, platform, run)
+    return job, err
+}
+
+// SubmitOnce is Submit for work identified by key: while a job with the same
+// key is queued or running it returns that job and true instead of queueing
+// run again. An empty key never matches.
+func (q *JobQueue) SubmitOnce(key, filename, platform string, run JobFunc) (Job, bool, error) {
+    now := time.Now().UTC()
+    job := &Job{
+        ID:        uuid.New().String(),
+        Status:    JobQueued,
+        Stage:     StageQueued,
+        Message:   "Waiting for a worker",
+        Filename:  filename,
+        Platform:  platform,
+        CreatedAt: now.Format(time.RFC3339),
+        UpdatedAt: now.Format(time.RFC3339),
+        key:       key,
+        changed:   make(chan struct{}),
+    }
+    q.mu.Lock()
+    q.pruneLocked(now)
+    if key != "" {
+        for _, other := range q.jobs {
+            if other.key == key && other.finishedAt.IsZero() {
+                snapshot := *other
+                q.mu.Unlock()
+                return snapshot, true, nil
+            }
+        }
+    }
+    q.emitLocked(job, JobEvent{Type: EventStage, Message: job.Message})
+    q.jobs[job.ID] = job
+    snapshot := *job
+    q.mu.Unlock()
+
+    select {
+    case q.tasks <- jobTask{id: job.ID, run: run}:
+        return snapshot, false, nil
+    default:
+        q.mu.Lock()
+        delete(q.jobs, job.ID)
+        q.mu.Unlock()
+        return Job{}, false, ErrQueueFull
+    }
+}
+
+// Get returns a snapshot of the job, or false if it is unknown or expired.
+func (q *JobQueue) Get(id string) (Job, bool) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    job, ok := q.jobs[id]
+    if !ok {
+        return Job{}, false
+    }
+    return *job, true
+}
+
+// Events returns the job's kept events with an ID of from or later, whether
+// the job has finished, and a channel that is closed when more events arrive.
+func (q *JobQueue) Events(id string, from int) ([]JobEvent, bool, <-chan struct{}, bool) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    job, ok := q.jobs[id]
+    if !ok {
+        return nil, false, nil, false
+    }
+    if from < 0 {
+        from = 0
+    }
+    var events []JobEvent
+    for _, ev := range job.events {
+        if ev.ID >= from {
+            events = append(events, ev)
+        }
+    }
+    return events, !job.finishedAt.IsZero(), job.changed, true
+}
+
+func (q *JobQueue) worker() {
+    for task := range q.tasks {
+        q.runTask(task)
+    }
+}
+
+func (q *JobQueue) runTask(task jobTask) {
+    ctx := context.Background()
+    if q.timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, q.timeout)
+        defer cancel()
+    }
+    q.update(task.id, func(j *Job) { j.Status = JobRunning })
+
+    var (
+        mindmapID string
+        err       error
+    )
+    func() {
+        // A panicking pipeline must not take the worker down with it
+        defer func() {
+            if p := recover(); p != nil {
+                err = fmt.Errorf("internal error")
+                log.Printf("jobs: job %s panicked: %v", task.id, p)
+            }
+        }()
+        mindmapID, err = task.run(ctx, JobProgress{q: q, id: task.id})
+    }()
+
+    q.update(task.id, func(j *Job) {
+        j.finishedAt = time.Now()
+        if err != nil {
+            j.Status = JobFailed
+            j.Error = err.Error()
+            // pipelines wrap or replace the context's error, so ask the context
+            if ctx.Err() == context.DeadlineExceeded {
+                j.Error = "job timed out"
+            }
+            log.Printf("jobs: job %s failed at stage %s: %v", j.ID, j.Stage, err)
+            q.emitLocked(j, JobEvent{Type: EventFailed, Error: j.Error})
+            return
+        }
+        j.Status = JobDone
+        j.Stage = StageDone
+        j.Percent = 100
+        j.Message = "Mind map saved"
+        j.MindmapID = mindmapID
+        q.emitLocked(j, JobEvent{Type: EventDone, Message: j.Message, MindmapID: mindmapID})
+    })
+}
+
+func (q *JobQueue) update(id string, fn func(j *Job)) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if job, ok := q.jobs[id]; ok {
+        fn(job)
+        job.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+    }
+}
+
+// emitLocked appends ev to the job's stream, stamped with the job's current
+// stage and percent, in place of the previous snapshot of its type, and wakes
+// anyone waiting on it.
+func (q *JobQueue) emitLocked(j *Job, ev JobEvent) {
+    ev.ID = j.nextEvent
+    j.nextEvent++
+    ev.Stage = j.Stage
+    ev.Percent = j.Percent
+    if ev.Type == EventPartial {
+        j.partialBytes += len(ev.Text)
+    }
+    kept := j.events[:0]
+    for _, old := range j.events {
+        switch {
+        case old.Type == EventPartial && j.partialBytes > maxPartialBytes:
+            j.partialBytes -= len(old.Text)
+        case old.Type == ev.Type && ev.Type != EventPartial:
+        default:
+            kept = append(kept, old)
+        }
+    }
+    j.events = append(kept, ev)
+    close(j.changed)
+    j.changed = make(chan struct{})
+}
+
+func (q *JobQueue) pruneLocked(now time.Time) {
+    if q.retention <= 0 {
+        return
+    }
+    for id, job := range q.jobs {
+        if !job.finishedAt.IsZero() && now.Sub(job.finishedAt) > q.retention {
+            delete(q.jobs, id)
+        }
+    }
+}
+
+// JobStatusHandler: GET /api/jobs/{id}
+func JobStatusHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    id, action := parseJobPath(r.URL.Path)
+    job, ok := UploadJobs().Get(id)
+    if id == "" || action != "" || !ok {
+        http.Error(w, "job not found", http.StatusNotFound)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(job)
+}
+
+// JobEventsHandler: GET /api/jobs/{id}/events
+//
+// Streams the job's events as Server-Sent Events, starting after the
+// Last-Event-ID a reconnecting client sends, and closes once the job is done.
+func JobEventsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    id, action := parseJobPath(r.URL.Path)
+    if action != "events" {
+        http.NotFound(w, r)
+        return
+    }
+    q := UploadJobs()
+    from := 0
+    if last := r.Header.Get("Last-Event-ID"); last != "" {
+        if n, err := strconv.Atoi(last); err == nil {
+            from = n + 1
+        }
+    }
+    if _, _, _, ok := q.Events(id, from); id == "" || !ok {
+        http.Error(w, "job not found", http.StatusNotFound)
+        return
+    }
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    // Stop reverse proxies such as nginx from buffering the stream
+    w.Header().Set("X-Accel-Buffering", "no")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    heartbeat := time.NewTicker(15 * time.Second)
+    defer heartbeat.Stop()
+    for {
+        events, finished, changed, ok := q.Events(id, from)
+        if !ok {
+            return
+        }
+        for _, ev := range events {
+            data, _ := json.Marshal(ev)
+            fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+            from = ev.ID + 1
+        }
+        flusher.Flush()
+        if finished {
+            return
+        }
+        select {
+        case <-changed:
+        case <-heartbeat.C:
+            fmt.Fprint(w, ": keep-alive\n\n")
+            flusher.Flush()
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
+
+// parseJobPath splits /api/jobs/{id}/{action} into its parts.
+func parseJobPath(path string) (id string, action string) {
+    parts := strings.SplitN(strings.Trim(strings.TrimPrefix(path, "/api/jobs/"), "/"), "/", 2)
+    id = parts[0]
+    if len(parts) > 1 {
+        action = parts[1]
+    }
+    return
+}
+
+func envInt(name string, def int) int {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return def
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil || n < 1 {
+        log.Printf("jobs: ignoring invalid %s=%q", name, v)
+        return def
+    }
+    return n
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return def
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil || d <= 0 {
+        log.Printf("jobs: ignoring invalid %s=%q", name, v)
+        return def
+    }
+    return d
+}
@@ -0,0 +1,267 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitForJob(t *testing.T, q *JobQueue, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := q.Get(id); ok && (job.Status == JobDone || job.Status == JobFailed) {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return Job{}
+}
+
+func TestJobQueueReportsStagesAndResult(t *testing.T) {
+	q := NewJobQueue(1, 4, time.Minute, time.Hour)
+	release := make(chan struct{})
+	job, err := q.Submit("paper.pdf", "memory", func(ctx context.Context, progress JobProgress) (string, error) {
+		progress.Stage(StageMindmap, "generating")
+		<-release
+		return "mindmap-1", nil
+	})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if job.Status != JobQueued || job.Stage != StageQueued {
+		t.Fatalf("new job should be queued, got %+v", job)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got, _ := q.Get(job.ID); got.Stage == StageMindmap {
+			if got.Status != JobRunning || got.Percent != stagePercent[StageMindmap] {
+				t.Fatalf("expected running at mindmap stage, got %+v", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job never reached the mindmap stage")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(release)
+
+	done := waitForJob(t, q, job.ID)
+	if done.Status != JobDone || done.Percent != 100 || done.MindmapID != "mindmap-1" {
+		t.Fatalf("expected finished job, got %+v", done)
+	}
+}
+
+func TestJobQueueFailuresAndPanics(t *testing.T) {
+	q := NewJobQueue(1, 4, time.Minute, time.Hour)
+	failed, _ := q.Submit("a.pdf", "memory", func(ctx context.Context, progress JobProgress) (string, error) {
+		progress.Stage(StageMetadata, "parsed")
+		return "", errors.New("failed to extract metadata")
+	})
+	panicked, _ := q.Submit("b.pdf", "memory", func(ctx context.Context, progress JobProgress) (string, error) {
+		panic("boom")
+	})
+
+	if job := waitForJob(t, q, failed.ID); job.Status != JobFailed || job.Error != "failed to extract metadata" || job.Stage != StageMetadata {
+		t.Fatalf("expected failure at metadata stage, got %+v", job)
+	}
+	if job := waitForJob(t, q, panicked.ID); job.Status != JobFailed || job.Error != "internal error" {
+		t.Fatalf("a panic should fail the job, got %+v", job)
+	}
+}
+
+func TestJobQueueRejectsWhenFull(t *testing.T) {
+	q := NewJobQueue(1, 1, time.Minute, time.Hour)
+	block := make(chan struct{})
+	defer close(block)
+	wait := func(ctx context.Context, progress JobProgress) (string, error) {
+		<-block
+		return "", nil
+	}
+
+	first, _ := q.Submit("running.pdf", "memory", wait)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if job, _ := q.Get(first.ID); job.Status == JobRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("first job never started")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := q.Submit("queued.pdf", "memory", wait); err != nil {
+		t.Fatalf("backlog has room for one job: %v", err)
+	}
+	if _, err := q.Submit("rejected.pdf", "memory", wait); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+}
+
+func TestJobQueueEventStream(t *testing.T) {
+	q := NewJobQueue(1, 4, time.Minute, time.Hour)
+	release := make(chan struct{})
+	job, _ := q.Submit("paper.pdf", "memory", func(ctx context.Context, progress JobProgress) (string, error) {
+		progress.Stage(StageMetadata, "PDF parsed with 3 pages")
+		<-release
+		progress.Partial(`{"name":"Root"`)
+		progress.Tree(map[string]interface{}{"name": "Root"})
+		progress.Partial(`,"children":[]}`)
+		progress.Tree(map[string]interface{}{"name": "Root", "children": []interface{}{}})
+		return "mindmap-1", nil
+	})
+
+	// a subscriber that is waiting is woken by the next event
+	events, finished, changed, ok := q.Events(job.ID, 0)
+	if !ok || finished || len(events) == 0 || events[0].Type != EventStage {
+		t.Fatalf("expected a stage event first, got %+v", events)
+	}
+	close(release)
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber was not woken")
+	}
+
+	// a late subscriber replays the latest snapshots and every piece of text
+	waitForJob(t, q, job.ID)
+	events, finished, _, _ = q.Events(job.ID, 0)
+	var types []string
+	for i, ev := range events {
+		if i > 0 && ev.ID <= events[i-1].ID {
+			t.Fatalf("event ids must count up, got %+v", events)
+		}
+		types = append(types, ev.Type)
+	}
+	want := []string{EventStage, EventPartial, EventPartial, EventTree, EventDone}
+	if !finished || strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected events %v, got %v (finished=%t)", want, types, finished)
+	}
+	if ev := events[0]; ev.ID != 1 || ev.Message != "PDF parsed with 3 pages" || ev.Percent != stagePercent[StageMetadata] {
+		t.Fatalf("unexpected stage event %+v", ev)
+	}
+	if text := events[1].Text + events[2].Text; text != `{"name":"Root","children":[]}` {
+		t.Fatalf("expected all of the streamed text, got %q", text)
+	}
+	if ev := events[3]; ev.ID != 5 || ev.Tree["children"] == nil {
+		t.Fatalf("expected the final tree, got %+v", ev)
+	}
+	if ev := events[4]; ev.ID != 6 || ev.MindmapID != "mindmap-1" || ev.Percent != 100 {
+		t.Fatalf("unexpected done event %+v", ev)
+	}
+	if rest, _, _, _ := q.Events(job.ID, 5); len(rest) != 2 || rest[0].Type != EventTree {
+		t.Fatalf("resuming mid-stream returned %+v", rest)
+	}
+}
+
+func TestJobQueueKeepsPartialsBetweenReads(t *testing.T) {
+	q := NewJobQueue(1, 4, time.Minute, time.Hour)
+	step := make(chan struct{})
+	job, _ := q.Submit("paper.pdf", "memory", func(ctx context.Context, progress JobProgress) (string, error) {
+		for _, piece := range []string{"a", "b", "c"} {
+			progress.Partial(piece)
+			progress.Tree(map[string]interface{}{"name": piece})
+		}
+		<-step
+		for _, piece := range []string{"d", "e", "f"} {
+			progress.Partial(piece)
+			progress.Tree(map[string]interface{}{"name": piece})
+		}
+		return "mindmap-1", nil
+	})
+
+	// a reader that falls behind still gets every piece of text, in order
+	read := func(from int) (string, int) {
+		events, _, _, _ := q.Events(job.ID, from)
+		var text strings.Builder
+		for _, ev := range events {
+			if ev.Type == EventPartial {
+				text.WriteString(ev.Text)
+			}
+			from = ev.ID + 1
+		}
+		return text.String(), from
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if events, _, _, _ := q.Events(job.ID, 0); len(events) > 0 && events[len(events)-1].Tree["name"] == "c" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job never streamed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	first, from := read(0)
+	close(step)
+	waitForJob(t, q, job.ID)
+	rest, _ := read(from)
+	if first != "abc" || rest != "def" {
+		t.Fatalf("expected abc then def, got %q then %q", first, rest)
+	}
+}
+
+func TestJobQueueBoundsPartials(t *testing.T) {
+	q := NewJobQueue(1, 4, time.Minute, time.Hour)
+	piece := strings.Repeat("x", maxPartialBytes/2)
+	job, _ := q.Submit("paper.pdf", "memory", func(ctx context.Context, progress JobProgress) (string, error) {
+		progress.Partial(piece + "1")
+		progress.Partial(piece + "2")
+		progress.Partial(piece + "3")
+		return "mindmap-1", nil
+	})
+	waitForJob(t, q, job.ID)
+	events, _, _, _ := q.Events(job.ID, 0)
+	var kept []string
+	for _, ev := range events {
+		if ev.Type == EventPartial {
+			kept = append(kept, ev.Text[len(ev.Text)-1:])
+		}
+	}
+	if strings.Join(kept, "") != "3" {
+		t.Fatalf("expected only the newest piece within the bound, got %v", kept)
+	}
+}
+
+func TestJobQueueReportsTimeouts(t *testing.T) {
+	q := NewJobQueue(1, 4, 10*time.Millisecond, time.Hour)
+	job, _ := q.Submit("slow.pdf", "memory", func(ctx context.Context, progress JobProgress) (string, error) {
+		<-ctx.Done()
+		// like an SDK that reports the cancelled request in its own words
+		return "", errors.New("request canceled")
+	})
+	if got := waitForJob(t, q, job.ID); got.Status != JobFailed || got.Error != "job timed out" {
+		t.Fatalf("expected a timed-out job, got %+v", got)
+	}
+}
+
+func TestJobQueueSubmitOnce(t *testing.T) {
+	q := NewJobQueue(1, 4, time.Minute, time.Hour)
+	release := make(chan struct{})
+	wait := func(ctx context.Context, progress JobProgress) (string, error) {
+		<-release
+		return "mindmap-1", nil
+	}
+	first, pending, err := q.SubmitOnce("aws:abc", "a.pdf", "aws", wait)
+	if err != nil || pending {
+		t.Fatalf("first submit should queue, got %t %v", pending, err)
+	}
+	again, pending, _ := q.SubmitOnce("aws:abc", "copy.pdf", "aws", wait)
+	if !pending || again.ID != first.ID {
+		t.Fatalf("expected the pending job %s, got %+v (%t)", first.ID, again, pending)
+	}
+	if other, pending, _ := q.SubmitOnce("gcp:abc", "a.pdf", "gcp", wait); pending || other.ID == first.ID {
+		t.Fatal("a different key must get its own job")
+	}
+	close(release)
+
+	waitForJob(t, q, first.ID)
+	if next, pending, _ := q.SubmitOnce("aws:abc", "a.pdf", "aws", wait); pending || next.ID == first.ID {
+		t.Fatal("a finished job must not absorb new work")
+	}
+}
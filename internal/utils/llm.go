@@ -0,0 +1,212 @@
+package utils
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+    genai "github.com/google/generative-ai-go/genai"
+)
+
+// LLMProvider is a model vendor that answers a prompt with a single JSON object.
+type LLMProvider interface {
+    Name() string
+    CompleteJSON(ctx context.Context, system, prompt string) (map[string]interface{}, error)
+}
+
+// StreamingProvider is implemented by providers that can hand over a reply's
+// text as it is generated, before returning the parsed object.
+type StreamingProvider interface {
+    LLMProvider
+    StreamJSON(ctx context.Context, system, prompt string, onText func(chunk string)) (map[string]interface{}, error)
+}
+
+// Operations tag each LLM call with the pipeline step that issued it.
+const (
+    OpMetadata        = "metadata"
+    OpMindmap         = "mindmap"
+    OpMindmapChunk    = "mindmap-chunk"
+    OpMindmapMerge    = "mindmap-merge"
+    OpRedoDescription = "redo-description"
+    OpRemakeSubtree   = "remake-subtree"
+    OpGoDeeper        = "go-deeper"
+)
+
+type operationKey struct{}
+
+// WithOperation records which pipeline step a CompleteJSON call belongs to.
+func WithOperation(ctx context.Context, op string) context.Context {
+    return context.WithValue(ctx, operationKey{}, op)
+}
+
+// OperationFrom returns the operation set by WithOperation, or "".
+func OperationFrom(ctx context.Context) string {
+    op, _ := ctx.Value(operationKey{}).(string)
+    return op
+}
+
+type streamKey struct{}
+
+// WithStream asks for a call's output to be passed to onText as it arrives,
+// when the provider can stream.
+func WithStream(ctx context.Context, onText func(chunk string)) context.Context {
+    return context.WithValue(ctx, streamKey{}, onText)
+}
+
+// StreamFrom returns the callback set by WithStream, or nil.
+func StreamFrom(ctx context.Context) func(chunk string) {
+    fn, _ := ctx.Value(streamKey{}).(func(string))
+    return fn
+}
+
+// completeJSON streams the reply when both the caller and the provider
+// support it, and otherwise makes a plain CompleteJSON call.
+func completeJSON(ctx context.Context, llm LLMProvider, system, prompt string) (map[string]interface{}, error) {
+    if onText := StreamFrom(ctx); onText != nil {
+        if s, ok := llm.(StreamingProvider); ok {
+            return s.StreamJSON(ctx, system, prompt, onText)
+        }
+    }
+    return llm.CompleteJSON(ctx, system, prompt)
+}
+
+// ProviderFactory builds a provider on demand, so vendors whose credentials
+// are missing only fail when they are actually selected.
+type ProviderFactory func(ctx context.Context) (LLMProvider, error)
+
+var (
+    providersMu sync.RWMutex
+    providers   = map[string]ProviderFactory{}
+)
+
+func init() {
+    RegisterProvider("bedrock", func(ctx context.Context) (LLMProvider, error) {
+        client, err := NewBedrockClient()
+        if err != nil {
+            return nil, err
+        }
+        return &BedrockProvider{Client: client}, nil
+    })
+    RegisterProvider("gemini", func(ctx context.Context) (LLMProvider, error) {
+        client, err := NewGeminiClient(ctx)
+        if err != nil {
+            return nil, err
+        }
+        return &GeminiProvider{Client: client}, nil
+    })
+}
+
+// RegisterProvider makes a vendor available under the given name.
+func RegisterProvider(name string, factory ProviderFactory) {
+    providersMu.Lock()
+    defer providersMu.Unlock()
+    providers[strings.ToLower(name)] = factory
+}
+
+// ProviderNames lists the registered vendor names in sorted order.
+func ProviderNames() []string {
+    providersMu.RLock()
+    defer providersMu.RUnlock()
+    names := make([]string, 0, len(providers))
+    for n := range providers {
+        names = append(names, n)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// NewProvider builds the vendor registered under name.
+func NewProvider(ctx context.Context, name string) (LLMProvider, error) {
+    providersMu.RLock()
+    factory, ok := providers[strings.ToLower(name)]
+    providersMu.RUnlock()
+    if !ok {
+        return nil, fmt.Errorf("unknown llm provider %q", name)
+    }
+    return factory(ctx)
+}
+
+// ProviderForPlatform picks the vendor for a storage platform. LLM_PROVIDER
+// overrides everything; otherwise aws uses bedrock, gcp uses gemini, and any
+// other store falls back to bedrock.
+func ProviderForPlatform(ctx context.Context, platform string) (LLMProvider, error) {
+    return NewProvider(ctx, providerNameForPlatform(platform))
+}
+
+func providerNameForPlatform(platform string) string {
+    if p := strings.ToLower(strings.TrimSpace(os.Getenv("LLM_PROVIDER"))); p != "" {
+        return p
+    }
+    if platform == "gcp" {
+        return "gemini"
+    }
+    return "bedrock"
+}
+
+// closeProvider releases any client the provider holds open.
+func closeProvider(p LLMProvider) {
+    if c, ok := p.(interface{ Close() error }); ok {
+        c.Close()
+    }
+}
+
+// BedrockProvider calls Claude through Bedrock.
+type BedrockProvider struct {
+    Client *bedrockruntime.Client
+}
+
+func (p *BedrockProvider) Name() string { return "bedrock" }
+
+// ContextBudget leaves headroom below Claude 3.5 Haiku's 200k-token window.
+func (p *BedrockProvider) ContextBudget() int { return 150000 }
+
+func (p *BedrockProvider) CompleteJSON(ctx context.Context, system, prompt string) (map[string]interface{}, error) {
+    return CallClaude(ctx, p.Client, prompt, system)
+}
+
+func (p *BedrockProvider) StreamJSON(ctx context.Context, system, prompt string, onText func(chunk string)) (map[string]interface{}, error) {
+    return CallClaudeStream(ctx, p.Client, prompt, system, onText)
+}
+
+// GeminiProvider calls Gemini through the Generative AI SDK.
+type GeminiProvider struct {
+    Client *genai.Client
+}
+
+func (p *GeminiProvider) Name() string { return "gemini" }
+
+// ContextBudget leaves headroom below Gemini 1.5 Flash's 1M-token window.
+func (p *GeminiProvider) ContextBudget() int { return 800000 }
+
+func (p *GeminiProvider) CompleteJSON(ctx context.Context, system, prompt string) (map[string]interface{}, error) {
+    return CallGemini(ctx, p.Client, prompt, system)
+}
+
+func (p *GeminiProvider) StreamJSON(ctx context.Context, system, prompt string, onText func(chunk string)) (map[string]interface{}, error) {
+    return CallGeminiStream(ctx, p.Client, prompt, system, onText)
+}
+
+func (p *GeminiProvider) Close() error { return p.Client.Close() }
+
+var jsonObjectRe = regexp.MustCompile(`\{[\s\S]*\}`)
+
+// parseJSONObject decodes a model reply, falling back to the outermost {...}
+// block when the model wraps its JSON in prose or code fences.
+func parseJSONObject(vendor, text string) (map[string]interface{}, error) {
+    var out map[string]interface{}
+    if err := json.Unmarshal([]byte(text), &out); err == nil {
+        return out, nil
+    }
+    if jsonMatch := jsonObjectRe.FindString(text); jsonMatch != "" {
+        if err := json.Unmarshal([]byte(jsonMatch), &out); err == nil {
+            return out, nil
+        }
+    }
+    return nil, fmt.Errorf("could not parse JSON from %s response: %s", vendor, text)
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	brtypes "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	genai "github.com/google/generative-ai-go/genai"
+)
+
+type echoProvider struct{}
+
+func (echoProvider) Name() string { return "echo" }
+func (echoProvider) CompleteJSON(ctx context.Context, system, prompt string) (map[string]interface{}, error) {
+	return map[string]interface{}{"system": system, "prompt": prompt}, nil
+}
+
+func TestProviderRegistry(t *testing.T) {
+	RegisterProvider("Echo", func(ctx context.Context) (LLMProvider, error) { return echoProvider{}, nil })
+
+	p, err := NewProvider(context.Background(), "echo")
+	if err != nil {
+		t.Fatalf("expected echo provider: %v", err)
+	}
+	out, err := p.CompleteJSON(context.Background(), "sys", "hi")
+	if err != nil || out["prompt"] != "hi" || out["system"] != "sys" {
+		t.Fatalf("unexpected completion %v (%v)", out, err)
+	}
+	if _, err := NewProvider(context.Background(), "nope"); err == nil {
+		t.Fatal("expected error for unknown provider")
+	}
+}
+
+func TestProviderNameForPlatform(t *testing.T) {
+	t.Setenv("LLM_PROVIDER", "")
+	cases := map[string]string{"aws": "bedrock", "gcp": "gemini", "local": "bedrock"}
+	for platform, want := range cases {
+		if got := providerNameForPlatform(platform); got != want {
+			t.Errorf("platform %s: expected %s, got %s", platform, want, got)
+		}
+	}
+	t.Setenv("LLM_PROVIDER", "Gemini")
+	if got := providerNameForPlatform("aws"); got != "gemini" {
+		t.Errorf("expected LLM_PROVIDER override, got %s", got)
+	}
+}
+
+func TestParseJSONObject(t *testing.T) {
+	out, err := parseJSONObject("test", `{"title":"x"}`)
+	if err != nil || out["title"] != "x" {
+		t.Fatalf("plain JSON: %v (%v)", out, err)
+	}
+	out, err = parseJSONObject("test", "Sure! Here it is:\n```json\n{\"title\":\"y\"}\n```")
+	if err != nil || out["title"] != "y" {
+		t.Fatalf("wrapped JSON: %v (%v)", out, err)
+	}
+	if _, err := parseJSONObject("test", "no json here"); err == nil {
+		t.Fatal("expected error for reply without JSON")
+	}
+}
+
+func claudeChunk(payload string) brtypes.ResponseStream {
+	return &brtypes.ResponseStreamMemberChunk{Value: brtypes.PayloadPart{Bytes: []byte(payload)}}
+}
+
+func TestReadClaudeStream(t *testing.T) {
+	events := make(chan brtypes.ResponseStream, 8)
+	events <- claudeChunk(`{"type":"message_start","message":{"usage":{"input_tokens":120,"output_tokens":1}}}`)
+	events <- claudeChunk(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"{\"title\":"}}`)
+	events <- claudeChunk(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"\"x\"}"}}`)
+	events <- claudeChunk(`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":7}}`)
+	events <- claudeChunk(`{"type":"message_stop"}`)
+	close(events)
+
+	var pieces []string
+	text, usage, err := readClaudeStream(context.Background(), events, func(chunk string) { pieces = append(pieces, chunk) })
+	if err != nil || text != `{"title":"x"}` || len(pieces) != 2 {
+		t.Fatalf("unexpected stream result %q %v (%v)", text, pieces, err)
+	}
+	if usage.InputTokens != 120 || usage.OutputTokens != 7 {
+		t.Fatalf("expected 120 input and 7 output tokens, got %+v", usage)
+	}
+
+	failing := make(chan brtypes.ResponseStream, 1)
+	failing <- claudeChunk(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+	if _, _, err := readClaudeStream(context.Background(), failing, func(string) {}); err == nil {
+		t.Fatal("expected an error event to fail the stream")
+	}
+
+	// a cancelled caller stops waiting on a stalled stream
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := readClaudeStream(ctx, make(chan brtypes.ResponseStream), func(string) {}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestGeminiText(t *testing.T) {
+	resp := &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{
+		Content: &genai.Content{Parts: []genai.Part{genai.Text(`{"a":`), genai.Blob{}, genai.Text(`1}`)}},
+	}}}
+	if got := geminiText(resp); got != `{"a":1}` {
+		t.Fatalf("expected joined text parts, got %q", got)
+	}
+	if got := geminiText(&genai.GenerateContentResponse{}); got != "" {
+		t.Fatalf("expected no text without candidates, got %q", got)
+	}
+}
+
+func TestBuiltInProvidersStream(t *testing.T) {
+	for _, p := range []LLMProvider{&BedrockProvider{}, &GeminiProvider{}, NewFakeProvider()} {
+		if _, ok := p.(StreamingProvider); !ok {
+			t.Errorf("%s should support streaming", p.Name())
+		}
+	}
+}
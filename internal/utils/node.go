@@ -0,0 +1,293 @@
+package utils
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "strconv"
+    "strings"
+
+    "github.com/google/uuid"
+)
+
+// Node is one topic in a mind map. The D3 frontend needs every node to carry
+// string name/tooltip/section/pages fields and a children array; anything
+// else a node holds (e.g. pagesVerified) is kept in Extra and written back
+// inline. ID is the node's stable identifier, assigned when it is generated.
+type Node struct {
+    ID       string
+    Name     string
+    Tooltip  string
+    Section  string
+    Pages    string
+    Children []*Node
+    Extra    map[string]interface{}
+}
+
+// MaxNodeDepth bounds how deep a tree may nest; deeper levels are dropped.
+const MaxNodeDepth = 12
+
+var nodeCoreFields = map[string]bool{"id": true, "name": true, "tooltip": true, "section": true, "pages": true, "children": true}
+
+func (n *Node) MarshalJSON() ([]byte, error) {
+    out := make(map[string]interface{}, len(n.Extra)+5)
+    for k, v := range n.Extra {
+        out[k] = v
+    }
+    children := n.Children
+    if children == nil {
+        children = []*Node{}
+    }
+    if n.ID != "" {
+        out["id"] = n.ID
+    }
+    out["name"] = n.Name
+    out["tooltip"] = n.Tooltip
+    out["section"] = n.Section
+    out["pages"] = n.Pages
+    out["children"] = children
+    return json.Marshal(out)
+}
+
+func (n *Node) UnmarshalJSON(b []byte) error {
+    var m map[string]interface{}
+    if err := json.Unmarshal(b, &m); err != nil {
+        return err
+    }
+    parsed, _, err := ParseNode(m)
+    if err != nil {
+        return err
+    }
+    *n = *parsed
+    return nil
+}
+
+// Map converts the node back into the untyped shape stored as mindmapData.
+func (n *Node) Map() map[string]interface{} {
+    raw, _ := json.Marshal(n)
+    var m map[string]interface{}
+    json.Unmarshal(raw, &m)
+    return m
+}
+
+// ChildMaps returns the node's children in their stored, untyped shape.
+func (n *Node) ChildMaps() []interface{} {
+    out := make([]interface{}, 0, len(n.Children))
+    for _, c := range n.Children {
+        out = append(out, c.Map())
+    }
+    return out
+}
+
+// Walk visits n and every descendant depth-first, stopping early if fn returns false.
+func (n *Node) Walk(fn func(node *Node) bool) bool {
+    if !fn(n) {
+        return false
+    }
+    for _, c := range n.Children {
+        if !c.Walk(fn) {
+            return false
+        }
+    }
+    return true
+}
+
+// Validate reports the first structural problem in a typed tree.
+func (n *Node) Validate() error {
+    var err error
+    n.Walk(func(node *Node) bool {
+        if strings.TrimSpace(node.Name) == "" {
+            err = fmt.Errorf("node without a name")
+            return false
+        }
+        return true
+    })
+    return err
+}
+
+// ParseNode reads an untyped tree (as decoded from an LLM reply) into a Node,
+// repairing what it can: numeric or list 'pages' become strings, missing
+// 'children' become empty, bare-string children become named nodes, unnamed
+// nodes borrow their section, and anything past MaxNodeDepth is dropped.
+// Every repair is described in the returned slice. Only trees that cannot be
+// salvaged, such as an unnamed root with no children, are rejected.
+func ParseNode(m map[string]interface{}) (*Node, []string, error) {
+    if m == nil {
+        return nil, nil, fmt.Errorf("mind map is empty")
+    }
+    var repairs []string
+    root := parseNode(m, "root", 1, &repairs)
+    if root.Name == "" {
+        if len(root.Children) == 0 {
+            return nil, repairs, fmt.Errorf("mind map root has no name and no children")
+        }
+        root.Name = "Untitled"
+        repairs = append(repairs, "root: missing name, set to \"Untitled\"")
+    }
+    if err := root.Validate(); err != nil {
+        return nil, repairs, err
+    }
+    return root, repairs, nil
+}
+
+func parseNode(m map[string]interface{}, path string, depth int, repairs *[]string) *Node {
+    repair := func(format string, args ...interface{}) {
+        *repairs = append(*repairs, path+": "+fmt.Sprintf(format, args...))
+    }
+    id, _ := m["id"].(string)
+    n := &Node{
+        ID:      strings.TrimSpace(id),
+        Name:    strings.TrimSpace(nodeString(m["name"])),
+        Tooltip: nodeString(m["tooltip"]),
+        Section: nodeString(m["section"]),
+    }
+    for k, v := range m {
+        if !nodeCoreFields[k] {
+            if n.Extra == nil {
+                n.Extra = map[string]interface{}{}
+            }
+            n.Extra[k] = v
+        }
+    }
+    for _, f := range []string{"name", "tooltip", "section"} {
+        if v, ok := m[f]; ok && v != nil {
+            if _, isStr := v.(string); !isStr {
+                repair("%s was %T, converted to string", f, v)
+            }
+        }
+    }
+    if n.Name == "" && depth > 1 {
+        if s := strings.TrimSpace(n.Section); s != "" {
+            n.Name = s
+            repair("missing name, used section %q", s)
+        }
+    }
+
+    switch p := m["pages"].(type) {
+    case nil:
+    case string:
+        n.Pages = strings.TrimSpace(p)
+    default:
+        n.Pages = pagesString(p)
+        repair("pages was %T, converted to %q", p, n.Pages)
+    }
+
+    switch kids := m["children"].(type) {
+    case nil:
+    case []interface{}:
+        if depth >= MaxNodeDepth {
+            if len(kids) > 0 {
+                repair("dropped %d children beyond depth %d", len(kids), MaxNodeDepth)
+            }
+            break
+        }
+        for i, k := range kids {
+            childPath := fmt.Sprintf("%s.children[%d]", path, i)
+            switch c := k.(type) {
+            case map[string]interface{}:
+                child := parseNode(c, childPath, depth+1, repairs)
+                if child.Name == "" {
+                    *repairs = append(*repairs, childPath+": dropped unnamed node")
+                    continue
+                }
+                n.Children = append(n.Children, child)
+            case string:
+                if strings.TrimSpace(c) == "" {
+                    continue
+                }
+                n.Children = append(n.Children, &Node{Name: strings.TrimSpace(c), Children: []*Node{}})
+                *repairs = append(*repairs, childPath+": bare string child converted to node")
+            default:
+                *repairs = append(*repairs, fmt.Sprintf("%s: dropped %T child", childPath, k))
+            }
+        }
+    case map[string]interface{}:
+        // A single child object instead of an array
+        child := parseNode(kids, path+".children[0]", depth+1, repairs)
+        if child.Name != "" {
+            n.Children = append(n.Children, child)
+        }
+        repair("children was an object, wrapped in an array")
+    default:
+        repair("children was %T, replaced with empty array", kids)
+    }
+    if n.Children == nil {
+        n.Children = []*Node{}
+    }
+    return n
+}
+
+func nodeString(v interface{}) string {
+    switch t := v.(type) {
+    case nil:
+        return ""
+    case string:
+        return t
+    case float64:
+        return strconv.FormatFloat(t, 'f', -1, 64)
+    default:
+        return valueAsString(t)
+    }
+}
+
+// pagesString renders a non-string 'pages' value (3, [3, 4], ["5-7"]) as the
+// string form the frontend expects.
+func pagesString(v interface{}) string {
+    switch t := v.(type) {
+    case float64:
+        if t == math.Trunc(t) {
+            return strconv.Itoa(int(t))
+        }
+        return strconv.FormatFloat(t, 'f', -1, 64)
+    case []interface{}:
+        parts := make([]string, 0, len(t))
+        for _, e := range t {
+            if s := pagesString(e); s != "" {
+                parts = append(parts, s)
+            }
+        }
+        return strings.Join(parts, ", ")
+    case string:
+        return strings.TrimSpace(t)
+    case nil:
+        return ""
+    default:
+        return fmt.Sprintf("%v", t)
+    }
+}
+
+// AssignIDs gives n and every descendant a fresh id, replacing any it had.
+func (n *Node) AssignIDs() {
+    n.Walk(func(node *Node) bool {
+        node.ID = uuid.New().String()
+        return true
+    })
+}
+
+// normalizeTree parses an LLM-produced tree, logging any repairs made. The
+// nodes are new, so they get fresh ids whatever the model put there.
+func normalizeTree(label string, raw map[string]interface{}) (*Node, error) {
+    node, repairs, err := ParseNode(raw)
+    for _, r := range repairs {
+        log.Printf("%s: repaired mind map: %s", label, r)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("malformed mind map: %w", err)
+    }
+    node.AssignIDs()
+    return node, nil
+}
+
+// normalizeChildren parses an LLM-produced list of child nodes.
+func normalizeChildren(label string, raw interface{}) ([]*Node, error) {
+    kids, ok := raw.([]interface{})
+    if !ok {
+        return nil, fmt.Errorf("malformed mind map: expected a children array, got %T", raw)
+    }
+    holder, err := normalizeTree(label, map[string]interface{}{"name": "children", "children": kids})
+    if err != nil {
+        return nil, err
+    }
+    return holder.Children, nil
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseNodeRepairs(t *testing.T) {
+	var raw map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"name": "Root", "tooltip": "t", "section": "Abstract", "pages": 1,
+		"pagesVerified": true,
+		"children": [
+			{"name": "Pages as list", "pages": [3, 4]},
+			{"section": "2.1 Setup", "pages": "2"},
+			"Bare string",
+			{"tooltip": "no name or section"},
+			42,
+			{"name": "Single child", "children": {"name": "Wrapped"}}
+		]
+	}`), &raw)
+
+	root, repairs, err := ParseNode(raw)
+	if err != nil {
+		t.Fatalf("ParseNode: %v", err)
+	}
+	if len(repairs) == 0 {
+		t.Fatal("expected repairs to be reported")
+	}
+	if root.Pages != "1" {
+		t.Fatalf("numeric pages not converted: %q", root.Pages)
+	}
+	if root.Extra["pagesVerified"] != true {
+		t.Fatalf("extension field lost: %v", root.Extra)
+	}
+	var names []string
+	for _, c := range root.Children {
+		names = append(names, c.Name)
+		if c.Children == nil {
+			t.Fatalf("child %q has nil children", c.Name)
+		}
+	}
+	want := []string{"Pages as list", "2.1 Setup", "Bare string", "Single child"}
+	if len(names) != len(want) {
+		t.Fatalf("expected children %v, got %v", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("expected children %v, got %v", want, names)
+		}
+	}
+	if root.Children[0].Pages != "3, 4" {
+		t.Fatalf("list pages not converted: %q", root.Children[0].Pages)
+	}
+	if len(root.Children[3].Children) != 1 || root.Children[3].Children[0].Name != "Wrapped" {
+		t.Fatalf("object children not wrapped: %+v", root.Children[3])
+	}
+}
+
+func TestParseNodeRejects(t *testing.T) {
+	if _, _, err := ParseNode(nil); err == nil {
+		t.Fatal("expected nil tree to be rejected")
+	}
+	if _, _, err := ParseNode(map[string]interface{}{"tooltip": "nothing else"}); err == nil {
+		t.Fatal("expected unnamed, childless root to be rejected")
+	}
+	root, _, err := ParseNode(map[string]interface{}{"children": []interface{}{map[string]interface{}{"name": "a"}}})
+	if err != nil || root.Name != "Untitled" {
+		t.Fatalf("unnamed root with children should be repaired, got %v (%v)", root, err)
+	}
+}
+
+func TestParseNodeDepthLimit(t *testing.T) {
+	leaf := map[string]interface{}{"name": "leaf"}
+	for i := 0; i < MaxNodeDepth+3; i++ {
+		leaf = map[string]interface{}{"name": "level", "children": []interface{}{leaf}}
+	}
+	root, _, err := ParseNode(leaf)
+	if err != nil {
+		t.Fatalf("ParseNode: %v", err)
+	}
+	depth := 0
+	for n := root; n != nil; depth++ {
+		if len(n.Children) == 0 {
+			break
+		}
+		n = n.Children[0]
+	}
+	if depth+1 > MaxNodeDepth {
+		t.Fatalf("tree deeper than MaxNodeDepth: %d", depth+1)
+	}
+}
+
+func TestNodeJSONRoundTrip(t *testing.T) {
+	n := &Node{Name: "Root", Pages: "1", Extra: map[string]interface{}{"pagesClaimed": "9"}}
+	m := n.Map()
+	if m["pagesClaimed"] != "9" || m["name"] != "Root" {
+		t.Fatalf("Map lost fields: %v", m)
+	}
+	if kids, ok := m["children"].([]interface{}); !ok || len(kids) != 0 {
+		t.Fatalf("Map must always include a children array: %v", m)
+	}
+	var back Node
+	raw, _ := json.Marshal(n)
+	if err := json.Unmarshal(raw, &back); err != nil || back.Name != "Root" || back.Extra["pagesClaimed"] != "9" {
+		t.Fatalf("round trip failed: %+v (%v)", back, err)
+	}
+}
+
+func TestNormalizeTreeAssignsFreshIDs(t *testing.T) {
+	raw := map[string]interface{}{
+		"name": "Root", "id": "from-the-model",
+		"children": []interface{}{map[string]interface{}{"name": "a", "id": "from-the-model"}},
+	}
+	root, err := normalizeTree("test", raw)
+	if err != nil {
+		t.Fatalf("normalizeTree: %v", err)
+	}
+	child := root.Children[0]
+	if root.ID == "" || root.ID == "from-the-model" || child.ID == "" || child.ID == root.ID {
+		t.Fatalf("expected fresh unique ids, got root=%q child=%q", root.ID, child.ID)
+	}
+	if m := root.Map(); m["id"] != root.ID || FindNodeByID(m, child.ID)["name"] != "a" {
+		t.Fatalf("ids not written back: %v", m)
+	}
+}
@@ -0,0 +1,174 @@
+package utils
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+func init() {
+    RegisterProvider("openai", func(ctx context.Context) (LLMProvider, error) {
+        return NewOpenAIProvider(), nil
+    })
+}
+
+// OpenAIProvider talks to any server implementing the OpenAI chat-completions
+// protocol (vLLM, llama.cpp server, Ollama, or OpenAI itself).
+type OpenAIProvider struct {
+    BaseURL    string
+    Model      string
+    APIKey     string
+    // ContextTokens is the model's context window (OPENAI_CONTEXT_TOKENS).
+    ContextTokens int
+    HTTPClient    *http.Client
+}
+
+// NewOpenAIProvider reads OPENAI_BASE_URL (default: a local Ollama), OPENAI_MODEL,
+// OPENAI_CONTEXT_TOKENS and the optional OPENAI_API_KEY.
+func NewOpenAIProvider() *OpenAIProvider {
+    base := strings.TrimSpace(os.Getenv("OPENAI_BASE_URL"))
+    if base == "" {
+        base = "http://localhost:11434/v1"
+    }
+    model := strings.TrimSpace(os.Getenv("OPENAI_MODEL"))
+    if model == "" {
+        model = "llama3.1"
+    }
+    contextTokens := 8192
+    if v := strings.TrimSpace(os.Getenv("OPENAI_CONTEXT_TOKENS")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n > 0 {
+            contextTokens = n
+        }
+    }
+    return &OpenAIProvider{
+        BaseURL:       strings.TrimRight(base, "/"),
+        Model:         model,
+        APIKey:        strings.TrimSpace(os.Getenv("OPENAI_API_KEY")),
+        ContextTokens: contextTokens,
+        HTTPClient:    &http.Client{Timeout: 5 * time.Minute},
+    }
+}
+
+func (p *OpenAIProvider) Name() string { return "openai" }
+
+// ContextBudget reserves room in the window for the 4000-token reply and
+// the prompt instructions.
+func (p *OpenAIProvider) ContextBudget() int {
+    if n := p.ContextTokens - 5000; n > 1024 {
+        return n
+    }
+    return 1024
+}
+
+// OpenAIRequest represents the chat-completions request payload
+type OpenAIRequest struct {
+    Model       string    `json:"model"`
+    Messages    []Message `json:"messages"`
+    MaxTokens   int       `json:"max_tokens,omitempty"`
+    Temperature float64   `json:"temperature"`
+}
+
+// OpenAIResponse represents the chat-completions response
+type OpenAIResponse struct {
+    Choices []struct {
+        Message Message `json:"message"`
+    } `json:"choices"`
+    Usage struct {
+        PromptTokens     int `json:"prompt_tokens"`
+        CompletionTokens int `json:"completion_tokens"`
+    } `json:"usage"`
+}
+
+func (p *OpenAIProvider) CompleteJSON(ctx context.Context, system, prompt string) (map[string]interface{}, error) {
+    return CallOpenAI(ctx, p, prompt, system)
+}
+
+func CallOpenAI(ctx context.Context, p *OpenAIProvider, prompt, systemPrompt string) (map[string]interface{}, error) {
+    if err := enforceBudget(ctx); err != nil {
+        return nil, err
+    }
+    payload := OpenAIRequest{
+        Model:       p.Model,
+        MaxTokens:   4000,
+        Temperature: 0.0,
+        Messages: []Message{
+            {Role: "system", Content: systemPrompt},
+            {Role: "user", Content: prompt},
+        },
+    }
+    payloadBytes, err := json.Marshal(payload)
+    if err != nil {
+        return nil, fmt.Errorf("failed to marshal payload: %w", err)
+    }
+
+    const maxRetries = 3
+    delay := time.Second
+
+    for i := range maxRetries {
+        body, status, err := p.post(ctx, payloadBytes)
+        if err != nil || status == http.StatusTooManyRequests || status >= 500 {
+            if err == nil {
+                err = fmt.Errorf("status %d: %s", status, strings.TrimSpace(string(body)))
+            }
+            log.Printf("OpenAI-compatible API error (attempt %d): %v", i+1, err)
+            if ctx.Err() != nil {
+                return nil, ctx.Err()
+            }
+            if i < maxRetries-1 {
+                log.Printf("Retrying in %v...", delay)
+                select {
+                case <-ctx.Done():
+                    return nil, ctx.Err()
+                case <-time.After(delay):
+                }
+                delay *= 2
+                continue
+            }
+            return nil, fmt.Errorf("openai-compatible API call failed after %d retries: %w", maxRetries, err)
+        }
+        if status != http.StatusOK {
+            return nil, fmt.Errorf("openai-compatible API returned status %d: %s", status, strings.TrimSpace(string(body)))
+        }
+
+        var responseBody OpenAIResponse
+        if err := json.Unmarshal(body, &responseBody); err != nil {
+            return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+        }
+        recordUsage(ctx, "openai", p.Model, responseBody.Usage.PromptTokens, responseBody.Usage.CompletionTokens)
+        if len(responseBody.Choices) == 0 {
+            return nil, fmt.Errorf("empty response content")
+        }
+        return parseJSONObject("OpenAI-compatible", responseBody.Choices[0].Message.Content)
+    }
+
+    return nil, fmt.Errorf("openai-compatible API call failed after multiple retries")
+}
+
+func (p *OpenAIProvider) post(ctx context.Context, payload []byte) ([]byte, int, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.BaseURL+"/chat/completions", bytes.NewReader(payload))
+    if err != nil {
+        return nil, 0, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if p.APIKey != "" {
+        req.Header.Set("Authorization", "Bearer "+p.APIKey)
+    }
+    resp, err := p.HTTPClient.Do(req)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, resp.StatusCode, err
+    }
+    return body, resp.StatusCode, nil
+}
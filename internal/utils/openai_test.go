@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOpenAIProviderCompleteJSON(t *testing.T) {
+	var got OpenAIRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("unexpected Authorization header %q", auth)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Here you go:\n{\"title\":\"Offline\",\"authors\":[\"A\"]}"}}]}`))
+	}))
+	defer srv.Close()
+
+	t.Setenv("OPENAI_BASE_URL", srv.URL+"/v1/")
+	t.Setenv("OPENAI_MODEL", "tiny")
+	t.Setenv("OPENAI_API_KEY", "secret")
+	p, err := NewProvider(context.Background(), "openai")
+	if err != nil {
+		t.Fatalf("expected openai provider: %v", err)
+	}
+
+	out, err := ExtractMetadata(context.Background(), p, "some paper text")
+	if err != nil {
+		t.Fatalf("ExtractMetadata failed: %v", err)
+	}
+	if out["title"] != "Offline" {
+		t.Fatalf("expected title from fallback JSON extraction, got %v", out)
+	}
+	if got.Model != "tiny" || len(got.Messages) != 2 || got.Messages[0].Role != "system" {
+		t.Fatalf("unexpected request payload %+v", got)
+	}
+}
+
+func TestOpenAIProviderClientError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"model not found"}`, http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	p := &OpenAIProvider{BaseURL: srv.URL, Model: "missing", HTTPClient: srv.Client()}
+	if _, err := p.CompleteJSON(context.Background(), "sys", "prompt"); err == nil {
+		t.Fatal("expected error for 404 response")
+	}
+}
+
+func TestOpenAIProviderStopsRetryingWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		cancel()
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	p := &OpenAIProvider{BaseURL: srv.URL, Model: "tiny", HTTPClient: srv.Client()}
+	start := time.Now()
+	_, err := p.CompleteJSON(ctx, "sys", "prompt")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancellation, got %v", err)
+	}
+	if attempts != 1 || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected no retries after cancelling, got %d attempts in %v", attempts, time.Since(start))
+	}
+}
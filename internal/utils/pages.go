@@ -0,0 +1,263 @@
+package utils
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+// Prompts receive page-marked text so the model can cite real page numbers,
+// and VerifyPages checks those citations against where a node's key terms
+// actually occur.
+
+const pageMarkerFormat = "--- Page %d ---"
+
+// pageMarkerNote is appended to prompt instructions wherever page-marked text is sent.
+const pageMarkerNote = `The text is split into pages, each starting with a line like "--- Page 3 ---". Take 'pages' values from these markers.`
+
+var pageMarkerRe = regexp.MustCompile(`--- Page (\d+)(?: \(continued\))? ---`)
+
+// MarkPages joins pages into one text, each preceded by a "--- Page N ---" line.
+func MarkPages(pages []db.PageText) string {
+    var b strings.Builder
+    for _, p := range pages {
+        fmt.Fprintf(&b, pageMarkerFormat+"\n", p.Page)
+        b.WriteString(p.Text)
+        if !strings.HasSuffix(p.Text, "\n") {
+            b.WriteString("\n")
+        }
+    }
+    return b.String()
+}
+
+// paperText returns the text node-action prompts should see: page-marked when
+// the item has per-page text, otherwise the legacy flat PDFText.
+func paperText(item *db.MindmapItem) string {
+    if len(item.PageTexts) > 0 {
+        return MarkPages(item.PageTexts)
+    }
+    return item.PDFText
+}
+
+// continuedMarker returns the page marker to prepend to a chunk that starts at
+// offset in a page-marked text, or "" if the chunk already starts with one.
+func continuedMarker(text string, offset int) string {
+    if strings.HasPrefix(text[offset:], "--- Page ") {
+        return ""
+    }
+    all := pageMarkerRe.FindAllStringSubmatchIndex(text[:offset], -1)
+    if len(all) == 0 {
+        return ""
+    }
+    last := all[len(all)-1]
+    return fmt.Sprintf("--- Page %s (continued) ---\n", text[last[2]:last[3]])
+}
+
+// Page verification modes, selected with PAGE_VERIFY.
+const (
+    PageVerifyCorrect = "correct" // replace wrong citations with the pages the terms appear on
+    PageVerifyFlag    = "flag"    // keep the model's citation but mark it unverified
+    PageVerifyOff     = "off"
+)
+
+func pageVerifyMode() string {
+    switch m := strings.ToLower(strings.TrimSpace(os.Getenv("PAGE_VERIFY"))); m {
+    case PageVerifyFlag, PageVerifyOff:
+        return m
+    }
+    return PageVerifyCorrect
+}
+
+// PageMismatch describes a node whose cited pages did not contain its key terms.
+type PageMismatch struct {
+    Node    string
+    Claimed string
+    Found   string
+}
+
+// maxCorrectedPages caps how many pages a correction may cite; terms that
+// appear everywhere are not evidence of any particular page.
+const maxCorrectedPages = 5
+
+var stopwords = map[string]bool{
+    "about": true, "above": true, "after": true, "also": true, "among": true, "and": true,
+    "based": true, "been": true, "between": true, "both": true, "from": true, "have": true,
+    "into": true, "more": true, "most": true, "other": true, "over": true, "such": true,
+    "than": true, "that": true, "their": true, "them": true, "then": true, "there": true,
+    "these": true, "they": true, "this": true, "through": true, "using": true, "very": true,
+    "what": true, "when": true, "which": true, "while": true, "with": true, "within": true,
+}
+
+var wordRe = regexp.MustCompile(`[\p{L}\p{N}][\p{L}\p{N}\-]*`)
+
+// keyTerms extracts the distinctive lower-cased words of a node name.
+func keyTerms(name string) []string {
+    seen := map[string]bool{}
+    var terms []string
+    for _, w := range wordRe.FindAllString(strings.ToLower(name), -1) {
+        if len(w) < 4 || stopwords[w] || seen[w] {
+            continue
+        }
+        seen[w] = true
+        terms = append(terms, w)
+    }
+    return terms
+}
+
+// ParsePageRanges reads citations like "3", "5-7" or "3, 7-8" into sorted,
+// de-duplicated page numbers.
+func ParsePageRanges(s string) ([]int, error) {
+    set := map[int]bool{}
+    for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' }) {
+        part = strings.TrimSpace(part)
+        part = strings.TrimPrefix(strings.TrimPrefix(part, "pp."), "p.")
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        lo, hi, isRange := strings.Cut(part, "-")
+        if !isRange {
+            lo, hi, isRange = strings.Cut(part, "–")
+        }
+        a, err := strconv.Atoi(strings.TrimSpace(lo))
+        if err != nil {
+            return nil, fmt.Errorf("invalid page %q", part)
+        }
+        b := a
+        if isRange {
+            if b, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+                return nil, fmt.Errorf("invalid page range %q", part)
+            }
+        }
+        if b < a || b-a > 10000 {
+            return nil, fmt.Errorf("invalid page range %q", part)
+        }
+        for p := a; p <= b; p++ {
+            set[p] = true
+        }
+    }
+    out := make([]int, 0, len(set))
+    for p := range set {
+        out = append(out, p)
+    }
+    sort.Ints(out)
+    return out, nil
+}
+
+// FormatPageRanges renders sorted page numbers compactly, e.g. "3, 5-7".
+func FormatPageRanges(pages []int) string {
+    var parts []string
+    for i := 0; i < len(pages); {
+        j := i
+        for j+1 < len(pages) && pages[j+1] == pages[j]+1 {
+            j++
+        }
+        if i == j {
+            parts = append(parts, strconv.Itoa(pages[i]))
+        } else {
+            parts = append(parts, fmt.Sprintf("%d-%d", pages[i], pages[j]))
+        }
+        i = j + 1
+    }
+    return strings.Join(parts, ", ")
+}
+
+// VerifyPages walks a mind map and checks each node's 'pages' against the
+// pages where its key terms appear. Nodes whose terms are found get
+// "pagesVerified"; mismatches are corrected (keeping the model's value in
+// "pagesClaimed") or flagged, depending on mode.
+func VerifyPages(root map[string]interface{}, pages []db.PageText, mode string) []PageMismatch {
+    if root == nil || len(pages) == 0 || mode == PageVerifyOff {
+        return nil
+    }
+    lowered := make([]string, len(pages))
+    for i, p := range pages {
+        lowered[i] = strings.ToLower(p.Text)
+    }
+
+    var mismatches []PageMismatch
+    var walk func(node map[string]interface{})
+    walk = func(node map[string]interface{}) {
+        if m, ok := verifyNode(node, pages, lowered, mode); ok {
+            mismatches = append(mismatches, m)
+        }
+        if kids, ok := node["children"].([]interface{}); ok {
+            for _, k := range kids {
+                if child, ok := k.(map[string]interface{}); ok {
+                    walk(child)
+                }
+            }
+        }
+    }
+    walk(root)
+    return mismatches
+}
+
+func verifyNode(node map[string]interface{}, pages []db.PageText, lowered []string, mode string) (PageMismatch, bool) {
+    name := valueAsString(node["name"])
+    terms := keyTerms(name)
+    if len(terms) == 0 {
+        return PageMismatch{}, false
+    }
+
+    // Score each page by how many distinct terms it mentions
+    best := 0
+    scores := make([]int, len(pages))
+    for i, text := range lowered {
+        for _, t := range terms {
+            if strings.Contains(text, t) {
+                scores[i]++
+            }
+        }
+        if scores[i] > best {
+            best = scores[i]
+        }
+    }
+    // Too little evidence to judge either way
+    if best == 0 || best < min(2, len(terms)) {
+        return PageMismatch{}, false
+    }
+    var evidence []int
+    for i, s := range scores {
+        if s == best {
+            evidence = append(evidence, pages[i].Page)
+        }
+    }
+
+    claimedRaw := valueAsString(node["pages"])
+    claimed, err := ParsePageRanges(claimedRaw)
+    if err == nil {
+        for _, c := range claimed {
+            for _, e := range evidence {
+                if c == e {
+                    node["pagesVerified"] = true
+                    return PageMismatch{}, false
+                }
+            }
+        }
+    }
+
+    found := FormatPageRanges(evidence)
+    if mode == PageVerifyCorrect && len(evidence) <= maxCorrectedPages {
+        node["pagesClaimed"] = claimedRaw
+        node["pages"] = found
+        node["pagesVerified"] = true
+    } else {
+        node["pagesVerified"] = false
+    }
+    return PageMismatch{Node: name, Claimed: claimedRaw, Found: found}, true
+}
+
+// verifyAndLog runs VerifyPages with the configured mode and logs mismatches.
+func verifyAndLog(label string, root map[string]interface{}, pages []db.PageText) {
+    mode := pageVerifyMode()
+    for _, m := range VerifyPages(root, pages, mode) {
+        log.Printf("%s: node %q cites pages %q but its terms appear on %q (mode=%s)", label, m.Node, m.Claimed, m.Found, mode)
+    }
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+func TestParseAndFormatPageRanges(t *testing.T) {
+	got, err := ParsePageRanges("7-8, 3; p. 5, 4")
+	if err != nil {
+		t.Fatalf("ParsePageRanges: %v", err)
+	}
+	if want := []int{3, 4, 5, 7, 8}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if s := FormatPageRanges(got); s != "3-5, 7-8" {
+		t.Fatalf("expected compact ranges, got %q", s)
+	}
+	for _, bad := range []string{"three", "9-2"} {
+		if _, err := ParsePageRanges(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestMarkPagesAndContinuedMarker(t *testing.T) {
+	pages := []db.PageText{{Page: 1, Text: "first page"}, {Page: 2, Text: "second page\n"}}
+	text := MarkPages(pages)
+	if text != "--- Page 1 ---\nfirst page\n--- Page 2 ---\nsecond page\n" {
+		t.Fatalf("unexpected marked text %q", text)
+	}
+	mid := strings.Index(text, "second")
+	if m := continuedMarker(text, mid); m != "--- Page 2 (continued) ---\n" {
+		t.Fatalf("expected page 2 continuation, got %q", m)
+	}
+	if m := continuedMarker(text, strings.Index(text, "--- Page 2")); m != "" {
+		t.Fatalf("chunk already starting with a marker needs none, got %q", m)
+	}
+}
+
+func verifyFixture() (map[string]interface{}, []db.PageText) {
+	pages := []db.PageText{
+		{Page: 1, Text: "Abstract. We study sparse attention for long documents."},
+		{Page: 2, Text: "Related work on recurrent models."},
+		{Page: 3, Text: "Our sparse attention kernel and its memory layout."},
+		{Page: 4, Text: "Results on the benchmark."},
+	}
+	root := map[string]interface{}{
+		"name": "Paper", "pages": "1",
+		"children": []interface{}{
+			map[string]interface{}{"name": "Recurrent models", "pages": "2"},
+			map[string]interface{}{"name": "Sparse attention kernel", "pages": "4"},
+			map[string]interface{}{"name": "Quantum gravity", "pages": "9"},
+		},
+	}
+	return root, pages
+}
+
+func TestVerifyPagesCorrects(t *testing.T) {
+	root, pages := verifyFixture()
+	mismatches := VerifyPages(root, pages, PageVerifyCorrect)
+	if len(mismatches) != 1 || mismatches[0].Node != "Sparse attention kernel" {
+		t.Fatalf("expected exactly the kernel node to mismatch, got %+v", mismatches)
+	}
+	kids := root["children"].([]interface{})
+	recurrent := kids[0].(map[string]interface{})
+	if recurrent["pagesVerified"] != true || recurrent["pages"] != "2" {
+		t.Fatalf("correct citation should be verified and kept: %v", recurrent)
+	}
+	kernel := kids[1].(map[string]interface{})
+	if kernel["pages"] != "3" || kernel["pagesClaimed"] != "4" || kernel["pagesVerified"] != true {
+		t.Fatalf("wrong citation should be corrected to page 3: %v", kernel)
+	}
+	unknown := kids[2].(map[string]interface{})
+	if _, ok := unknown["pagesVerified"]; ok || unknown["pages"] != "9" {
+		t.Fatalf("node with no evidence should be left alone: %v", unknown)
+	}
+}
+
+func TestVerifyPagesFlagsAndOff(t *testing.T) {
+	root, pages := verifyFixture()
+	VerifyPages(root, pages, PageVerifyFlag)
+	kernel := root["children"].([]interface{})[1].(map[string]interface{})
+	if kernel["pages"] != "4" || kernel["pagesVerified"] != false {
+		t.Fatalf("flag mode should keep the citation and mark it unverified: %v", kernel)
+	}
+
+	root, pages = verifyFixture()
+	if got := VerifyPages(root, pages, PageVerifyOff); got != nil {
+		t.Fatalf("off mode should not verify, got %+v", got)
+	}
+}
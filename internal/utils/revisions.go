@@ -0,0 +1,289 @@
+package utils
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+// Operations recorded on revisions that are not LLM calls.
+const (
+    OpUpload  = "upload"
+    OpRestore = "restore"
+)
+
+// FieldChange is one node field's value in two revisions.
+type FieldChange struct {
+    From interface{} `json:"from"`
+    To   interface{} `json:"to"`
+}
+
+// NodeDiff is a node added, removed or changed between two revisions.
+type NodeDiff struct {
+    ID       string                 `json:"id"`
+    Name     string                 `json:"name"`
+    ParentID string                 `json:"parentId,omitempty"`
+    Changes  map[string]FieldChange `json:"changes,omitempty"`
+}
+
+// RevisionDiff compares two revisions node by node.
+type RevisionDiff struct {
+    From    int        `json:"from"`
+    To      int        `json:"to"`
+    Added   []NodeDiff `json:"added"`
+    Removed []NodeDiff `json:"removed"`
+    Changed []NodeDiff `json:"changed"`
+}
+
+type flatNode struct {
+    node   map[string]interface{}
+    parent string
+    order  int
+}
+
+// flattenTree indexes the nodes of root by id, in depth-first order. Nodes
+// without an id cannot be matched across revisions and are left out.
+func flattenTree(root map[string]interface{}) map[string]flatNode {
+    out := map[string]flatNode{}
+    var walk func(node map[string]interface{}, parent string)
+    walk = func(node map[string]interface{}, parent string) {
+        id, _ := node["id"].(string)
+        if id != "" {
+            out[id] = flatNode{node: node, parent: parent, order: len(out)}
+        }
+        kids, _ := node["children"].([]interface{})
+        for _, k := range kids {
+            if child, ok := k.(map[string]interface{}); ok {
+                walk(child, id)
+            }
+        }
+    }
+    if root != nil {
+        walk(root, "")
+    }
+    return out
+}
+
+// DiffTrees lists the nodes only in to, only in from, and in both with a
+// different field or parent. Children are compared as nodes of their own.
+func DiffTrees(from, to map[string]interface{}) (added, removed, changed []NodeDiff) {
+    a, b := flattenTree(from), flattenTree(to)
+    added, removed, changed = []NodeDiff{}, []NodeDiff{}, []NodeDiff{}
+    for id, n := range b {
+        old, ok := a[id]
+        if !ok {
+            added = append(added, NodeDiff{ID: id, Name: valueAsString(n.node["name"]), ParentID: n.parent})
+            continue
+        }
+        changes := map[string]FieldChange{}
+        for _, k := range fieldUnion(old.node, n.node) {
+            if valueAsString(old.node[k]) != valueAsString(n.node[k]) {
+                changes[k] = FieldChange{From: old.node[k], To: n.node[k]}
+            }
+        }
+        if old.parent != n.parent {
+            changes["parentId"] = FieldChange{From: old.parent, To: n.parent}
+        }
+        if len(changes) > 0 {
+            changed = append(changed, NodeDiff{ID: id, Name: valueAsString(n.node["name"]), ParentID: n.parent, Changes: changes})
+        }
+    }
+    for id, n := range a {
+        if _, ok := b[id]; !ok {
+            removed = append(removed, NodeDiff{ID: id, Name: valueAsString(n.node["name"]), ParentID: n.parent})
+        }
+    }
+    byOrder := func(list []NodeDiff, index map[string]flatNode) {
+        sort.Slice(list, func(i, j int) bool { return index[list[i].ID].order < index[list[j].ID].order })
+    }
+    byOrder(added, b)
+    byOrder(changed, b)
+    byOrder(removed, a)
+    return added, removed, changed
+}
+
+// fieldUnion lists the keys of either node, other than id and children.
+func fieldUnion(a, b map[string]interface{}) []string {
+    seen := map[string]bool{"id": true, "children": true}
+    var keys []string
+    for _, m := range []map[string]interface{}{a, b} {
+        for k := range m {
+            if !seen[k] {
+                seen[k] = true
+                keys = append(keys, k)
+            }
+        }
+    }
+    return keys
+}
+
+// cloneTree deep-copies a mind map tree, so it can be kept as it was before
+// a change is applied in place.
+func cloneTree(tree map[string]interface{}) map[string]interface{} {
+    if tree == nil {
+        return nil
+    }
+    raw, err := json.Marshal(tree)
+    if err != nil {
+        return nil
+    }
+    var out map[string]interface{}
+    json.Unmarshal(raw, &out)
+    return out
+}
+
+// RevisionsHandler serves a mind map's history:
+//
+//    GET  /api/mindmaps/{id}/revisions                     list, without the trees
+//    GET  /api/mindmaps/{id}/revisions/{version}           one revision
+//    GET  /api/mindmaps/{id}/revisions/diff?from=N&to=M    node-level diff
+//    POST /api/mindmaps/{id}/revisions/{version}/restore   make it current again
+func RevisionsHandler(w http.ResponseWriter, r *http.Request) {
+    store, _, err := db.StoreForRequest(r)
+    if err != nil {
+        http.Error(w, "unknown platform", http.StatusBadRequest)
+        return
+    }
+    revs, err := db.Revisions(store)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotImplemented)
+        return
+    }
+    parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/mindmaps/"), "/")
+    if len(parts) < 2 || parts[0] == "" || parts[1] != "revisions" {
+        http.NotFound(w, r)
+        return
+    }
+    id, rest := parts[0], parts[2:]
+    // The history of a map in the trash, or purged, is gone with it
+    item, err := store.Get(r.Context(), id)
+    if err != nil {
+        log.Printf("revisions: get %s failed: %v", id, err)
+        http.Error(w, "failed to load mindmap", http.StatusInternalServerError)
+        return
+    }
+    if item == nil || item.DeletedAt != "" {
+        http.Error(w, "mindmap not found", http.StatusNotFound)
+        return
+    }
+
+    switch {
+    case r.Method == http.MethodGet && len(rest) == 0:
+        list, err := revs.ListRevisions(r.Context(), id)
+        if err != nil {
+            log.Printf("revisions: list %s failed: %v", id, err)
+            http.Error(w, "failed to load revisions", http.StatusInternalServerError)
+            return
+        }
+        for i := range list {
+            list[i].MindmapData = nil
+        }
+        writeJSON(w, map[string]interface{}{"success": true, "revisions": list})
+    case r.Method == http.MethodGet && len(rest) == 1 && rest[0] == "diff":
+        from, errFrom := strconv.Atoi(r.URL.Query().Get("from"))
+        to, errTo := strconv.Atoi(r.URL.Query().Get("to"))
+        if errFrom != nil || errTo != nil {
+            http.Error(w, "from and to must be revision versions", http.StatusBadRequest)
+            return
+        }
+        a, ok := loadRevision(w, r, revs, id, from)
+        if !ok {
+            return
+        }
+        b, ok := loadRevision(w, r, revs, id, to)
+        if !ok {
+            return
+        }
+        diff := RevisionDiff{From: from, To: to}
+        diff.Added, diff.Removed, diff.Changed = DiffTrees(a.MindmapData, b.MindmapData)
+        writeJSON(w, map[string]interface{}{"success": true, "diff": diff})
+    case r.Method == http.MethodGet && len(rest) == 1:
+        version, err := strconv.Atoi(rest[0])
+        if err != nil {
+            http.NotFound(w, r)
+            return
+        }
+        rev, ok := loadRevision(w, r, revs, id, version)
+        if !ok {
+            return
+        }
+        writeJSON(w, map[string]interface{}{"success": true, "revision": rev})
+    case r.Method == http.MethodPost && len(rest) == 2 && rest[1] == "restore":
+        version, err := strconv.Atoi(rest[0])
+        if err != nil {
+            http.NotFound(w, r)
+            return
+        }
+        rev, ok := loadRevision(w, r, revs, id, version)
+        if !ok {
+            return
+        }
+        from := rev.Version
+        newVersion, ok := saveTree(w, r, store, id, rev.MindmapData, db.Revision{Operation: OpRestore, RestoredFrom: &from})
+        if !ok {
+            return
+        }
+        writeJSON(w, map[string]interface{}{"success": true, "version": newVersion, "mindmapData": rev.MindmapData})
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// loadRevision fetches one revision, replying 404 when there is none.
+func loadRevision(w http.ResponseWriter, r *http.Request, revs db.RevisionStore, id string, version int) (*db.Revision, bool) {
+    rev, err := revs.GetRevision(r.Context(), id, version)
+    if err != nil {
+        log.Printf("revisions: get %s@%d failed: %v", id, version, err)
+        http.Error(w, "failed to load revision", http.StatusInternalServerError)
+        return nil, false
+    }
+    if rev == nil {
+        http.Error(w, "revision not found", http.StatusNotFound)
+        return nil, false
+    }
+    return rev, true
+}
+
+// saveTree replaces a mind map's whole tree, whatever version it is at, and
+// records the change as rev. The replacement is meant to win, so a lost race
+// is simply retried against the newer version. It writes error responses
+// itself and returns the new version.
+func saveTree(w http.ResponseWriter, r *http.Request, store db.MindmapStore, id string, tree map[string]interface{}, rev db.Revision) (int, bool) {
+    for attempt := 0; ; attempt++ {
+        item, err := store.Get(r.Context(), id)
+        if err != nil || item == nil || item.DeletedAt != "" {
+            http.Error(w, "mindmap not found", http.StatusNotFound)
+            return 0, false
+        }
+        err = store.UpdateIfVersion(r.Context(), id, item.Version, map[string]interface{}{"mindmapData": tree, "lastEditedBy": sessionUser(r), "updatedAt": time.Now().UTC().Format(time.RFC3339)})
+        if err == nil {
+            rev.MindmapID, rev.Version, rev.Actor, rev.MindmapData = id, item.Version+1, sessionUser(r), tree
+            db.RecordRevision(r.Context(), store, item, rev)
+            return rev.Version, true
+        }
+        if !errors.Is(err, db.ErrVersionConflict) {
+            http.Error(w, "update failed", http.StatusInternalServerError)
+            return 0, false
+        }
+        if attempt == nodeActionRetries {
+            if item, _ := store.Get(r.Context(), id); item != nil {
+                writeVersionConflict(w, item.Version)
+                return 0, false
+            }
+            http.Error(w, "mindmap not found", http.StatusNotFound)
+            return 0, false
+        }
+    }
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,32 @@
+package utils
+
+import "testing"
+
+func TestDiffTrees(t *testing.T) {
+	from := map[string]interface{}{"id": "r", "name": "Root", "children": []interface{}{
+		map[string]interface{}{"id": "a", "name": "A", "tooltip": "old", "children": []interface{}{
+			map[string]interface{}{"id": "a1", "name": "A1"},
+		}},
+		map[string]interface{}{"id": "b", "name": "B"},
+	}}
+	to := map[string]interface{}{"id": "r", "name": "Root", "children": []interface{}{
+		map[string]interface{}{"id": "a", "name": "A", "tooltip": "new"},
+		map[string]interface{}{"id": "b", "name": "B", "children": []interface{}{
+			map[string]interface{}{"id": "a1", "name": "A1"},
+			map[string]interface{}{"id": "b1", "name": "B1"},
+		}},
+	}}
+	added, removed, changed := DiffTrees(from, to)
+	if len(added) != 1 || added[0].ID != "b1" || added[0].ParentID != "b" {
+		t.Fatalf("expected b1 added under b, got %+v", added)
+	}
+	if len(removed) != 0 {
+		t.Fatalf("expected nothing removed, got %+v", removed)
+	}
+	if len(changed) != 2 || changed[0].ID != "a" || changed[0].Changes["tooltip"].To != "new" {
+		t.Fatalf("expected a's tooltip changed first, got %+v", changed)
+	}
+	if moved := changed[1]; moved.ID != "a1" || moved.Changes["parentId"] != (FieldChange{From: "a", To: "b"}) {
+		t.Fatalf("expected a1 moved from a to b, got %+v", moved)
+	}
+}
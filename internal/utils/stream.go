@@ -0,0 +1,117 @@
+package utils
+
+import (
+    "encoding/json"
+    "strings"
+)
+
+// A streamed mind map arrives as JSON text that is incomplete until the last
+// token. partialTree turns the text received so far into the tree of every
+// node that has been fully written, so clients can draw it as it grows.
+
+// partialTree accumulates streamed text and reports the tree parsed from it
+// whenever another node has been completed.
+type partialTree struct {
+    text  strings.Builder
+    nodes int
+}
+
+// Add appends chunk and returns the current tree when it holds more complete
+// nodes than the last one returned.
+func (p *partialTree) Add(chunk string) (map[string]interface{}, bool) {
+    p.text.WriteString(chunk)
+    if !strings.Contains(chunk, "}") {
+        return nil, false
+    }
+    tree, ok := parsePartialObject(p.text.String())
+    if !ok {
+        return nil, false
+    }
+    n := countNodes(tree)
+    if n <= p.nodes {
+        return nil, false
+    }
+    p.nodes = n
+    return tree, true
+}
+
+// parsePartialObject parses the first JSON object in text, cutting it after
+// the last object that was closed and closing whatever is still open around it.
+func parsePartialObject(text string) (map[string]interface{}, bool) {
+    start := strings.Index(text, "{")
+    if start < 0 {
+        return nil, false
+    }
+    text = text[start:]
+
+    var (
+        stack    []byte // closing brackets still owed, innermost last
+        inString bool
+        escaped  bool
+        cut      = -1
+        closers  string
+    )
+    for i := 0; i < len(text); i++ {
+        c := text[i]
+        if inString {
+            switch {
+            case escaped:
+                escaped = false
+            case c == '\\':
+                escaped = true
+            case c == '"':
+                inString = false
+            }
+            continue
+        }
+        switch c {
+        case '"':
+            inString = true
+        case '{':
+            stack = append(stack, '}')
+        case '[':
+            stack = append(stack, ']')
+        case '}', ']':
+            if len(stack) == 0 || stack[len(stack)-1] != c {
+                return nil, false
+            }
+            stack = stack[:len(stack)-1]
+            if c == '}' {
+                cut = i + 1
+                closers = reverseBytes(stack)
+            }
+            if len(stack) == 0 {
+                cut, closers = i+1, ""
+                i = len(text)
+            }
+        }
+    }
+    if cut < 0 {
+        return nil, false
+    }
+    var out map[string]interface{}
+    if err := json.Unmarshal([]byte(text[:cut]+closers), &out); err != nil {
+        return nil, false
+    }
+    return out, true
+}
+
+func reverseBytes(b []byte) string {
+    out := make([]byte, len(b))
+    for i, c := range b {
+        out[len(b)-1-i] = c
+    }
+    return string(out)
+}
+
+// countNodes counts node and its descendants.
+func countNodes(node map[string]interface{}) int {
+    n := 1
+    kids, _ := node["children"].([]interface{})
+    for _, k := range kids {
+        if child, ok := k.(map[string]interface{}); ok {
+            n += countNodes(child)
+        }
+    }
+    return n
+}
@@ -0,0 +1,42 @@
+package utils
+
+import "testing"
+
+func TestParsePartialObject(t *testing.T) {
+	cases := []struct {
+		text  string
+		nodes int // 0 means no tree yet
+	}{
+		{`{"name":"Root","children":[`, 0},
+		{"```json\n" + `{"name":"Root","children":[{"name":"A","tooltip":"has } and ] inside"}`, 2},
+		{`{"name":"Root","children":[{"name":"A","children":[{"name":"A1"}]},{"name":"B","tool`, 3},
+		{`{"name":"Root","children":[{"name":"A"},{"name":"B"}]} trailing prose`, 3},
+		{`{"name":"Root"]`, 0},
+	}
+	for _, c := range cases {
+		tree, ok := parsePartialObject(c.text)
+		if c.nodes == 0 {
+			if ok {
+				t.Errorf("%q: expected no tree, got %v", c.text, tree)
+			}
+			continue
+		}
+		if !ok || tree["name"] != "Root" || countNodes(tree) != c.nodes {
+			t.Errorf("%q: expected %d nodes under Root, got %v (ok=%t)", c.text, c.nodes, tree, ok)
+		}
+	}
+}
+
+func TestPartialTreeReportsOnlyGrowth(t *testing.T) {
+	var p partialTree
+	chunks := []string{`{"name":"Root","child`, `ren":[{"name":"A"}`, `,{"name":"B",`, `"tooltip":"{x}"`, `}]}`}
+	var sizes []int
+	for _, c := range chunks {
+		if tree, ok := p.Add(c); ok {
+			sizes = append(sizes, countNodes(tree))
+		}
+	}
+	if len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 3 {
+		t.Fatalf("expected trees of 2 then 3 nodes, got %v", sizes)
+	}
+}
@@ -0,0 +1,179 @@
+package utils
+
+import (
+    "context"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+// DeleteMindmapHandler: DELETE /api/mindmaps/{id}
+//
+// The mind map moves to the trash, where it can be restored until it is
+// purged.
+func DeleteMindmapHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    store, _, err := db.StoreForRequest(r)
+    if err != nil {
+        http.Error(w, "unknown platform", http.StatusBadRequest)
+        return
+    }
+    id, action := parseMindmapAction(r.URL.Path)
+    if id == "" || action != "" {
+        http.NotFound(w, r)
+        return
+    }
+    trashed, err := db.TrashMindmap(r.Context(), store, id, sessionUser(r))
+    if err != nil {
+        log.Printf("trash: delete %s failed: %v", id, err)
+        http.Error(w, "error deleting mindmap", http.StatusInternalServerError)
+        return
+    }
+    if !trashed {
+        http.Error(w, "mindmap not found", http.StatusNotFound)
+        return
+    }
+    writeJSON(w, map[string]interface{}{"success": true, "message": "Mindmap moved to the trash"})
+}
+
+// trashEntry is what the trash lists about an item.
+type trashEntry struct {
+    ID        string   `json:"id"`
+    Title     string   `json:"title"`
+    Authors   []string `json:"authors"`
+    Filename  string   `json:"filename"`
+    Owner     string   `json:"owner,omitempty"`
+    DeletedAt string   `json:"deletedAt"`
+    DeletedBy string   `json:"deletedBy,omitempty"`
+    // PurgeAt is when the background purge will remove the item, if it runs.
+    PurgeAt string `json:"purgeAt,omitempty"`
+}
+
+// TrashHandler serves the trash:
+//
+//    GET    /api/trash               the items in it, most recently deleted first
+//    POST   /api/trash/{id}/restore  take one back out
+//    DELETE /api/trash/{id}          purge one, with its history, for good
+//    DELETE /api/trash               purge everything in it
+func TrashHandler(w http.ResponseWriter, r *http.Request) {
+    store, _, err := db.StoreForRequest(r)
+    if err != nil {
+        http.Error(w, "unknown platform", http.StatusBadRequest)
+        return
+    }
+    rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/trash"), "/")
+    id, action, _ := strings.Cut(rest, "/")
+
+    switch {
+    case r.Method == http.MethodGet && id == "":
+        trash, err := db.ListTrash(r.Context(), store)
+        if err != nil {
+            log.Printf("trash: list failed: %v", err)
+            http.Error(w, "failed to load the trash", http.StatusInternalServerError)
+            return
+        }
+        retention := trashRetention()
+        entries := make([]trashEntry, 0, len(trash))
+        for _, item := range trash {
+            e := trashEntry{ID: item.ID, Title: item.Title, Authors: item.Authors, Filename: item.Filename, Owner: item.Owner, DeletedAt: item.DeletedAt, DeletedBy: item.DeletedBy}
+            if t, err := time.Parse(time.RFC3339, item.DeletedAt); err == nil && retention > 0 {
+                e.PurgeAt = t.Add(retention).Format(time.RFC3339)
+            }
+            entries = append(entries, e)
+        }
+        writeJSON(w, map[string]interface{}{"success": true, "items": entries})
+    case r.Method == http.MethodPost && id != "" && action == "restore":
+        restored, err := db.RestoreMindmap(r.Context(), store, id)
+        if err != nil {
+            log.Printf("trash: restore %s failed: %v", id, err)
+            http.Error(w, "error restoring mindmap", http.StatusInternalServerError)
+            return
+        }
+        if !restored {
+            http.Error(w, "mindmap not in the trash", http.StatusNotFound)
+            return
+        }
+        writeJSON(w, map[string]interface{}{"success": true, "message": "Mindmap restored"})
+    case r.Method == http.MethodDelete && id != "" && action == "":
+        purged, err := db.PurgeMindmap(r.Context(), store, id)
+        if err != nil {
+            log.Printf("trash: purge %s failed: %v", id, err)
+            http.Error(w, "error purging mindmap", http.StatusInternalServerError)
+            return
+        }
+        if !purged {
+            http.Error(w, "mindmap not in the trash", http.StatusNotFound)
+            return
+        }
+        writeJSON(w, map[string]interface{}{"success": true, "purged": 1})
+    case r.Method == http.MethodDelete && id == "":
+        purged, err := db.PurgeTrash(r.Context(), store, "")
+        if err != nil {
+            http.Error(w, "error emptying the trash", http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, map[string]interface{}{"success": true, "purged": purged})
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+// trashRetention reads TRASH_RETENTION (default 720h, 30 days), how long
+// items stay in the trash. "off" keeps them until they are purged by hand
+// and returns 0.
+func trashRetention() time.Duration {
+    if strings.EqualFold(strings.TrimSpace(os.Getenv("TRASH_RETENTION")), "off") {
+        return 0
+    }
+    return envDuration("TRASH_RETENTION", 30*24*time.Hour)
+}
+
+// StartTrashPurge purges trash older than the retention window every
+// TRASH_PURGE_INTERVAL (default 1h) until ctx ends. It covers the platforms
+// in TRASH_PURGE_PLATFORMS (comma separated), or the default platform.
+func StartTrashPurge(ctx context.Context) {
+    retention := trashRetention()
+    if retention == 0 {
+        log.Printf("trash: TRASH_RETENTION=off, items stay in the trash until purged by hand")
+        return
+    }
+    platforms := db.PlatformsFromEnv("TRASH_PURGE_PLATFORMS")
+    interval := envDuration("TRASH_PURGE_INTERVAL", time.Hour)
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                purgeExpiredTrash(ctx, platforms, retention)
+            }
+        }
+    }()
+}
+
+func purgeExpiredTrash(ctx context.Context, platforms []string, retention time.Duration) {
+    cutoff := time.Now().UTC().Add(-retention).Format(time.RFC3339)
+    for _, p := range platforms {
+        store, err := db.GetStore(p)
+        if err != nil {
+            log.Printf("trash: %v", err)
+            continue
+        }
+        n, err := db.PurgeTrash(ctx, store, cutoff)
+        if err != nil {
+            log.Printf("trash: purge on %s incomplete: %v", p, err)
+        }
+        if n > 0 {
+            log.Printf("trash: purged %d mind maps deleted before %s on %s", n, cutoff, p)
+        }
+    }
+}
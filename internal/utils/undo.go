@@ -0,0 +1,173 @@
+package utils
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+
+    "github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+// Operations recorded on revisions made by undo and redo.
+const (
+    OpUndo = "undo"
+    OpRedo = "redo"
+)
+
+// pastTense words the refusals.
+var pastTense = map[string]string{OpUndo: "undone", OpRedo: "redone"}
+
+// undoableFields names the node field each undoable node action replaces.
+var undoableFields = map[string]string{
+    OpRedoDescription: "tooltip",
+    OpRemakeSubtree:   "children",
+    OpGoDeeper:        "children",
+}
+
+// undoStacks replays one user's revisions of a map, oldest first, and returns
+// the node actions they can still undo and those they can redo, most recent
+// last. A new action clears the redo stack, as in any editor.
+func undoStacks(revs []db.Revision, user string) (done, undone []db.Revision) {
+    take := func(stack []db.Revision, version int) ([]db.Revision, *db.Revision) {
+        for i := len(stack) - 1; i >= 0; i-- {
+            if stack[i].Version == version {
+                rev := stack[i]
+                return append(stack[:i:i], stack[i+1:]...), &rev
+            }
+        }
+        return stack, nil
+    }
+    for _, rev := range revs {
+        if rev.Actor != user {
+            continue
+        }
+        switch {
+        case undoableFields[rev.Operation] != "":
+            done, undone = append(done, rev), nil
+        case rev.Operation == OpUndo && rev.Reverts != nil:
+            var action *db.Revision
+            if done, action = take(done, *rev.Reverts); action != nil {
+                undone = append(undone, *action)
+            }
+        case rev.Operation == OpRedo && rev.Reverts != nil:
+            var action *db.Revision
+            if undone, action = take(undone, *rev.Reverts); action != nil {
+                done = append(done, *action)
+            }
+        }
+    }
+    return done, undone
+}
+
+// UndoHandler: POST /api/mindmaps/{id}/undo and POST /api/mindmaps/{id}/redo
+//
+// Undo takes back the caller's own most recent redo-description,
+// remake-subtree or go-deeper on the map by putting the node's tooltip or
+// children back as they were; redo puts the action back. Only that node field
+// is touched, and if anyone has changed it since, nothing is and the caller
+// gets 409, so other people's work is never thrown away.
+func UndoHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    store, _, err := db.StoreForRequest(r)
+    if err != nil {
+        http.Error(w, "unknown platform", http.StatusBadRequest)
+        return
+    }
+    revs, err := db.Revisions(store)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotImplemented)
+        return
+    }
+    id, action := parseMindmapAction(r.URL.Path)
+    if id == "" || (action != OpUndo && action != OpRedo) {
+        http.NotFound(w, r)
+        return
+    }
+
+    list, err := revs.ListRevisions(r.Context(), id)
+    if err != nil {
+        log.Printf("undo: list revisions of %s failed: %v", id, err)
+        http.Error(w, "failed to load revisions", http.StatusInternalServerError)
+        return
+    }
+    done, undone := undoStacks(list, sessionUser(r))
+    stack := done
+    if action == OpRedo {
+        stack = undone
+    }
+    if len(stack) == 0 {
+        writeRefusal(w, "Nothing to "+action+" on this mind map")
+        return
+    }
+    target := stack[len(stack)-1]
+    field := undoableFields[target.Operation]
+
+    // undo goes from the action's result back to the state before it
+    before, err := revs.GetRevision(r.Context(), id, target.Version-1)
+    if err != nil {
+        log.Printf("undo: get %s@%d failed: %v", id, target.Version-1, err)
+        http.Error(w, "failed to load revisions", http.StatusInternalServerError)
+        return
+    }
+    if before == nil || target.NodeID == "" {
+        writeRefusal(w, "The history of that change is incomplete, so it cannot be "+pastTense[action])
+        return
+    }
+    from, to := target.MindmapData, before.MindmapData
+    if action == OpRedo {
+        from, to = to, from
+    }
+    fromNode, toNode := FindNodeByID(from, target.NodeID), FindNodeByID(to, target.NodeID)
+    if fromNode == nil || toNode == nil {
+        writeRefusal(w, "The history of that change is incomplete, so it cannot be "+pastTense[action])
+        return
+    }
+
+    item, err := store.Get(r.Context(), id)
+    if err != nil || item == nil || item.DeletedAt != "" {
+        http.Error(w, "mindmap not found", http.StatusNotFound)
+        return
+    }
+    db.EnsureNodeIDs(item.MindmapData)
+    // checked again on every retry, so a write that lands meanwhile is kept
+    untouched := func(item *db.MindmapItem) error {
+        current := FindNodeByID(item.MindmapData, target.NodeID)
+        if current == nil {
+            return errors.New("The node that change was made to no longer exists")
+        }
+        if valueAsString(current[field]) != valueAsString(fromNode[field]) {
+            return errors.New("Someone has changed that node since, so your " + target.Operation + " cannot be " + pastTense[action])
+        }
+        return nil
+    }
+
+    value := toNode[field]
+    if value == nil && field == "children" {
+        value = []interface{}{}
+    }
+    req := &nodeActionRequest{NodeID: target.NodeID}
+    reverts := target.Version
+    version, ok := saveNodeAction(w, r, store, id, db.Revision{Operation: action, Reverts: &reverts}, req, item, map[string]interface{}{field: value}, untouched)
+    if !ok {
+        return
+    }
+    writeJSON(w, map[string]interface{}{
+        "success":   true,
+        "version":   version,
+        "operation": target.Operation,
+        "nodeId":    target.NodeID,
+        "updates":   map[string]interface{}{field: value},
+    })
+}
+
+// writeRefusal refuses a change that cannot be made, like an undo of a node
+// that has changed since.
+func writeRefusal(w http.ResponseWriter, message string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusConflict)
+    json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": message})
+}
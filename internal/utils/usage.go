@@ -0,0 +1,266 @@
+package utils
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+
+    "github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+// UsageTags names what an LLM call was made for, beyond its operation.
+type UsageTags struct {
+    MindmapID string
+    User      string
+}
+
+type usageTagsKey struct{}
+
+// WithUsageTags attributes the LLM calls made under ctx to a mind map and user.
+func WithUsageTags(ctx context.Context, tags UsageTags) context.Context {
+    return context.WithValue(ctx, usageTagsKey{}, tags)
+}
+
+// UsageTagsFrom returns the tags set by WithUsageTags, or zero tags.
+func UsageTagsFrom(ctx context.Context) UsageTags {
+    tags, _ := ctx.Value(usageTagsKey{}).(UsageTags)
+    return tags
+}
+
+// ModelPrice is what a model charges in US dollars per million tokens.
+type ModelPrice struct {
+    Input  float64
+    Output float64
+}
+
+// defaultPrices are list prices at the time of writing; LLM_PRICES overrides
+// them. Models missing from both are recorded at zero cost.
+var defaultPrices = map[string]ModelPrice{
+    claudeModelID: {Input: 0.80, Output: 4.00},
+    geminiModel:   {Input: 0.075, Output: 0.30},
+}
+
+var (
+    pricesMu   sync.Mutex
+    pricesSpec string
+    prices     map[string]ModelPrice
+)
+
+// modelPrices reads LLM_PRICES as "model=input/output,..." in dollars per
+// million tokens, on top of defaultPrices. It is parsed again only when it
+// changes.
+func modelPrices() map[string]ModelPrice {
+    spec := os.Getenv("LLM_PRICES")
+    pricesMu.Lock()
+    defer pricesMu.Unlock()
+    if prices == nil || spec != pricesSpec {
+        prices, pricesSpec = parsePrices(spec), spec
+    }
+    return prices
+}
+
+func parsePrices(spec string) map[string]ModelPrice {
+    out := map[string]ModelPrice{}
+    for k, v := range defaultPrices {
+        out[k] = v
+    }
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        model, price, ok := strings.Cut(entry, "=")
+        in, outPrice, ok2 := strings.Cut(price, "/")
+        inUSD, err1 := strconv.ParseFloat(strings.TrimSpace(in), 64)
+        outUSD, err2 := strconv.ParseFloat(strings.TrimSpace(outPrice), 64)
+        if !ok || !ok2 || err1 != nil || err2 != nil {
+            log.Printf("usage: ignoring LLM_PRICES entry %q", entry)
+            continue
+        }
+        out[strings.TrimSpace(model)] = ModelPrice{Input: inUSD, Output: outUSD}
+    }
+    return out
+}
+
+// usageCost prices a call's tokens at the model's rate.
+func usageCost(model string, inputTokens, outputTokens int) float64 {
+    p := modelPrices()[model]
+    return (float64(inputTokens)*p.Input + float64(outputTokens)*p.Output) / 1e6
+}
+
+// recordUsage stores the token counts of one completed LLM call, tagged from
+// ctx. Accounting must never fail a call, so errors are only logged.
+func recordUsage(ctx context.Context, provider, model string, inputTokens, outputTokens int) {
+    tags := UsageTagsFrom(ctx)
+    rec := db.UsageRecord{
+        ID:           uuid.New().String(),
+        Time:         time.Now().UTC().Format(time.RFC3339),
+        Provider:     provider,
+        Model:        model,
+        Operation:    OperationFrom(ctx),
+        MindmapID:    tags.MindmapID,
+        User:         tags.User,
+        InputTokens:  inputTokens,
+        OutputTokens: outputTokens,
+        CostUSD:      usageCost(model, inputTokens, outputTokens),
+    }
+    store, err := db.Usage()
+    if err != nil {
+        log.Printf("usage: %v", err)
+        return
+    }
+    // The tokens were spent even if the caller has since gone away
+    saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+    defer cancel()
+    if err := store.RecordUsage(saveCtx, rec); err != nil {
+        log.Printf("usage: failed to record %s call (%s, %d+%d tokens): %v", rec.Operation, model, inputTokens, outputTokens, err)
+        return
+    }
+    spend.add(store, rec)
+}
+
+// UsageTotal sums the records sharing one key.
+type UsageTotal struct {
+    Key          string  `json:"key"`
+    Title        string  `json:"title,omitempty"`
+    Calls        int     `json:"calls"`
+    InputTokens  int     `json:"inputTokens"`
+    OutputTokens int     `json:"outputTokens"`
+    CostUSD      float64 `json:"costUsd"`
+}
+
+func (t *UsageTotal) add(rec db.UsageRecord) {
+    t.Calls++
+    t.InputTokens += rec.InputTokens
+    t.OutputTokens += rec.OutputTokens
+    t.CostUSD += rec.CostUSD
+}
+
+// UsageReport aggregates usage records over a time range.
+type UsageReport struct {
+    From        string       `json:"from"`
+    To          string       `json:"to"`
+    Total       UsageTotal   `json:"total"`
+    ByMindmap   []UsageTotal `json:"byMindmap"`
+    ByUser      []UsageTotal `json:"byUser"`
+    ByOperation []UsageTotal `json:"byOperation"`
+    ByModel     []UsageTotal `json:"byModel"`
+}
+
+// SummarizeUsage totals records overall and by mind map, user, operation and
+// model, most expensive first. Calls without a mind map or user are grouped
+// under "".
+func SummarizeUsage(records []db.UsageRecord) UsageReport {
+    report := UsageReport{Total: UsageTotal{Key: "total"}}
+    groups := [4]map[string]*UsageTotal{{}, {}, {}, {}}
+    for _, rec := range records {
+        report.Total.add(rec)
+        for i, key := range [4]string{rec.MindmapID, rec.User, rec.Operation, rec.Model} {
+            g, ok := groups[i][key]
+            if !ok {
+                g = &UsageTotal{Key: key}
+                groups[i][key] = g
+            }
+            g.add(rec)
+        }
+    }
+    sorted := func(m map[string]*UsageTotal) []UsageTotal {
+        out := make([]UsageTotal, 0, len(m))
+        for _, t := range m {
+            out = append(out, *t)
+        }
+        sort.Slice(out, func(i, j int) bool {
+            if out[i].CostUSD != out[j].CostUSD {
+                return out[i].CostUSD > out[j].CostUSD
+            }
+            return out[i].Key < out[j].Key
+        })
+        return out
+    }
+    report.ByMindmap = sorted(groups[0])
+    report.ByUser = sorted(groups[1])
+    report.ByOperation = sorted(groups[2])
+    report.ByModel = sorted(groups[3])
+    return report
+}
+
+// UsageHandler: GET /api/admin/usage?from=&to=
+//
+// Both bounds accept RFC 3339 times or YYYY-MM-DD dates; the range defaults
+// to the current calendar month (UTC).
+func UsageHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    now := time.Now().UTC()
+    from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+    to := from.AddDate(0, 1, 0)
+    q := r.URL.Query()
+    for _, b := range []struct {
+        name string
+        dst  *time.Time
+        end  bool
+    }{{"from", &from, false}, {"to", &to, true}} {
+        v := strings.TrimSpace(q.Get(b.name))
+        if v == "" {
+            continue
+        }
+        t, ok := db.ParseTimeBound(v, b.end)
+        if !ok {
+            http.Error(w, "invalid "+b.name+": use RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+            return
+        }
+        *b.dst = t
+    }
+    if !to.After(from) {
+        http.Error(w, "to must be after from", http.StatusBadRequest)
+        return
+    }
+
+    store, err := db.Usage()
+    if err != nil {
+        log.Printf("usage: %v", err)
+        http.Error(w, "usage store unavailable", http.StatusServiceUnavailable)
+        return
+    }
+    records, err := store.ListUsage(r.Context(), from.Format(time.RFC3339), to.Format(time.RFC3339))
+    if err != nil {
+        log.Printf("usage: list failed: %v", err)
+        http.Error(w, "failed to load usage", http.StatusInternalServerError)
+        return
+    }
+    report := SummarizeUsage(records)
+    report.From = from.Format(time.RFC3339)
+    report.To = to.Format(time.RFC3339)
+    addMindmapTitles(r, report.ByMindmap)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "usage": report})
+}
+
+// addMindmapTitles labels per-mind-map totals with the paper's title where
+// the mind map still exists.
+func addMindmapTitles(r *http.Request, totals []UsageTotal) {
+    store, _, err := db.StoreForRequest(r)
+    if err != nil {
+        return
+    }
+    for i := range totals {
+        if totals[i].Key == "" {
+            continue
+        }
+        if item, err := store.Get(r.Context(), totals[i].Key); err == nil && item != nil {
+            totals[i].Title = item.Title
+        }
+    }
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/Tmacphee13/NanachiGo/internal/db"
+)
+
+func TestRecordUsageTagsCalls(t *testing.T) {
+	db.RegisterStore("usage-test", db.NewMemoryStore())
+	t.Setenv("USERS_PLATFORM", "usage-test")
+	ctx := WithUsageTags(context.Background(), UsageTags{MindmapID: "usage-test-map", User: "erin"})
+	if _, err := NewFakeProvider().CompleteJSON(WithOperation(ctx, OpGoDeeper), "sys", "prompt"); err != nil {
+		t.Fatalf("fake call failed: %v", err)
+	}
+
+	store, err := db.Usage()
+	if err != nil {
+		t.Fatalf("usage store: %v", err)
+	}
+	records, err := store.ListUsage(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	var found *db.UsageRecord
+	for i := range records {
+		if records[i].MindmapID == "usage-test-map" {
+			found = &records[i]
+		}
+	}
+	if found == nil {
+		t.Fatal("expected a usage record for the call")
+	}
+	if found.User != "erin" || found.Operation != OpGoDeeper || found.Provider != "fake" || found.InputTokens == 0 || found.OutputTokens == 0 {
+		t.Fatalf("unexpected record %+v", found)
+	}
+}
+
+func TestSummarizeUsage(t *testing.T) {
+	report := SummarizeUsage([]db.UsageRecord{
+		{MindmapID: "m1", User: "erin", Operation: OpMetadata, Model: "a", InputTokens: 100, OutputTokens: 10, CostUSD: 0.5},
+		{MindmapID: "m1", User: "erin", Operation: OpMindmap, Model: "a", InputTokens: 200, OutputTokens: 20, CostUSD: 1},
+		{MindmapID: "m2", User: "vic", Operation: OpGoDeeper, Model: "b", InputTokens: 50, OutputTokens: 5, CostUSD: 2},
+	})
+	if report.Total.Calls != 3 || report.Total.InputTokens != 350 || report.Total.OutputTokens != 35 || math.Abs(report.Total.CostUSD-3.5) > 1e-9 {
+		t.Fatalf("unexpected total %+v", report.Total)
+	}
+	// most expensive first
+	if len(report.ByMindmap) != 2 || report.ByMindmap[0].Key != "m2" || report.ByMindmap[1].Calls != 2 {
+		t.Fatalf("unexpected per-mindmap totals %+v", report.ByMindmap)
+	}
+	if len(report.ByUser) != 2 || len(report.ByOperation) != 3 || len(report.ByModel) != 2 {
+		t.Fatalf("unexpected grouping %+v", report)
+	}
+}
+
+func TestParsePrices(t *testing.T) {
+	prices := parsePrices("tiny=1/2, bogus, " + geminiModel + "=0.1/0.4")
+	if prices["tiny"] != (ModelPrice{Input: 1, Output: 2}) {
+		t.Fatalf("expected tiny priced, got %+v", prices["tiny"])
+	}
+	if prices[geminiModel] != (ModelPrice{Input: 0.1, Output: 0.4}) {
+		t.Fatalf("expected override of default price, got %+v", prices[geminiModel])
+	}
+	if prices[claudeModelID] != defaultPrices[claudeModelID] {
+		t.Fatal("expected defaults kept for models not overridden")
+	}
+	if _, ok := prices["bogus"]; ok {
+		t.Fatal("expected malformed entry ignored")
+	}
+}
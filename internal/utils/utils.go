@@ -2,12 +2,15 @@ package utils
 
 import (
     "context"
+    "crypto/sha256"
+    "encoding/hex"
     "encoding/json"
+    "errors"
     "fmt"
     "log"
     "math"
     "net/http"
-    "regexp"
+    "strconv"
     "strings"
     "time"
     "os"
@@ -16,11 +19,14 @@ import (
 
     "github.com/aws/aws-sdk-go-v2/aws"
     "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+    brtypes "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
     pdfread "github.com/ledongthuc/pdf"
     "github.com/google/uuid"
     "github.com/Tmacphee13/NanachiGo/internal/db"
     "github.com/Tmacphee13/NanachiGo/internal/auth"
+    "github.com/Tmacphee13/NanachiGo/internal/login"
     genai "github.com/google/generative-ai-go/genai"
+    "google.golang.org/api/iterator"
     "google.golang.org/api/option"
 )
 
@@ -47,7 +53,14 @@ type Message struct {
 
 // ClaudeResponse represents the response from Claude
 type ClaudeResponse struct {
-	Content []Content `json:"content"`
+	Content []Content   `json:"content"`
+	Usage   claudeUsage `json:"usage"`
+}
+
+// claudeUsage is the token count Anthropic reports for a message
+type claudeUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
 }
 
 // Content represents the content in Claude's response
@@ -60,8 +73,11 @@ func UploadPaper(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
         return
     }
-    platform := r.URL.Query().Get("platform")
-    if platform == "" { platform = defaultPlatform() }
+    store, platform, err := db.StoreForRequest(r)
+    if err != nil {
+        http.Error(w, "unknown platform", http.StatusBadRequest)
+        return
+    }
     log.Printf("upload: starting PDF upload (platform=%s)", platform)
 
     // Parse multipart form (allow up to ~25MB)
@@ -78,7 +94,8 @@ func UploadPaper(w http.ResponseWriter, r *http.Request) {
     defer file.Close()
     log.Printf("upload: received file %q", header.Filename)
 
-    // Read file bytes to temp path for pdf parser
+    // Save the upload to a temp file, hashing it on the way; the job owns
+    // the file from here on
     tmpDir := os.TempDir()
     tmpPath := filepath.Join(tmpDir, fmt.Sprintf("upload-%s.pdf", uuid.New().String()))
     out, err := os.Create(tmpPath)
@@ -87,7 +104,8 @@ func UploadPaper(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "failed to create temp file", http.StatusInternalServerError)
         return
     }
-    if _, err := io.Copy(out, file); err != nil {
+    hasher := sha256.New()
+    if _, err := io.Copy(io.MultiWriter(out, hasher), file); err != nil {
         out.Close()
         os.Remove(tmpPath)
         log.Printf("upload: failed to write temp file: %v", err)
@@ -95,66 +113,152 @@ func UploadPaper(w http.ResponseWriter, r *http.Request) {
         return
     }
     out.Close()
-    defer os.Remove(tmpPath)
+    contentHash := hex.EncodeToString(hasher.Sum(nil))
+
+    // The same PDF again returns the existing mind map unless force=true
+    force, _ := strconv.ParseBool(r.FormValue("force"))
+    if !force {
+        existing, err := db.FindByContentHash(r.Context(), store, contentHash)
+        if err != nil {
+            log.Printf("upload: duplicate lookup failed, generating anyway: %v", err)
+        } else if existing != nil {
+            os.Remove(tmpPath)
+            log.Printf("upload: %q duplicates mindmap %s", header.Filename, existing.ID)
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(map[string]interface{}{
+                "success":   true,
+                "duplicate": true,
+                "message":   "This PDF has already been uploaded.",
+                "mindmapId": existing.ID,
+                "title":     existing.Title,
+            })
+            return
+        }
+    }
+
+    // Optional comma-separated labels to filter the list by
+    var tags []string
+    for _, t := range strings.Split(r.FormValue("tags"), ",") {
+        if t = strings.TrimSpace(t); t != "" {
+            tags = append(tags, t)
+        }
+    }
 
-    // Extract PDF text
-    pdfFile, rdr, err := pdfread.Open(tmpPath)
+    owner := sessionUser(r)
+    budgetWarning, err := CheckBudget(r.Context(), owner)
     if err != nil {
-        log.Printf("upload: failed to read pdf: %v", err)
-        http.Error(w, "failed to read pdf", http.StatusInternalServerError)
+        os.Remove(tmpPath)
+        writeBudgetError(w, err)
         return
     }
+
+    // ...and the same PDF while it is still being processed follows that job
+    key := ""
+    if !force {
+        key = platform + ":" + contentHash
+    }
+    filename := header.Filename
+    job, pending, err := UploadJobs().SubmitOnce(key, filename, platform, func(ctx context.Context, progress JobProgress) (string, error) {
+        defer os.Remove(tmpPath)
+        return processUpload(ctx, store, platform, filename, owner, tmpPath, contentHash, tags, progress)
+    })
+    if err != nil {
+        os.Remove(tmpPath)
+        log.Printf("upload: failed to enqueue %q: %v", filename, err)
+        http.Error(w, "server is busy, try again shortly", http.StatusServiceUnavailable)
+        return
+    }
+    message := "PDF received and queued for processing."
+    if pending {
+        os.Remove(tmpPath)
+        message = "This PDF is already being processed."
+        log.Printf("upload: %q duplicates job %s", filename, job.ID)
+    } else {
+        log.Printf("upload: queued job %s for %q", job.ID, filename)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Location", "/api/jobs/"+job.ID)
+    w.WriteHeader(http.StatusAccepted)
+    resp := map[string]interface{}{
+        "success": true,
+        "message": message,
+        "jobId":   job.ID,
+        "job":     job,
+    }
+    if pending {
+        resp["inProgress"] = true
+    }
+    if budgetWarning != "" {
+        resp["budgetWarning"] = budgetWarning
+    }
+    json.NewEncoder(w).Encode(resp)
+}
+
+// sessionUser names the signed-in user making r, or "" if there is none.
+func sessionUser(r *http.Request) string {
+    s, _ := login.SessionFrom(r.Context())
+    return s.User
+}
+
+// processUpload runs the upload pipeline for a PDF saved at path: extract the
+// text, ask the LLM for metadata and a mind map, and store the result as
+// owner's along with the PDF's hash and tags. The returned error is shown to
+// the user, so details are logged instead.
+func processUpload(ctx context.Context, store db.MindmapStore, platform, filename, owner, path, contentHash string, tags []string, progress JobProgress) (string, error) {
+    progress.Stage(StageExtracting, "Reading PDF")
+    pdfFile, rdr, err := pdfread.Open(path)
+    if err != nil {
+        log.Printf("upload: failed to read pdf: %v", err)
+        return "", fmt.Errorf("failed to read pdf")
+    }
     defer pdfFile.Close()
-    var buf strings.Builder
+    var pages []db.PageText
     totalPage := rdr.NumPage()
     for pageIndex := 1; pageIndex <= totalPage; pageIndex++ {
         p := rdr.Page(pageIndex)
         if p.V.IsNull() { continue }
         content, _ := p.GetPlainText(nil)
-        buf.WriteString(content)
-        buf.WriteString("\n")
+        pages = append(pages, db.PageText{Page: pageIndex, Text: content})
     }
-    pdfText := buf.String()
-
-    ctx := r.Context()
-    var metadata map[string]interface{}
-    var mindmapData map[string]interface{}
-    switch platform {
-    case "aws":
-        brClient, err := NewBedrockClient()
-        if err != nil {
-            log.Printf("aws: bedrock init failed: %v", err)
-            http.Error(w, "failed to init bedrock", http.StatusInternalServerError)
-            return
-        }
-        metadata, err = ExtractMetadata(ctx, brClient, pdfText)
-        if err != nil { log.Printf("metadata error: %v", err); http.Error(w, "failed to extract metadata", http.StatusInternalServerError); return }
-        mindmapData, err = GenerateMindmap(ctx, brClient, pdfText)
-        if err != nil { log.Printf("mindmap error: %v", err); http.Error(w, "failed to generate mindmap", http.StatusInternalServerError); return }
-    case "gcp":
-        gmClient, err := NewGeminiClient(ctx)
-        if err != nil {
-            log.Printf("gcp: gemini init failed: %v", err)
-            http.Error(w, "failed to init gemini", http.StatusInternalServerError)
-            return
-        }
-        // Close Gemini client after we're done with both calls
-        defer gmClient.Close()
-        metadata, err = ExtractMetadataGemini(ctx, gmClient, pdfText)
-        if err != nil { log.Printf("metadata error: %v", err); http.Error(w, "failed to extract metadata", http.StatusInternalServerError); return }
-        mindmapData, err = GenerateMindmapGemini(ctx, gmClient, pdfText)
-        if err != nil { log.Printf("mindmap error: %v", err); http.Error(w, "failed to generate mindmap", http.StatusInternalServerError); return }
-    default:
-        http.Error(w, "unknown platform", http.StatusBadRequest)
-        return
+    // Only the pages are stored: keeping the flat text as well would double
+    // the item, and DynamoDB items are capped at 400 KB
+    pdfText := (&db.MindmapItem{PageTexts: pages}).PlainText()
+
+    // The id is chosen up front so the LLM calls can be billed to it
+    id := uuid.New().String()
+    ctx = WithUsageTags(ctx, UsageTags{MindmapID: id, User: owner})
+    llm, err := ProviderForPlatform(ctx, platform)
+    if err != nil {
+        log.Printf("llm: init failed (platform=%s): %v", platform, err)
+        return "", fmt.Errorf("failed to init llm")
     }
+    defer closeProvider(llm)
+    progress.Stage(StageMetadata, fmt.Sprintf("PDF parsed with %d pages", len(pages)))
+    metadata, err := ExtractMetadata(ctx, llm, pdfText)
+    if err != nil { log.Printf("metadata error: %v", err); return "", llmFailure(err, "failed to extract metadata") }
+    progress.Stage(StageMindmap, "Metadata extracted; mind map generation started")
+    // Forward streamed output, plus the tree so far whenever a node completes
+    var partial partialTree
+    streamCtx := WithStream(ctx, func(chunk string) {
+        progress.Partial(chunk)
+        if tree, ok := partial.Add(chunk); ok {
+            progress.Tree(tree)
+        }
+    })
+    rawMindmap, err := GenerateMindmap(streamCtx, llm, MarkPages(pages))
+    if err != nil { log.Printf("mindmap error: %v", err); return "", llmFailure(err, "failed to generate mindmap") }
+    tree, err := normalizeTree("upload", rawMindmap)
+    if err != nil { log.Printf("mindmap error: %v", err); return "", fmt.Errorf("LLM returned a malformed mind map") }
+    mindmapData := tree.Map()
+    verifyAndLog("upload", mindmapData, pages)
 
     // Normalize fields from metadata
     title, _ := metadata["title"].(string)
     title = strings.TrimSpace(title)
     if title == "" {
         // Fallback to filename without extension
-        base := strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename))
+        base := strings.TrimSuffix(filename, filepath.Ext(filename))
         title = base
     }
     date, _ := metadata["date"].(string)
@@ -169,33 +273,34 @@ func UploadPaper(w http.ResponseWriter, r *http.Request) {
         authors = arrs
     }
 
+    progress.Stage(StagePersisting, "Mind map generated; saving")
     now := time.Now().UTC().Format(time.RFC3339)
     item := db.MindmapItem{
-        ID:          uuid.New().String(),
-        Filename:    header.Filename,
-        Title:       title,
-        Authors:     authors,
-        Date:        date,
-        MindmapData: mindmapData,
-        PDFText:     pdfText,
-        CreatedAt:   now,
-        UpdatedAt:   now,
-    }
-
-    id, err := db.CreateMindmapPlatform(ctx, platform, item)
-    if err != nil {
-        log.Printf("db: create mindmap failed: %v", err)
-        http.Error(w, "failed to store mindmap", http.StatusInternalServerError)
-        return
+        ID:           id,
+        Filename:     filename,
+        Title:        title,
+        Authors:      authors,
+        Date:         date,
+        Tags:         tags,
+        MindmapData:  mindmapData,
+        PageTexts:    pages,
+        Owner:        owner,
+        LastEditedBy: owner,
+        ContentHash:  contentHash,
+        CreatedAt:    now,
+        UpdatedAt:    now,
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    w.WriteHeader(http.StatusCreated)
-    fmt.Fprintf(w, `{"success":true,"message":"PDF processed and mind map created!","mindmapId":"%s"}` , id)
+    if _, err := store.Create(ctx, item); err != nil {
+        log.Printf("db: create mindmap failed: %v", err)
+        return "", fmt.Errorf("failed to store mindmap")
+    }
+    db.RecordRevision(ctx, store, nil, db.Revision{MindmapID: id, Version: 0, Time: now, Actor: owner, Operation: OpUpload, MindmapData: mindmapData})
+    return id, nil
 }
 
-func ExtractMetadata(ctx context.Context, client *bedrockruntime.Client, pdfText string) (map[string]interface{}, error) {
-	// Define the system-level prompt for Claude
+func ExtractMetadata(ctx context.Context, llm LLMProvider, pdfText string) (map[string]interface{}, error) {
+	// Define the system-level prompt
 	systemPrompt := `You are a research paper analyzer. Extract the title, all authors, and publication date from research papers. Return only valid JSON with no additional text.`
 
 	// Define the user-level prompt to extract metadata
@@ -211,21 +316,24 @@ Text:
 
 %s`, pdfText[:int(math.Min(float64(len(pdfText)), 4000))])
 
-	// Call Claude with the provided prompts
-	response, err := CallClaude(ctx, client, prompt, systemPrompt)
+	// Call the model with the provided prompts
+	response, err := llm.CompleteJSON(WithOperation(ctx, OpMetadata), systemPrompt, prompt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to call Claude: %w", err)
+		return nil, fmt.Errorf("failed to call %s: %w", llm.Name(), err)
 	}
 
 	return response, nil
 }
 
-func GenerateMindmap(ctx context.Context, client *bedrockruntime.Client, pdfText string) (map[string]interface{}, error) {
-	// Define the system-level prompt for Claude
-	systemPrompt := `You are an expert at creating hierarchical mind maps from academic papers. Create structured JSON mind maps with up to 8 levels of depth. Each node must have: name, tooltip, section, pages, and optionally children. Return only valid JSON with no additional text.`
+const mindmapSystemPrompt = `You are an expert at creating hierarchical mind maps from academic papers. Create structured JSON mind maps with up to 8 levels of depth. Each node must have: name, tooltip, section, pages, and optionally children. Return only valid JSON with no additional text.`
+
+func GenerateMindmap(ctx context.Context, llm LLMProvider, pdfText string) (map[string]interface{}, error) {
+	// Papers too long for the model's context are generated chunk by chunk and merged
+	if budget := ContextBudget(llm); EstimateTokens(pdfText) > budget {
+		return generateMindmapChunked(ctx, llm, pdfText, budget)
+	}
 
 	// Define the user-level prompt to generate a mind map
-	// No need to truncate text here, as Claude’s token limit will likely be handled at the API level or by CallClaude
 	prompt := fmt.Sprintf(`Analyze the following research paper text and create a hierarchical mind map summarizing its key concepts. The structure should be a nested JSON object with up to 8 levels but start with no more than 5.
 
 For each node, provide:
@@ -235,6 +343,8 @@ For each node, provide:
 - 'pages': a string with the source page number(s) (e.g., "3" or "5-7" - these must be factually accurate)
 - 'children': array of child nodes (if applicable)
 
+%s
+
 The root object should represent the paper's main theme and must have a 'children' array.
 
 Return the response as a JSON object in this exact format:
@@ -256,20 +366,21 @@ Return the response as a JSON object in this exact format:
 
 Here is the text:
 
-%s`, pdfText)
+%s`, pageMarkerNote, pdfText)
 
-	// Call Claude with the provided prompts
-	response, err := CallClaude(ctx, client, prompt, systemPrompt)
+	// Call the model with the provided prompts
+	response, err := completeJSON(WithOperation(ctx, OpMindmap), llm, mindmapSystemPrompt, prompt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to call Claude: %w", err)
+		return nil, fmt.Errorf("failed to call %s: %w", llm.Name(), err)
 	}
 
 	return response, nil
 }
 
-func CallClaude(ctx context.Context, client *bedrockruntime.Client, prompt, systemPrompt string) (map[string]interface{}, error) {
-	modelID := "anthropic.claude-3-5-haiku-20241022-v1:0" // Claude 3.5 Haiku
+const claudeModelID = "anthropic.claude-3-5-haiku-20241022-v1:0" // Claude 3.5 Haiku
 
+// claudePayload builds the Bedrock request body shared by CallClaude and CallClaudeStream.
+func claudePayload(prompt, systemPrompt string) ([]byte, error) {
 	payload := ClaudeRequest{
 		AnthropicVersion: "bedrock-2023-05-31",
 		MaxTokens:        4000,
@@ -287,13 +398,30 @@ func CallClaude(ctx context.Context, client *bedrockruntime.Client, prompt, syst
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
+	return payloadBytes, nil
+}
+
+// isBedrockRetryable reports whether a Bedrock error is worth retrying.
+func isBedrockRetryable(err error) bool {
+	errStr := err.Error()
+	return strings.Contains(errStr, "ThrottlingException") || strings.Contains(errStr, "ServiceException")
+}
+
+func CallClaude(ctx context.Context, client *bedrockruntime.Client, prompt, systemPrompt string) (map[string]interface{}, error) {
+	if err := enforceBudget(ctx); err != nil {
+		return nil, err
+	}
+	payloadBytes, err := claudePayload(prompt, systemPrompt)
+	if err != nil {
+		return nil, err
+	}
 
 	const maxRetries = 3
 	delay := time.Second // Start with a 1-second delay
 
 	for i := range maxRetries {
 		input := &bedrockruntime.InvokeModelInput{
-			ModelId:     aws.String(modelID),
+			ModelId:     aws.String(claudeModelID),
 			ContentType: aws.String("application/json"),
 			Accept:      aws.String("application/json"),
 			Body:        payloadBytes,
@@ -304,8 +432,7 @@ func CallClaude(ctx context.Context, client *bedrockruntime.Client, prompt, syst
 			log.Printf("Bedrock API error (attempt %d): %v", i+1, err)
 
 			// Check for throttling or service errors
-			errStr := err.Error()
-			if strings.Contains(errStr, "ThrottlingException") || strings.Contains(errStr, "ServiceException") {
+			if isBedrockRetryable(err) {
 				if i < maxRetries-1 {
 					log.Printf("Retrying in %v...", delay)
 					time.Sleep(delay)
@@ -327,6 +454,7 @@ func CallClaude(ctx context.Context, client *bedrockruntime.Client, prompt, syst
 		if err := json.Unmarshal(response.Body, &responseBody); err != nil {
 			return nil, fmt.Errorf("failed to unmarshal response: %w", err)
 		}
+		recordUsage(ctx, "bedrock", claudeModelID, responseBody.Usage.InputTokens, responseBody.Usage.OutputTokens)
 
 		if len(responseBody.Content) == 0 {
 			return nil, fmt.Errorf("empty response content")
@@ -334,25 +462,124 @@ func CallClaude(ctx context.Context, client *bedrockruntime.Client, prompt, syst
 
 		responseText := responseBody.Content[0].Text
 
-		// Try to parse as JSON
-		var result map[string]interface{}
-		if err := json.Unmarshal([]byte(responseText), &result); err == nil {
-			return result, nil
-		}
+		// Parse as JSON, extracting it from surrounding text if needed
+		return parseJSONObject("Claude", responseText)
+	}
+
+	return nil, fmt.Errorf("bedrock Claude API call failed after multiple retries")
+}
 
-		// If JSON parsing fails, try to extract JSON from the text
-		re := regexp.MustCompile(`\{[\s\S]*\}`)
-		jsonMatch := re.FindString(responseText)
-		if jsonMatch != "" {
-			if err := json.Unmarshal([]byte(jsonMatch), &result); err == nil {
-				return result, nil
+// CallClaudeStream is CallClaude over InvokeModelWithResponseStream: each piece
+// of text is passed to onText as Claude writes it, and the whole reply is
+// parsed once the stream ends. Cancelling ctx closes the stream.
+func CallClaudeStream(ctx context.Context, client *bedrockruntime.Client, prompt, systemPrompt string, onText func(chunk string)) (map[string]interface{}, error) {
+	if err := enforceBudget(ctx); err != nil {
+		return nil, err
+	}
+	payloadBytes, err := claudePayload(prompt, systemPrompt)
+	if err != nil {
+		return nil, err
+	}
+
+	const maxRetries = 3
+	delay := time.Second
+
+	for i := range maxRetries {
+		response, err := client.InvokeModelWithResponseStream(ctx, &bedrockruntime.InvokeModelWithResponseStreamInput{
+			ModelId:     aws.String(claudeModelID),
+			ContentType: aws.String("application/json"),
+			Accept:      aws.String("application/json"),
+			Body:        payloadBytes,
+		})
+		if err != nil {
+			log.Printf("Bedrock stream error (attempt %d): %v", i+1, err)
+			// Only the opening call is retried; once text has been handed on it cannot be taken back
+			if isBedrockRetryable(err) && i < maxRetries-1 {
+				log.Printf("Retrying in %v...", delay)
+				time.Sleep(delay)
+				delay *= 2
+				continue
 			}
+			return nil, fmt.Errorf("bedrock stream failed: %w", err)
 		}
 
-		return nil, fmt.Errorf("could not parse JSON from Claude response: %s", responseText)
+		stream := response.GetStream()
+		text, usage, err := readClaudeStream(ctx, stream.Events(), onText)
+		stream.Close()
+		if err == nil {
+			err = stream.Err()
+		}
+		if usage.InputTokens > 0 || usage.OutputTokens > 0 {
+			recordUsage(ctx, "bedrock", claudeModelID, usage.InputTokens, usage.OutputTokens)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bedrock stream failed: %w", err)
+		}
+		if text == "" {
+			return nil, fmt.Errorf("empty response content")
+		}
+		return parseJSONObject("Claude", text)
 	}
 
-	return nil, fmt.Errorf("bedrock Claude API call failed after multiple retries")
+	return nil, fmt.Errorf("bedrock Claude stream failed after multiple retries")
+}
+
+// claudeStreamEvent is the part of an Anthropic messages stream event we use.
+// message_start carries the input token count and message_delta the running
+// output count.
+type claudeStreamEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage claudeUsage `json:"usage"`
+	} `json:"message"`
+	Usage claudeUsage `json:"usage"`
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// readClaudeStream collects the text deltas from a Bedrock response stream,
+// passing each to onText, until the stream closes or ctx is cancelled. The
+// token usage seen so far is returned even when the stream fails.
+func readClaudeStream(ctx context.Context, events <-chan brtypes.ResponseStream, onText func(chunk string)) (string, claudeUsage, error) {
+	var b strings.Builder
+	var usage claudeUsage
+	for {
+		select {
+		case <-ctx.Done():
+			return "", usage, ctx.Err()
+		case ev, ok := <-events:
+			if !ok {
+				return b.String(), usage, nil
+			}
+			chunk, ok := ev.(*brtypes.ResponseStreamMemberChunk)
+			if !ok {
+				continue
+			}
+			var event claudeStreamEvent
+			if err := json.Unmarshal(chunk.Value.Bytes, &event); err != nil {
+				return "", usage, fmt.Errorf("failed to unmarshal stream event: %w", err)
+			}
+			switch event.Type {
+			case "error":
+				return "", usage, fmt.Errorf("%s: %s", event.Error.Type, event.Error.Message)
+			case "message_start":
+				usage = event.Message.Usage
+			case "message_delta":
+				usage.OutputTokens = event.Usage.OutputTokens
+			case "content_block_delta":
+				if event.Delta.Type == "text_delta" && event.Delta.Text != "" {
+					b.WriteString(event.Delta.Text)
+					onText(event.Delta.Text)
+				}
+			}
+		}
+	}
 }
 
 // NewBedrockClient creates a Bedrock runtime client using shared AWS config
@@ -376,90 +603,83 @@ func NewGeminiClient(ctx context.Context) (*genai.Client, error) {
     return genai.NewClient(ctx, option.WithAPIKey(apiKey))
 }
 
+const geminiModel = "gemini-1.5-flash"
+
 func CallGemini(ctx context.Context, client *genai.Client, prompt, systemPrompt string) (map[string]interface{}, error) {
-    model := client.GenerativeModel("gemini-1.5-flash")
+    if err := enforceBudget(ctx); err != nil {
+        return nil, err
+    }
+    model := client.GenerativeModel(geminiModel)
     // Combine system + user prompts to keep logic simple
     fullPrompt := systemPrompt + "\n\n" + prompt
     resp, err := model.GenerateContent(ctx, genai.Text(fullPrompt))
     if err != nil {
         return nil, err
     }
+    if resp.UsageMetadata != nil {
+        recordUsage(ctx, "gemini", geminiModel, int(resp.UsageMetadata.PromptTokenCount), int(resp.UsageMetadata.CandidatesTokenCount))
+    }
     if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
         return nil, fmt.Errorf("empty response from Gemini")
     }
-    // Concatenate text parts
-    var b strings.Builder
-    for _, part := range resp.Candidates[0].Content.Parts {
-        if t, ok := part.(genai.Text); ok {
-            b.WriteString(string(t))
-        }
-    }
-    text := b.String()
+    text := geminiText(resp)
 
     // Parse JSON or extract JSON like in Claude path
-    var out map[string]interface{}
-    if err := json.Unmarshal([]byte(text), &out); err == nil {
-        return out, nil
-    }
-    re := regexp.MustCompile(`\{[\s\S]*\}`)
-    jsonMatch := re.FindString(text)
-    if jsonMatch != "" {
-        if err := json.Unmarshal([]byte(jsonMatch), &out); err == nil {
-            return out, nil
-        }
-    }
-    return nil, fmt.Errorf("could not parse JSON from Gemini response: %s", text)
-}
-
-func ExtractMetadataGemini(ctx context.Context, client *genai.Client, pdfText string) (map[string]interface{}, error) {
-    systemPrompt := `You are a research paper analyzer. Extract the title, all authors, and publication date from research papers. Return only valid JSON with no additional text.`
-    prompt := fmt.Sprintf(`Extract the title, all authors, and the publication date from the following research paper text. The date might be just a month and year, or more specific. Return only a JSON object with the following structure:
-{
-  "title": "paper title",
-  "authors": ["author1", "author2"],
-  "date": "publication date"
-}
-
-Text:
-
-%s`, pdfText[:int(math.Min(float64(len(pdfText)), 4000))])
-    return CallGemini(ctx, client, prompt, systemPrompt)
+    return parseJSONObject("Gemini", text)
 }
 
-func GenerateMindmapGemini(ctx context.Context, client *genai.Client, pdfText string) (map[string]interface{}, error) {
-    systemPrompt := `You are an expert at creating hierarchical mind maps from academic papers. Create structured JSON mind maps with up to 8 levels of depth. Each node must have: name, tooltip, section, pages, and optionally children. Return only valid JSON with no additional text.`
-    prompt := fmt.Sprintf(`Analyze the following research paper text and create a hierarchical mind map summarizing its key concepts. The structure should be a nested JSON object with up to 8 levels but start with no more than 5.
-
-For each node, provide:
-- 'name': concise topic name
-- 'tooltip': three to five sentences, plain-english explanation, summarization of content
-- 'section': the document section it belongs to (e.g., "Introduction", "2.1 Related Work")
-- 'pages': a string with the source page number(s) (e.g., "3" or "5-7" - these must be factually accurate)
-- 'children': array of child nodes (if applicable)
-
-The root object should represent the paper's main theme and must have a 'children' array.
-
-Return the response as a JSON object in this exact format:
-{
-  "name": "main topic",
-  "tooltip": "explanation",
-  "section": "section name",
-  "pages": "page numbers",
-  "children": [
-    {
-      "name": "subtopic",
-      "tooltip": "explanation",
-      "section": "section name",
-      "pages": "page numbers",
-      "children": [...]
+// CallGeminiStream is CallGemini over GenerateContentStream: each piece of
+// text is passed to onText as it arrives, and the whole reply is parsed once
+// the stream ends. Cancelling ctx ends the stream.
+func CallGeminiStream(ctx context.Context, client *genai.Client, prompt, systemPrompt string, onText func(chunk string)) (map[string]interface{}, error) {
+    if err := enforceBudget(ctx); err != nil {
+        return nil, err
     }
-  ]
+    model := client.GenerativeModel(geminiModel)
+    fullPrompt := systemPrompt + "\n\n" + prompt
+    iter := model.GenerateContentStream(ctx, genai.Text(fullPrompt))
+    var b strings.Builder
+    // Each response carries the running totals, so the last one counts
+    var usage *genai.UsageMetadata
+    defer func() {
+        if usage != nil {
+            recordUsage(ctx, "gemini", geminiModel, int(usage.PromptTokenCount), int(usage.CandidatesTokenCount))
+        }
+    }()
+    for {
+        resp, err := iter.Next()
+        if errors.Is(err, iterator.Done) {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        if resp.UsageMetadata != nil {
+            usage = resp.UsageMetadata
+        }
+        if text := geminiText(resp); text != "" {
+            b.WriteString(text)
+            onText(text)
+        }
+    }
+    if b.Len() == 0 {
+        return nil, fmt.Errorf("empty response from Gemini")
+    }
+    return parseJSONObject("Gemini", b.String())
 }
 
-Here is the text:
-
-%s`, pdfText)
-    return CallGemini(ctx, client, prompt, systemPrompt)
+// geminiText concatenates the text parts of the first candidate.
+func geminiText(resp *genai.GenerateContentResponse) string {
+    if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+        return ""
+    }
+    var b strings.Builder
+    for _, part := range resp.Candidates[0].Content.Parts {
+        if t, ok := part.(genai.Text); ok {
+            b.WriteString(string(t))
+        }
+    }
+    return b.String()
 }
 
 // UpdateNodeByPath traverses and updates a node based on a path array
@@ -522,36 +742,235 @@ func UpdateNodeByPath(root map[string]interface{}, path []interface{}, updates m
     return false
 }
 
+// FindNodeByID returns the node in root whose "id" is id, or nil.
+func FindNodeByID(root map[string]interface{}, id string) map[string]interface{} {
+    if root == nil || id == "" {
+        return nil
+    }
+    if nid, _ := root["id"].(string); nid == id {
+        return root
+    }
+    kids, _ := root["children"].([]interface{})
+    for _, k := range kids {
+        if child, ok := k.(map[string]interface{}); ok {
+            if found := FindNodeByID(child, id); found != nil {
+                return found
+            }
+        }
+    }
+    return nil
+}
+
 // ---------------------- Action Handlers under /api/mindmaps/{id}/* ---------------------- //
 
+// nodeActionRequest names the node to act on. NodeID is preferred; NodePath
+// (e.g. ["children", 0, "children", 1]) is still accepted from older clients
+// but goes stale as soon as siblings are reordered.
 type nodeActionRequest struct {
+    NodeID   string                 `json:"nodeId"`
     NodePath []interface{}          `json:"nodePath"`
     NodeData map[string]interface{} `json:"nodeData"`
 }
 
+// targetName returns the name of the addressed node. With a NodeID the stored
+// node must still exist; its stored name wins over whatever the client sent.
+func (req *nodeActionRequest) targetName(data map[string]interface{}) (string, bool) {
+    if req.NodeID == "" {
+        return valueAsString(req.NodeData["name"]), true
+    }
+    node := FindNodeByID(data, req.NodeID)
+    if node == nil {
+        return "", false
+    }
+    return valueAsString(node["name"]), true
+}
+
+// targetID returns the id of the addressed node, or "" when its path leads
+// nowhere.
+func (req *nodeActionRequest) targetID(data map[string]interface{}) string {
+    if req.NodeID != "" {
+        return req.NodeID
+    }
+    var current interface{} = data
+    for _, key := range req.NodePath {
+        switch k := key.(type) {
+        case string:
+            m, _ := current.(map[string]interface{})
+            current = m[k]
+        case float64:
+            arr, _ := current.([]interface{})
+            if int(k) < 0 || int(k) >= len(arr) {
+                return ""
+            }
+            current = arr[int(k)]
+        default:
+            return ""
+        }
+    }
+    node, _ := current.(map[string]interface{})
+    id, _ := node["id"].(string)
+    return id
+}
+
+// apply merges updates into the addressed node.
+func (req *nodeActionRequest) apply(data map[string]interface{}, updates map[string]interface{}) bool {
+    if req.NodeID == "" {
+        return UpdateNodeByPath(data, req.NodePath, updates)
+    }
+    node := FindNodeByID(data, req.NodeID)
+    if node == nil {
+        return false
+    }
+    for k, v := range updates {
+        node[k] = v
+    }
+    return true
+}
+
+// loadNodeAction decodes the request body and loads the mind map it targets,
+// writing the error response itself when either fails.
+func loadNodeAction(w http.ResponseWriter, r *http.Request, store db.MindmapStore, id string) (*nodeActionRequest, *db.MindmapItem, string, bool) {
+    var req nodeActionRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "invalid request body", http.StatusBadRequest)
+        return nil, nil, "", false
+    }
+    item, err := store.Get(r.Context(), id)
+    if err != nil || item == nil || item.DeletedAt != "" {
+        http.Error(w, "mindmap not found", http.StatusNotFound)
+        return nil, nil, "", false
+    }
+    // Backfilled ids are persisted with the action's update
+    db.EnsureNodeIDs(item.MindmapData)
+    name, ok := req.targetName(item.MindmapData)
+    if !ok {
+        http.Error(w, "node not found", http.StatusNotFound)
+        return nil, nil, "", false
+    }
+    return &req, item, name, true
+}
+
+// usageContext attributes a node action's LLM call to the mind map and caller.
+func usageContext(r *http.Request, id string) context.Context {
+    return WithUsageTags(r.Context(), UsageTags{MindmapID: id, User: sessionUser(r)})
+}
+
+// nodeActionBudget refuses the action with 402 when the caller is out of
+// budget, and otherwise returns any warning to pass back.
+func nodeActionBudget(w http.ResponseWriter, r *http.Request) (string, bool) {
+    warning, err := CheckBudget(r.Context(), sessionUser(r))
+    if err != nil {
+        writeBudgetError(w, err)
+        return "", false
+    }
+    return warning, true
+}
+
+// writeLLMError reports a failed node action LLM call.
+func writeLLMError(w http.ResponseWriter, err error) {
+    if errors.Is(err, ErrBudgetExceeded) {
+        writeBudgetError(w, err)
+        return
+    }
+    http.Error(w, "LLM error", http.StatusInternalServerError)
+}
+
+// writeNodeActionResult sends a node action's success reply, adding the
+// budget warning when there is one.
+func writeNodeActionResult(w http.ResponseWriter, resp map[string]interface{}, budgetWarning string) {
+    resp["success"] = true
+    if budgetWarning != "" {
+        resp["budgetWarning"] = budgetWarning
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(resp)
+}
+
+// nodeActionRetries is how many times a node action re-reads and reapplies
+// its change after losing a race with another write.
+const nodeActionRetries = 3
+
+// saveNodeAction merges updates into the addressed node and writes the mind
+// map back only if nobody changed it since it was read, recording the result
+// as rev, whose Operation the caller sets. On a conflict it re-reads the map
+// and tries again, which is safe only when the node is addressed by id;
+// otherwise, or once retries run out, it replies 409 with the current
+// version. check, if set, must accept every version of the map the change is
+// applied to; its error is sent back with 409. It writes error responses
+// itself and returns the new version.
+func saveNodeAction(w http.ResponseWriter, r *http.Request, store db.MindmapStore, id string, rev db.Revision, req *nodeActionRequest, item *db.MindmapItem, updates map[string]interface{}, check func(*db.MindmapItem) error) (int, bool) {
+    for attempt := 0; ; attempt++ {
+        if check != nil {
+            if err := check(item); err != nil {
+                writeRefusal(w, err.Error())
+                return 0, false
+            }
+        }
+        before := *item
+        before.MindmapData = cloneTree(item.MindmapData)
+        data := item.MindmapData
+        if ok := req.apply(data, updates); !ok {
+            http.Error(w, "node not found", http.StatusNotFound)
+            return 0, false
+        }
+        err := store.UpdateIfVersion(r.Context(), id, item.Version, map[string]interface{}{"mindmapData": data, "lastEditedBy": sessionUser(r), "updatedAt": time.Now().UTC().Format(time.RFC3339)})
+        if err == nil {
+            rev.MindmapID, rev.Version, rev.Actor, rev.NodeID, rev.MindmapData = id, item.Version+1, sessionUser(r), req.targetID(data), data
+            db.RecordRevision(r.Context(), store, &before, rev)
+            return rev.Version, true
+        }
+        if !errors.Is(err, db.ErrVersionConflict) {
+            http.Error(w, "update failed", http.StatusInternalServerError)
+            return 0, false
+        }
+        item, err = store.Get(r.Context(), id)
+        if err != nil || item == nil || item.DeletedAt != "" {
+            http.Error(w, "mindmap not found", http.StatusNotFound)
+            return 0, false
+        }
+        if req.NodeID == "" || attempt == nodeActionRetries {
+            log.Printf("node action on %s lost to a concurrent update (now version %d)", id, item.Version)
+            writeVersionConflict(w, item.Version)
+            return 0, false
+        }
+        db.EnsureNodeIDs(item.MindmapData)
+    }
+}
+
+// writeVersionConflict tells the caller the mind map changed under them.
+func writeVersionConflict(w http.ResponseWriter, current int) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusConflict)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success":        false,
+        "message":        "This mind map was changed by someone else; reload it and try again",
+        "currentVersion": current,
+    })
+}
+
 // RedoDescriptionHandler: POST /api/mindmaps/{id}/redo-description
 func RedoDescriptionHandler(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPost {
         http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
         return
     }
-    platform := r.URL.Query().Get("platform")
-    if platform == "" { platform = defaultPlatform() }
+    store, platform, err := db.StoreForRequest(r)
+    if err != nil {
+        http.Error(w, "unknown platform", http.StatusBadRequest)
+        return
+    }
     id, action := parseMindmapAction(r.URL.Path)
     if id == "" || action != "redo-description" {
         http.NotFound(w, r)
         return
     }
 
-    var req nodeActionRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "invalid request body", http.StatusBadRequest)
+    req, item, name, ok := loadNodeAction(w, r, store, id)
+    if !ok {
         return
     }
-
-    item, err := db.GetMindmapByIDPlatform(r.Context(), platform, id)
-    if err != nil || item == nil {
-        http.Error(w, "mindmap not found", http.StatusNotFound)
+    budgetWarning, ok := nodeActionBudget(w, r)
+    if !ok {
         return
     }
     systemPrompt := "You are an expert at explaining academic concepts. Provide clear, concise explanations in plain English. Return only valid JSON with no additional text."
@@ -562,40 +981,25 @@ Return only a JSON object in this format:
   "tooltip": "your explanation here"
 }
 
-Full Paper Text:
-%s`, valueAsString(req.NodeData["name"]), item.PDFText)
-    var tooltip string
-    switch platform {
-    case "aws":
-        br, err := NewBedrockClient()
-        if err != nil { http.Error(w, "bedrock init error", http.StatusInternalServerError); return }
-        result, err := CallClaude(r.Context(), br, prompt, systemPrompt)
-        if err != nil { http.Error(w, "LLM error", http.StatusInternalServerError); return }
-        tooltip = valueAsString(result["tooltip"])
-    case "gcp":
-        gm, err := NewGeminiClient(r.Context())
-        if err != nil { http.Error(w, "gemini init error", http.StatusInternalServerError); return }
-        defer gm.Close()
-        result, err := CallGemini(r.Context(), gm, prompt, systemPrompt)
-        if err != nil { http.Error(w, "LLM error", http.StatusInternalServerError); return }
-        tooltip = valueAsString(result["tooltip"])
-    default:
-        http.Error(w, "unknown platform", http.StatusBadRequest)
-        return
-    }
+%s
 
-    data := item.MindmapData
-    if ok := UpdateNodeByPath(data, req.NodePath, map[string]interface{}{"tooltip": tooltip}); !ok {
-        http.Error(w, "node path not found", http.StatusNotFound)
-        return
-    }
-    if err := db.UpdateMindmapPlatform(r.Context(), platform, id, map[string]interface{}{"mindmapData": data, "updatedAt": time.Now().UTC().Format(time.RFC3339)}); err != nil {
-        http.Error(w, "update failed", http.StatusInternalServerError)
+Full Paper Text:
+%s`, name, pageMarkerNote, paperText(item))
+    llm, err := ProviderForPlatform(r.Context(), platform)
+    if err != nil { http.Error(w, "llm init error", http.StatusInternalServerError); return }
+    defer closeProvider(llm)
+    result, err := llm.CompleteJSON(WithOperation(usageContext(r, id), OpRedoDescription), systemPrompt, prompt)
+    if err != nil { writeLLMError(w, err); return }
+    tooltip, _ := result["tooltip"].(string)
+    tooltip = strings.TrimSpace(tooltip)
+    if tooltip == "" { http.Error(w, "LLM returned no tooltip", http.StatusBadGateway); return }
+
+    version, ok := saveNodeAction(w, r, store, id, db.Revision{Operation: OpRedoDescription}, req, item, map[string]interface{}{"tooltip": tooltip}, nil)
+    if !ok {
         return
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "newTooltip": tooltip})
+    writeNodeActionResult(w, map[string]interface{}{"newTooltip": tooltip, "version": version}, budgetWarning)
 }
 
 // RemakeSubtreeHandler: POST /api/mindmaps/{id}/remake-subtree
@@ -604,21 +1008,22 @@ func RemakeSubtreeHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
         return
     }
-    platform := r.URL.Query().Get("platform")
-    if platform == "" { platform = defaultPlatform() }
+    store, platform, err := db.StoreForRequest(r)
+    if err != nil {
+        http.Error(w, "unknown platform", http.StatusBadRequest)
+        return
+    }
     id, action := parseMindmapAction(r.URL.Path)
     if id == "" || action != "remake-subtree" {
         http.NotFound(w, r)
         return
     }
-    var req nodeActionRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "invalid request body", http.StatusBadRequest)
+    req, item, name, ok := loadNodeAction(w, r, store, id)
+    if !ok {
         return
     }
-    item, err := db.GetMindmapByIDPlatform(r.Context(), platform, id)
-    if err != nil || item == nil {
-        http.Error(w, "mindmap not found", http.StatusNotFound)
+    budgetWarning, ok := nodeActionBudget(w, r)
+    if !ok {
         return
     }
     systemPrompt := "You are an expert at creating hierarchical mind maps from academic papers. Create structured JSON mind maps. Return only valid JSON with no additional text."
@@ -647,41 +1052,25 @@ Return the response as a JSON object in this format:
   ]
 }
 
+%s
+
 Full Paper Text:
-%s`, valueAsString(req.NodeData["name"]), valueAsString(req.NodeData["name"]), valueAsString(req.NodeData["name"]), item.PDFText)
-
-    var newTree map[string]interface{}
-    switch platform {
-    case "aws":
-        br, err := NewBedrockClient()
-        if err != nil { http.Error(w, "bedrock init error", http.StatusInternalServerError); return }
-        newTree, err = CallClaude(r.Context(), br, prompt, systemPrompt)
-        if err != nil { http.Error(w, "LLM error", http.StatusInternalServerError); return }
-    case "gcp":
-        gm, err := NewGeminiClient(r.Context())
-        if err != nil { http.Error(w, "gemini init error", http.StatusInternalServerError); return }
-        defer gm.Close()
-        newTree, err = CallGemini(r.Context(), gm, prompt, systemPrompt)
-        if err != nil { http.Error(w, "LLM error", http.StatusInternalServerError); return }
-    default:
-        http.Error(w, "unknown platform", http.StatusBadRequest)
-        return
-    }
-    var children []interface{}
-    if c, ok := newTree["children"].([]interface{}); ok {
-        children = c
-    }
-    data := item.MindmapData
-    if ok := UpdateNodeByPath(data, req.NodePath, map[string]interface{}{"children": children}); !ok {
-        http.Error(w, "node path not found", http.StatusNotFound)
+%s`, name, name, name, pageMarkerNote, paperText(item))
+
+    llm, err := ProviderForPlatform(r.Context(), platform)
+    if err != nil { http.Error(w, "llm init error", http.StatusInternalServerError); return }
+    defer closeProvider(llm)
+    newTree, err := llm.CompleteJSON(WithOperation(usageContext(r, id), OpRemakeSubtree), systemPrompt, prompt)
+    if err != nil { writeLLMError(w, err); return }
+    subtree, err := normalizeTree("remake-subtree", newTree)
+    if err != nil || len(subtree.Children) == 0 { http.Error(w, "LLM returned a malformed mind map", http.StatusBadGateway); return }
+    children := subtree.ChildMaps()
+    verifyAndLog("remake-subtree", map[string]interface{}{"children": children}, item.PageTexts)
+    version, ok := saveNodeAction(w, r, store, id, db.Revision{Operation: OpRemakeSubtree}, req, item, map[string]interface{}{"children": children}, nil)
+    if !ok {
         return
     }
-    if err := db.UpdateMindmapPlatform(r.Context(), platform, id, map[string]interface{}{"mindmapData": data, "updatedAt": time.Now().UTC().Format(time.RFC3339)}); err != nil {
-        http.Error(w, "update failed", http.StatusInternalServerError)
-        return
-    }
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "newChildren": children})
+    writeNodeActionResult(w, map[string]interface{}{"newChildren": children, "version": version}, budgetWarning)
 }
 
 // GoDeeperHandler: POST /api/mindmaps/{id}/go-deeper
@@ -690,21 +1079,22 @@ func GoDeeperHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
         return
     }
-    platform := r.URL.Query().Get("platform")
-    if platform == "" { platform = "aws" }
+    store, platform, err := db.StoreForRequest(r)
+    if err != nil {
+        http.Error(w, "unknown platform", http.StatusBadRequest)
+        return
+    }
     id, action := parseMindmapAction(r.URL.Path)
     if id == "" || action != "go-deeper" {
         http.NotFound(w, r)
         return
     }
-    var req nodeActionRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "invalid request body", http.StatusBadRequest)
+    req, item, name, ok := loadNodeAction(w, r, store, id)
+    if !ok {
         return
     }
-    item, err := db.GetMindmapByIDPlatform(r.Context(), platform, id)
-    if err != nil || item == nil {
-        http.Error(w, "mindmap not found", http.StatusNotFound)
+    budgetWarning, ok := nodeActionBudget(w, r)
+    if !ok {
         return
     }
     systemPrompt := "You are an expert at expanding academic topics into subtopics. Create structured JSON arrays. Return only valid JSON with no additional text."
@@ -728,41 +1118,25 @@ Return this as a JSON object with a single 'children' array:
   ]
 }
 
+%s
+
 Full Paper Text:
-%s`, valueAsString(req.NodeData["name"]), item.PDFText)
-
-    var result map[string]interface{}
-    switch platform {
-    case "aws":
-        br, err := NewBedrockClient()
-        if err != nil { http.Error(w, "bedrock init error", http.StatusInternalServerError); return }
-        result, err = CallClaude(r.Context(), br, prompt, systemPrompt)
-        if err != nil { http.Error(w, "LLM error", http.StatusInternalServerError); return }
-    case "gcp":
-        gm, err := NewGeminiClient(r.Context())
-        if err != nil { http.Error(w, "gemini init error", http.StatusInternalServerError); return }
-        defer gm.Close()
-        result, err = CallGemini(r.Context(), gm, prompt, systemPrompt)
-        if err != nil { http.Error(w, "LLM error", http.StatusInternalServerError); return }
-    default:
-        http.Error(w, "unknown platform", http.StatusBadRequest)
+%s`, name, pageMarkerNote, paperText(item))
+
+    llm, err := ProviderForPlatform(r.Context(), platform)
+    if err != nil { http.Error(w, "llm init error", http.StatusInternalServerError); return }
+    defer closeProvider(llm)
+    result, err := llm.CompleteJSON(WithOperation(usageContext(r, id), OpGoDeeper), systemPrompt, prompt)
+    if err != nil { writeLLMError(w, err); return }
+    kids, err := normalizeChildren("go-deeper", result["children"])
+    if err != nil || len(kids) == 0 { http.Error(w, "LLM returned a malformed mind map", http.StatusBadGateway); return }
+    children := (&Node{Children: kids}).ChildMaps()
+    verifyAndLog("go-deeper", map[string]interface{}{"children": children}, item.PageTexts)
+    version, ok := saveNodeAction(w, r, store, id, db.Revision{Operation: OpGoDeeper}, req, item, map[string]interface{}{"children": children}, nil)
+    if !ok {
         return
     }
-    var children []interface{}
-    if c, ok := result["children"].([]interface{}); ok {
-        children = c
-    }
-    data := item.MindmapData
-    if ok := UpdateNodeByPath(data, req.NodePath, map[string]interface{}{"children": children}); !ok {
-        http.Error(w, "node path not found", http.StatusNotFound)
-        return
-    }
-    if err := db.UpdateMindmapPlatform(r.Context(), platform, id, map[string]interface{}{"mindmapData": data, "updatedAt": time.Now().UTC().Format(time.RFC3339)}); err != nil {
-        http.Error(w, "update failed", http.StatusInternalServerError)
-        return
-    }
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "newChildren": children})
+    writeNodeActionResult(w, map[string]interface{}{"newChildren": children, "version": version}, budgetWarning)
 }
 
 func parseMindmapAction(path string) (id string, action string) {
@@ -784,9 +1158,3 @@ func valueAsString(v interface{}) string {
     b, _ := json.Marshal(v)
     return string(b)
 }
-
-func defaultPlatform() string {
-    p := strings.ToLower(strings.TrimSpace(os.Getenv("DEFAULT_PLATFORM")))
-    if p == "gcp" { return "gcp" }
-    return "aws"
-}
@@ -5,3 +5,11 @@ echo ""
 printf "~~~~~~~~~~~~~~~ Server Setup Tests ~~~~~~~~~~~~~~~\n"
 go test -v ./internal/server
 echo ""
+
+printf "~~~~~~~~~~~~~~~ Storage Backend Tests ~~~~~~~~~~~~~~~\n"
+go test -v ./internal/db
+echo ""
+
+printf "~~~~~~~~~~~~~~~ LLM Provider Tests ~~~~~~~~~~~~~~~\n"
+go test -v ./internal/utils
+echo ""